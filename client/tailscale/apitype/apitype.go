@@ -5,7 +5,13 @@
 // Package apitype contains types for the Tailscale local API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -27,3 +33,180 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// LocalAPIScope is a permission that can be granted to a LocalAPI
+// bearer token, for use by tools that shouldn't have full access to
+// the local daemon.
+type LocalAPIScope string
+
+const (
+	// ScopeRead permits all read-only LocalAPI requests.
+	ScopeRead LocalAPIScope = "read"
+
+	// ScopeWrite permits all LocalAPI requests, except for managing
+	// tokens.
+	ScopeWrite LocalAPIScope = "write"
+
+	// ScopeStatusRead permits reading the daemon's status and
+	// looking up the owners of Tailscale IPs.
+	ScopeStatusRead LocalAPIScope = "status:read"
+
+	// ScopeFileSend permits listing Taildrop targets and sending
+	// files to them.
+	ScopeFileSend LocalAPIScope = "file:send"
+
+	// ScopeFileReceive permits listing, fetching and deleting
+	// received Taildrop files.
+	ScopeFileReceive LocalAPIScope = "file:receive"
+
+	// ScopePrefsWrite permits reading and editing all preferences.
+	ScopePrefsWrite LocalAPIScope = "prefs:write"
+
+	// ScopePrefsWriteExitNode permits reading preferences, but only
+	// editing the exit node settings.
+	ScopePrefsWriteExitNode LocalAPIScope = "prefs:write:exit-node"
+)
+
+// Valid reports whether s is a known scope.
+func (s LocalAPIScope) Valid() bool {
+	switch s {
+	case ScopeRead, ScopeWrite, ScopeStatusRead, ScopeFileSend,
+		ScopeFileReceive, ScopePrefsWrite, ScopePrefsWriteExitNode:
+		return true
+	}
+	return false
+}
+
+// LocalAPIToken describes a scoped bearer token minted by tailscaled
+// for accessing its LocalAPI.
+type LocalAPIToken struct {
+	ID      string
+	Name    string `json:",omitempty"` // human-readable description
+	Scopes  []LocalAPIScope
+	Created time.Time
+
+	// Token is the secret bearer token, to be sent in an
+	// "Authorization: Bearer" header. It's only populated in the
+	// response to the request that created the token; tailscaled
+	// does not store it.
+	Token string `json:",omitempty"`
+}
+
+// HealthStatus is the JSON type returned by the peer API's
+// /v0/debug/health handler, describing a node's health.
+type HealthStatus struct {
+	// Error is the node's current overall health error,
+	// or empty if it's healthy.
+	Error string `json:",omitempty"`
+
+	// Recent are the most recent transitions between healthy and
+	// unhealthy, oldest first.
+	Recent []HealthChange
+}
+
+// HealthChange is a transition of a node's overall health.
+type HealthChange struct {
+	Time  time.Time
+	Error string `json:",omitempty"` // or empty if it became healthy
+}
+
+// The following types are the JSON output of the tailscale CLI's
+// --json flags. Fields are only ever added to them, never removed
+// or changed in meaning, so scripts may depend on them.
+
+// IPOutput is the output of "tailscale ip --json".
+type IPOutput struct {
+	// Host is the peer name or IP that was looked up, or empty
+	// for the local node.
+	Host string `json:",omitempty"`
+
+	// IPs are the node's Tailscale IPs, limited to IPv4 or IPv6
+	// if -4 or -6 was given.
+	IPs []netaddr.IP
+}
+
+// PingOutput is the output of "tailscale ping --json", one JSON
+// object per line for each ping sent.
+type PingOutput struct {
+	// Seq is the 1-based number of this ping.
+	Seq int
+
+	// IP is the Tailscale IP that was pinged.
+	IP string
+
+	// Timeout is whether no reply arrived in time. If so, all
+	// following fields are empty.
+	Timeout bool `json:",omitempty"`
+
+	// Err is the error pinging, if any.
+	Err string `json:",omitempty"`
+
+	NodeName string `json:",omitempty"` // the responding node's name
+	NodeIP   string `json:",omitempty"` // the responding node's Tailscale IP
+
+	// Via is how the pong arrived: "direct", "DERP", "peer-relay"
+	// or "TSMP".
+	Via string `json:",omitempty"`
+
+	// Endpoint is the ip:port of the direct path, if Via is "direct".
+	Endpoint string `json:",omitempty"`
+
+	// DERPRegionCode is the DERP region used, if Via is "DERP".
+	DERPRegionCode string `json:",omitempty"`
+
+	// PeerRelay is the name of the peer relay used, if Via is
+	// "peer-relay".
+	PeerRelay string `json:",omitempty"`
+
+	LatencySeconds float64 `json:",omitempty"`
+
+	// PeerAPIPort is the responding node's peer API port, if known.
+	PeerAPIPort uint16 `json:",omitempty"`
+}
+
+// FileTargetOutput is an element of the array printed by
+// "tailscale file cp --targets --json".
+type FileTargetOutput struct {
+	IP   netaddr.IP // the node's first Tailscale IP
+	Name string     // the node's name, as used for "file cp"
+
+	// Online is whether the node is connected to the coordination
+	// server, or nil if unknown.
+	Online *bool `json:",omitempty"`
+
+	LastSeen *time.Time `json:",omitempty"`
+}
+
+// VersionOutput is the output of "tailscale version --json".
+type VersionOutput struct {
+	Short     string // e.g. "1.10.0"
+	Long      string // e.g. "1.10.0-t6e8a4c0d3-g51b8b4f7e"
+	GitCommit string `json:",omitempty"`
+	GoVersion string
+
+	// Daemon is the version of the running tailscaled, with
+	// --daemon only.
+	Daemon string `json:",omitempty"`
+}
+
+// BugReportOutput is the output of "tailscale bugreport --json".
+type BugReportOutput struct {
+	// Marker is the identifier logged by tailscaled, to share
+	// with support.
+	Marker string
+}
+
+// FilterDebug is the JSON type returned by the LocalAPI's
+// debug-filter handler: the packet filter currently in effect.
+type FilterDebug struct {
+	// ShieldsUp is whether incoming connections are all refused.
+	ShieldsUp bool
+
+	// LocalNets are the destinations that incoming packets must be
+	// addressed to.
+	LocalNets []netaddr.IPPrefix
+
+	// Matches are the filter's rules, checked in order: the IPv4
+	// rules, then the IPv6 ones.
+	Matches []filter.Match
+}
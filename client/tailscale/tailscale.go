@@ -15,20 +15,29 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strconv"
 	"strings"
 
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
 )
 
 // TailscaledSocket is the tailscaled Unix socket.
 var TailscaledSocket = paths.DefaultTailscaledSocket()
 
+// LocalAPIToken, if non-empty, is a scoped bearer token (see
+// CreateLocalAPIToken) to authenticate to the local daemon with,
+// instead of the identity of the connecting process.
+var LocalAPIToken string
+
 // tsClient does HTTP requests to the local Tailscale daemon.
 var tsClient = &http.Client{
 	Transport: &http.Transport{
@@ -60,7 +69,9 @@ var tsClient = &http.Client{
 //
 // DoLocalRequest may mutate the request to add Authorization headers.
 func DoLocalRequest(req *http.Request) (*http.Response, error) {
-	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+	if LocalAPIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+LocalAPIToken)
+	} else if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
 		req.SetBasicAuth("", token)
 	}
 	return tsClient.Do(req)
@@ -278,3 +289,280 @@ func SetDNS(ctx context.Context, name, value string) error {
 	_, err := send(ctx, "POST", "/localapi/v0/set-dns?"+v.Encode(), 200, nil)
 	return err
 }
+
+// Ping sends a ping of the given type ("disco" or "TSMP"; empty means
+// "disco") to ip and returns its result. The caller should set a
+// deadline on ctx, as a down host may never reply.
+func Ping(ctx context.Context, ip netaddr.IP, pingType string) (*ipnstate.PingResult, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("type", pingType)
+	body, err := send(ctx, "POST", "/localapi/v0/ping?"+v.Encode(), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	pr := new(ipnstate.PingResult)
+	if err := json.Unmarshal(body, pr); err != nil {
+		return nil, fmt.Errorf("invalid ping JSON: %w", err)
+	}
+	return pr, nil
+}
+
+// NetcheckReport returns the daemon's view of the local network
+// conditions. If fresh is false, the daemon's most recent report is
+// returned; otherwise the daemon runs a new check first.
+func NetcheckReport(ctx context.Context, fresh bool) (*netcheck.Report, error) {
+	body, err := get200(ctx, "/localapi/v0/netcheck?fresh="+strconv.FormatBool(fresh))
+	if err != nil {
+		return nil, err
+	}
+	r := new(netcheck.Report)
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("invalid netcheck JSON: %w", err)
+	}
+	return r, nil
+}
+
+// DebugMagicsock returns a snapshot of the daemon's per-peer disco
+// state.
+func DebugMagicsock(ctx context.Context) (*ipnstate.MagicsockDebug, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-magicsock")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.MagicsockDebug)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, fmt.Errorf("invalid magicsock debug JSON: %w", err)
+	}
+	return st, nil
+}
+
+// DebugDERPConns returns the daemon's active DERP connections.
+func DebugDERPConns(ctx context.Context) ([]ipnstate.DERPConnDebug, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-derp")
+	if err != nil {
+		return nil, err
+	}
+	var conns []ipnstate.DERPConnDebug
+	if err := json.Unmarshal(body, &conns); err != nil {
+		return nil, fmt.Errorf("invalid DERP debug JSON: %w", err)
+	}
+	return conns, nil
+}
+
+// DebugFilter returns the daemon's active packet filter.
+func DebugFilter(ctx context.Context) (*apitype.FilterDebug, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-filter")
+	if err != nil {
+		return nil, err
+	}
+	f := new(apitype.FilterDebug)
+	if err := json.Unmarshal(body, f); err != nil {
+		return nil, fmt.Errorf("invalid filter debug JSON: %w", err)
+	}
+	return f, nil
+}
+
+// CurrentDERPMap returns the DERP map the daemon is currently using.
+func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	body, err := get200(ctx, "/localapi/v0/derpmap")
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(body, dm); err != nil {
+		return nil, fmt.Errorf("invalid derp map JSON: %w", err)
+	}
+	return dm, nil
+}
+
+// PeerDebug fetches remote diagnostics from the peer API of another
+// node owned by the same user, identified by its Tailscale IP.
+// The what parameter is one of "status", "netcheck", "health" (all
+// returning JSON) or "bugreport" (returning a log marker, and logging
+// note on the remote node).
+func PeerDebug(ctx context.Context, ip netaddr.IP, what, note string) ([]byte, error) {
+	v := url.Values{}
+	v.Set("ip", ip.String())
+	v.Set("what", what)
+	v.Set("note", note)
+	return send(ctx, "POST", "/localapi/v0/peer-debug?"+v.Encode(), 200, nil)
+}
+
+// DialTCP asks the local daemon to open a TCP connection to port on
+// host, which is either an IP address or a MagicDNS name of a peer.
+// Unlike dialing directly, this works even when tailscaled is in
+// userspace-networking mode and the OS can't reach the tailnet.
+//
+// The connection lives until it's closed or ctx is done. It also has a
+// CloseWrite method, to signal EOF to the remote side while still
+// reading its reply, where the platform's connection to tailscaled
+// supports half-closing.
+func DialTCP(ctx context.Context, host string, port uint16) (io.ReadWriteCloser, error) {
+	var conn net.Conn
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{
+		"Upgrade":    []string{"ts-dial"},
+		"Connection": []string{"upgrade"},
+		"Dial-Host":  []string{host},
+		"Dial-Port":  []string{strconv.Itoa(int(port))},
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP response: %s, %s", res.Status, bytes.TrimSpace(body))
+	}
+	// For 101 Switching Protocols responses, net/http makes the
+	// body writable, carrying the rest of the connection.
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return nil, errors.New("internal error: switched HTTP body isn't writable")
+	}
+	return &dialConn{ReadWriteCloser: rwc, conn: conn}, nil
+}
+
+// dialConn is the connection returned by DialTCP.
+type dialConn struct {
+	io.ReadWriteCloser
+	conn net.Conn // underlying connection to tailscaled, or nil
+}
+
+// CloseWrite shuts down the writing side of the connection, if the
+// underlying connection to tailscaled supports it.
+func (c *dialConn) CloseWrite() error {
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite not supported")
+}
+
+// StreamDebugCapture asks the local daemon to capture the packets
+// passing through its tunnel, and disco messages, and returns the
+// stream in pcapng format. The stream continues until the returned
+// ReadCloser is closed or ctx is done.
+func StreamDebugCapture(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/debug-capture", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	return res.Body, nil
+}
+
+// CreateLocalAPIToken asks the local daemon to mint a LocalAPI bearer
+// token granting only the provided scopes. The returned token's Token
+// field holds the secret; it can't be retrieved again later.
+//
+// Tokens can only be managed by callers with full (root or operator)
+// access, not by other tokens.
+func CreateLocalAPIToken(ctx context.Context, name string, scopes ...apitype.LocalAPIScope) (*apitype.LocalAPIToken, error) {
+	reqj, err := json.Marshal(apitype.LocalAPIToken{Name: name, Scopes: scopes})
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/tokens", 200, bytes.NewReader(reqj))
+	if err != nil {
+		return nil, err
+	}
+	tok := new(apitype.LocalAPIToken)
+	if err := json.Unmarshal(body, tok); err != nil {
+		return nil, fmt.Errorf("invalid token JSON: %w", err)
+	}
+	return tok, nil
+}
+
+// LocalAPITokens returns the LocalAPI tokens minted by the local daemon,
+// without their secrets.
+func LocalAPITokens(ctx context.Context) ([]apitype.LocalAPIToken, error) {
+	body, err := get200(ctx, "/localapi/v0/tokens")
+	if err != nil {
+		return nil, err
+	}
+	var toks []apitype.LocalAPIToken
+	if err := json.Unmarshal(body, &toks); err != nil {
+		return nil, fmt.Errorf("invalid tokens JSON: %w", err)
+	}
+	return toks, nil
+}
+
+// RevokeLocalAPIToken revokes the LocalAPI token with the given ID.
+func RevokeLocalAPIToken(ctx context.Context, id string) error {
+	_, err := send(ctx, "DELETE", "/localapi/v0/tokens?id="+url.QueryEscape(id), http.StatusNoContent, nil)
+	return err
+}
+
+// IPNBusWatcher is an active subscription (watch) of the local tailscaled IPN bus.
+// It's returned by WatchIPNBus.
+//
+// It must be closed when done.
+type IPNBusWatcher struct {
+	res *http.Response
+	dec *json.Decoder
+}
+
+// WatchIPNBus subscribes to the IPN notification bus. It returns a watcher
+// once the bus is connected successfully.
+//
+// The mask selects which kinds of updates (netmap, prefs, engine status,
+// files) are delivered; see ipn.NotifyWatchOpt. Watching netmaps
+// requires write access to tailscaled. Private keys are never included.
+//
+// The caller must call Close on the returned watcher when done, or
+// cancel ctx.
+func WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*IPNBusWatcher, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"http://local-tailscaled.sock/localapi/v0/watch-ipn-bus?mask="+strconv.FormatUint(uint64(mask), 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, bestError(fmt.Errorf("HTTP %s: %s", res.Status, body), body)
+	}
+	return &IPNBusWatcher{
+		res: res,
+		dec: json.NewDecoder(res.Body),
+	}, nil
+}
+
+// Next returns the next ipn.Notify from the stream.
+// If the context from WatchIPNBus is done, that error is returned.
+func (w *IPNBusWatcher) Next() (ipn.Notify, error) {
+	var n ipn.Notify
+	if err := w.dec.Decode(&n); err != nil {
+		if cerr := w.res.Request.Context().Err(); cerr != nil {
+			err = cerr
+		}
+		return ipn.Notify{}, err
+	}
+	return n, nil
+}
+
+// Close stops the watcher and releases its resources.
+func (w *IPNBusWatcher) Close() error {
+	return w.res.Body.Close()
+}
@@ -46,6 +46,7 @@ var (
 	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
+	stunAltPort   = flag.Int("stun-alt-port", 0, "if non-zero and --stun is set, a second STUN port, from which replies to RFC 5780 change-port requests are sent (and vice versa), for clients to classify their NAT")
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
@@ -148,6 +149,7 @@ func main() {
 	mux.Handle("/derp", derphttp.Handler(s))
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", handleBootstrapDNS)
+	mux.HandleFunc("/generate_204", derphttp.ServeNoContent)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(200)
@@ -199,8 +201,17 @@ func main() {
 			cert.Certificate = append(cert.Certificate, s.MetaCert())
 			return cert, nil
 		}
+		port80 := certManager.HTTPHandler(tsweb.Port80Handler{Main: mux})
 		go func() {
-			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+			// Captive portal checks are done over plain HTTP, so
+			// don't redirect them to HTTPS like everything else.
+			err := http.ListenAndServe(":80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/generate_204" {
+					derphttp.ServeNoContent(w, r)
+					return
+				}
+				port80.ServeHTTP(w, r)
+			}))
 			if err != nil {
 				if err != http.ErrServerClosed {
 					log.Fatal(err)
@@ -256,6 +267,14 @@ func serveSTUN() {
 		log.Fatalf("failed to open STUN listener: %v", err)
 	}
 	log.Printf("running STUN server on %v", pc.LocalAddr())
+	var altPC net.PacketConn
+	if *stunAltPort != 0 {
+		altPC, err = net.ListenPacket("udp", fmt.Sprintf(":%d", *stunAltPort))
+		if err != nil {
+			log.Fatalf("failed to open STUN alternate port listener: %v", err)
+		}
+		log.Printf("running STUN server on alternate port %v", altPC.LocalAddr())
+	}
 
 	var (
 		stats           = new(metrics.Set)
@@ -274,44 +293,56 @@ func serveSTUN() {
 	stats.Set("counter_addrfamily", stunAddrFamily)
 	expvar.Publish("stun", stats)
 
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		ua, ok := addr.(*net.UDPAddr)
-		if !ok {
-			log.Printf("STUN unexpected address %T %v", addr, addr)
-			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		if ua.IP.To4() != nil {
-			stunIPv4.Add(1)
-		} else {
-			stunIPv6.Add(1)
-		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		_, err = pc.WriteTo(res, addr)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
+	// serve answers STUN requests arriving on pc. Requests asking
+	// for a changed port are answered from other, if non-nil.
+	serve := func(pc, other net.PacketConn) {
+		var buf [64 << 10]byte
+		for {
+			n, addr, err := pc.ReadFrom(buf[:])
+			if err != nil {
+				log.Printf("STUN ReadFrom: %v", err)
+				time.Sleep(time.Second)
+				stunReadError.Add(1)
+				continue
+			}
+			ua, ok := addr.(*net.UDPAddr)
+			if !ok {
+				log.Printf("STUN unexpected address %T %v", addr, addr)
+				stunReadError.Add(1)
+				continue
+			}
+			pkt := buf[:n]
+			if !stun.Is(pkt) {
+				stunNotSTUN.Add(1)
+				continue
+			}
+			txid, err := stun.ParseBindingRequest(pkt)
+			if err != nil {
+				stunNotSTUN.Add(1)
+				continue
+			}
+			if ua.IP.To4() != nil {
+				stunIPv4.Add(1)
+			} else {
+				stunIPv6.Add(1)
+			}
+			res := stun.Response(txid, ua.IP, uint16(ua.Port))
+			replyPC := pc
+			if other != nil && stun.WantsChangedPort(pkt) {
+				replyPC = other
+			}
+			_, err = replyPC.WriteTo(res, addr)
+			if err != nil {
+				stunWriteError.Add(1)
+			} else {
+				stunSuccess.Add(1)
+			}
 		}
 	}
+	if altPC != nil {
+		go serve(altPC, pc)
+	}
+	serve(pc, altPC)
 }
 
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
@@ -7,17 +7,28 @@ package cli
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 )
 
 var bugReportCmd = &ffcli.Command{
 	Name:       "bugreport",
 	Exec:       runBugReport,
 	ShortHelp:  "Print a shareable identifier to help diagnose issues",
-	ShortUsage: "bugreport [note]",
+	ShortUsage: "bugreport [--json] [note]",
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("bugreport", flag.ExitOnError)
+		fs.BoolVar(&bugReportArgs.json, "json", false, "output in JSON format (see apitype.BugReportOutput)")
+		return fs
+	})(),
+}
+
+var bugReportArgs struct {
+	json bool // output in JSON format
 }
 
 func runBugReport(ctx context.Context, args []string) error {
@@ -33,6 +44,9 @@ func runBugReport(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	if bugReportArgs.json {
+		return printJSON(apitype.BugReportOutput{Marker: logMarker})
+	}
 	fmt.Println(logMarker)
 	return nil
 }
@@ -8,6 +8,7 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -98,11 +99,16 @@ change in the future.
 		Subcommands: []*ffcli.Command{
 			upCmd,
 			downCmd,
+			setCmd,
+			exitNodeCmd,
 			logoutCmd,
 			netcheckCmd,
 			ipCmd,
 			statusCmd,
+			whoisCmd,
 			pingCmd,
+			ncCmd,
+			sshProxyCmd,
 			versionCmd,
 			webCmd,
 			fileCmd,
@@ -112,6 +118,7 @@ change in the future.
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
 		UsageFunc: usageFunc,
 	}
+	rootCmd.Subcommands = append(rootCmd.Subcommands, newCompletionCmd(rootCmd))
 	for _, c := range rootCmd.Subcommands {
 		c.UsageFunc = usageFunc
 	}
@@ -197,6 +204,16 @@ func pump(ctx context.Context, bc *ipn.BackendClient, conn net.Conn) error {
 	return ctx.Err()
 }
 
+// printJSON prints v to stdout as indented JSON, for --json flags.
+func printJSON(v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", j)
+	return nil
+}
+
 func strSliceContains(ss []string, s string) bool {
 	for _, v := range ss {
 		if v == s {
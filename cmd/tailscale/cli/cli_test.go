@@ -9,14 +9,25 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/peterbourgon/ff/v2/ffcli"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
 	"tailscale.com/types/preftype"
+	"tailscale.com/wgengine/filter"
 )
 
 // geese is a collection of gooses. It need not be complete.
@@ -666,3 +677,772 @@ func TestFlagAppliesToOS(t *testing.T) {
 		})
 	}
 }
+
+func TestMaskedPrefsFromSetArgs(t *testing.T) {
+	curPrefs := &ipn.Prefs{
+		AdvertiseRoutes: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("10.0.0.0/16"),
+			netaddr.MustParseIPPrefix("0.0.0.0/0"),
+			netaddr.MustParseIPPrefix("::/0"),
+		},
+	}
+	st := &ipnstate.Status{
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.1.2")},
+	}
+	tests := []struct {
+		name    string
+		flags   []string
+		want    *ipn.MaskedPrefs
+		wantErr string
+	}{
+		{
+			name:  "shields_up",
+			flags: []string{"--shields-up"},
+			want: &ipn.MaskedPrefs{
+				Prefs:        ipn.Prefs{ShieldsUp: true},
+				ShieldsUpSet: true,
+			},
+		},
+		{
+			name:  "peer_relay",
+			flags: []string{"--advertise-peer-relay"},
+			want: &ipn.MaskedPrefs{
+				Prefs:                 ipn.Prefs{AdvertisePeerRelay: true},
+				AdvertisePeerRelaySet: true,
+			},
+		},
+		{
+			name:  "exit_node",
+			flags: []string{"--exit-node=100.64.5.6"},
+			want: &ipn.MaskedPrefs{
+				Prefs:         ipn.Prefs{ExitNodeIP: netaddr.MustParseIP("100.64.5.6")},
+				ExitNodeIDSet: true,
+				ExitNodeIPSet: true,
+			},
+		},
+		{
+			name:  "clear_exit_node",
+			flags: []string{"--exit-node="},
+			want: &ipn.MaskedPrefs{
+				ExitNodeIDSet: true,
+				ExitNodeIPSet: true,
+			},
+		},
+		{
+			name:    "exit_node_self",
+			flags:   []string{"--exit-node=100.64.1.2"},
+			wantErr: "cannot use 100.64.1.2 as the exit node as it is a local IP address to this machine, did you mean --advertise-exit-node?",
+		},
+		{
+			name:  "advertise_routes_keeps_exit_node",
+			flags: []string{"--advertise-routes=192.168.0.0/24"},
+			want: &ipn.MaskedPrefs{
+				Prefs: ipn.Prefs{AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+					netaddr.MustParseIPPrefix("::/0"),
+					netaddr.MustParseIPPrefix("192.168.0.0/24"),
+				}},
+				AdvertiseRoutesSet: true,
+			},
+		},
+		{
+			name:  "stop_advertising_exit_node_keeps_routes",
+			flags: []string{"--advertise-exit-node=false"},
+			want: &ipn.MaskedPrefs{
+				Prefs: ipn.Prefs{AdvertiseRoutes: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("10.0.0.0/16"),
+				}},
+				AdvertiseRoutesSet: true,
+			},
+		},
+		{
+			name:    "bad_route",
+			flags:   []string{"--advertise-routes=1.2.3.4/16"},
+			wantErr: "1.2.3.4/16 has non-address bits set; expected 1.2.0.0/16",
+		},
+		{
+			name:    "bad_tag",
+			flags:   []string{"--advertise-tags=foo"},
+			wantErr: `tag: "foo": tags must start with 'tag:'`,
+		},
+		{
+			name:    "bad_netfilter_mode",
+			flags:   []string{"--netfilter-mode=bogus"},
+			wantErr: `invalid value --netfilter-mode="bogus"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args setArgsT
+			fs := newSetFlagSet("linux", &args)
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			mp, err := maskedPrefsFromSetArgs(fs, args, t.Logf, curPrefs, st)
+			if err != nil {
+				if err.Error() != tt.wantErr {
+					t.Fatalf("err = %q; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("unexpected success; want error %q", tt.wantErr)
+			}
+			if !reflect.DeepEqual(mp, tt.want) {
+				t.Errorf("got %s\nwant %s", mp.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+// Test that maskedPrefsFromSetArgs handles every "tailscale set" flag
+// and that each one results in an edit.
+func TestSetFlagsAllHandled(t *testing.T) {
+	for _, goos := range geese {
+		var args setArgsT
+		fs := newSetFlagSet(goos, &args)
+		fs.VisitAll(func(f *flag.Flag) {
+			var args setArgsT
+			fs := newSetFlagSet(goos, &args)
+			if err := fs.Set(f.Name, f.DefValue); err != nil {
+				t.Fatal(err)
+			}
+			mp, err := maskedPrefsFromSetArgs(fs, args, t.Logf, new(ipn.Prefs), nil)
+			if err != nil {
+				t.Fatalf("%s: flag %q: %v", goos, f.Name, err)
+			}
+			if got := mp.Pretty(); got == "MaskedPrefs{}" {
+				t.Errorf("%s: flag %q caused no edit", goos, f.Name)
+			}
+		})
+	}
+}
+
+func TestPrefsDiff(t *testing.T) {
+	cur := ipn.NewPrefs()
+	cur.Hostname = "foo"
+	if got := prefsDiff(cur, cur.Clone()); len(got) != 0 {
+		t.Errorf("diff of equal prefs = %q; want none", got)
+	}
+
+	next := cur.Clone()
+	next.Hostname = "bar"
+	next.ShieldsUp = true
+	next.Persist = nil // ignored
+	want := []string{
+		"Hostname: foo -> bar",
+		"ShieldsUp: false -> true",
+	}
+	if got := prefsDiff(cur, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestSuggestExitNode(t *testing.T) {
+	dm := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "fra"},
+		},
+	}
+	report := &netcheck.Report{
+		RegionLatency: map[int]time.Duration{
+			1: 80 * time.Millisecond,
+			2: 20 * time.Millisecond,
+		},
+	}
+	peer := func(name string, mod func(*ipnstate.PeerStatus)) *ipnstate.PeerStatus {
+		ps := &ipnstate.PeerStatus{
+			HostName:       name,
+			DNSName:        name + ".",
+			ExitNodeOption: true,
+			Online:         true,
+		}
+		mod(ps)
+		return ps
+	}
+	tests := []struct {
+		name  string
+		peers []*ipnstate.PeerStatus
+		want  string // HostName, or empty for none
+	}{
+		{
+			name: "none",
+			peers: []*ipnstate.PeerStatus{
+				peer("a", func(ps *ipnstate.PeerStatus) { ps.ExitNodeOption = false }),
+				peer("b", func(ps *ipnstate.PeerStatus) { ps.Online = false }),
+			},
+		},
+		{
+			name: "closest_derp_region",
+			peers: []*ipnstate.PeerStatus{
+				peer("a", func(ps *ipnstate.PeerStatus) { ps.Relay = "nyc" }),
+				peer("b", func(ps *ipnstate.PeerStatus) { ps.Relay = "fra" }),
+			},
+			want: "b",
+		},
+		{
+			name: "direct_beats_far_relay",
+			peers: []*ipnstate.PeerStatus{
+				peer("a", func(ps *ipnstate.PeerStatus) {
+					ps.Relay = "nyc"
+					ps.CurAddr = "1.2.3.4:41641"
+					ps.LatencySeconds = 0.005
+				}),
+				peer("b", func(ps *ipnstate.PeerStatus) { ps.Relay = "fra" }),
+			},
+			want: "a",
+		},
+		{
+			name: "known_latency_beats_unknown",
+			peers: []*ipnstate.PeerStatus{
+				peer("a", func(ps *ipnstate.PeerStatus) {}),
+				peer("b", func(ps *ipnstate.PeerStatus) { ps.Relay = "nyc" }),
+			},
+			want: "b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &ipnstate.Status{Peer: map[key.Public]*ipnstate.PeerStatus{}}
+			for i, ps := range tt.peers {
+				st.Peer[key.Public{byte(i + 1)}] = ps
+			}
+			got := suggestExitNode(st, dm, report)
+			var gotName string
+			if got != nil {
+				gotName = got.HostName
+			}
+			if gotName != tt.want {
+				t.Errorf("got %q; want %q", gotName, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhoisAddr(t *testing.T) {
+	tests := []struct {
+		in, want, wantErr string
+	}{
+		{in: "100.101.102.103", want: "100.101.102.103:0"},
+		{in: "100.101.102.103:22", want: "100.101.102.103:22"},
+		{in: "fd7a:115c:a1e0::1", want: "[fd7a:115c:a1e0::1]:0"},
+		{in: "[fd7a:115c:a1e0::1]:443", want: "[fd7a:115c:a1e0::1]:443"},
+		{in: "foo", wantErr: `invalid IP or IP:port "foo"`},
+	}
+	for _, tt := range tests {
+		got, err := whoisAddr(tt.in)
+		if err != nil {
+			if err.Error() != tt.wantErr {
+				t.Errorf("whoisAddr(%q) error = %q; want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("whoisAddr(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatWhoIs(t *testing.T) {
+	who := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name:     "foo.example.ts.net.",
+			StableID: "nFoo",
+			Addresses: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("100.101.102.103/32"),
+			},
+			AllowedIPs: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("100.101.102.103/32"),
+				netaddr.MustParseIPPrefix("10.0.0.0/8"),
+			},
+			Hostinfo: tailcfg.Hostinfo{
+				OS:          "linux",
+				RequestTags: []string{"tag:server"},
+			},
+		},
+		UserProfile: &tailcfg.UserProfile{
+			ID:          123,
+			LoginName:   "alice@example.com",
+			DisplayName: "Alice",
+		},
+	}
+	got := string(formatWhoIs(who))
+	want := `Machine:
+  Name:           foo.example.ts.net
+  ID:             nFoo
+  Addresses:      100.101.102.103
+  OS:             linux
+  Requested Tags: tag:server
+  Primary Routes: 10.0.0.0/8
+User:
+  Name:           Alice
+  ID:             123
+  Login:          alice@example.com
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStatusPeerFilter(t *testing.T) {
+	st := &ipnstate.Status{
+		User: map[tailcfg.UserID]tailcfg.UserProfile{
+			1: {ID: 1, LoginName: "alice@example.com"},
+		},
+	}
+	ps := &ipnstate.PeerStatus{
+		OS:             "linux",
+		UserID:         1,
+		RequestTags:    []string{"tag:server"},
+		Online:         true,
+		ExitNodeOption: true,
+	}
+	oldArgs := statusArgs
+	defer func() { statusArgs = oldArgs }()
+	tests := []struct {
+		name  string
+		set   func()
+		match bool
+	}{
+		{"none", func() {}, true},
+		{"os", func() { statusArgs.os = "Linux" }, true},
+		{"os_mismatch", func() { statusArgs.os = "windows" }, false},
+		{"tag", func() { statusArgs.tag = "tag:server" }, true},
+		{"tag_mismatch", func() { statusArgs.tag = "tag:db" }, false},
+		{"user_login", func() { statusArgs.user = "alice@example.com" }, true},
+		{"user_short", func() { statusArgs.user = "alice" }, true},
+		{"user_mismatch", func() { statusArgs.user = "bob" }, false},
+		{"online", func() { statusArgs.online = "true" }, true},
+		{"offline", func() { statusArgs.online = "false" }, false},
+		{"exit_nodes", func() { statusArgs.exitNodes = true }, true},
+		{"active", func() { statusArgs.active = true }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusArgs.os, statusArgs.tag, statusArgs.user, statusArgs.online = "", "", "", ""
+			statusArgs.exitNodes, statusArgs.active = false, false
+			tt.set()
+			if got := statusPeerFilter(st, ps); got != tt.match {
+				t.Errorf("statusPeerFilter = %v; want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestFormatStatusTablePath(t *testing.T) {
+	oldArgs := statusArgs
+	defer func() { statusArgs = oldArgs }()
+	statusArgs.self, statusArgs.peers, statusArgs.active = false, true, false
+	statusArgs.os, statusArgs.tag, statusArgs.user, statusArgs.online = "", "", "", ""
+	statusArgs.exitNodes = false
+
+	tests := []struct {
+		name string
+		ps   ipnstate.PeerStatus
+		want string
+	}{
+		{"direct", ipnstate.PeerStatus{CurAddr: "1.2.3.4:41641", Relay: "nyc"}, `direct `},
+		{"derp", ipnstate.PeerStatus{Relay: "nyc"}, `relay "nyc"`},
+		{"peer_relay", ipnstate.PeerStatus{PeerRelay: "bar", CurAddr: "100.64.0.9:41641", Relay: "nyc"}, `peer-relay "bar"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := tt.ps
+			ps.HostName = "foo"
+			st := &ipnstate.Status{Peer: map[key.Public]*ipnstate.PeerStatus{{1}: &ps}}
+			got := string(formatStatusTable(st, nil, 0))
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("table missing path %q:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFmtRate(t *testing.T) {
+	tests := []struct {
+		n    int64
+		d    time.Duration
+		want string
+	}{
+		{0, time.Second, "0B/s"},
+		{500, 2 * time.Second, "250B/s"},
+		{3000, time.Second, "3.0kB/s"},
+		{5e6, 2 * time.Second, "2.5MB/s"},
+		{-1, time.Second, "-"},
+	}
+	for _, tt := range tests {
+		if got := fmtRate(tt.n, tt.d); got != tt.want {
+			t.Errorf("fmtRate(%d, %v) = %q; want %q", tt.n, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	root := &ffcli.Command{
+		Name:        "tailscale",
+		FlagSet:     flag.NewFlagSet("tailscale", flag.ContinueOnError),
+		Subcommands: []*ffcli.Command{upCmd, pingCmd, fileCmd, debugCmd},
+	}
+	root.Subcommands = append(root.Subcommands, newCompletionCmd(root))
+	comp := completer{
+		peers:     func() []string { return []string{"foo", "bar"} },
+		exitNodes: func() []string { return []string{"100.1.1.1", "100.2.2.2"} },
+	}
+	tests := []struct {
+		words []string
+		want  []string
+	}{
+		{nil, []string{"completion", "debug", "file", "ping", "up"}},
+		{[]string{"pi"}, []string{"ping"}},
+		{[]string{"ping", ""}, []string{"bar", "foo"}},
+		{[]string{"ping", "f"}, []string{"foo"}},
+		{[]string{"ping", "-c", "3", "b"}, []string{"bar"}},
+		{[]string{"ping", "--verbose", "b"}, []string{"bar"}},
+		{[]string{"ping", "foo", ""}, nil},
+		{[]string{"up", "--accept-"}, []string{"--accept-dns", "--accept-routes"}},
+		{[]string{"up", "--exit-node", ""}, []string{"100.1.1.1", "100.2.2.2"}},
+		{[]string{"up", "--exit-node=100.2"}, []string{"--exit-node=100.2.2.2"}},
+		{[]string{"file", ""}, []string{"cp", "get"}},
+		{[]string{"file", "cp", "a.txt", "f"}, []string{"foo:"}},
+		{[]string{"debug", "remote", "foo", "s"}, []string{"status"}},
+		{[]string{"completion", "z"}, []string{"zsh"}},
+	}
+	for _, tt := range tests {
+		got := complete(root, tt.words, comp)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("complete(%q) = %q; want %q", tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestPingOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		pr   *ipnstate.PingResult
+		tsmp bool
+		want apitype.PingOutput
+	}{
+		{
+			name: "direct",
+			pr:   &ipnstate.PingResult{IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", Endpoint: "1.2.3.4:41641", LatencySeconds: 0.01},
+			want: apitype.PingOutput{Seq: 1, IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", Via: "direct", Endpoint: "1.2.3.4:41641", LatencySeconds: 0.01},
+		},
+		{
+			name: "derp",
+			pr:   &ipnstate.PingResult{IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", DERPRegionID: 1, DERPRegionCode: "nyc"},
+			want: apitype.PingOutput{Seq: 1, IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", Via: "DERP", DERPRegionCode: "nyc"},
+		},
+		{
+			name: "peer_relay",
+			pr:   &ipnstate.PingResult{IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", PeerRelay: "bar", LatencySeconds: 0.02},
+			want: apitype.PingOutput{Seq: 1, IP: "100.1.2.3", NodeName: "foo", NodeIP: "100.1.2.3", Via: "peer-relay", PeerRelay: "bar", LatencySeconds: 0.02},
+		},
+		{
+			name: "tsmp",
+			pr:   &ipnstate.PingResult{IP: "100.1.2.3", NodeIP: "100.1.2.3", PeerAPIPort: 123},
+			tsmp: true,
+			want: apitype.PingOutput{Seq: 1, IP: "100.1.2.3", NodeIP: "100.1.2.3", Via: "TSMP", PeerAPIPort: 123},
+		},
+		{
+			name: "error",
+			pr:   &ipnstate.PingResult{IP: "100.1.2.3", Err: "no matching peer"},
+			want: apitype.PingOutput{Seq: 1, IP: "100.1.2.3", Err: "no matching peer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pingOutput(1, tt.pr, tt.tsmp); got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckWebListenAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{"localhost:8088", false},
+		{"127.0.0.1:8088", false},
+		{"[::1]:0", false},
+		{"100.101.102.103:8088", false},
+		{"[fd7a:115c:a1e0::1]:8088", false},
+		{":8088", true},
+		{"0.0.0.0:8088", true},
+		{"192.168.1.2:8088", true},
+		{"example.com:8088", true},
+		{"localhost", true},
+	}
+	for _, tt := range tests {
+		err := checkWebListenAddr(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkWebListenAddr(%q) = %v; wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWebPrefsFromForm(t *testing.T) {
+	st := &ipnstate.Status{
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.100.100.1")},
+	}
+	form := url.Values{
+		"advertise-routes":    {"10.0.0.0/24, 10.1.0.0/16"},
+		"advertise-exit-node": {"on"},
+		"exit-node":           {""},
+		"accept-routes":       {"on"},
+	}
+	got, err := webPrefsFromForm(form, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.MaskedPrefs{
+		Prefs: ipn.Prefs{
+			AdvertiseRoutes: []netaddr.IPPrefix{
+				netaddr.MustParseIPPrefix("0.0.0.0/0"),
+				netaddr.MustParseIPPrefix("::/0"),
+				netaddr.MustParseIPPrefix("10.1.0.0/16"),
+				netaddr.MustParseIPPrefix("10.0.0.0/24"),
+			},
+			RouteAll: true,
+		},
+		AdvertiseRoutesSet: true,
+		ExitNodeIDSet:      true,
+		ExitNodeIPSet:      true,
+		ShieldsUpSet:       true,
+		RouteAllSet:        true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	form = url.Values{"exit-node": {"100.100.100.1"}}
+	if _, err := webPrefsFromForm(form, st); err == nil {
+		t.Error("using own IP as exit node: got nil error")
+	}
+	form = url.Values{"advertise-routes": {"10.0.0.1/24"}}
+	if _, err := webPrefsFromForm(form, st); err == nil {
+		t.Error("non-masked route: got nil error")
+	}
+}
+
+func TestWebServerLocalToken(t *testing.T) {
+	ws, err := newWebServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		url    string
+		cookie string
+		want   bool
+	}{
+		{"no_token", "/", "", false},
+		{"bad_token", "/?token=bad", "", false},
+		{"url_token", "/?token=" + ws.token, "", true},
+		{"cookie", "/", ws.token, true},
+		{"bad_cookie", "/", "bad", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: webTokenCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			if got := ws.authorize(w, r); got != tt.want {
+				t.Errorf("authorize = %v; want %v", got, tt.want)
+			}
+			if !tt.want && w.Code != http.StatusForbidden {
+				t.Errorf("status = %v; want 403", w.Code)
+			}
+			if strings.Contains(tt.url, "token="+ws.token) && !strings.Contains(w.Header().Get("Set-Cookie"), ws.token) {
+				t.Errorf("token in URL didn't set cookie")
+			}
+		})
+	}
+}
+
+func TestWebHandlerCSRF(t *testing.T) {
+	// Without the cookie, a POST is rejected, and the cookie set.
+	r := httptest.NewRequest("POST", "/prefs", strings.NewReader("shields_up=on"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	webHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST without cookie: status = %v; want 403", w.Code)
+	}
+	res := w.Result()
+	var tok string
+	for _, c := range res.Cookies() {
+		if c.Name == webCSRFCookie {
+			tok = c.Value
+		}
+	}
+	if tok == "" {
+		t.Fatal("no CSRF cookie set")
+	}
+
+	// With the cookie, but not the token, it's still rejected.
+	r = httptest.NewRequest("POST", "/delete-file", strings.NewReader("name=foo"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: webCSRFCookie, Value: tok})
+	w = httptest.NewRecorder()
+	webHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST without token: status = %v; want 403", w.Code)
+	}
+
+	// An empty expected token fails closed.
+	r = httptest.NewRequest("POST", "/prefs", nil)
+	w = httptest.NewRecorder()
+	serveWeb(w, r, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST with no CSRF token configured: status = %v; want 403", w.Code)
+	}
+}
+
+func TestWebTemplate(t *testing.T) {
+	data := tmplData{
+		Status:     "Running",
+		DeviceName: "foo",
+		IP:         "100.1.2.3",
+		CSRFToken:  "csrf-token",
+		Prefs: webPrefs{
+			AdvertiseRoutes: "10.0.0.0/24",
+			ExitNode:        "100.2.3.4",
+			AcceptRoutes:    true,
+		},
+		ExitNodes: []webPeer{{Name: "exit", IP: "100.2.3.4", Online: true, ExitNodeOption: true, ExitNode: true}},
+		Peers: []webPeer{
+			{Name: "exit", IP: "100.2.3.4", Online: true, ExitNodeOption: true, ExitNode: true},
+			{Name: "laptop", IP: "100.3.4.5", OS: "macOS"},
+		},
+		Files: []apitype.WaitingFile{{Name: "report.pdf", Size: 123}},
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`value="10.0.0.0/24"`,
+		`<option value="100.2.3.4" selected>`,
+		`name="csrf" value="csrf-token"`,
+		`laptop`,
+		`href="files/report.pdf"`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output doesn't contain %q", want)
+		}
+	}
+}
+
+func TestDebugStateOutput(t *testing.T) {
+	now := time.Unix(1000, 0)
+	t.Run("magicsock", func(t *testing.T) {
+		var buf bytes.Buffer
+		printMagicsockDebug(&buf, &ipnstate.MagicsockDebug{
+			HomeDERP:     1,
+			HomeDERPCode: "nyc",
+			Endpoints:    []string{"1.2.3.4:41641", "10.0.0.2:41641"},
+			Peers: []*ipnstate.PeerDiscoDebug{
+				{
+					Name:               "foo.example.ts.net.",
+					Active:             true,
+					DERPAddr:           "127.3.3.40:1",
+					BestAddr:           "5.6.7.8:41641",
+					BestAddrLatency:    12 * time.Millisecond,
+					BestAddrAt:         now.Add(-2 * time.Second),
+					TrustBestAddrUntil: now.Add(4 * time.Second),
+					LastSend:           now.Add(-time.Second),
+					Heartbeat:          true,
+					Endpoints: []*ipnstate.DiscoEndpointDebug{{
+						Addr:            "5.6.7.8:41641",
+						LastPing:        now.Add(-2500 * time.Millisecond),
+						LastPong:        now.Add(-2 * time.Second),
+						LastPongLatency: 12 * time.Millisecond,
+						Pongs:           3,
+						CallMeMaybe:     now.Add(-time.Minute),
+					}},
+					Path: &ipnstate.PeerPathStats{
+						CurPath:  "direct",
+						CurAddr:  "5.6.7.8:41641",
+						CurSince: now.Add(-10 * time.Second),
+						Relayed:  5 * time.Second,
+						Paths: []*ipnstate.PathStats{{
+							Addr:       "5.6.7.8:41641",
+							TxBytes:    100,
+							RxBytes:    200,
+							RTTSamples: 3,
+							RTTMin:     10 * time.Millisecond,
+							RTTAvg:     12 * time.Millisecond,
+							RTTP95:     15 * time.Millisecond,
+						}},
+						Changes: []ipnstate.PathChange{
+							{At: now.Add(-15 * time.Second), To: "derp-1"},
+							{At: now.Add(-10 * time.Second), From: "derp-1", To: "5.6.7.8:41641"},
+						},
+					},
+				},
+				{Name: "idle.example.ts.net."},
+			},
+		}, now)
+		got := buf.String()
+		for _, want := range []string{
+			"home DERP: 1 (nyc)\n",
+			"endpoints: 1.2.3.4:41641, 10.0.0.2:41641\n",
+			"\n\tderp: 127.3.3.40:1\n",
+			"\tbest: 5.6.7.8:41641, 12ms, confirmed 2s ago, trusted for 4s\n",
+			"\tlast send 1s ago, recv never, full ping never; heartbeat on\n",
+			"\t5.6.7.8:41641: ping 3s ago, pong 2s ago (12ms, 3 recent), call-me-maybe 1m0s ago\n",
+			"\tpath: direct 5.6.7.8:41641 since 10s ago, relayed 5s total\n",
+			"\t\t5.6.7.8:41641: tx 100, rx 200, rtt min/avg/p95 10ms/12ms/15ms (3 samples)\n",
+			"\t\tchanged 15s ago: none -> derp-1\n",
+			"\t\tchanged 10s ago: derp-1 -> 5.6.7.8:41641\n",
+			"idle.example.ts.net. (",
+			"\tinactive\n",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("output missing %q; got:\n%s", want, got)
+			}
+		}
+	})
+	t.Run("derp", func(t *testing.T) {
+		var buf bytes.Buffer
+		printDERPConnsDebug(&buf, []ipnstate.DERPConnDebug{
+			{RegionID: 1, RegionCode: "nyc", Home: true, Created: now.Add(-5 * time.Minute), LastWrite: now.Add(-time.Second)},
+			{RegionID: 2, RegionCode: "sfo", Created: now.Add(-time.Minute), LastWrite: now.Add(-30 * time.Second)},
+		}, now)
+		want := "" +
+			"REGION  CODE  HOME  AGE   LAST WRITE\n" +
+			"1       nyc   *     5m0s  1s ago\n" +
+			"2       sfo         1m0s  30s ago\n"
+		if got := buf.String(); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+	t.Run("filter", func(t *testing.T) {
+		var buf bytes.Buffer
+		printFilterDebug(&buf, &apitype.FilterDebug{
+			LocalNets: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")},
+			Matches: []filter.Match{{
+				IPProto: []ipproto.Proto{ipproto.TCP},
+				Srcs:    []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.2/32")},
+				Dsts: []filter.NetPortRange{{
+					Net:   netaddr.MustParseIPPrefix("100.64.0.1/32"),
+					Ports: filter.PortRange{First: 22, Last: 22},
+				}},
+			}},
+		})
+		want := "" +
+			"shields up: false\n" +
+			"local nets: 100.64.0.1/32\n" +
+			"rules:\n" +
+			"\t1: [TCP]100.64.0.2/32=>100.64.0.1/32:22\n"
+		if got := buf.String(); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// completeCmdName is the hidden argument to "tailscale completion"
+// that the generated shell scripts call back into to get the
+// candidate completions for a partial command line.
+const completeCmdName = "__complete"
+
+func newCompletionCmd(root *ffcli.Command) *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "completion",
+		ShortUsage: "completion <bash|zsh|fish>",
+		ShortHelp:  "Print a shell completion script",
+		LongHelp: strings.TrimSpace(`
+
+The 'tailscale completion' command prints a script that makes the
+given shell complete tailscale subcommands, flags, peer names and
+exit nodes. Peers and exit nodes are looked up from tailscaled as
+you type.
+
+To load completions for the current shell session:
+
+  bash: source <(tailscale completion bash)  (needs bash-completion)
+  zsh:  source <(tailscale completion zsh)
+  fish: tailscale completion fish | source
+
+To load them for every new session, write the output to your shell's
+completion directory instead, such as
+/etc/bash_completion.d/tailscale, a file named _tailscale in your
+$fpath, or ~/.config/fish/completions/tailscale.fish.
+
+`),
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 && args[0] == completeCmdName {
+				words := args[1:]
+				if len(words) > 0 && words[0] == "--" {
+					words = words[1:]
+				}
+				for _, c := range complete(root, words, statusCompleter(ctx)) {
+					fmt.Println(c)
+				}
+				return nil
+			}
+			if len(args) != 1 {
+				return errors.New("usage: completion <bash|zsh|fish>")
+			}
+			script, ok := completionScripts[args[0]]
+			if !ok {
+				return fmt.Errorf("unsupported shell %q; want bash, zsh or fish", args[0])
+			}
+			fmt.Print(script)
+			return nil
+		},
+	}
+}
+
+// completionScripts are the per-shell completion scripts. Each one
+// runs "tailscale completion __complete -- <words...>" with the words
+// typed after "tailscale", the last of which is the (possibly empty)
+// word being completed, and offers its output lines as candidates.
+// When there are none, they fall back to completing file names, as
+// for "tailscale file cp".
+var completionScripts = map[string]string{
+	"bash": `# bash completion for tailscale
+_tailscale() {
+	# Keep "--flag=value" and "peer:" whole rather than split at
+	# COMP_WORDBREAKS, then trim the candidates back to the part
+	# after the last = or : that bash is actually completing.
+	local cur words cword
+	_get_comp_words_by_ref -n =: cur words cword
+	local IFS=$'\n'
+	COMPREPLY=($(tailscale completion __complete -- "${words[@]:1:cword}" 2>/dev/null))
+	if [[ $cur == *=* && $COMP_WORDBREAKS == *=* ]]; then
+		local prefix=${cur%"${cur##*=}"}
+		COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+		cur=${cur#"$prefix"}
+	fi
+	__ltrim_colon_completions "$cur"
+}
+complete -o default -F _tailscale tailscale
+`,
+	"zsh": `#compdef tailscale
+# zsh completion for tailscale
+_tailscale() {
+	local -a completions
+	completions=(${(f)"$(tailscale completion __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#completions} )); then
+		compadd -a completions
+	else
+		_files
+	fi
+}
+compdef _tailscale tailscale
+`,
+	"fish": `# fish completion for tailscale
+function __tailscale_complete
+	set -l words (commandline -opc)[2..-1] (commandline -ct)
+	tailscale completion __complete -- $words 2>/dev/null
+end
+complete -c tailscale -a '(__tailscale_complete)'
+`,
+}
+
+// completer provides the dynamic completions, which come from
+// tailscaled. Its funcs are only called if needed.
+type completer struct {
+	peers     func() []string // peer names
+	exitNodes func() []string // exit node IPs
+}
+
+// statusCompleter returns a completer that fetches peers and exit
+// nodes from tailscaled's status. Errors result in no completions.
+func statusCompleter(ctx context.Context) completer {
+	var st *ipnstate.Status
+	getStatus := func() *ipnstate.Status {
+		if st == nil {
+			st, _ = tailscale.Status(ctx)
+			if st == nil {
+				st = new(ipnstate.Status)
+			}
+		}
+		return st
+	}
+	return completer{
+		peers: func() (ret []string) {
+			st := getStatus()
+			for _, ps := range st.Peer {
+				if name := dnsname.TrimSuffix(ps.DNSName, st.MagicDNSSuffix); name != "" {
+					ret = append(ret, name)
+				}
+			}
+			return ret
+		},
+		exitNodes: func() (ret []string) {
+			for _, ps := range getStatus().Peer {
+				if ps.ExitNodeOption && len(ps.TailscaleIPs) > 0 {
+					ret = append(ret, ps.TailscaleIPs[0].String())
+				}
+			}
+			return ret
+		},
+	}
+}
+
+// complete returns the sorted completions for the last of words,
+// the arguments typed after "tailscale" on a command line, by walking
+// the command tree from root.
+func complete(root *ffcli.Command, words []string, comp completer) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cmd := root
+	var pos int              // number of positional args seen for cmd
+	var flagValue *flag.Flag // non-nil if the next word is this flag's value
+	for _, w := range words[:len(words)-1] {
+		switch {
+		case flagValue != nil:
+			flagValue = nil
+		case w == "--":
+			// Positional arguments follow; not worth distinguishing.
+		case strings.HasPrefix(w, "-"):
+			name := strings.TrimLeft(w, "-")
+			if strings.Contains(name, "=") {
+				continue
+			}
+			if f := lookupFlag(cmd, name); f != nil && !isBoolFlag(f) {
+				flagValue = f
+			}
+		default:
+			if sub := subcommand(cmd, w); sub != nil && pos == 0 {
+				cmd = sub
+				continue
+			}
+			pos++
+		}
+	}
+
+	partial := words[len(words)-1]
+	var cands []string
+	switch {
+	case flagValue != nil:
+		cands = flagValueCompletions(flagValue.Name, comp)
+	case strings.HasPrefix(partial, "-"):
+		if i := strings.Index(partial, "="); i != -1 {
+			name := strings.TrimLeft(partial[:i], "-")
+			for _, v := range flagValueCompletions(name, comp) {
+				cands = append(cands, partial[:i+1]+v)
+			}
+			break
+		}
+		if cmd.FlagSet != nil {
+			cmd.FlagSet.VisitAll(func(f *flag.Flag) {
+				cands = append(cands, "--"+f.Name)
+			})
+		}
+	default:
+		if pos == 0 {
+			for _, sub := range cmd.Subcommands {
+				cands = append(cands, sub.Name)
+			}
+		}
+		cands = append(cands, argCompletions(cmd, pos, comp)...)
+	}
+
+	var ret []string
+	for _, c := range cands {
+		if strings.HasPrefix(c, partial) {
+			ret = append(ret, c)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// argCompletions returns the candidates for cmd's pos'th (0-based)
+// positional argument.
+func argCompletions(cmd *ffcli.Command, pos int, comp completer) []string {
+	if cmd.Name == "completion" && pos == 0 {
+		return []string{"bash", "fish", "zsh"}
+	}
+	switch cmd {
+	case pingCmd, ipCmd, whoisCmd, ncCmd, sshProxyCmd:
+		if pos == 0 {
+			return comp.peers()
+		}
+	case debugRemoteCmd:
+		switch pos {
+		case 0:
+			return comp.peers()
+		case 1:
+			return []string{"status", "netcheck", "health", "bugreport"}
+		}
+	case fileCpCmd:
+		// The target comes after any number of files.
+		var ret []string
+		for _, p := range comp.peers() {
+			ret = append(ret, p+":")
+		}
+		return ret
+	}
+	return nil
+}
+
+// flagValueCompletions returns the candidate values for the flag
+// with the given name.
+func flagValueCompletions(name string, comp completer) []string {
+	switch name {
+	case "exit-node":
+		return comp.exitNodes()
+	}
+	return nil
+}
+
+// subcommand returns cmd's subcommand with the given name, or nil.
+func subcommand(cmd *ffcli.Command, name string) *ffcli.Command {
+	for _, sub := range cmd.Subcommands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// lookupFlag returns cmd's flag with the given name, or nil.
+func lookupFlag(cmd *ffcli.Command, name string) *flag.Flag {
+	if cmd.FlagSet == nil {
+		return nil
+	}
+	return cmd.FlagSet.Lookup(name)
+}
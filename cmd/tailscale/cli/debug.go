@@ -13,12 +13,19 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 )
@@ -26,6 +33,13 @@ import (
 var debugCmd = &ffcli.Command{
 	Name: "debug",
 	Exec: runDebug,
+	Subcommands: []*ffcli.Command{
+		debugRemoteCmd,
+		debugCaptureCmd,
+		debugMagicsockCmd,
+		debugDERPCmd,
+		debugFilterCmd,
+	},
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("debug", flag.ExitOnError)
 		fs.BoolVar(&debugArgs.goroutines, "daemon-goroutines", false, "If true, dump the tailscaled daemon's goroutines")
@@ -127,3 +141,379 @@ func runDebug(ctx context.Context, args []string) error {
 	}
 	return nil
 }
+
+var debugRemoteCmd = &ffcli.Command{
+	Name:       "remote",
+	ShortUsage: "debug remote [flags] <hostname-or-IP> [status|netcheck|health|bugreport]",
+	ShortHelp:  "Fetch diagnostics from another of your nodes via its peer API",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale debug remote' command fetches diagnostics from another
+node owned by the same user, over the Tailscale network, without
+needing to log in to it.
+
+The default is "health", which shows the node's current health error,
+if any, and its recent health changes. "status" and "netcheck" print
+the remote node's status and last netcheck report as JSON.
+"bugreport" logs a bug report marker on the remote node and prints it.
+
+`),
+	Exec: runDebugRemote,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("remote", flag.ExitOnError)
+		fs.StringVar(&debugRemoteArgs.note, "note", "", "note to log on the remote node with \"bugreport\"")
+		return fs
+	})(),
+}
+
+var debugRemoteArgs struct {
+	note string
+}
+
+func runDebugRemote(ctx context.Context, args []string) error {
+	what := "health"
+	switch len(args) {
+	case 1:
+	case 2:
+		what = args[1]
+	default:
+		return errors.New("usage: debug remote <hostname-or-IP> [status|netcheck|health|bugreport]")
+	}
+	ipStr, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return err
+	}
+	body, err := tailscale.PeerDebug(ctx, ip, what, debugRemoteArgs.note)
+	if err != nil {
+		return err
+	}
+	if what != "health" {
+		os.Stdout.Write(body)
+		return nil
+	}
+	var hs apitype.HealthStatus
+	if err := json.Unmarshal(body, &hs); err != nil {
+		return fmt.Errorf("invalid health JSON: %w", err)
+	}
+	if hs.Error == "" {
+		fmt.Printf("%s is healthy\n", args[0])
+	} else {
+		fmt.Printf("%s is unhealthy: %s\n", args[0], hs.Error)
+	}
+	if len(hs.Recent) > 0 {
+		fmt.Printf("\nRecent changes:\n")
+	}
+	for _, c := range hs.Recent {
+		state := "healthy"
+		if c.Error != "" {
+			state = c.Error
+		}
+		fmt.Printf("\t%s: %s\n", c.Time.Local().Format(time.RFC3339), state)
+	}
+	return nil
+}
+
+var debugCaptureCmd = &ffcli.Command{
+	Name:       "capture",
+	ShortUsage: "debug capture [-o <file>]",
+	ShortHelp:  "Stream a packet capture of tunnel and disco traffic",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale debug capture' command records the packets that pass
+through tailscaled's tunnel device, in both directions, along with
+disco messages, and writes them in pcapng format until interrupted.
+
+Unlike tcpdump on the tunnel interface, it also works in
+userspace-networking mode, and it includes packets dropped by the
+packet filter. Each packet's comment records whether the filter
+accepted or dropped it, or whether it was injected by tailscaled.
+IP packets are on the first interface, as raw IP; disco messages
+are on the second, as link type USER0.
+
+`),
+	Exec: runDebugCapture,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("capture", flag.ExitOnError)
+		fs.StringVar(&debugCaptureArgs.out, "o", "", "file to write the pcapng capture to, or \"-\" for stdout")
+		return fs
+	})(),
+}
+
+var debugCaptureArgs struct {
+	out string
+}
+
+func runDebugCapture(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	if debugCaptureArgs.out == "" {
+		return errors.New("missing -o flag; use -o - to write to stdout")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(interrupt)
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	rc, err := tailscale.StreamDebugCapture(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var w io.Writer = os.Stdout
+	if debugCaptureArgs.out != "-" {
+		f, err := os.Create(debugCaptureArgs.out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+		fmt.Fprintf(os.Stderr, "Capturing to %s; press Ctrl+C to stop.\n", debugCaptureArgs.out)
+	}
+	_, err = io.Copy(w, rc)
+	if ctx.Err() != nil {
+		// Interrupted; that's the normal way to stop.
+		return nil
+	}
+	return err
+}
+
+var debugStateArgs struct {
+	json bool
+}
+
+// newDebugStateFlagSet returns the flags shared by the debug
+// subcommands that print a snapshot of tailscaled's internal state.
+func newDebugStateFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&debugStateArgs.json, "json", false, "output in JSON format")
+	return fs
+}
+
+var debugMagicsockCmd = &ffcli.Command{
+	Name:       "magicsock",
+	ShortUsage: "debug magicsock [--json]",
+	ShortHelp:  "Print per-peer disco path state",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale debug magicsock' command prints tailscaled's view of
+each peer's paths: its DERP address, the best direct UDP address and
+how long that's trusted for, and the state of each candidate endpoint
+(recent pings, pongs and call-me-maybe advertisements).
+
+`),
+	Exec:    runDebugMagicsock,
+	FlagSet: newDebugStateFlagSet("magicsock"),
+}
+
+func runDebugMagicsock(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	st, err := tailscale.DebugMagicsock(ctx)
+	if err != nil {
+		return err
+	}
+	if debugStateArgs.json {
+		return printJSON(st)
+	}
+	printMagicsockDebug(os.Stdout, st, time.Now())
+	return nil
+}
+
+func printMagicsockDebug(w io.Writer, st *ipnstate.MagicsockDebug, now time.Time) {
+	fmt.Fprintf(w, "disco key: %s\n", st.DiscoKey.ShortString())
+	if st.HomeDERP == 0 {
+		fmt.Fprintf(w, "home DERP: none\n")
+	} else {
+		fmt.Fprintf(w, "home DERP: %d (%s)\n", st.HomeDERP, st.HomeDERPCode)
+	}
+	fmt.Fprintf(w, "endpoints: %s\n", strings.Join(st.Endpoints, ", "))
+	for _, p := range st.Peers {
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "\n%s (%s, %s)\n", name, p.NodeKey.ShortString(), p.DiscoKey.ShortString())
+		if !p.Active {
+			fmt.Fprintf(w, "\tinactive\n")
+			continue
+		}
+		if p.DERPAddr != "" {
+			fmt.Fprintf(w, "\tderp: %s\n", p.DERPAddr)
+		}
+		if p.BestAddr == "" {
+			fmt.Fprintf(w, "\tbest: none\n")
+		} else {
+			trust := "untrusted"
+			if p.TrustBestAddrUntil.After(now) {
+				trust = "trusted for " + roundDur(p.TrustBestAddrUntil.Sub(now)).String()
+			}
+			fmt.Fprintf(w, "\tbest: %s, %v, confirmed %s, %s\n", p.BestAddr, p.BestAddrLatency, ago(now, p.BestAddrAt), trust)
+		}
+		heartbeat := "off"
+		if p.Heartbeat {
+			heartbeat = "on"
+		}
+		fmt.Fprintf(w, "\tlast send %s, recv %s, full ping %s; heartbeat %s\n",
+			ago(now, p.LastSend), ago(now, p.LastRecv), ago(now, p.LastFullPing), heartbeat)
+		for _, ep := range p.Endpoints {
+			fmt.Fprintf(w, "\t%s: ping %s, pong %s", ep.Addr, ago(now, ep.LastPing), ago(now, ep.LastPong))
+			if ep.Pongs > 0 {
+				fmt.Fprintf(w, " (%v, %d recent)", ep.LastPongLatency, ep.Pongs)
+			}
+			if !ep.CallMeMaybe.IsZero() {
+				fmt.Fprintf(w, ", call-me-maybe %s", ago(now, ep.CallMeMaybe))
+			}
+			if !ep.LastGotPing.IsZero() {
+				fmt.Fprintf(w, ", learned from ping %s", ago(now, ep.LastGotPing))
+			}
+			fmt.Fprintln(w)
+		}
+		if p.Path != nil {
+			printPathStats(w, p.Path, now)
+		}
+	}
+}
+
+func printPathStats(w io.Writer, ps *ipnstate.PeerPathStats, now time.Time) {
+	if ps.CurPath == "" {
+		fmt.Fprintf(w, "\tpath: none")
+	} else {
+		fmt.Fprintf(w, "\tpath: %s %s since %s", ps.CurPath, ps.CurAddr, ago(now, ps.CurSince))
+	}
+	fmt.Fprintf(w, ", relayed %v total\n", roundDur(ps.Relayed))
+	for _, st := range ps.Paths {
+		fmt.Fprintf(w, "\t\t%s: tx %d, rx %d", st.Addr, st.TxBytes, st.RxBytes)
+		if st.RTTSamples > 0 {
+			fmt.Fprintf(w, ", rtt min/avg/p95 %v/%v/%v (%d samples)", st.RTTMin, st.RTTAvg, st.RTTP95, st.RTTSamples)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, c := range ps.Changes {
+		from := c.From
+		if from == "" {
+			from = "none"
+		}
+		fmt.Fprintf(w, "\t\tchanged %s: %s -> %s\n", ago(now, c.At), from, c.To)
+	}
+}
+
+var debugDERPCmd = &ffcli.Command{
+	Name:       "derp",
+	ShortUsage: "debug derp [--json]",
+	ShortHelp:  "Print active DERP connections",
+	Exec:       runDebugDERP,
+	FlagSet:    newDebugStateFlagSet("derp"),
+}
+
+func runDebugDERP(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	conns, err := tailscale.DebugDERPConns(ctx)
+	if err != nil {
+		return err
+	}
+	if debugStateArgs.json {
+		return printJSON(conns)
+	}
+	printDERPConnsDebug(os.Stdout, conns, time.Now())
+	return nil
+}
+
+func printDERPConnsDebug(w io.Writer, conns []ipnstate.DERPConnDebug, now time.Time) {
+	if len(conns) == 0 {
+		fmt.Fprintln(w, "no active DERP connections")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+	fmt.Fprintf(tw, "REGION\tCODE\tHOME\tAGE\tLAST WRITE\n")
+	for _, c := range conns {
+		home := ""
+		if c.Home {
+			home = "*"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%s\n", c.RegionID, c.RegionCode, home, roundDur(now.Sub(c.Created)), ago(now, c.LastWrite))
+	}
+	tw.Flush()
+}
+
+var debugFilterCmd = &ffcli.Command{
+	Name:       "filter",
+	ShortUsage: "debug filter [--json]",
+	ShortHelp:  "Print the active packet filter rules",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale debug filter' command prints the packet filter that
+tailscaled applies to incoming traffic: the local networks packets
+must be addressed to, and the rules, in the order they're checked.
+Each rule reads "[protocols]sources=>destination:ports".
+
+`),
+	Exec:    runDebugFilter,
+	FlagSet: newDebugStateFlagSet("filter"),
+}
+
+func runDebugFilter(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	f, err := tailscale.DebugFilter(ctx)
+	if err != nil {
+		return err
+	}
+	if debugStateArgs.json {
+		return printJSON(f)
+	}
+	printFilterDebug(os.Stdout, f)
+	return nil
+}
+
+func printFilterDebug(w io.Writer, f *apitype.FilterDebug) {
+	fmt.Fprintf(w, "shields up: %v\n", f.ShieldsUp)
+	nets := make([]string, 0, len(f.LocalNets))
+	for _, n := range f.LocalNets {
+		nets = append(nets, n.String())
+	}
+	fmt.Fprintf(w, "local nets: %s\n", strings.Join(nets, ", "))
+	if len(f.Matches) == 0 {
+		fmt.Fprintf(w, "rules: none (all incoming connections refused)\n")
+		return
+	}
+	fmt.Fprintf(w, "rules:\n")
+	for i, m := range f.Matches {
+		fmt.Fprintf(w, "\t%d: %v\n", i+1, m)
+	}
+}
+
+// ago returns how long before now t was, for debug output, or "never"
+// if t is zero.
+func ago(now, t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return roundDur(now.Sub(t)).String() + " ago"
+}
+
+// roundDur rounds d for display: to the millisecond if under a
+// second, otherwise to the second.
+func roundDur(d time.Duration) time.Duration {
+	if d < time.Second && d > -time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+)
+
+var exitNodeCmd = &ffcli.Command{
+	Name:       "exit-node",
+	ShortUsage: "exit-node [list|suggest]",
+	ShortHelp:  "Show machines on your tailnet that can be used as exit nodes",
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "list",
+			ShortUsage: "exit-node list",
+			ShortHelp:  "List peers that can be used as exit nodes",
+			Exec:       runExitNodeList,
+		},
+		{
+			Name:       "suggest",
+			ShortUsage: "exit-node suggest",
+			ShortHelp:  "Suggest the best available exit node",
+			Exec:       runExitNodeSuggest,
+		},
+	},
+	Exec: func(context.Context, []string) error {
+		return flag.ErrHelp
+	},
+}
+
+// exitNodeInfo is what "tailscale exit-node" needs to know about the
+// tailnet.
+type exitNodeInfo struct {
+	st     *ipnstate.Status
+	dm     *tailcfg.DERPMap // or nil
+	report *netcheck.Report // or nil
+}
+
+func getExitNodeInfo(ctx context.Context) (*exitNodeInfo, error) {
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info := &exitNodeInfo{st: st}
+	// The DERP map and netcheck report are only used to describe
+	// and rank peers, so carry on without them if unavailable.
+	info.dm, _ = tailscale.CurrentDERPMap(ctx)
+	info.report, _ = tailscale.NetcheckReport(ctx, false)
+	return info, nil
+}
+
+// exitNodePeers returns the peers in st that can be used as exit
+// nodes, sorted by hostname.
+func exitNodePeers(st *ipnstate.Status) []*ipnstate.PeerStatus {
+	var peers []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		if ps.ExitNodeOption && !ps.ShareeNode {
+			peers = append(peers, ps)
+		}
+	}
+	ipnstate.SortPeers(peers)
+	return peers
+}
+
+func runExitNodeList(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	info, err := getExitNodeInfo(ctx)
+	if err != nil {
+		return err
+	}
+	peers := exitNodePeers(info.st)
+	if len(peers) == 0 {
+		return errors.New("no exit nodes found on your tailnet")
+	}
+
+	var buf bytes.Buffer
+	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
+	f("%-15s %-20s %-20s %-8s %-9s %s\n", "IP", "HOSTNAME", "REGION", "STATUS", "LATENCY", "PATH")
+	for _, ps := range peers {
+		status := "offline"
+		if ps.Online {
+			status = "online"
+		}
+		if ps.ExitNode {
+			status = "selected"
+		}
+		latency := "-"
+		if d, ok := exitNodeLatency(ps, info.dm, info.report); ok {
+			latency = d.Round(time.Millisecond).String()
+		}
+		path := "-"
+		if ps.CurAddr != "" {
+			path = "direct"
+		} else if ps.Relay != "" {
+			path = fmt.Sprintf("relay %q", ps.Relay)
+		}
+		f("%-15s %-20s %-20s %-8s %-9s %s\n",
+			firstIPString(ps.TailscaleIPs),
+			dnsOrQuoteHostname(info.st, ps),
+			derpRegionName(info.dm, ps.Relay),
+			status,
+			latency,
+			path,
+		)
+	}
+	os.Stdout.Write(buf.Bytes())
+	return nil
+}
+
+func runExitNodeSuggest(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	info, err := getExitNodeInfo(ctx)
+	if err != nil {
+		return err
+	}
+	ps := suggestExitNode(info.st, info.dm, info.report)
+	if ps == nil {
+		return errors.New("no online exit nodes found on your tailnet")
+	}
+	ip := firstIPString(ps.TailscaleIPs)
+	fmt.Printf("Suggested exit node: %s (%s)\n", dnsOrQuoteHostname(info.st, ps), ip)
+	fmt.Printf("To use it, run: tailscale set --exit-node=%s\n", ip)
+	return nil
+}
+
+// suggestExitNode returns the online exit node peer in st with the
+// lowest estimated latency (see exitNodeLatency), or nil if there are
+// no online exit nodes. Peers without a latency estimate are only
+// suggested if no peer has one.
+func suggestExitNode(st *ipnstate.Status, dm *tailcfg.DERPMap, report *netcheck.Report) *ipnstate.PeerStatus {
+	var best *ipnstate.PeerStatus
+	var bestLatency time.Duration
+	bestKnown := false
+	for _, ps := range exitNodePeers(st) {
+		if !ps.Online {
+			continue
+		}
+		d, ok := exitNodeLatency(ps, dm, report)
+		switch {
+		case best == nil,
+			ok && !bestKnown,
+			ok && d < bestLatency:
+			best, bestLatency, bestKnown = ps, d, ok
+		}
+	}
+	return best
+}
+
+// exitNodeLatency estimates the round trip time to ps.
+//
+// If ps has a direct path, that's the latency of the most recent disco
+// ping. Otherwise traffic is relayed via the peer's home DERP region,
+// so our netcheck latency to that region is used as a lower bound.
+func exitNodeLatency(ps *ipnstate.PeerStatus, dm *tailcfg.DERPMap, report *netcheck.Report) (_ time.Duration, ok bool) {
+	if ps.CurAddr != "" && ps.LatencySeconds > 0 {
+		return time.Duration(ps.LatencySeconds * float64(time.Second)), true
+	}
+	if dm == nil || report == nil || ps.Relay == "" {
+		return 0, false
+	}
+	for id, r := range dm.Regions {
+		if r.RegionCode == ps.Relay {
+			d, ok := report.RegionLatency[id]
+			return d, ok
+		}
+	}
+	return 0, false
+}
+
+// derpRegionName returns the name of the DERP region with the given
+// code, falling back to the code itself.
+func derpRegionName(dm *tailcfg.DERPMap, code string) string {
+	if code == "" {
+		return "-"
+	}
+	if dm != nil {
+		for _, r := range dm.Regions {
+			if r.RegionCode == code && r.RegionName != "" {
+				return r.RegionName
+			}
+		}
+	}
+	return code
+}
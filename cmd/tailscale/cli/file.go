@@ -59,6 +59,7 @@ var fileCpCmd = &ffcli.Command{
 		fs.StringVar(&cpArgs.name, "name", "", "alternate filename to use, especially useful when <file> is \"-\" (stdin)")
 		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
 		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
+		fs.BoolVar(&cpArgs.json, "json", false, "with --targets, output in JSON format (see apitype.FileTargetOutput)")
 		return fs
 	})(),
 }
@@ -67,12 +68,16 @@ var cpArgs struct {
 	name    string
 	verbose bool
 	targets bool
+	json    bool // with targets, output in JSON format
 }
 
 func runCp(ctx context.Context, args []string) error {
 	if cpArgs.targets {
 		return runCpTargets(ctx, args)
 	}
+	if cpArgs.json {
+		return errors.New("--json is only supported with --targets")
+	}
 	if len(args) < 2 {
 		//lint:ignore ST1005 no sorry need that colon at the end
 		return errors.New("usage: tailscale file cp <files...> <target>:")
@@ -277,6 +282,9 @@ func runCpTargets(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
+	if cpArgs.json {
+		return printJSON(fileTargetsOutput(fts))
+	}
 	for _, ft := range fts {
 		n := ft.Node
 		var detail string
@@ -299,6 +307,25 @@ func runCpTargets(ctx context.Context, args []string) error {
 	return nil
 }
 
+// fileTargetsOutput returns the "file cp --targets --json" output
+// for fts.
+func fileTargetsOutput(fts []apitype.FileTarget) []apitype.FileTargetOutput {
+	ret := []apitype.FileTargetOutput{} // non-nil, to print [] when empty
+	for _, ft := range fts {
+		n := ft.Node
+		if len(n.Addresses) == 0 {
+			continue
+		}
+		ret = append(ret, apitype.FileTargetOutput{
+			IP:       n.Addresses[0].IP(),
+			Name:     n.ComputedName,
+			Online:   n.Online,
+			LastSeen: n.LastSeen,
+		})
+	}
+	return ret
+}
+
 var fileGetCmd = &ffcli.Command{
 	Name:       "get",
 	ShortUsage: "file get [--wait] [--verbose] <target-directory>",
@@ -13,12 +13,13 @@ import (
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnstate"
 )
 
 var ipCmd = &ffcli.Command{
 	Name:       "ip",
-	ShortUsage: "ip [-4] [-6] [peername]",
+	ShortUsage: "ip [-4] [-6] [--json] [peername]",
 	ShortHelp:  "Show current Tailscale IP address(es)",
 	LongHelp:   "Shows the Tailscale IP address of the current machine without an argument. With an argument, it shows the IP of a named peer.",
 	Exec:       runIP,
@@ -26,6 +27,7 @@ var ipCmd = &ffcli.Command{
 		fs := flag.NewFlagSet("ip", flag.ExitOnError)
 		fs.BoolVar(&ipArgs.want4, "4", false, "only print IPv4 address")
 		fs.BoolVar(&ipArgs.want6, "6", false, "only print IPv6 address")
+		fs.BoolVar(&ipArgs.json, "json", false, "output in JSON format (see apitype.IPOutput)")
 		return fs
 	})(),
 }
@@ -33,6 +35,7 @@ var ipCmd = &ffcli.Command{
 var ipArgs struct {
 	want4 bool
 	want6 bool
+	json  bool // output in JSON format
 }
 
 func runIP(ctx context.Context, args []string) error {
@@ -71,14 +74,13 @@ func runIP(ctx context.Context, args []string) error {
 		return fmt.Errorf("no current Tailscale IPs; state: %v", st.BackendState)
 	}
 
-	match := false
+	var match []netaddr.IP
 	for _, ip := range ips {
 		if ip.Is4() && v4 || ip.Is6() && v6 {
-			match = true
-			fmt.Println(ip)
+			match = append(match, ip)
 		}
 	}
-	if !match {
+	if len(match) == 0 {
 		if ipArgs.want4 {
 			return errors.New("no Tailscale IPv4 address")
 		}
@@ -86,6 +88,12 @@ func runIP(ctx context.Context, args []string) error {
 			return errors.New("no Tailscale IPv6 address")
 		}
 	}
+	if ipArgs.json {
+		return printJSON(apitype.IPOutput{Host: of, IPs: match})
+	}
+	for _, ip := range match {
+		fmt.Println(ip)
+	}
 	return nil
 }
 
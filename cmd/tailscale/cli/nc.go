@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+)
+
+var ncCmd = &ffcli.Command{
+	Name:       "nc",
+	ShortUsage: "nc <hostname-or-IP> <port>",
+	ShortHelp:  "Connect to a port on a host, connected to stdin/stdout",
+	LongHelp: strings.TrimSpace(`
+"tailscale nc" asks tailscaled to open a TCP connection to the given
+host and port and copies it to and from stdin and stdout. As
+tailscaled makes the connection, it works in userspace-networking
+mode too, where the OS can't reach Tailscale IPs.
+
+For example, to use it with OpenSSH, add to ~/.ssh/config:
+
+    Host *.ts.net
+        ProxyCommand tailscale nc %h %p
+`),
+	Exec: runNC,
+}
+
+func runNC(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: nc <hostname-or-IP> <port>")
+	}
+	host, portStr := args[0], args[1]
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("invalid port number %q", portStr)
+	}
+
+	return connectStdio(ctx, host, uint16(port))
+}
+
+// connectStdio asks tailscaled to dial port on host and copies the
+// connection to and from stdin and stdout until the remote side is
+// done. At EOF on stdin, the connection's write side is half-closed
+// so the remote side can still finish its reply.
+func connectStdio(ctx context.Context, host string, port uint16) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c, err := tailscale.DialTCP(ctx, host, port)
+	if err != nil {
+		return fmt.Errorf("Dial(%q, %v): %w", host, port, err)
+	}
+	defer c.Close()
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, c)
+		errc <- err
+	}()
+	go func() {
+		if _, err := io.Copy(c, os.Stdin); err != nil {
+			errc <- err
+			return
+		}
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	return <-errc
+}
@@ -103,7 +103,11 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	}
 
 	fmt.Printf("\nReport:\n")
-	fmt.Printf("\t* UDP: %v\n", report.UDP)
+	if report.UDPBlocked {
+		fmt.Printf("\t* UDP: false (blocked by this network; DERP reachable over HTTPS)\n")
+	} else {
+		fmt.Printf("\t* UDP: %v\n", report.UDP)
+	}
 	if report.GlobalV4 != "" {
 		fmt.Printf("\t* IPv4: yes, %v\n", report.GlobalV4)
 	} else {
@@ -118,7 +122,13 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	}
 	fmt.Printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	fmt.Printf("\t* HairPinning: %v\n", report.HairPinning)
+	fmt.Printf("\t* NAT: %v\n", natType(report))
 	fmt.Printf("\t* PortMapping: %v\n", portMapping(report))
+	fmt.Printf("\t* CaptivePortal: %v\n", report.CaptivePortal)
+	fmt.Printf("\t* HTTPSProxy: %v\n", report.HTTPSProxy)
+	if !report.NAT64Prefix.IsZero() {
+		fmt.Printf("\t* NAT64: yes, %v\n", report.NAT64Prefix)
+	}
 
 	// When DERP latency checking failed,
 	// magicsock will try to pick the DERP server that
@@ -160,6 +170,25 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	return nil
 }
 
+// natType describes the NAT's RFC 4787 mapping and filtering
+// behavior, as classified by netcheck.
+func natType(r *netcheck.Report) string {
+	if r.NATMapping == "" && r.NATFiltering == "" {
+		return "unknown"
+	}
+	desc := func(b netcheck.NATBehavior) string {
+		if b == "" {
+			return "unknown"
+		}
+		return string(b)
+	}
+	s := fmt.Sprintf("%s mapping, %s filtering", desc(r.NATMapping), desc(r.NATFiltering))
+	if r.NATMapping == netcheck.AddressAndPortDependent {
+		s += " (hard NAT; direct connections are unlikely without port mapping)"
+	}
+	return s
+}
+
 func portMapping(r *netcheck.Report) string {
 	if !r.AnyPortMappingChecked() {
 		return "not checked"
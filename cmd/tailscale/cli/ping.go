@@ -6,6 +6,7 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,13 +17,14 @@ import (
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 )
 
 var pingCmd = &ffcli.Command{
 	Name:       "ping",
-	ShortUsage: "ping <hostname-or-IP>",
+	ShortUsage: "ping [flags] <hostname-or-IP>",
 	ShortHelp:  "Ping a host at the Tailscale layer, see how it routed",
 	LongHelp: strings.TrimSpace(`
 
@@ -51,6 +53,7 @@ relay node.
 		fs.BoolVar(&pingArgs.tsmp, "tsmp", false, "do a TSMP-level ping (through IP + wireguard, but not involving host OS stack)")
 		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
 		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
+		fs.BoolVar(&pingArgs.json, "json", false, "output a JSON object per ping (see apitype.PingOutput)")
 		return fs
 	})(),
 }
@@ -61,6 +64,7 @@ var pingArgs struct {
 	verbose     bool
 	tsmp        bool
 	timeout     time.Duration
+	json        bool // output JSON lines
 }
 
 func runPing(ctx context.Context, args []string) error {
@@ -101,11 +105,18 @@ func runPing(ctx context.Context, args []string) error {
 		timer := time.NewTimer(pingArgs.timeout)
 		select {
 		case <-timer.C:
-			fmt.Printf("timeout waiting for ping reply\n")
+			if pingArgs.json {
+				printPingJSON(apitype.PingOutput{Seq: n, IP: ip, Timeout: true})
+			} else {
+				fmt.Printf("timeout waiting for ping reply\n")
+			}
 		case err := <-pumpErr:
 			return err
 		case pr := <-prc:
 			timer.Stop()
+			if pingArgs.json {
+				printPingJSON(pingOutput(n, pr, pingArgs.tsmp))
+			}
 			if pr.Err != "" {
 				return errors.New(pr.Err)
 			}
@@ -114,6 +125,9 @@ func runPing(ctx context.Context, args []string) error {
 			if pr.DERPRegionID != 0 {
 				via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
 			}
+			if pr.PeerRelay != "" {
+				via = fmt.Sprintf("peer-relay(%s)", pr.PeerRelay)
+			}
 			if pingArgs.tsmp {
 				// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
 				// For now just say it came via TSMP.
@@ -124,7 +138,9 @@ func runPing(ctx context.Context, args []string) error {
 			if pr.PeerAPIPort != 0 {
 				extra = fmt.Sprintf(", %d", pr.PeerAPIPort)
 			}
-			fmt.Printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
+			if !pingArgs.json {
+				fmt.Printf("pong from %s (%s%s) via %v in %v\n", pr.NodeName, pr.NodeIP, extra, via, latency)
+			}
 			if pingArgs.tsmp {
 				return nil
 			}
@@ -147,6 +163,41 @@ func runPing(ctx context.Context, args []string) error {
 	}
 }
 
+// pingOutput returns the --json output for the seq'th ping's result.
+func pingOutput(seq int, pr *ipnstate.PingResult, tsmp bool) apitype.PingOutput {
+	po := apitype.PingOutput{
+		Seq:            seq,
+		IP:             pr.IP,
+		Err:            pr.Err,
+		NodeName:       pr.NodeName,
+		NodeIP:         pr.NodeIP,
+		LatencySeconds: pr.LatencySeconds,
+		PeerAPIPort:    pr.PeerAPIPort,
+	}
+	switch {
+	case pr.Err != "":
+		return po
+	case tsmp:
+		po.Via = "TSMP"
+	case pr.DERPRegionID != 0:
+		po.Via = "DERP"
+		po.DERPRegionCode = pr.DERPRegionCode
+	case pr.PeerRelay != "":
+		po.Via = "peer-relay"
+		po.PeerRelay = pr.PeerRelay
+	default:
+		po.Via = "direct"
+		po.Endpoint = pr.Endpoint
+	}
+	return po
+}
+
+// printPingJSON prints po as a single line of JSON.
+func printPingJSON(po apitype.PingOutput) {
+	j, _ := json.Marshal(po)
+	fmt.Printf("%s\n", j)
+}
+
 func tailscaleIPFromArg(ctx context.Context, hostOrIP string) (ip string, err error) {
 	// If the argument is an IP address, use it directly without any resolution.
 	if net.ParseIP(hostOrIP) != nil {
@@ -0,0 +1,194 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/safesocket"
+	"tailscale.com/types/logger"
+)
+
+var setCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "set [flags]",
+	ShortHelp:  "Change specified preferences",
+
+	LongHelp: strings.TrimSpace(`
+"tailscale set" changes only the preferences named by the given flags,
+leaving all other settings as they are. Unlike "tailscale up", it never
+resets unmentioned settings to their defaults and never starts a login.
+`),
+	FlagSet: setFlagSet,
+	Exec:    runSet,
+}
+
+var setFlagSet = newSetFlagSet(runtime.GOOS, &setArgs)
+
+// setArgsT holds the flags of "tailscale set". They share their
+// names, meanings and validation with the equivalent "tailscale up"
+// flags.
+type setArgsT struct {
+	acceptRoutes           bool
+	acceptDNS              bool
+	singleRoutes           bool
+	exitNodeIP             string
+	exitNodeAllowLANAccess bool
+	shieldsUp              bool
+	forceDaemon            bool
+	advertiseRoutes        string
+	advertiseDefaultRoute  bool
+	advertiseTags          string
+	advertisePeerRelay     bool
+	snat                   bool
+	netfilterMode          string
+	hostname               string
+	opUser                 string
+}
+
+var setArgs setArgsT
+
+func newSetFlagSet(goos string, setArgs *setArgsT) *flag.FlagSet {
+	setf := flag.NewFlagSet("set", flag.ExitOnError)
+
+	setf.BoolVar(&setArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
+	setf.BoolVar(&setArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	setf.BoolVar(&setArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
+	setf.StringVar(&setArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty string to not use an exit node")
+	setf.BoolVar(&setArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
+	setf.BoolVar(&setArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	setf.StringVar(&setArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
+	setf.StringVar(&setArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+	setf.StringVar(&setArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
+	setf.BoolVar(&setArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	setf.BoolVar(&setArgs.advertisePeerRelay, "advertise-peer-relay", false, "offer to relay traffic between peers that can't connect directly")
+	if safesocket.GOOSUsesPeerCreds(goos) {
+		setf.StringVar(&setArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
+	}
+	switch goos {
+	case "linux":
+		setf.BoolVar(&setArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
+		setf.StringVar(&setArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
+	case "windows":
+		setf.BoolVar(&setArgs.forceDaemon, "unattended", false, "run in \"Unattended Mode\" where Tailscale keeps running even after the current GUI user logs out (Windows-only)")
+	}
+	return setf
+}
+
+func runSet(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		fatalf("too many non-flag arguments: %q", args)
+	}
+	if setFlagSet.NFlag() == 0 {
+		return errors.New("no preferences specified; see 'tailscale set --help'")
+	}
+
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		fatalf("can't fetch status from tailscaled: %v", err)
+	}
+	curPrefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	mp, err := maskedPrefsFromSetArgs(setFlagSet, setArgs, warnf, curPrefs, st)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	if mp.AdvertiseRoutesSet && len(withoutExitNodes(mp.AdvertiseRoutes)) > 0 {
+		if err := tailscale.CheckIPForwarding(ctx); err != nil {
+			warnf("%v", err)
+		}
+	}
+
+	_, err = tailscale.EditPrefs(ctx, mp)
+	return err
+}
+
+// maskedPrefsFromSetArgs returns the ipn.MaskedPrefs that changes
+// exactly the preferences corresponding to the flags set in fs.
+//
+// curPrefs are the currently active preferences. They're consulted
+// only where two flags share one preference, so setting one of them
+// doesn't clobber the other: --advertise-routes and
+// --advertise-exit-node both live in Prefs.AdvertiseRoutes.
+//
+// Like prefsFromUpArgs, it has no side effects.
+func maskedPrefsFromSetArgs(fs *flag.FlagSet, setArgs setArgsT, warnf logger.Logf, curPrefs *ipn.Prefs, st *ipnstate.Status) (*ipn.MaskedPrefs, error) {
+	flagIsSet := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		flagIsSet[f.Name] = true
+	})
+
+	mp := new(ipn.MaskedPrefs)
+	p := &mp.Prefs
+	for name := range flagIsSet {
+		var err error
+		switch name {
+		case "accept-routes":
+			p.RouteAll = setArgs.acceptRoutes
+		case "accept-dns":
+			p.CorpDNS = setArgs.acceptDNS
+		case "host-routes":
+			p.AllowSingleHosts = setArgs.singleRoutes
+		case "exit-node":
+			p.ExitNodeIP, err = exitNodeIPFromArg(setArgs.exitNodeIP, st)
+		case "exit-node-allow-lan-access":
+			p.ExitNodeAllowLANAccess = setArgs.exitNodeAllowLANAccess
+		case "shields-up":
+			p.ShieldsUp = setArgs.shieldsUp
+		case "advertise-tags":
+			p.AdvertiseTags, err = tagsFromArg(setArgs.advertiseTags)
+		case "advertise-peer-relay":
+			p.AdvertisePeerRelay = setArgs.advertisePeerRelay
+		case "hostname":
+			err = checkHostname(setArgs.hostname)
+			p.Hostname = setArgs.hostname
+		case "advertise-routes", "advertise-exit-node":
+			// Handled below, as both flags map to one pref.
+		case "operator":
+			p.OperatorUser = setArgs.opUser
+		case "snat-subnet-routes":
+			p.NoSNAT = !setArgs.snat
+		case "netfilter-mode":
+			p.NetfilterMode, err = netfilterModeFromArg(setArgs.netfilterMode, warnf)
+		case "unattended":
+			p.ForceDaemon = setArgs.forceDaemon
+		default:
+			panic(fmt.Sprintf("internal error: unhandled flag %q", name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		updateMaskedPrefsFromUpFlag(mp, name)
+	}
+
+	if flagIsSet["advertise-routes"] || flagIsSet["advertise-exit-node"] {
+		advRoutes := setArgs.advertiseRoutes
+		advDefault := setArgs.advertiseDefaultRoute
+		if !flagIsSet["advertise-routes"] {
+			advRoutes = joinPrefixes(withoutExitNodes(curPrefs.AdvertiseRoutes))
+		}
+		if !flagIsSet["advertise-exit-node"] {
+			advDefault = hasExitNodeRoutes(curPrefs.AdvertiseRoutes)
+		}
+		routes, err := calcAdvertiseRoutes(advRoutes, advDefault)
+		if err != nil {
+			return nil, err
+		}
+		p.AdvertiseRoutes = routes
+	}
+	return mp, nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+)
+
+var sshProxyCmd = &ffcli.Command{
+	Name:       "ssh-proxy",
+	ShortUsage: "ssh-proxy <hostname-or-IP> [port]",
+	ShortHelp:  "Connect stdin/stdout to a peer's SSH server, for use as an ssh ProxyCommand",
+	LongHelp: strings.TrimSpace(`
+"tailscale ssh-proxy" connects stdin and stdout to the SSH server
+(port 22, unless another port is given) on a tailnet peer, via
+tailscaled. It's meant to be OpenSSH's ProxyCommand, so that ssh can
+reach peers even in userspace-networking mode. For example, in
+~/.ssh/config:
+
+    Host *.ts.net
+        ProxyCommand tailscale ssh-proxy %h %p
+
+The host may also be given as user@host, as ssh accepts, in which
+case the user part is ignored.
+`),
+	Exec: runSSHProxy,
+}
+
+func runSSHProxy(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: ssh-proxy <hostname-or-IP> [port]")
+	}
+	host := args[0]
+	if i := strings.LastIndexByte(host, '@'); i != -1 {
+		host = host[i+1:]
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	port := uint64(22)
+	if len(args) == 2 {
+		var err error
+		port, err = strconv.ParseUint(args[1], 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("invalid port number %q", args[1])
+		}
+	}
+	return connectStdio(ctx, host, uint16(port))
+}
@@ -8,11 +8,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,9 +30,19 @@ import (
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [--active] [--web] [--json]",
+	ShortUsage: "status [--active] [--watch] [--web] [--json] [filter flags]",
 	ShortHelp:  "Show state of tailscaled and its connections",
-	Exec:       runStatus,
+	LongHelp: strings.TrimSpace(`
+
+With --watch, the peer list is redrawn in a table with extra PATH,
+ENDPOINT, HANDSHAKE, RX and TX columns showing each peer's current
+path (direct or relay), its direct endpoint, time since the last
+WireGuard handshake, and receive and transmit rates. These columns
+appear only in --watch mode, as the rates are computed between
+redraws.
+
+`),
+	Exec: runStatus,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("status", flag.ExitOnError)
 		fs.BoolVar(&statusArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
@@ -40,6 +52,12 @@ var statusCmd = &ffcli.Command{
 		fs.BoolVar(&statusArgs.peers, "peers", true, "show status of peers")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address for web mode; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.BoolVar(&statusArgs.watch, "watch", false, "continuously redraw a table of peers as their state changes, with path, endpoint, handshake and rate columns")
+		fs.StringVar(&statusArgs.os, "os", "", "filter output to only peers running this OS (e.g. \"linux\")")
+		fs.StringVar(&statusArgs.tag, "tag", "", "filter output to only peers that requested this ACL tag (e.g. \"tag:server\")")
+		fs.StringVar(&statusArgs.user, "user", "", "filter output to only peers owned by this user (login name, or the part before the @)")
+		fs.StringVar(&statusArgs.online, "online", "", "if \"true\" or \"false\", filter output to only peers that are or aren't connected to the control server")
+		fs.BoolVar(&statusArgs.exitNodes, "exit-nodes", false, "filter output to only peers that can be used as exit nodes")
 		return fs
 	})(),
 }
@@ -52,19 +70,36 @@ var statusArgs struct {
 	active  bool   // in CLI mode, filter output to only peers with active sessions
 	self    bool   // in CLI mode, show status of local machine
 	peers   bool   // in CLI mode, show status of peer machines
+	watch   bool   // in CLI mode, redraw a table of peers on change
+
+	// Peer filters, applying to all modes but web mode.
+	os        string // if non-empty, only peers with this OS
+	tag       string // if non-empty, only peers that requested this tag
+	user      string // if non-empty, only peers owned by this user
+	online    string // if "true" or "false", only peers with this online state
+	exitNodes bool   // only peers that can be exit nodes
 }
 
 func runStatus(ctx context.Context, args []string) error {
+	switch statusArgs.online {
+	case "", "true", "false":
+	default:
+		return fmt.Errorf("invalid --online value %q; want true or false", statusArgs.online)
+	}
+	if statusArgs.watch {
+		if statusArgs.json || statusArgs.web {
+			return errors.New("--watch can't be used with --json or --web")
+		}
+		return runStatusWatch(ctx)
+	}
 	st, err := tailscale.Status(ctx)
 	if err != nil {
 		return err
 	}
 	if statusArgs.json {
-		if statusArgs.active {
-			for peer, ps := range st.Peer {
-				if !peerActive(ps) {
-					delete(st.Peer, peer)
-				}
+		for peer, ps := range st.Peer {
+			if !statusPeerFilter(st, ps) {
+				delete(st.Peer, peer)
 			}
 		}
 		j, err := json.MarshalIndent(st, "", "  ")
@@ -152,7 +187,9 @@ func runStatus(ctx context.Context, args []string) error {
 			if ps.ExitNode {
 				f("exit node; ")
 			}
-			if relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer-relay %q", ps.PeerRelay)
+			} else if relay != "" && ps.CurAddr == "" {
 				f("relay %q", relay)
 			} else if ps.CurAddr != "" {
 				f("direct %s", ps.CurAddr)
@@ -178,17 +215,204 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 		ipnstate.SortPeers(peers)
 		for _, ps := range peers {
-			active := peerActive(ps)
-			if statusArgs.active && !active {
+			if !statusPeerFilter(st, ps) {
 				continue
 			}
 			printPS(ps)
 		}
 	}
+	printHealth(&buf, st)
 	os.Stdout.Write(buf.Bytes())
 	return nil
 }
 
+// printHealth writes st's health warnings, if any, to buf, as
+// comments after the peer list.
+func printHealth(buf *bytes.Buffer, st *ipnstate.Status) {
+	if len(st.Health) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "\n# Health check:\n")
+	for _, m := range st.Health {
+		fmt.Fprintf(buf, "#     - %s\n", m)
+	}
+}
+
+// statusPeerFilter reports whether the peer ps in st matches the
+// filters in statusArgs.
+func statusPeerFilter(st *ipnstate.Status, ps *ipnstate.PeerStatus) bool {
+	if statusArgs.active && !peerActive(ps) {
+		return false
+	}
+	if statusArgs.os != "" && !strings.EqualFold(ps.OS, statusArgs.os) {
+		return false
+	}
+	if statusArgs.tag != "" && !strSliceContains(ps.RequestTags, statusArgs.tag) {
+		return false
+	}
+	if statusArgs.user != "" {
+		u := st.User[ps.UserID]
+		if !strings.EqualFold(u.LoginName, statusArgs.user) &&
+			!strings.EqualFold(strings.SplitN(u.LoginName, "@", 2)[0], statusArgs.user) {
+			return false
+		}
+	}
+	if statusArgs.online != "" && strconv.FormatBool(ps.Online) != statusArgs.online {
+		return false
+	}
+	if statusArgs.exitNodes && !ps.ExitNodeOption {
+		return false
+	}
+	return true
+}
+
+// runStatusWatch implements "tailscale status --watch". It redraws a
+// table of peers whenever tailscaled reports a state, prefs or engine
+// change, and every few seconds to keep the transfer rates current.
+//
+// The bus messages only trigger redraws; the table itself comes from
+// Status, so there's no need to watch full netmaps.
+func runStatusWatch(ctx context.Context) error {
+	w, err := tailscale.WatchIPNBus(ctx, ipn.NotifyWatchPrefs|ipn.NotifyWatchEngineUpdates)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	changed := make(chan bool, 1)
+	watchErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := w.Next(); err != nil {
+				watchErr <- err
+				return
+			}
+			select {
+			case changed <- true:
+			default:
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	var prev *ipnstate.Status
+	var prevAt time.Time
+	for {
+		st, err := tailscale.Status(ctx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var buf bytes.Buffer
+		buf.WriteString("\x1b[H\x1b[2J") // move cursor home and clear screen
+		fmt.Fprintf(&buf, "Tailscale %s at %s\n\n", st.BackendState, now.Format("15:04:05"))
+		buf.Write(formatStatusTable(st, prev, now.Sub(prevAt)))
+		os.Stdout.Write(buf.Bytes())
+		prev, prevAt = st, now
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watchErr:
+			return err
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// formatStatusTable formats st as the table used by
+// "tailscale status --watch". If prev is non-nil, it's the status from
+// elapsed ago and is used to compute transfer rates.
+func formatStatusTable(st, prev *ipnstate.Status, elapsed time.Duration) []byte {
+	var buf bytes.Buffer
+	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
+	const rowFmt = "%-15s %-20s %-12s %-7s %-12s %-21s %-9s %-9s %s\n"
+	f(rowFmt, "IP", "HOSTNAME", "USER", "OS", "PATH", "ENDPOINT", "HANDSHAKE", "RX", "TX")
+
+	now := time.Now()
+	printPS := func(ps *ipnstate.PeerStatus, isSelf bool) {
+		path, endpoint, handshake := "-", "-", "-"
+		rx, tx := "-", "-"
+		if !isSelf {
+			if ps.PeerRelay != "" {
+				path = fmt.Sprintf("peer-relay %q", ps.PeerRelay)
+			} else if ps.Relay != "" && ps.CurAddr == "" {
+				path = fmt.Sprintf("relay %q", ps.Relay)
+			} else if ps.CurAddr != "" {
+				path = "direct"
+				endpoint = ps.CurAddr
+			}
+			if !ps.LastHandshake.IsZero() {
+				handshake = fmtAgo(now.Sub(ps.LastHandshake))
+			}
+			if prev != nil && elapsed > 0 {
+				if old, ok := prev.Peer[ps.PublicKey]; ok {
+					rx = fmtRate(ps.RxBytes-old.RxBytes, elapsed)
+					tx = fmtRate(ps.TxBytes-old.TxBytes, elapsed)
+				}
+			}
+		}
+		f(rowFmt,
+			firstIPString(ps.TailscaleIPs),
+			dnsOrQuoteHostname(st, ps),
+			ownerLogin(st, ps),
+			ps.OS,
+			path,
+			endpoint,
+			handshake,
+			rx,
+			tx,
+		)
+	}
+
+	if statusArgs.self && st.Self != nil {
+		printPS(st.Self, true)
+	}
+	if statusArgs.peers {
+		var peers []*ipnstate.PeerStatus
+		for _, ps := range st.Peer {
+			if !ps.ShareeNode && statusPeerFilter(st, ps) {
+				peers = append(peers, ps)
+			}
+		}
+		ipnstate.SortPeers(peers)
+		for _, ps := range peers {
+			printPS(ps, false)
+		}
+	}
+	return buf.Bytes()
+}
+
+// fmtAgo formats d, the time since some past event, compactly.
+func fmtAgo(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh ago", int(d.Hours()))
+}
+
+// fmtRate formats n bytes transferred over d as a rate.
+func fmtRate(n int64, d time.Duration) string {
+	if n < 0 {
+		// Counters were reset (e.g. the peer was re-added).
+		return "-"
+	}
+	r := float64(n) / d.Seconds()
+	switch {
+	case r < 1000:
+		return fmt.Sprintf("%.0fB/s", r)
+	case r < 1000*1000:
+		return fmt.Sprintf("%.1fkB/s", r/1000)
+	}
+	return fmt.Sprintf("%.1fMB/s", r/1000/1000)
+}
+
 // peerActive reports whether ps has recent activity.
 //
 // TODO: have the server report this bool instead.
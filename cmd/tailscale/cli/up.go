@@ -21,6 +21,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
@@ -58,6 +59,8 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 
 	upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
 	upf.BoolVar(&upArgs.reset, "reset", false, "reset unspecified settings to their default values")
+	upf.StringVar(&upArgs.configFile, "config", "", "path to a JSON or YAML config file to apply instead of the settings flags")
+	upf.BoolVar(&upArgs.dryRun, "dry-run", false, "print the settings that would change, without changing them")
 
 	upf.StringVar(&upArgs.server, "login-server", ipn.DefaultControlURL, "base URL of control server")
 	upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
@@ -71,6 +74,7 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\")")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
+	upf.BoolVar(&upArgs.advertisePeerRelay, "advertise-peer-relay", false, "offer to relay traffic between peers that can't connect directly")
 	if safesocket.GOOSUsesPeerCreds(goos) {
 		upf.StringVar(&upArgs.opUser, "operator", "", "Unix username to allow to operate on tailscaled without sudo")
 	}
@@ -93,6 +97,8 @@ func defaultNetfilterMode() string {
 
 type upArgsT struct {
 	reset                  bool
+	configFile             string
+	dryRun                 bool
 	server                 string
 	acceptRoutes           bool
 	acceptDNS              bool
@@ -105,6 +111,7 @@ type upArgsT struct {
 	advertiseRoutes        string
 	advertiseDefaultRoute  bool
 	advertiseTags          string
+	advertisePeerRelay     bool
 	snat                   bool
 	netfilterMode          string
 	authKey                string
@@ -130,10 +137,61 @@ var (
 // function exists for testing and should have no side effects or
 // outside interactions (e.g. no making Tailscale local API calls).
 func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goos string) (*ipn.Prefs, error) {
+	routes, err := calcAdvertiseRoutes(upArgs.advertiseRoutes, upArgs.advertiseDefaultRoute)
+	if err != nil {
+		return nil, err
+	}
+
+	exitNodeIP, err := exitNodeIPFromArg(upArgs.exitNodeIP, st)
+	if err != nil {
+		return nil, err
+	}
+	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
+		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+	}
+
+	tags, err := tagsFromArg(upArgs.advertiseTags)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkHostname(upArgs.hostname); err != nil {
+		return nil, err
+	}
+
+	prefs := ipn.NewPrefs()
+	prefs.ControlURL = upArgs.server
+	prefs.WantRunning = true
+	prefs.RouteAll = upArgs.acceptRoutes
+	prefs.ExitNodeIP = exitNodeIP
+	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.CorpDNS = upArgs.acceptDNS
+	prefs.AllowSingleHosts = upArgs.singleRoutes
+	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.AdvertiseRoutes = routes
+	prefs.AdvertiseTags = tags
+	prefs.AdvertisePeerRelay = upArgs.advertisePeerRelay
+	prefs.Hostname = upArgs.hostname
+	prefs.ForceDaemon = upArgs.forceDaemon
+	prefs.OperatorUser = upArgs.opUser
+
+	if goos == "linux" {
+		prefs.NoSNAT = !upArgs.snat
+		prefs.NetfilterMode, err = netfilterModeFromArg(upArgs.netfilterMode, warnf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prefs, nil
+}
+
+// calcAdvertiseRoutes returns the sorted routes to advertise for the
+// provided --advertise-routes and --advertise-exit-node values.
+func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]netaddr.IPPrefix, error) {
 	routeMap := map[netaddr.IPPrefix]bool{}
 	var default4, default6 bool
-	if upArgs.advertiseRoutes != "" {
-		advroutes := strings.Split(upArgs.advertiseRoutes, ",")
+	if advertiseRoutes != "" {
+		advroutes := strings.Split(advertiseRoutes, ",")
 		for _, s := range advroutes {
 			ipp, err := netaddr.ParseIPPrefix(s)
 			if err != nil {
@@ -155,9 +213,9 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 			return nil, fmt.Errorf("%s advertised without its IPv6 counterpart, please also advertise %s", ipv6default, ipv4default)
 		}
 	}
-	if upArgs.advertiseDefaultRoute {
-		routeMap[netaddr.MustParseIPPrefix("0.0.0.0/0")] = true
-		routeMap[netaddr.MustParseIPPrefix("::/0")] = true
+	if advertiseDefaultRoute {
+		routeMap[ipv4default] = true
+		routeMap[ipv6default] = true
 	}
 	routes := make([]netaddr.IPPrefix, 0, len(routeMap))
 	for r := range routeMap {
@@ -169,75 +227,126 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		}
 		return routes[i].IP().Less(routes[j].IP())
 	})
+	return routes, nil
+}
 
-	var exitNodeIP netaddr.IP
-	if upArgs.exitNodeIP != "" {
-		var err error
-		exitNodeIP, err = netaddr.ParseIP(upArgs.exitNodeIP)
-		if err != nil {
-			return nil, fmt.Errorf("invalid IP address %q for --exit-node: %v", upArgs.exitNodeIP, err)
-		}
-	} else if upArgs.exitNodeAllowLANAccess {
-		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
+// exitNodeIPFromArg parses the --exit-node value s. It returns the
+// zero IP if s is empty. It's an error to use one of this node's own
+// Tailscale IPs (as listed in st) as the exit node.
+func exitNodeIPFromArg(s string, st *ipnstate.Status) (netaddr.IP, error) {
+	if s == "" {
+		return netaddr.IP{}, nil
 	}
-
-	if upArgs.exitNodeIP != "" {
-		for _, ip := range st.TailscaleIPs {
-			if exitNodeIP == ip {
-				return nil, fmt.Errorf("cannot use %s as the exit node as it is a local IP address to this machine, did you mean --advertise-exit-node?", upArgs.exitNodeIP)
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		return netaddr.IP{}, fmt.Errorf("invalid IP address %q for --exit-node: %v", s, err)
+	}
+	if st != nil {
+		for _, selfIP := range st.TailscaleIPs {
+			if ip == selfIP {
+				return netaddr.IP{}, fmt.Errorf("cannot use %s as the exit node as it is a local IP address to this machine, did you mean --advertise-exit-node?", s)
 			}
 		}
 	}
+	return ip, nil
+}
 
-	var tags []string
-	if upArgs.advertiseTags != "" {
-		tags = strings.Split(upArgs.advertiseTags, ",")
-		for _, tag := range tags {
-			err := tailcfg.CheckTag(tag)
-			if err != nil {
-				return nil, fmt.Errorf("tag: %q: %s", tag, err)
-			}
+// tagsFromArg parses the comma-separated --advertise-tags value s.
+func tagsFromArg(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	tags := strings.Split(s, ",")
+	for _, tag := range tags {
+		err := tailcfg.CheckTag(tag)
+		if err != nil {
+			return nil, fmt.Errorf("tag: %q: %s", tag, err)
 		}
 	}
+	return tags, nil
+}
 
-	if len(upArgs.hostname) > 256 {
-		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
+func checkHostname(hostname string) error {
+	if len(hostname) > 256 {
+		return fmt.Errorf("hostname too long: %d bytes (max 256)", len(hostname))
 	}
+	return nil
+}
 
-	prefs := ipn.NewPrefs()
-	prefs.ControlURL = upArgs.server
-	prefs.WantRunning = true
-	prefs.RouteAll = upArgs.acceptRoutes
-	prefs.ExitNodeIP = exitNodeIP
-	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
-	prefs.CorpDNS = upArgs.acceptDNS
-	prefs.AllowSingleHosts = upArgs.singleRoutes
-	prefs.ShieldsUp = upArgs.shieldsUp
-	prefs.AdvertiseRoutes = routes
-	prefs.AdvertiseTags = tags
-	prefs.Hostname = upArgs.hostname
-	prefs.ForceDaemon = upArgs.forceDaemon
-	prefs.OperatorUser = upArgs.opUser
-
-	if goos == "linux" {
-		prefs.NoSNAT = !upArgs.snat
+// netfilterModeFromArg parses the --netfilter-mode value s, warning
+// via warnf about modes that need manual configuration.
+func netfilterModeFromArg(s string, warnf logger.Logf) (preftype.NetfilterMode, error) {
+	switch s {
+	case "on":
+		return preftype.NetfilterOn, nil
+	case "nodivert":
+		warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+		return preftype.NetfilterNoDivert, nil
+	case "off":
+		if defaultNetfilterMode() != "off" {
+			warnf("netfilter=off; configure iptables yourself.")
+		}
+		return preftype.NetfilterOff, nil
+	}
+	return 0, fmt.Errorf("invalid value --netfilter-mode=%q", s)
+}
 
-		switch upArgs.netfilterMode {
-		case "on":
-			prefs.NetfilterMode = preftype.NetfilterOn
-		case "nodivert":
-			prefs.NetfilterMode = preftype.NetfilterNoDivert
-			warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
-		case "off":
-			prefs.NetfilterMode = preftype.NetfilterOff
-			if defaultNetfilterMode() != "off" {
-				warnf("netfilter=off; configure iptables yourself.")
-			}
+// prefsFromConfigFile loads the config file at path and returns the
+// result of applying it to curPrefs, along with the edits themselves.
+// As a side effect, it sets upArgs.authKey and upArgs.server from the
+// file, for use by the rest of runUp.
+//
+// The config file replaces the settings flags, so it's an error to
+// use any of them along with it.
+func prefsFromConfigFile(path string, curPrefs *ipn.Prefs) (*ipn.Prefs, *ipn.MaskedPrefs, error) {
+	var conflict []string
+	upFlagSet.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "dry-run", "force-reauth":
 		default:
-			return nil, fmt.Errorf("invalid value --netfilter-mode=%q", upArgs.netfilterMode)
+			conflict = append(conflict, "--"+f.Name)
 		}
+	})
+	if len(conflict) > 0 {
+		return nil, nil, fmt.Errorf("--config can't be combined with %s", strings.Join(conflict, ", "))
 	}
-	return prefs, nil
+	conf, err := conffile.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	mp, err := conf.MaskedPrefs()
+	if err != nil {
+		return nil, nil, err
+	}
+	prefs := curPrefs.Clone()
+	prefs.Persist = nil
+	prefs.ApplyEdits(mp)
+	upArgs.authKey = conf.AuthKey
+	upArgs.server = prefs.ControlURLOrDefault()
+	return prefs, mp, nil
+}
+
+// prefsDiff returns a human-readable description of the preferences
+// that differ between cur and new, one line per preference, sorted by
+// preference name.
+func prefsDiff(cur, new *ipn.Prefs) []string {
+	var ret []string
+	cv := reflect.ValueOf(cur).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "Persist" {
+			continue
+		}
+		a, b := cv.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("%s: %v -> %v", name, a, b))
+	}
+	sort.Strings(ret)
+	return ret
 }
 
 func runUp(ctx context.Context, args []string) error {
@@ -280,23 +389,34 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
-	prefs, err := prefsFromUpArgs(upArgs, warnf, st, runtime.GOOS)
+	curPrefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var prefs *ipn.Prefs
+	var confEdits *ipn.MaskedPrefs // non-nil if using --config
+	if upArgs.configFile != "" {
+		prefs, confEdits, err = prefsFromConfigFile(upArgs.configFile, curPrefs)
+	} else {
+		prefs, err = prefsFromUpArgs(upArgs, warnf, st, runtime.GOOS)
+	}
 	if err != nil {
 		fatalf("%s", err)
 	}
+	if confEdits != nil && st.BackendState != ipn.NeedsLogin.String() && st.BackendState != ipn.NoState.String() {
+		// Already logged in. Ignore the config's auth key so that
+		// re-applying the same config doesn't force a new login.
+		upArgs.authKey = ""
+	}
 
-	if len(prefs.AdvertiseRoutes) > 0 {
+	if len(prefs.AdvertiseRoutes) > 0 && !upArgs.dryRun {
 		if err := tailscale.CheckIPForwarding(context.Background()); err != nil {
 			warnf("%v", err)
 		}
 	}
 
-	curPrefs, err := tailscale.GetPrefs(ctx)
-	if err != nil {
-		return err
-	}
-
-	if !upArgs.reset {
+	if !upArgs.reset && confEdits == nil {
 		applyImplicitPrefs(prefs, curPrefs, os.Getenv("USER"))
 
 		if err := checkForAccidentalSettingReverts(upFlagSet, curPrefs, prefs, upCheckEnv{
@@ -307,6 +427,17 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
+	if upArgs.dryRun {
+		diff := prefsDiff(curPrefs, prefs)
+		if len(diff) == 0 {
+			fmt.Println("No changes.")
+		}
+		for _, line := range diff {
+			fmt.Println(line)
+		}
+		return nil
+	}
+
 	controlURLChanged := curPrefs.ControlURL != prefs.ControlURL
 	if controlURLChanged && st.BackendState == ipn.Running.String() && !upArgs.forceReauth {
 		fatalf("can't change --login-server without --force-reauth")
@@ -322,12 +453,15 @@ func runUp(ctx context.Context, args []string) error {
 		upArgs.authKey == "" &&
 		!controlURLChanged
 	if justEdit {
-		mp := new(ipn.MaskedPrefs)
-		mp.WantRunningSet = true
-		mp.Prefs = *prefs
-		upFlagSet.Visit(func(f *flag.Flag) {
-			updateMaskedPrefsFromUpFlag(mp, f.Name)
-		})
+		mp := confEdits
+		if mp == nil {
+			mp = new(ipn.MaskedPrefs)
+			mp.WantRunningSet = true
+			mp.Prefs = *prefs
+			upFlagSet.Visit(func(f *flag.Flag) {
+				updateMaskedPrefsFromUpFlag(mp, f.Name)
+			})
+		}
 
 		_, err := tailscale.EditPrefs(ctx, mp)
 		return err
@@ -483,6 +617,7 @@ func init() {
 	addPrefFlagMapping("accept-dns", "CorpDNS")
 	addPrefFlagMapping("accept-routes", "RouteAll")
 	addPrefFlagMapping("advertise-tags", "AdvertiseTags")
+	addPrefFlagMapping("advertise-peer-relay", "AdvertisePeerRelay")
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
@@ -509,7 +644,7 @@ func addPrefFlagMapping(flagName string, prefNames ...string) {
 // correspond to an ipn.Pref.
 func preflessFlag(flagName string) bool {
 	switch flagName {
-	case "authkey", "force-reauth", "reset":
+	case "authkey", "force-reauth", "reset", "config", "dry-run":
 		return true
 	}
 	return false
@@ -691,16 +826,11 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 		case "operator":
 			set(prefs.OperatorUser)
 		case "advertise-routes":
-			var sb strings.Builder
-			for i, r := range withoutExitNodes(prefs.AdvertiseRoutes) {
-				if i > 0 {
-					sb.WriteByte(',')
-				}
-				sb.WriteString(r.String())
-			}
-			set(sb.String())
+			set(joinPrefixes(withoutExitNodes(prefs.AdvertiseRoutes)))
 		case "advertise-exit-node":
 			set(hasExitNodeRoutes(prefs.AdvertiseRoutes))
+		case "advertise-peer-relay":
+			set(prefs.AdvertisePeerRelay)
 		case "snat-subnet-routes":
 			set(!prefs.NoSNAT)
 		case "netfilter-mode":
@@ -752,6 +882,19 @@ func withoutExitNodes(rr []netaddr.IPPrefix) []netaddr.IPPrefix {
 	return out
 }
 
+// joinPrefixes returns rr formatted as a comma-separated list, as
+// accepted by --advertise-routes.
+func joinPrefixes(rr []netaddr.IPPrefix) string {
+	var sb strings.Builder
+	for i, r := range rr {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(r.String())
+	}
+	return sb.String()
+}
+
 // exitNodeIP returns the exit node IP from p, using st to map
 // it from its ID form to an IP address if needed.
 func exitNodeIP(p *ipn.Prefs, st *ipnstate.Status) (ip netaddr.IP) {
@@ -9,9 +9,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"runtime"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/version"
 )
 
@@ -22,6 +24,7 @@ var versionCmd = &ffcli.Command{
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("version", flag.ExitOnError)
 		fs.BoolVar(&versionArgs.daemon, "daemon", false, "also print local node's daemon version")
+		fs.BoolVar(&versionArgs.json, "json", false, "output in JSON format (see apitype.VersionOutput)")
 		return fs
 	})(),
 	Exec: runVersion,
@@ -29,12 +32,29 @@ var versionCmd = &ffcli.Command{
 
 var versionArgs struct {
 	daemon bool // also check local node's daemon version
+	json   bool // output in JSON format
 }
 
 func runVersion(ctx context.Context, args []string) error {
 	if len(args) > 0 {
 		log.Fatalf("too many non-flag arguments: %q", args)
 	}
+	if versionArgs.json {
+		vo := apitype.VersionOutput{
+			Short:     version.Short,
+			Long:      version.Long,
+			GitCommit: version.GitCommit,
+			GoVersion: runtime.Version(),
+		}
+		if versionArgs.daemon {
+			st, err := tailscale.StatusWithoutPeers(ctx)
+			if err != nil {
+				return err
+			}
+			vo.Daemon = st.Version
+		}
+		return printJSON(vo)
+	}
 	if !versionArgs.daemon {
 		fmt.Println(version.String())
 		return nil
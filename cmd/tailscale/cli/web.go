@@ -7,24 +7,37 @@ package cli
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/cgi"
 	"net/url"
 	"os/exec"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/preftype"
 	"tailscale.com/util/groupmember"
@@ -53,6 +66,34 @@ type tmplData struct {
 	Status       string
 	DeviceName   string
 	IP           string
+
+	SynoToken string // to carry over into links and forms, if non-empty
+	CSRFToken string // to send with POSTs
+
+	// The following are only populated when Status is "Running".
+	Prefs     webPrefs
+	ExitNodes []webPeer // peers offering to be an exit node
+	Peers     []webPeer
+	Files     []apitype.WaitingFile
+}
+
+// webPrefs are the preferences the web UI can edit.
+type webPrefs struct {
+	AdvertiseRoutes   string // comma-separated, excluding exit node routes
+	AdvertiseExitNode bool
+	ExitNode          string // IP, or empty for none
+	ShieldsUp         bool
+	AcceptRoutes      bool
+}
+
+// webPeer is a peer as shown by the web UI.
+type webPeer struct {
+	Name           string
+	IP             string
+	OS             string
+	Online         bool
+	ExitNodeOption bool // offers to be an exit node
+	ExitNode       bool // is our current exit node
 }
 
 var webCmd = &ffcli.Command{
@@ -60,10 +101,26 @@ var webCmd = &ffcli.Command{
 	ShortUsage: "web [flags]",
 	ShortHelp:  "Run a web server for controlling Tailscale",
 
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale web' command runs a web server for viewing and changing
+this node's Tailscale settings (advertised routes, exit node, shields
+up and accepting routes), listing its peers, and fetching files
+waiting in its Taildrop inbox.
+
+The listen address must be a loopback or Tailscale IP address.
+Requests from this machine must include the token in the URL printed
+at startup; it's then remembered in a cookie. Requests from other
+nodes are only allowed from those owned by this node's user.
+
+On Synology and QNAP, the NAS's own login is used instead.
+
+`),
+
 	FlagSet: (func() *flag.FlagSet {
 		webf := flag.NewFlagSet("web", flag.ExitOnError)
 		webf.StringVar(&webArgs.listen, "listen", "localhost:8088", "listen address; use port 0 for automatic")
-		webf.BoolVar(&webArgs.cgi, "cgi", false, "run as CGI script")
+		webf.BoolVar(&webArgs.cgi, "cgi", false, "run as CGI script (Synology and QNAP only)")
 		return webf
 	})(),
 	Exec: runWeb,
@@ -80,13 +137,149 @@ func runWeb(ctx context.Context, args []string) error {
 	}
 
 	if webArgs.cgi {
+		// CGI mode relies on the NAS's login to authorize
+		// callers; see authorize.
+		if !isNAS() {
+			return errors.New("--cgi is only supported on Synology and QNAP")
+		}
 		if err := cgi.Serve(http.HandlerFunc(webHandler)); err != nil {
 			log.Printf("tailscale.cgi: %v", err)
 			return err
 		}
 		return nil
 	}
-	return http.ListenAndServe(webArgs.listen, http.HandlerFunc(webHandler))
+	if isNAS() {
+		return http.ListenAndServe(webArgs.listen, http.HandlerFunc(webHandler))
+	}
+
+	if err := checkWebListenAddr(webArgs.listen); err != nil {
+		return err
+	}
+	ws, err := newWebServer()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", webArgs.listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving the Tailscale web UI at http://%s/?token=%s\n", ln.Addr(), ws.token)
+	return http.Serve(ln, ws)
+}
+
+func isNAS() bool {
+	switch distro.Get() {
+	case distro.Synology, distro.QNAP:
+		return true
+	}
+	return false
+}
+
+// checkWebListenAddr checks that the --listen address hostPort is
+// on a loopback or Tailscale IP, so the web UI isn't exposed to the
+// LAN or internet.
+func checkWebListenAddr(hostPort string) error {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fmt.Errorf("invalid --listen address %q: %v", hostPort, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err == nil && (ip.IsLoopback() || tsaddr.IsTailscaleIP(ip)) {
+		return nil
+	}
+	return fmt.Errorf("--listen address %q must be on a loopback or Tailscale IP address", hostPort)
+}
+
+// webTokenCookie is the name of the cookie holding the web server's
+// token, once a local caller has provided it in the URL.
+const webTokenCookie = "TS-Web-Token"
+
+// webServer is the web UI's http.Handler when not running as a CGI
+// script or on a NAS. It authorizes callers before passing requests
+// on to webHandler.
+type webServer struct {
+	token string // required of local callers
+	csrf  string // required in POSTs
+}
+
+func newWebServer() (*webServer, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return &webServer{
+		token: hex.EncodeToString(b[:16]),
+		csrf:  hex.EncodeToString(b[16:]),
+	}, nil
+}
+
+func (s *webServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	serveWeb(w, r, s.csrf)
+}
+
+// authorize reports whether the caller of r may use the web UI.
+// Callers on this machine, including those connecting to its own
+// Tailscale IPs, must have the token, as they may be other local
+// users. Other callers must be Tailscale nodes owned by this node's
+// user. If authorize returns false, it has written an error to w.
+func (s *webServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	ipp, err := netaddr.ParseIPPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusForbidden)
+		return false
+	}
+	local := ipp.IP().IsLoopback()
+	var st *ipnstate.Status
+	if !local {
+		st, err = tailscale.StatusWithoutPeers(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		for _, ip := range st.TailscaleIPs {
+			if ip == ipp.IP() {
+				local = true
+			}
+		}
+	}
+	if local {
+		if t := r.URL.Query().Get("token"); t != "" && s.validToken(t) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     webTokenCookie,
+				Value:    s.token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			return true
+		}
+		if c, err := r.Cookie(webTokenCookie); err == nil && s.validToken(c.Value) {
+			return true
+		}
+		http.Error(w, "missing or invalid token; use the URL printed by 'tailscale web'", http.StatusForbidden)
+		return false
+	}
+
+	who, err := tailscale.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "caller is not a Tailscale node", http.StatusForbidden)
+		return false
+	}
+	if st.Self == nil || who.UserProfile == nil || who.UserProfile.ID != st.Self.UserID {
+		http.Error(w, "only this node's owner may use its web UI", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *webServer) validToken(t string) bool {
+	return subtle.ConstantTimeCompare([]byte(t), []byte(s.token)) == 1
 }
 
 // authorize returns the name of the user accessing the web UI after verifying
@@ -230,7 +423,50 @@ req.send(null);
 </body></html>
 `
 
+// webCSRFCookie is the name of the cookie holding the CSRF token in
+// NAS and CGI modes, where there's no long-lived webServer to hold
+// one. POSTs must echo it back, which a cross-site page can't do, as
+// it can't read the cookie.
+const webCSRFCookie = "TS-Web-CSRF"
+
+// webHandler serves the web UI on NAS devices and in CGI mode, which
+// authorize callers using the NAS's own login instead of webServer.
 func webHandler(w http.ResponseWriter, r *http.Request) {
+	csrf, err := csrfCookieToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveWeb(w, r, csrf)
+}
+
+// csrfCookieToken returns the CSRF token in r's webCSRFCookie or, if
+// it has none, a new one that it sets in the cookie via w.
+func csrfCookieToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(webCSRFCookie); err == nil && len(c.Value) == 32 {
+		if _, err := hex.DecodeString(c.Value); err == nil {
+			return c.Value, nil
+		}
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	tok := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     webCSRFCookie,
+		Value:    tok,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return tok, nil
+}
+
+// serveWeb serves the web UI. POST requests must include csrf in their
+// "csrf" form value or X-CSRF-Token header; if csrf is empty, they're
+// all rejected.
+func serveWeb(w http.ResponseWriter, r *http.Request, csrf string) {
 	if authRedirect(w, r) {
 		return
 	}
@@ -245,6 +481,36 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == "POST" {
+		got := r.Header.Get("X-CSRF-Token")
+		if got == "" {
+			got = r.FormValue("csrf")
+		}
+		if csrf == "" || subtle.ConstantTimeCompare([]byte(got), []byte(csrf)) != 1 {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Match path suffixes, as in CGI mode the path includes the
+	// script's own path.
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/prefs"):
+		serveWebPrefs(w, r)
+		return
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/delete-file"):
+		if err := tailscale.DeleteWaitingFile(r.Context(), r.FormValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		redirectToWebHome(w, r)
+		return
+	case r.Method == "GET" && strings.Contains(r.URL.Path, "/files/"):
+		i := strings.LastIndex(r.URL.Path, "/files/")
+		serveWebFile(w, r, r.URL.Path[i+len("/files/"):])
+		return
+	}
+
 	if r.Method == "POST" {
 		type mi map[string]interface{}
 		w.Header().Set("Content-Type", "application/json")
@@ -271,10 +537,25 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 		Profile:      profile,
 		Status:       st.BackendState,
 		DeviceName:   deviceName,
+		SynoToken:    r.URL.Query().Get("SynoToken"),
+		CSRFToken:    csrf,
 	}
 	if len(st.TailscaleIPs) != 0 {
 		data.IP = st.TailscaleIPs[0].String()
 	}
+	if st.BackendState == ipn.Running.String() {
+		prefs, err := tailscale.GetPrefs(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Files, err = tailscale.WaitingFiles(r.Context())
+		if err != nil {
+			// Taildrop may be unavailable; don't fail the whole page.
+			log.Printf("web: WaitingFiles: %v", err)
+		}
+		fillWebData(&data, st, prefs)
+	}
 
 	buf := new(bytes.Buffer)
 	if err := tmpl.Execute(buf, data); err != nil {
@@ -284,6 +565,111 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf.Bytes())
 }
 
+// fillWebData populates the management parts of data from st and prefs.
+func fillWebData(data *tmplData, st *ipnstate.Status, prefs *ipn.Prefs) {
+	data.Prefs = webPrefs{
+		AdvertiseRoutes:   joinPrefixes(withoutExitNodes(prefs.AdvertiseRoutes)),
+		AdvertiseExitNode: hasExitNodeRoutes(prefs.AdvertiseRoutes),
+		ShieldsUp:         prefs.ShieldsUp,
+		AcceptRoutes:      prefs.RouteAll,
+	}
+	if ip := exitNodeIP(prefs, st); !ip.IsZero() {
+		data.Prefs.ExitNode = ip.String()
+	}
+	for _, ps := range st.Peer {
+		p := webPeer{
+			Name:           dnsOrQuoteHostname(st, ps),
+			OS:             ps.OS,
+			Online:         ps.Online,
+			ExitNodeOption: ps.ExitNodeOption,
+			ExitNode:       ps.ExitNode,
+		}
+		if len(ps.TailscaleIPs) > 0 {
+			p.IP = ps.TailscaleIPs[0].String()
+		}
+		data.Peers = append(data.Peers, p)
+		if p.ExitNodeOption && p.IP != "" {
+			data.ExitNodes = append(data.ExitNodes, p)
+		}
+	}
+	sort.Slice(data.Peers, func(i, j int) bool { return data.Peers[i].Name < data.Peers[j].Name })
+	sort.Slice(data.ExitNodes, func(i, j int) bool { return data.ExitNodes[i].Name < data.ExitNodes[j].Name })
+}
+
+// webPrefsFromForm returns the prefs edits submitted in the web UI's
+// settings form. st is used to validate the exit node.
+func webPrefsFromForm(form url.Values, st *ipnstate.Status) (*ipn.MaskedPrefs, error) {
+	// Accept routes separated by commas and/or whitespace.
+	routes := strings.Join(strings.Fields(strings.ReplaceAll(form.Get("advertise-routes"), ",", " ")), ",")
+	mp := &ipn.MaskedPrefs{
+		AdvertiseRoutesSet: true,
+		ExitNodeIDSet:      true,
+		ExitNodeIPSet:      true,
+		ShieldsUpSet:       true,
+		RouteAllSet:        true,
+	}
+	var err error
+	mp.AdvertiseRoutes, err = calcAdvertiseRoutes(routes, form.Get("advertise-exit-node") == "on")
+	if err != nil {
+		return nil, err
+	}
+	mp.ExitNodeIP, err = exitNodeIPFromArg(form.Get("exit-node"), st)
+	if err != nil {
+		return nil, err
+	}
+	mp.ShieldsUp = form.Get("shields-up") == "on"
+	mp.RouteAll = form.Get("accept-routes") == "on"
+	return mp, nil
+}
+
+func serveWebPrefs(w http.ResponseWriter, r *http.Request) {
+	st, err := tailscale.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mp, err := webPrefsFromForm(r.PostForm, st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := tailscale.EditPrefs(r.Context(), mp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirectToWebHome(w, r)
+}
+
+// serveWebFile sends the Taildrop file name from the inbox as a
+// download.
+func serveWebFile(w http.ResponseWriter, r *http.Request, name string) {
+	rc, size, err := tailscale.GetWaitingFile(r.Context(), name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, rc)
+}
+
+// redirectToWebHome redirects a form POST back to the main page,
+// keeping the Synology session token, if any. The POST's path is
+// directly below the main page's.
+func redirectToWebHome(w http.ResponseWriter, r *http.Request) {
+	target := "./"
+	if t := r.FormValue("SynoToken"); t != "" {
+		target += "?" + url.Values{"SynoToken": {t}}.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
 // TODO(crawshaw): some of this is very similar to the code in 'tailscale up', can we share anything?
 func tailscaleUpForceReauth(ctx context.Context) (authURL string, retErr error) {
 	prefs := ipn.NewPrefs()
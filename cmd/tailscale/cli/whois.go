@@ -0,0 +1,121 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+var whoisCmd = &ffcli.Command{
+	Name:       "whois",
+	ShortUsage: "whois [--json] <ip|ip:port>",
+	ShortHelp:  "Show the machine and user associated with a Tailscale IP",
+	LongHelp: strings.TrimSpace(`
+"tailscale whois" shows the machine and user that own the given
+Tailscale IP address (or IP:port, as found in firewall logs),
+along with the machine's tags, capabilities and primary routes.
+`),
+	Exec: runWhoIs,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("whois", flag.ExitOnError)
+		fs.BoolVar(&whoisArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var whoisArgs struct {
+	json bool // output in JSON format
+}
+
+func runWhoIs(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: whois [--json] <ip|ip:port>")
+	}
+	addr, err := whoisAddr(args[0])
+	if err != nil {
+		return err
+	}
+	who, err := tailscale.WhoIs(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if whoisArgs.json {
+		j, err := json.MarshalIndent(who, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+	os.Stdout.Write(formatWhoIs(who))
+	return nil
+}
+
+// whoisAddr returns arg, an IP or IP:port, in the IP:port form
+// expected by the LocalAPI's whois handler. A bare IP gets port 0.
+func whoisAddr(arg string) (string, error) {
+	if ip, err := netaddr.ParseIP(arg); err == nil {
+		return netaddr.IPPortFrom(ip, 0).String(), nil
+	}
+	if _, err := netaddr.ParseIPPort(arg); err != nil {
+		return "", fmt.Errorf("invalid IP or IP:port %q", arg)
+	}
+	return arg, nil
+}
+
+// formatWhoIs returns the human-readable form of who.
+func formatWhoIs(who *apitype.WhoIsResponse) []byte {
+	var buf bytes.Buffer
+	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
+	if n := who.Node; n != nil {
+		f("Machine:\n")
+		f("  Name:           %s\n", strings.TrimSuffix(n.Name, "."))
+		f("  ID:             %s\n", n.StableID)
+		var addrs []string
+		for _, a := range n.Addresses {
+			addrs = append(addrs, a.IP().String())
+		}
+		f("  Addresses:      %s\n", strings.Join(addrs, ", "))
+		if n.Hostinfo.OS != "" {
+			f("  OS:             %s\n", n.Hostinfo.OS)
+		}
+		if len(n.Hostinfo.RequestTags) > 0 {
+			f("  Requested Tags: %s\n", strings.Join(n.Hostinfo.RequestTags, ", "))
+		}
+		if len(n.Capabilities) > 0 {
+			f("  Capabilities:   %s\n", strings.Join(n.Capabilities, ", "))
+		}
+		// Control only includes routes in AllowedIPs beyond the
+		// node's own addresses if the node is their primary.
+		var routes []string
+		for _, r := range n.AllowedIPs {
+			if !r.IsSingleIP() {
+				routes = append(routes, r.String())
+			}
+		}
+		if len(routes) > 0 {
+			f("  Primary Routes: %s\n", strings.Join(routes, ", "))
+		}
+	}
+	if u := who.UserProfile; u != nil {
+		f("User:\n")
+		f("  Name:           %s\n", u.DisplayName)
+		f("  ID:             %d\n", u.ID)
+		f("  Login:          %s\n", u.LoginName)
+	}
+	return buf.Bytes()
+}
@@ -30,6 +30,7 @@ import (
 
 	"github.com/go-multierror/multierror"
 	"inet.af/netaddr"
+	"tailscale.com/ipn/conffile"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
@@ -88,6 +89,10 @@ var args struct {
 	socketpath string
 	verbose    int
 	socksAddr  string // listen address for SOCKS5 server
+	configPath string // optional declarative config file; see package conffile
+
+	staticEndpoints  []netaddr.IPPort // extra endpoints to advertise, e.g. manual port forwards
+	hardNATTraversal bool             // spray ports to reach peers from behind hard NATs
 }
 
 var (
@@ -117,8 +122,11 @@ func main() {
 	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
+	flag.Var(flagtype.IPPortsValue(&args.staticEndpoints), "static-endpoint", `additional "ip:port" to advertise to peers, such as the public side of a port forward to --port; may be repeated`)
+	flag.BoolVar(&args.hardNATTraversal, "hard-nat-traversal", false, "open many UDP ports to reach peers directly from behind NATs that map each destination differently; only works with peers that also enable it")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.StringVar(&args.configPath, "config", "", "path to a JSON or YAML config file to apply at startup")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -209,6 +217,14 @@ func run() error {
 		log.Fatalf("--state is required")
 	}
 
+	var conf *conffile.Config
+	if args.configPath != "" {
+		conf, err = conffile.Load(args.configPath)
+		if err != nil {
+			log.Fatalf("--config: %v", err)
+		}
+	}
+
 	var debugMux *http.ServeMux
 	if args.debug != "" {
 		debugMux = newDebugMux()
@@ -306,6 +322,23 @@ func run() error {
 		SurviveDisconnects: runtime.GOOS != "windows",
 		DebugMux:           debugMux,
 	}
+	if ns != nil && useNetstack {
+		// The OS can't reach the tailnet in userspace-networking
+		// mode, so LocalAPI dials (e.g. "tailscale nc") use
+		// netstack. That includes subnet routes and exit nodes,
+		// as LocalBackend.DialTCP only dials tailnet destinations.
+		opts.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := ns.DialContextTCP(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	if conf != nil {
+		opts.AutostartEdits, _ = conf.MaskedPrefs() // already validated by Load
+		opts.AutostartAuthKey = conf.AuthKey
+	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
 	if err != nil && err != context.Canceled {
@@ -357,8 +390,10 @@ func shouldWrapNetstack() bool {
 
 func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.Engine, useNetstack bool, err error) {
 	conf := wgengine.Config{
-		ListenPort:  args.port,
-		LinkMonitor: linkMon,
+		ListenPort:       args.port,
+		StaticEndpoints:  args.staticEndpoints,
+		HardNATTraversal: args.hardNATTraversal,
+		LinkMonitor:      linkMon,
 	}
 	useNetstack = name == "userspace-networking"
 	if !useNetstack {
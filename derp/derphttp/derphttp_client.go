@@ -32,6 +32,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tshttpproxy"
@@ -51,6 +52,11 @@ type Client struct {
 	DNSCache  *dnscache.Resolver // optional; nil means no caching
 	MeshKey   string             // optional; for trusted clients
 
+	// NAT64Prefix optionally returns the network's NAT64 prefix,
+	// through which nodes with only an IPv4 address are dialed
+	// on IPv6-only networks. A zero prefix means none.
+	NAT64Prefix func() netaddr.IPPrefix
+
 	privateKey key.Private
 	logf       logger.Logf
 
@@ -530,6 +536,9 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 	if shouldDialProto(n.IPv6, netaddr.IP.Is6) {
 		startDial(n.IPv6, "tcp6")
 	}
+	if ip6 := c.nat64Addr(n); !ip6.IsZero() {
+		startDial(ip6.String(), "tcp6")
+	}
 	if nwait == 0 {
 		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
 	}
@@ -554,6 +563,19 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 	}
 }
 
+// nat64Addr returns the NAT64 address of node n's explicit IPv4
+// address, or the zero IP if it or the NAT64 prefix isn't known.
+func (c *Client) nat64Addr(n *tailcfg.DERPNode) netaddr.IP {
+	if c.NAT64Prefix == nil || n.IPv4 == "" {
+		return netaddr.IP{}
+	}
+	ip, err := netaddr.ParseIP(n.IPv4)
+	if err != nil {
+		return netaddr.IP{}
+	}
+	return nat64.Synthesize(c.NAT64Prefix(), ip)
+}
+
 func firstStr(a, b string) string {
 	if a != "" {
 		return a
@@ -53,3 +53,33 @@ func Handler(s *derp.Server) http.Handler {
 		s.Accept(netConn, conn, netConn.RemoteAddr().String())
 	})
 }
+
+// Headers used by ServeNoContent. A client sends a random challenge
+// in NoContentChallengeHeader and expects it back, prefixed with
+// "response ", in NoContentResponseHeader. A captive portal that
+// intercepts the request can't know to do that.
+const (
+	NoContentChallengeHeader = "X-Tailscale-Challenge"
+	NoContentResponseHeader  = "X-Tailscale-Response"
+)
+
+// ServeNoContent serves the DERP server's /generate_204 endpoint,
+// which clients fetch over plain HTTP to detect captive portals.
+func ServeNoContent(w http.ResponseWriter, r *http.Request) {
+	if ch := r.Header.Get(NoContentChallengeHeader); ch != "" && isChallengeValid(ch) {
+		w.Header().Set(NoContentResponseHeader, "response "+ch)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isChallengeValid(ch string) bool {
+	if len(ch) > 64 {
+		return false
+	}
+	for _, c := range ch {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -15,7 +15,7 @@
 // and then the inner payload structure is:
 //
 //     messageType    byte  (the MessageType constants below)
-//     messageVersion byte  (0 for now; but always ignore bytes at the end)
+//     messageVersion byte  (see Version; but always ignore bytes at the end)
 //     message-paylod [...]byte
 package disco
 
@@ -26,6 +26,7 @@ import (
 	"net"
 
 	"inet.af/netaddr"
+	"tailscale.com/types/key"
 )
 
 // Magic is the 6 byte header of all discovery messages.
@@ -39,13 +40,28 @@ const NonceLen = 24
 type MessageType byte
 
 const (
-	TypePing        = MessageType(0x01)
-	TypePong        = MessageType(0x02)
-	TypeCallMeMaybe = MessageType(0x03)
+	TypePing           = MessageType(0x01)
+	TypePong           = MessageType(0x02)
+	TypeCallMeMaybe    = MessageType(0x03)
+	TypeCallMeViaRelay = MessageType(0x04)
+	TypePathProbe      = MessageType(0x05)
+	TypePathProbeAck   = MessageType(0x06)
+	TypeSprayPorts     = MessageType(0x07)
 )
 
 const v0 = byte(0)
 
+// Version is the version of the disco protocol implemented by this
+// package. It's sent in Pong messages so a peer knows which messages
+// it can send back; peers ignore message types they don't know, but
+// that still wastes a round trip, or in the case of PathProbe, a lot
+// of bytes.
+//
+//	0: Ping, Pong, CallMeMaybe, CallMeViaRelay
+//	1: PathProbe, PathProbeAck
+//	2: SprayPorts
+const Version = 2
+
 var errShort = errors.New("short message")
 
 // LooksLikeDiscoWrapper reports whether p looks like it's a packet
@@ -71,6 +87,14 @@ func Parse(p []byte) (Message, error) {
 		return parsePong(ver, p)
 	case TypeCallMeMaybe:
 		return parseCallMeMaybe(ver, p)
+	case TypeCallMeViaRelay:
+		return parseCallMeViaRelay(ver, p)
+	case TypePathProbe:
+		return parsePathProbe(ver, p)
+	case TypePathProbeAck:
+		return parsePathProbeAck(ver, p)
+	case TypeSprayPorts:
+		return parseSprayPorts(ver, p)
 	default:
 		return nil, fmt.Errorf("unknown message type 0x%02x", byte(t))
 	}
@@ -172,6 +196,43 @@ func parseCallMeMaybe(ver uint8, p []byte) (m *CallMeMaybe, err error) {
 	return m, nil
 }
 
+// CallMeViaRelay is a message sent only over DERP to suggest that the
+// recipient reach the sender through a peer relay: a tailnet node
+// that forwards UDP between peers that can't reach each other
+// directly (see tailcfg.Hostinfo.PeerRelay).
+//
+// Like CallMeMaybe, it's sent when the sender starts discovery. The
+// recipient may ignore it, but usually it pings the sender through
+// each listed relay it can reach directly too.
+type CallMeViaRelay struct {
+	// Relays are the node keys of the relays the sender has a
+	// direct path to.
+	Relays []key.Public
+}
+
+func (m *CallMeViaRelay) AppendMarshal(b []byte) []byte {
+	ret, p := appendMsgHeader(b, TypeCallMeViaRelay, v0, keyLen*len(m.Relays))
+	for _, k := range m.Relays {
+		p = p[copy(p, k[:]):]
+	}
+	return ret
+}
+
+func parseCallMeViaRelay(ver uint8, p []byte) (m *CallMeViaRelay, err error) {
+	m = new(CallMeViaRelay)
+	if len(p)%keyLen != 0 || ver != 0 || len(p) == 0 {
+		return m, nil
+	}
+	m.Relays = make([]key.Public, 0, len(p)/keyLen)
+	for len(p) > 0 {
+		var k key.Public
+		copy(k[:], p)
+		m.Relays = append(m.Relays, k)
+		p = p[keyLen:]
+	}
+	return m, nil
+}
+
 // Pong is a response a Ping.
 //
 // It includes the sender's source IP + port, so it's effectively a
@@ -179,12 +240,16 @@ func parseCallMeMaybe(ver uint8, p []byte) (m *CallMeMaybe, err error) {
 type Pong struct {
 	TxID [12]byte
 	Src  netaddr.IPPort // 18 bytes (16+2) on the wire; v4-mapped ipv6 for IPv4
+
+	// Version is the sender's disco Version, sent as the message
+	// version. Peers before version 1 send (and ignore) 0.
+	Version uint8
 }
 
 const pongLen = 12 + 16 + 2
 
 func (m *Pong) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePong, v0, pongLen)
+	ret, d := appendMsgHeader(b, TypePong, m.Version, pongLen)
 	d = d[copy(d, m.TxID[:]):]
 	ip16 := m.Src.IP().As16()
 	d = d[copy(d, ip16[:]):]
@@ -196,7 +261,7 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	if len(p) < pongLen {
 		return nil, errShort
 	}
-	m = new(Pong)
+	m = &Pong{Version: ver}
 	copy(m.TxID[:], p)
 	p = p[12:]
 
@@ -207,6 +272,97 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 	return m, nil
 }
 
+// PathProbe is a message padded to a chosen size, sent directly over
+// a UDP path to learn whether the path carries packets that large.
+// The recipient replies with a PathProbeAck. Sending probes of
+// several sizes finds the path MTU.
+//
+// It's only sent to peers whose Pong had Version 1 or higher.
+type PathProbe struct {
+	TxID [12]byte
+
+	// Padding is the number of zero bytes following TxID on the
+	// wire. When parsing, it's however many bytes followed.
+	Padding int
+}
+
+func (m *PathProbe) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypePathProbe, v0, 12+m.Padding)
+	copy(d, m.TxID[:]) // the padding's already zeroed
+	return ret
+}
+
+func parsePathProbe(ver uint8, p []byte) (m *PathProbe, err error) {
+	if len(p) < 12 {
+		return nil, errShort
+	}
+	m = &PathProbe{Padding: len(p) - 12}
+	copy(m.TxID[:], p)
+	return m, nil
+}
+
+// PathProbeAck is the reply to a PathProbe.
+type PathProbeAck struct {
+	TxID [12]byte
+
+	// Size is the size of the UDP payload the probe arrived in,
+	// so the sender can tell it wasn't truncated.
+	Size uint16
+}
+
+const pathProbeAckLen = 12 + 2
+
+func (m *PathProbeAck) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypePathProbeAck, v0, pathProbeAckLen)
+	d = d[copy(d, m.TxID[:]):]
+	binary.BigEndian.PutUint16(d, m.Size)
+	return ret
+}
+
+func parsePathProbeAck(ver uint8, p []byte) (m *PathProbeAck, err error) {
+	if len(p) < pathProbeAckLen {
+		return nil, errShort
+	}
+	m = new(PathProbeAck)
+	copy(m.TxID[:], p)
+	m.Size = binary.BigEndian.Uint16(p[12:])
+	return m, nil
+}
+
+// SprayPorts is a message sent only over DERP by a node behind a NAT
+// that maps each destination to a different public port, so its
+// endpoints are useless to peers. The sender has just sent pings to
+// the recipient's endpoints from Count new source ports, and asks the
+// recipient to ping IP at random ports in return. When enough pings
+// go each way, one likely hits a port the other side's NAT opened.
+type SprayPorts struct {
+	// IP is the sender's public IP address.
+	IP netaddr.IP
+
+	// Count is the number of source ports the sender opened.
+	Count uint16
+}
+
+const sprayPortsLen = 16 + 2
+
+func (m *SprayPorts) AppendMarshal(b []byte) []byte {
+	ret, d := appendMsgHeader(b, TypeSprayPorts, v0, sprayPortsLen)
+	ip16 := m.IP.As16()
+	d = d[copy(d, ip16[:]):]
+	binary.BigEndian.PutUint16(d, m.Count)
+	return ret
+}
+
+func parseSprayPorts(ver uint8, p []byte) (m *SprayPorts, err error) {
+	if len(p) < sprayPortsLen {
+		return nil, errShort
+	}
+	m = new(SprayPorts)
+	m.IP, _ = netaddr.FromStdIP(net.IP(p[:16]))
+	m.Count = binary.BigEndian.Uint16(p[16:])
+	return m, nil
+}
+
 // MessageSummary returns a short summary of m for logging purposes.
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
@@ -216,6 +372,14 @@ func MessageSummary(m Message) string {
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
 	case *CallMeMaybe:
 		return "call-me-maybe"
+	case *CallMeViaRelay:
+		return fmt.Sprintf("call-me-via-relay relays=%d", len(m.Relays))
+	case *PathProbe:
+		return fmt.Sprintf("path-probe tx=%x padding=%d", m.TxID[:6], m.Padding)
+	case *PathProbeAck:
+		return fmt.Sprintf("path-probe-ack tx=%x size=%d", m.TxID[:6], m.Size)
+	case *SprayPorts:
+		return fmt.Sprintf("spray-ports ip=%v count=%d", m.IP, m.Count)
 	default:
 		return fmt.Sprintf("%#v", m)
 	}
@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"inet.af/netaddr"
+	"tailscale.com/types/key"
 )
 
 func TestMarshalAndParse(t *testing.T) {
@@ -42,6 +43,15 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "02 00 01 02 03 04 05 06 07 08 09 0a 0b 0c fe d0 00 00 00 00 00 00 00 00 00 00 00 00 00 12 1a 0a",
 		},
+		{
+			name: "pong_version",
+			m: &Pong{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Src:     mustIPPort("2.3.4.5:1234"),
+				Version: 1,
+			},
+			want: "02 01 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 04 d2",
+		},
 		{
 			name: "call_me_maybe",
 			m:    &CallMeMaybe{},
@@ -57,6 +67,42 @@ func TestMarshalAndParse(t *testing.T) {
 			},
 			want: "03 00 00 00 00 00 00 00 00 00 00 00 ff ff 01 02 03 04 02 37 20 01 00 00 00 00 00 00 00 00 00 00 00 00 34 56 03 15",
 		},
+		{
+			name: "call_me_via_relay",
+			m:    &CallMeViaRelay{},
+			want: "04 00",
+		},
+		{
+			name: "call_me_via_relay_keys",
+			m: &CallMeViaRelay{
+				Relays: []key.Public{{1: 1, 31: 2}, {0: 3}},
+			},
+			want: "04 00 00 01 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 02 03 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00",
+		},
+		{
+			name: "path_probe",
+			m: &PathProbe{
+				TxID:    [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Padding: 3,
+			},
+			want: "05 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 00 00 00",
+		},
+		{
+			name: "path_probe_ack",
+			m: &PathProbeAck{
+				TxID: [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+				Size: 1312,
+			},
+			want: "06 00 01 02 03 04 05 06 07 08 09 0a 0b 0c 05 20",
+		},
+		{
+			name: "spray_ports",
+			m: &SprayPorts{
+				IP:    netaddr.MustParseIP("2.3.4.5"),
+				Count: 256,
+			},
+			want: "07 00 00 00 00 00 00 00 00 00 00 00 ff ff 02 03 04 05 01 00",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
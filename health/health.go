@@ -22,9 +22,10 @@ var (
 	// mu guards everything in this var block.
 	mu sync.Mutex
 
-	sysErr   = map[Subsystem]error{}                     // error key => err (or nil for no error)
-	watchers = map[*watchHandle]func(Subsystem, error){} // opt func to run if error state changes
-	timer    *time.Timer
+	sysErr          = map[Subsystem]error{}                     // error key => err (or nil for no error)
+	watchers        = map[*watchHandle]func(Subsystem, error){} // opt func to run if error state changes
+	warningWatchers = map[*watchHandle]func(){}                 // funcs to run if Warnings changes
+	timer           *time.Timer
 
 	inMapPoll               bool
 	inMapPollSince          time.Time
@@ -38,8 +39,23 @@ var (
 	ipnWantRunning          bool
 	anyInterfaceUp          = true // until told otherwise
 	udp4Unbound             bool
+
+	// Network conditions from the most recent netcheck report.
+	// They're warnings, not errors: they degrade connectivity but
+	// don't make the node unhealthy.
+	netcheckUDPBlocked    bool
+	netcheckCaptivePortal bool
+	netcheckHTTPSProxy    bool
+
+	// overallChanges is the recent history of changes to the
+	// overall health, oldest first. See RecentOverallChanges.
+	overallChanges []ErrorChange
 )
 
+// maxOverallChanges is the number of overall health changes
+// remembered for RecentOverallChanges.
+const maxOverallChanges = 32
+
 // Subsystem is the name of a subsystem whose health can be monitored.
 type Subsystem string
 
@@ -85,6 +101,21 @@ func RegisterWatcher(cb func(key Subsystem, err error)) (unregister func()) {
 	}
 }
 
+// RegisterWarningsWatcher adds a function that will be called when
+// the result of Warnings changes. It must be non-nil and is run in its
+// own goroutine. The returned func unregisters it.
+func RegisterWarningsWatcher(cb func()) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	handle := new(watchHandle)
+	warningWatchers[handle] = cb
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(warningWatchers, handle)
+	}
+}
+
 // SetRouterHealth sets the state of the wgengine/router.Router.
 func SetRouterHealth(err error) { set(SysRouter, err) }
 
@@ -103,6 +134,36 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// OverallError returns the current overall health error of the node,
+// or nil if it's healthy (or its health isn't known yet).
+func OverallError() error { return get(SysOverall) }
+
+// ErrorChange is a transition of the overall health of the node
+// between healthy and unhealthy.
+type ErrorChange struct {
+	Time  time.Time
+	Error string // or empty if the node became healthy
+}
+
+// RecentOverallChanges returns the most recent transitions of the
+// overall health of the node, oldest first.
+func RecentOverallChanges() []ErrorChange {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]ErrorChange(nil), overallChanges...)
+}
+
+func noteOverallChangeLocked(err error) {
+	c := ErrorChange{Time: time.Now()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if len(overallChanges) >= maxOverallChanges {
+		overallChanges = append(overallChanges[:0], overallChanges[1:]...)
+	}
+	overallChanges = append(overallChanges, c)
+}
+
 func get(key Subsystem) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -133,6 +194,9 @@ func setLocked(key Subsystem, err error) {
 		return
 	}
 	sysErr[key] = err
+	if key == SysOverall {
+		noteOverallChangeLocked(err)
+	}
 	selfCheckLocked()
 	for _, cb := range watchers {
 		go cb(key, err)
@@ -223,6 +287,43 @@ func SetUDP4Unbound(unbound bool) {
 	selfCheckLocked()
 }
 
+// SetNetcheckResult sets the network conditions found by the most
+// recent netcheck report that users should be warned about.
+func SetNetcheckResult(udpBlocked, captivePortal, httpsProxy bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if netcheckUDPBlocked == udpBlocked &&
+		netcheckCaptivePortal == captivePortal &&
+		netcheckHTTPSProxy == httpsProxy {
+		return
+	}
+	netcheckUDPBlocked = udpBlocked
+	netcheckCaptivePortal = captivePortal
+	netcheckHTTPSProxy = httpsProxy
+	for _, cb := range warningWatchers {
+		go cb()
+	}
+}
+
+// Warnings returns human-readable warnings about conditions that
+// degrade connectivity without making the node unhealthy, such as
+// being behind a captive portal. It returns nil if there are none.
+func Warnings() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var ws []string
+	if netcheckCaptivePortal {
+		ws = append(ws, "This network appears to have a captive portal. Open a web browser to sign in to the network.")
+	}
+	if netcheckUDPBlocked {
+		ws = append(ws, "UDP is blocked on this network, so all connections are relayed through DERP servers, which is slower.")
+	}
+	if netcheckHTTPSProxy {
+		ws = append(ws, "Connections to DERP servers go through an HTTPS proxy. If connectivity is poor, check the proxy's configuration.")
+	}
+	return ws
+}
+
 func timerSelfCheck() {
 	mu.Lock()
 	defer mu.Unlock()
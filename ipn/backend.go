@@ -85,6 +85,11 @@ type Notify struct {
 	// of being transferred.
 	IncomingFiles []PartialFile `json:",omitempty"`
 
+	// HealthChanged, if non-nil, means the health warnings in
+	// ipnstate.Status.Health changed, such as when a captive portal
+	// was found. Frontends showing them should fetch the status.
+	HealthChanged *empty.Message `json:",omitempty"`
+
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
 	// This is currently only used by Tailscale when run in the
@@ -130,6 +135,9 @@ func (n Notify) String() string {
 	if len(n.IncomingFiles) != 0 {
 		sb.WriteString("IncomingFiles ")
 	}
+	if n.HealthChanged != nil {
+		sb.WriteString("HealthChanged ")
+	}
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
@@ -137,6 +145,66 @@ func (n Notify) String() string {
 	return s[0:len(s)-1] + "}"
 }
 
+// NotifyWatchOpt is a bitmask of options about what type of Notify messages
+// a watcher of the IPN bus (see LocalBackend.WatchNotifications) wants
+// to receive.
+//
+// Fields of a Notify not covered by any of these bits (State,
+// ErrMessage, BrowseToURL, LoginFinished, etc) are always delivered.
+type NotifyWatchOpt uint64
+
+const (
+	// NotifyWatchNetMap means to include NetMap updates.
+	NotifyWatchNetMap NotifyWatchOpt = 1 << iota
+	// NotifyWatchPrefs means to include Prefs updates.
+	NotifyWatchPrefs
+	// NotifyWatchEngineUpdates means to include Engine status updates.
+	NotifyWatchEngineUpdates
+	// NotifyWatchFiles means to include FilesWaiting and
+	// IncomingFiles updates.
+	NotifyWatchFiles
+	// NotifyInitialState means the first Notify sent to the watcher
+	// contains the current State, Prefs and NetMap (subject to the
+	// other bits in the mask), rather than waiting for them to change.
+	NotifyInitialState
+)
+
+// Filter returns a copy of n with the fields not selected by the
+// mask cleared. It reports false if nothing of interest remains
+// and the message should not be delivered.
+func (m NotifyWatchOpt) Filter(n *Notify) (_ *Notify, ok bool) {
+	n2 := *n
+	if m&NotifyWatchNetMap == 0 {
+		n2.NetMap = nil
+	}
+	if m&NotifyWatchPrefs == 0 {
+		n2.Prefs = nil
+	}
+	if m&NotifyWatchEngineUpdates == 0 {
+		n2.Engine = nil
+	}
+	if m&NotifyWatchFiles == 0 {
+		n2.FilesWaiting = nil
+		n2.IncomingFiles = nil
+	}
+	if n2.ErrMessage == nil &&
+		n2.LoginFinished == nil &&
+		n2.State == nil &&
+		n2.Prefs == nil &&
+		n2.NetMap == nil &&
+		n2.Engine == nil &&
+		n2.BrowseToURL == nil &&
+		n2.BackendLogID == nil &&
+		n2.PingResult == nil &&
+		n2.FilesWaiting == nil &&
+		n2.IncomingFiles == nil &&
+		n2.HealthChanged == nil &&
+		n2.LocalTCPPort == nil {
+		return nil, false
+	}
+	return &n2, true
+}
+
 // PartialFile represents an in-progress file transfer.
 type PartialFile struct {
 	Name         string    // e.g. "foo.jpg"
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"tailscale.com/types/empty"
+	"tailscale.com/types/netmap"
+)
+
+func TestNotifyWatchOptFilter(t *testing.T) {
+	running := Running
+	tests := []struct {
+		name      string
+		mask      NotifyWatchOpt
+		in        Notify
+		wantOK    bool
+		wantNM    bool
+		wantPrefs bool
+		wantFiles bool
+	}{
+		{
+			name:   "netmap_dropped",
+			mask:   NotifyWatchPrefs,
+			in:     Notify{NetMap: new(netmap.NetworkMap)},
+			wantOK: false,
+		},
+		{
+			name:   "netmap_kept",
+			mask:   NotifyWatchNetMap,
+			in:     Notify{NetMap: new(netmap.NetworkMap)},
+			wantOK: true,
+			wantNM: true,
+		},
+		{
+			name:   "state_always_delivered",
+			mask:   0,
+			in:     Notify{State: &running, NetMap: new(netmap.NetworkMap)},
+			wantOK: true,
+		},
+		{
+			name:      "prefs_and_files",
+			mask:      NotifyWatchPrefs | NotifyWatchFiles,
+			in:        Notify{Prefs: NewPrefs(), FilesWaiting: &empty.Message{}},
+			wantOK:    true,
+			wantPrefs: true,
+			wantFiles: true,
+		},
+		{
+			name:   "health_always_delivered",
+			mask:   0,
+			in:     Notify{HealthChanged: &empty.Message{}},
+			wantOK: true,
+		},
+		{
+			name:   "files_dropped",
+			mask:   NotifyWatchNetMap,
+			in:     Notify{IncomingFiles: []PartialFile{}},
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.mask.Filter(&tt.in)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if (got.NetMap != nil) != tt.wantNM {
+				t.Errorf("NetMap = %v; want set=%v", got.NetMap, tt.wantNM)
+			}
+			if (got.Prefs != nil) != tt.wantPrefs {
+				t.Errorf("Prefs = %v; want set=%v", got.Prefs, tt.wantPrefs)
+			}
+			if (got.FilesWaiting != nil) != tt.wantFiles {
+				t.Errorf("FilesWaiting = %v; want set=%v", got.FilesWaiting, tt.wantFiles)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conffile loads declarative node configuration documents,
+// as used by "tailscale up --config" and "tailscaled --config".
+//
+// A document is JSON or YAML (chosen by its file extension) of the
+// form:
+//
+//	{
+//	  "Version": 1,
+//	  "ServerURL": "https://login.example.com",
+//	  "AuthKey": "tskey-...",
+//	  "Prefs": {
+//	    "RouteAll": true,
+//	    "AdvertiseTags": ["tag:server"],
+//	    "NetfilterMode": "nodivert"
+//	  }
+//	}
+//
+// Keys are matched case-insensitively. The keys of Prefs are the
+// names of ipn.Prefs fields; only the preferences mentioned are
+// changed, so applying the same document twice is a no-op.
+package conffile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"tailscale.com/ipn"
+	"tailscale.com/types/preftype"
+)
+
+// CurrentVersion is the only document version currently understood.
+const CurrentVersion = 1
+
+// Config is a parsed configuration document.
+type Config struct {
+	// Version is the document's schema version. It must be
+	// CurrentVersion.
+	Version int
+
+	// ServerURL, if non-empty, is the control server to use.
+	// It's equivalent to setting Prefs.ControlURL.
+	ServerURL string `json:",omitempty"`
+
+	// AuthKey, if non-empty, is the node authorization key used if
+	// the node needs to log in.
+	AuthKey string `json:",omitempty"`
+
+	// Prefs maps ipn.Prefs field names to their desired values.
+	Prefs map[string]json.RawMessage `json:",omitempty"`
+}
+
+// Load reads and parses the configuration document at path. Files
+// ending in ".yaml" or ".yml" are parsed as YAML; everything else
+// as JSON.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		b, err = yamlToJSON(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses a JSON configuration document.
+func Parse(b []byte) (*Config, error) {
+	c := new(Config)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	if c.Version != CurrentVersion {
+		return nil, fmt.Errorf("unsupported config version %d; want %d", c.Version, CurrentVersion)
+	}
+	// Validate the prefs up front, so callers only need to check
+	// errors once.
+	if _, err := c.MaskedPrefs(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// MaskedPrefs returns the preference edits described by c.
+//
+// Unless the document mentions WantRunning, the edits also set
+// WantRunning, as applying a configuration is a request to be
+// connected, like "tailscale up".
+func (c *Config) MaskedPrefs() (*ipn.MaskedPrefs, error) {
+	mp := new(ipn.MaskedPrefs)
+	mv := reflect.ValueOf(mp).Elem()
+	pv := reflect.ValueOf(&mp.Prefs).Elem()
+	pt := pv.Type()
+	for key, raw := range c.Prefs {
+		i, ok := prefsFieldIndex(pt, key)
+		if !ok {
+			return nil, fmt.Errorf("unknown pref %q", key)
+		}
+		name := pt.Field(i).Name
+		switch name {
+		case "Persist", "LoggedOut":
+			return nil, fmt.Errorf("pref %q can't be set from a config file", key)
+		case "NetfilterMode":
+			m, err := parseNetfilterMode(raw)
+			if err != nil {
+				return nil, err
+			}
+			mp.NetfilterMode = m
+		default:
+			if err := json.Unmarshal(raw, pv.Field(i).Addr().Interface()); err != nil {
+				return nil, fmt.Errorf("pref %q: %w", key, err)
+			}
+		}
+		mv.FieldByName(name + "Set").SetBool(true)
+	}
+	if c.ServerURL != "" {
+		if mp.ControlURLSet && mp.ControlURL != c.ServerURL {
+			return nil, fmt.Errorf("ServerURL %q conflicts with Prefs.ControlURL %q", c.ServerURL, mp.ControlURL)
+		}
+		mp.ControlURL = c.ServerURL
+		mp.ControlURLSet = true
+	}
+	if !mp.WantRunningSet {
+		mp.WantRunning = true
+		mp.WantRunningSet = true
+	}
+	return mp, nil
+}
+
+// prefsFieldIndex returns the index of the ipn.Prefs field whose
+// JSON name case-insensitively matches key.
+func prefsFieldIndex(pt reflect.Type, key string) (int, bool) {
+	for i := 0; i < pt.NumField(); i++ {
+		f := pt.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseNetfilterMode parses raw as either a NetfilterMode's
+// string form ("on", "nodivert", "off") or its numeric value.
+func parseNetfilterMode(raw json.RawMessage) (preftype.NetfilterMode, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var m preftype.NetfilterMode
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return 0, fmt.Errorf("pref NetfilterMode: %w", err)
+		}
+		s = m.String()
+	}
+	switch s {
+	case "on":
+		return preftype.NetfilterOn, nil
+	case "nodivert":
+		return preftype.NetfilterNoDivert, nil
+	case "off":
+		return preftype.NetfilterOff, nil
+	}
+	return 0, fmt.Errorf("invalid NetfilterMode %q; want one of on, nodivert, off", s)
+}
+
+// yamlToJSON converts the YAML document b to JSON.
+func yamlToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible converts the map[interface{}]interface{} values
+// produced by the YAML decoder into map[string]interface{}, which
+// encoding/json can marshal.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = e
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := jsonCompatible(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+	}
+	return v, nil
+}
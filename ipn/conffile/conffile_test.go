@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conffile
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/preftype"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    *ipn.MaskedPrefs
+		wantErr string
+	}{
+		{
+			name: "basic",
+			in: `{"Version": 1, "ServerURL": "https://ctl.example.com", "Prefs": {
+				"routeall": true,
+				"AdvertiseRoutes": ["10.0.0.0/8"],
+				"NetfilterMode": "nodivert"
+			}}`,
+			want: &ipn.MaskedPrefs{
+				Prefs: ipn.Prefs{
+					ControlURL:      "https://ctl.example.com",
+					RouteAll:        true,
+					WantRunning:     true,
+					AdvertiseRoutes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+					NetfilterMode:   preftype.NetfilterNoDivert,
+				},
+				ControlURLSet:      true,
+				RouteAllSet:        true,
+				WantRunningSet:     true,
+				AdvertiseRoutesSet: true,
+				NetfilterModeSet:   true,
+			},
+		},
+		{
+			name: "want_running_false",
+			in:   `{"Version": 1, "Prefs": {"WantRunning": false}}`,
+			want: &ipn.MaskedPrefs{
+				WantRunningSet: true,
+			},
+		},
+		{
+			name:    "bad_version",
+			in:      `{"Version": 2}`,
+			wantErr: "unsupported config version 2; want 1",
+		},
+		{
+			name:    "unknown_pref",
+			in:      `{"Version": 1, "Prefs": {"Bogus": 1}}`,
+			wantErr: `unknown pref "Bogus"`,
+		},
+		{
+			name:    "persist",
+			in:      `{"Version": 1, "Prefs": {"Config": {}}}`,
+			wantErr: `pref "Config" can't be set from a config file`,
+		},
+		{
+			name:    "bad_netfilter",
+			in:      `{"Version": 1, "Prefs": {"NetfilterMode": "bogus"}}`,
+			wantErr: `invalid NetfilterMode "bogus"; want one of on, nodivert, off`,
+		},
+		{
+			name:    "conflicting_server",
+			in:      `{"Version": 1, "ServerURL": "https://a", "Prefs": {"ControlURL": "https://b"}}`,
+			wantErr: `ServerURL "https://a" conflicts with Prefs.ControlURL "https://b"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse([]byte(tt.in))
+			if err != nil {
+				if err.Error() != tt.wantErr {
+					t.Fatalf("err = %q; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("unexpected success; want error %q", tt.wantErr)
+			}
+			got, err := c.MaskedPrefs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %s\nwant %s", got.Pretty(), tt.want.Pretty())
+			}
+		})
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ts.yaml")
+	const doc = `
+version: 1
+authKey: tskey-foo
+prefs:
+  shieldsUp: true
+  advertiseTags:
+    - tag:server
+`
+	if err := ioutil.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthKey != "tskey-foo" {
+		t.Errorf("AuthKey = %q", c.AuthKey)
+	}
+	mp, err := c.MaskedPrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.ShieldsUpSet || !mp.ShieldsUp {
+		t.Errorf("ShieldsUp not set: %s", mp.Pretty())
+	}
+	if !mp.AdvertiseTagsSet || !reflect.DeepEqual(mp.AdvertiseTags, []string{"tag:server"}) {
+		t.Errorf("AdvertiseTags = %q", mp.AdvertiseTags)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+)
+
+// localAPITokenPrefix is the prefix of all LocalAPI bearer tokens.
+// A token is of the form "tslapi-<id>-<secret>".
+const localAPITokenPrefix = "tslapi-"
+
+// storedAPIToken is a LocalAPI token as persisted in the state store.
+// The token's secret is never stored, only its hash.
+type storedAPIToken struct {
+	apitype.LocalAPIToken
+	SecretHash string // hex SHA-256 of the secret part of the token
+}
+
+func hashAPITokenSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// loadAPITokensLocked returns the stored LocalAPI tokens.
+//
+// b.apiTokenMu must be held.
+func (b *LocalBackend) loadAPITokensLocked() ([]storedAPIToken, error) {
+	bs, err := b.store.ReadState(ipn.LocalAPITokensStateKey)
+	if errors.Is(err, ipn.ErrStateNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var toks []storedAPIToken
+	if err := json.Unmarshal(bs, &toks); err != nil {
+		return nil, fmt.Errorf("decoding LocalAPI tokens: %w", err)
+	}
+	return toks, nil
+}
+
+// saveAPITokensLocked replaces the stored LocalAPI tokens with toks.
+//
+// b.apiTokenMu must be held.
+func (b *LocalBackend) saveAPITokensLocked(toks []storedAPIToken) error {
+	if toks == nil {
+		toks = []storedAPIToken{}
+	}
+	bs, err := json.Marshal(toks)
+	if err != nil {
+		return err
+	}
+	return b.store.WriteState(ipn.LocalAPITokensStateKey, bs)
+}
+
+// CreateLocalAPIToken mints and stores a new LocalAPI bearer token
+// granting the provided scopes. The returned token's Token field
+// contains the secret, which is not retrievable later.
+func (b *LocalBackend) CreateLocalAPIToken(name string, scopes []apitype.LocalAPIScope) (*apitype.LocalAPIToken, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New("no scopes requested")
+	}
+	for _, s := range scopes {
+		if !s.Valid() {
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	id, err := randHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randHex(24)
+	if err != nil {
+		return nil, err
+	}
+
+	b.apiTokenMu.Lock()
+	defer b.apiTokenMu.Unlock()
+	toks, err := b.loadAPITokensLocked()
+	if err != nil {
+		return nil, err
+	}
+	st := storedAPIToken{
+		LocalAPIToken: apitype.LocalAPIToken{
+			ID:      id,
+			Name:    name,
+			Scopes:  append([]apitype.LocalAPIScope(nil), scopes...),
+			Created: time.Now().UTC().Truncate(time.Second),
+		},
+		SecretHash: hashAPITokenSecret(secret),
+	}
+	if err := b.saveAPITokensLocked(append(toks, st)); err != nil {
+		return nil, err
+	}
+	b.logf("created LocalAPI token %s (%q) with scopes %v", id, name, scopes)
+
+	ret := st.LocalAPIToken
+	ret.Token = localAPITokenPrefix + id + "-" + secret
+	return &ret, nil
+}
+
+// LocalAPITokens returns the stored LocalAPI tokens, without their secrets.
+func (b *LocalBackend) LocalAPITokens() ([]apitype.LocalAPIToken, error) {
+	b.apiTokenMu.Lock()
+	defer b.apiTokenMu.Unlock()
+	toks, err := b.loadAPITokensLocked()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]apitype.LocalAPIToken, len(toks))
+	for i, t := range toks {
+		ret[i] = t.LocalAPIToken
+	}
+	return ret, nil
+}
+
+// RevokeLocalAPIToken deletes the LocalAPI token with the given ID.
+func (b *LocalBackend) RevokeLocalAPIToken(id string) error {
+	b.apiTokenMu.Lock()
+	defer b.apiTokenMu.Unlock()
+	toks, err := b.loadAPITokensLocked()
+	if err != nil {
+		return err
+	}
+	for i, t := range toks {
+		if t.ID == id {
+			toks = append(toks[:i], toks[i+1:]...)
+			if err := b.saveAPITokensLocked(toks); err != nil {
+				return err
+			}
+			b.logf("revoked LocalAPI token %s", id)
+			return nil
+		}
+	}
+	return fmt.Errorf("no LocalAPI token with ID %q", id)
+}
+
+// LocalAPITokenScopes returns the scopes granted by the bearer token
+// tok. It reports false if the token is malformed, unknown or revoked.
+func (b *LocalBackend) LocalAPITokenScopes(tok string) (scopes []apitype.LocalAPIScope, ok bool) {
+	rest := strings.TrimPrefix(tok, localAPITokenPrefix)
+	if rest == tok {
+		return nil, false
+	}
+	i := strings.Index(rest, "-")
+	if i == -1 {
+		return nil, false
+	}
+	id, secret := rest[:i], rest[i+1:]
+	hash := hashAPITokenSecret(secret)
+
+	b.apiTokenMu.Lock()
+	defer b.apiTokenMu.Unlock()
+	toks, err := b.loadAPITokensLocked()
+	if err != nil {
+		b.logf("loading LocalAPI tokens: %v", err)
+		return nil, false
+	}
+	for _, t := range toks {
+		if t.ID == id && subtle.ConstantTimeCompare([]byte(t.SecretHash), []byte(hash)) == 1 {
+			return t.Scopes, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+)
+
+func TestLocalAPITokens(t *testing.T) {
+	b := &LocalBackend{
+		logf:  t.Logf,
+		store: new(ipn.MemoryStore),
+	}
+	if _, err := b.CreateLocalAPIToken("bogus", []apitype.LocalAPIScope{"root"}); err == nil {
+		t.Fatal("unexpected success creating token with unknown scope")
+	}
+
+	scopes := []apitype.LocalAPIScope{apitype.ScopeStatusRead, apitype.ScopeFileSend}
+	tok, err := b.CreateLocalAPIToken("monitoring", scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tok.Token, localAPITokenPrefix+tok.ID+"-") {
+		t.Fatalf("unexpected token format %q", tok.Token)
+	}
+
+	got, ok := b.LocalAPITokenScopes(tok.Token)
+	if !ok {
+		t.Fatal("token not accepted")
+	}
+	if !reflect.DeepEqual(got, scopes) {
+		t.Errorf("scopes = %v; want %v", got, scopes)
+	}
+	if _, ok := b.LocalAPITokenScopes(tok.Token + "x"); ok {
+		t.Error("token with wrong secret accepted")
+	}
+	if _, ok := b.LocalAPITokenScopes("garbage"); ok {
+		t.Error("garbage token accepted")
+	}
+
+	list, err := b.LocalAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != tok.ID || list[0].Token != "" {
+		t.Fatalf("LocalAPITokens = %+v; want just %v without secret", list, tok.ID)
+	}
+
+	if err := b.RevokeLocalAPIToken(tok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.LocalAPITokenScopes(tok.Token); ok {
+		t.Error("revoked token accepted")
+	}
+	if err := b.RevokeLocalAPIToken(tok.ID); err == nil {
+		t.Error("unexpected success revoking token twice")
+	}
+}
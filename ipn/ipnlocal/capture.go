@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"io"
+
+	"tailscale.com/wgengine/capture"
+)
+
+// StreamDebugCapture writes a pcapng capture of the packets passing
+// through the engine to w until ctx is done or a write to w fails.
+// Multiple captures may run at once.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
+	s := capture.NewSink(w)
+	b.addCaptureSink(s)
+	defer b.removeCaptureSink(s)
+
+	select {
+	case <-ctx.Done():
+	case <-s.Done():
+	}
+	s.Close()
+	if n := s.Dropped(); n > 0 {
+		b.logf("debug capture: dropped %d packets", n)
+	}
+	return s.Err()
+}
+
+func (b *LocalBackend) addCaptureSink(s *capture.Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.captureSinks == nil {
+		b.captureSinks = make(map[*capture.Sink]bool)
+	}
+	b.captureSinks[s] = true
+	b.installCaptureHookLocked()
+}
+
+func (b *LocalBackend) removeCaptureSink(s *capture.Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.captureSinks, s)
+	b.installCaptureHookLocked()
+}
+
+// installCaptureHookLocked installs an engine capture hook that fans
+// out to the current set of sinks, or removes the hook if there are
+// none. The sinks are copied so the hook needn't take b.mu.
+//
+// b.mu must be held.
+func (b *LocalBackend) installCaptureHookLocked() {
+	if len(b.captureSinks) == 0 {
+		b.e.InstallCaptureHook(nil)
+		return
+	}
+	sinks := make([]*capture.Sink, 0, len(b.captureSinks))
+	for s := range b.captureSinks {
+		sinks = append(sinks, s)
+	}
+	b.e.InstallCaptureHook(func(p *capture.Packet) {
+		for _, s := range sinks {
+			s.Capture(p)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"errors"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// magicConn returns the engine's magicsock.Conn.
+func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
+	ig, ok := b.e.(wgengine.InternalsGetter)
+	if !ok {
+		return nil, errors.New("engine does not expose its internals")
+	}
+	_, mc, ok := ig.GetInternals()
+	if !ok {
+		return nil, errors.New("engine has no magicsock")
+	}
+	return mc, nil
+}
+
+// DebugMagicsock returns a snapshot of magicsock's per-peer disco
+// state, for "tailscale debug magicsock".
+func (b *LocalBackend) DebugMagicsock() (*ipnstate.MagicsockDebug, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.DebugState(), nil
+}
+
+// DebugDERPConns returns magicsock's active DERP connections, for
+// "tailscale debug derp".
+func (b *LocalBackend) DebugDERPConns() ([]ipnstate.DERPConnDebug, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	return mc.DebugDERPConns(), nil
+}
+
+// DebugFilter returns the packet filter in effect, for "tailscale
+// debug filter".
+func (b *LocalBackend) DebugFilter() (*apitype.FilterDebug, error) {
+	f := b.e.GetFilter()
+	if f == nil {
+		return nil, errors.New("no packet filter installed")
+	}
+	return &apitype.FilterDebug{
+		ShieldsUp: f.ShieldsUp(),
+		LocalNets: f.LocalNets(),
+		Matches:   f.Matches(),
+	}, nil
+}
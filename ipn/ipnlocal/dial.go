@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+// DialFunc dials network (always "tcp" for now) address addr.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SetDialer sets the func DialTCP uses to make connections. It's
+// needed when the OS can't reach Tailscale IPs itself, such as in
+// userspace-networking mode, where connections must go via netstack.
+// If nil, the OS dialer is used.
+func (b *LocalBackend) SetDialer(dial DialFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialer = dial
+}
+
+// DialTCP opens a TCP connection to port on host, which is either the
+// name of a peer in the current network map or an IP address routed
+// to one. Other destinations are rejected, so LocalAPI callers can't
+// use tailscaled as a general-purpose TCP relay.
+func (b *LocalBackend) DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	b.mu.Lock()
+	nm := b.netMap
+	dial := b.dialer
+	var exitNodeID tailcfg.StableNodeID
+	if b.prefs != nil {
+		exitNodeID = b.prefs.ExitNodeID
+	}
+	b.mu.Unlock()
+
+	ip, err := resolveTailnetHost(nm, exitNodeID, host)
+	if err != nil {
+		return nil, err
+	}
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return dial(ctx, "tcp", netaddr.IPPortFrom(ip, port).String())
+}
+
+// resolveTailnetHost returns the IP address of host, which is either
+// an IP address literal or a peer name from nm. Peer names may be
+// fully qualified MagicDNS names, with or without the trailing dot,
+// or just their first label. IPv4 addresses are preferred.
+//
+// IP literals must be one of a peer's addresses or within its
+// AllowedIPs. Default routes only count for exitNodeID, the exit
+// node in use, if any.
+func resolveTailnetHost(nm *netmap.NetworkMap, exitNodeID tailcfg.StableNodeID, host string) (netaddr.IP, error) {
+	if nm == nil {
+		return netaddr.IP{}, fmt.Errorf("unknown host %q; no network map", host)
+	}
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		if !peerRoutesIP(nm, exitNodeID, ip) {
+			return netaddr.IP{}, fmt.Errorf("%v is not a tailnet address", ip)
+		}
+		return ip, nil
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, p := range nm.Peers {
+		name := strings.TrimSuffix(p.Name, ".")
+		firstLabel := name
+		if i := strings.IndexByte(name, '.'); i != -1 {
+			firstLabel = name[:i]
+		}
+		if !strings.EqualFold(name, host) && !strings.EqualFold(firstLabel, host) {
+			continue
+		}
+		var ret netaddr.IP
+		for _, a := range p.Addresses {
+			if !a.IsSingleIP() {
+				continue
+			}
+			if a.IP().Is4() {
+				return a.IP(), nil
+			}
+			if ret.IsZero() {
+				ret = a.IP()
+			}
+		}
+		if !ret.IsZero() {
+			return ret, nil
+		}
+	}
+	return netaddr.IP{}, fmt.Errorf("unknown host %q", host)
+}
+
+// peerRoutesIP reports whether ip belongs to, or is routed via, a peer
+// in nm.
+func peerRoutesIP(nm *netmap.NetworkMap, exitNodeID tailcfg.StableNodeID, ip netaddr.IP) bool {
+	for _, p := range nm.Peers {
+		for _, a := range p.Addresses {
+			if a.Contains(ip) {
+				return true
+			}
+		}
+		for _, r := range p.AllowedIPs {
+			if r.Bits() == 0 && (exitNodeID == "" || p.StableID != exitNodeID) {
+				continue
+			}
+			if r.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func testDialNetMap() *netmap.NetworkMap {
+	return &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{
+				Name: "foo.example.ts.net.",
+				Addresses: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+					netaddr.MustParseIPPrefix("100.64.0.1/32"),
+				},
+			},
+			{
+				Name:     "bar.example.ts.net.",
+				StableID: "bar",
+				Addresses: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("fd7a:115c:a1e0::2/128"),
+				},
+				AllowedIPs: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("fd7a:115c:a1e0::2/128"),
+					netaddr.MustParseIPPrefix("192.168.1.0/24"),
+					netaddr.MustParseIPPrefix("0.0.0.0/0"),
+				},
+			},
+		},
+	}
+}
+
+func TestResolveTailnetHost(t *testing.T) {
+	nm := testDialNetMap()
+	tests := []struct {
+		host       string
+		exitNodeID tailcfg.StableNodeID
+		want       string
+		wantErr    bool
+	}{
+		{host: "100.64.0.1", want: "100.64.0.1"},
+		{host: "192.168.1.5", want: "192.168.1.5"},
+		{host: "100.64.0.9", wantErr: true},
+		{host: "8.8.8.8", wantErr: true},
+		{host: "8.8.8.8", exitNodeID: "foo", wantErr: true},
+		{host: "8.8.8.8", exitNodeID: "bar", want: "8.8.8.8"},
+		{host: "foo", want: "100.64.0.1"},
+		{host: "FOO.example.ts.net", want: "100.64.0.1"},
+		{host: "foo.example.ts.net.", want: "100.64.0.1"},
+		{host: "bar", want: "fd7a:115c:a1e0::2"},
+		{host: "baz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveTailnetHost(nm, tt.exitNodeID, tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveTailnetHost(%q) = %v; want error", tt.host, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveTailnetHost(%q): %v", tt.host, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("resolveTailnetHost(%q) = %v; want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestResolveTailnetHostNoNetmap(t *testing.T) {
+	if ip, err := resolveTailnetHost(nil, "", "100.64.0.1"); err == nil {
+		t.Errorf("got %v; want error", ip)
+	}
+}
+
+// Tests that DialTCP uses the dialer set with SetDialer for all the
+// destinations it accepts, including subnet routes, which the OS
+// can't reach in userspace-networking mode.
+func TestDialTCPUsesDialer(t *testing.T) {
+	b := &LocalBackend{
+		netMap: testDialNetMap(),
+		prefs:  ipn.NewPrefs(),
+	}
+	errDialed := errors.New("dialed")
+	var got []string
+	b.SetDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		got = append(got, network+" "+addr)
+		return nil, errDialed
+	})
+
+	ctx := context.Background()
+	for _, host := range []string{"100.64.0.1", "192.168.1.5", "foo"} {
+		if _, err := b.DialTCP(ctx, host, 22); err != errDialed {
+			t.Errorf("DialTCP(%q) error = %v; want %v", host, err, errDialed)
+		}
+	}
+	if _, err := b.DialTCP(ctx, "8.8.8.8", 22); err == nil || err == errDialed {
+		t.Errorf("DialTCP(8.8.8.8) error = %v; want rejection", err)
+	}
+	want := []string{"tcp 100.64.0.1:22", "tcp 192.168.1.5:22", "tcp 100.64.0.1:22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dialed %q; want %q", got, want)
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"tailscale.com/ipn/policy"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
@@ -52,6 +53,7 @@ import (
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/wgcfg"
@@ -89,6 +91,7 @@ type LocalBackend struct {
 	backendLogID          string
 	unregisterLinkMon     func()
 	unregisterHealthWatch func()
+	unregisterWarnings    func()
 	portpoll              *portlist.Poller // may be nil
 	portpollOnce          sync.Once        // guards starting readPoller
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
@@ -97,11 +100,16 @@ type LocalBackend struct {
 
 	filterHash string
 
+	// apiTokenMu serializes read-modify-write updates of the
+	// LocalAPI tokens in store. See apitoken.go.
+	apiTokenMu sync.Mutex
+
 	// The mutex protects the following elements.
 	mu             sync.Mutex
 	httpTestClient *http.Client // for controlclient. nil by default, used by tests.
 	ccGen          clientGen    // function for producing controlclient; lazily populated
 	notify         func(ipn.Notify)
+	notifyWatchers map[*notifyWatcher]bool // IPN bus watchers; see WatchNotifications
 	cc             controlclient.Client
 	stateKey       ipn.StateKey // computed in part from user-provided value
 	userID         string       // current controlling user ID (for Windows, primarily)
@@ -125,6 +133,9 @@ type LocalBackend struct {
 	prevIfState      *interfaces.State
 	peerAPIServer    *peerAPIServer // or nil
 	peerAPIListeners []*peerAPIListener
+	peerAPIExt       map[string]http.Handler // name => handler; see HandlePeerAPI
+	dialer           DialFunc                // or nil for the OS; see SetDialer
+	captureSinks     map[*capture.Sink]bool  // see StreamDebugCapture
 	incomingFiles    map[*incomingFile]bool
 	// directFileRoot, if non-empty, means to write received files
 	// directly to this directory, without staging them in an
@@ -188,6 +199,7 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 	b.unregisterLinkMon = linkMon.RegisterChangeCallback(b.linkChange)
 
 	b.unregisterHealthWatch = health.RegisterWatcher(b.onHealthChange)
+	b.unregisterWarnings = health.RegisterWarningsWatcher(b.onHealthWarningsChange)
 
 	wiredPeerAPIPort := false
 	if ig, ok := e.(wgengine.InternalsGetter); ok {
@@ -261,6 +273,12 @@ func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 	}
 }
 
+// onHealthWarningsChange tells frontends that the health warnings
+// in the status changed.
+func (b *LocalBackend) onHealthWarningsChange() {
+	b.send(ipn.Notify{HealthChanged: &empty.Message{}})
+}
+
 // Shutdown halts the backend and all its sub-components. The backend
 // can no longer be used after Shutdown returns.
 func (b *LocalBackend) Shutdown() {
@@ -270,6 +288,7 @@ func (b *LocalBackend) Shutdown() {
 
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
+	b.unregisterWarnings()
 	if cc != nil {
 		cc.Shutdown()
 	}
@@ -283,12 +302,40 @@ func (b *LocalBackend) Prefs() *ipn.Prefs {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	p := b.prefs.Clone()
+	stripPrivateKeys(p)
+	return p
+}
+
+// stripPrivateKeys zeroes the private keys in p's Persist, if any, so
+// p can be handed to LocalAPI clients.
+func stripPrivateKeys(p *ipn.Prefs) {
 	if p != nil && p.Persist != nil {
 		p.Persist.LegacyFrontendPrivateMachineKey = wgkey.Private{}
 		p.Persist.PrivateNodeKey = wgkey.Private{}
 		p.Persist.OldPrivateNodeKey = wgkey.Private{}
 	}
-	return p
+}
+
+// withoutPrivateKeys returns n, or a copy of it without the private
+// keys in its Prefs and NetMap if it has any. The Prefs' Persist, which
+// holds the node keys, is dropped entirely. It's used for IPN bus
+// watchers, which, unlike the frontend notify callback, may be
+// unprivileged LocalAPI clients.
+func withoutPrivateKeys(n *ipn.Notify) *ipn.Notify {
+	if (n.Prefs == nil || n.Prefs.Persist == nil) && (n.NetMap == nil || n.NetMap.PrivateKey.IsZero()) {
+		return n
+	}
+	n2 := *n
+	if n.Prefs != nil && n.Prefs.Persist != nil {
+		n2.Prefs = n.Prefs.Clone()
+		n2.Prefs.Persist = nil
+	}
+	if n.NetMap != nil && !n.NetMap.PrivateKey.IsZero() {
+		nm := *n.NetMap
+		nm.PrivateKey = wgkey.Private{}
+		n2.NetMap = &nm
+	}
+	return &n2
 }
 
 // Status returns the latest status of the backend and its
@@ -326,6 +373,7 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		if b.netMap != nil {
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 		}
+		s.Health = health.Warnings()
 	})
 	sb.MutateSelfStatus(func(ss *ipnstate.PeerStatus) {
 		if b.netMap != nil && b.netMap.SelfNode != nil {
@@ -377,11 +425,14 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			HostName:           p.Hostinfo.Hostname,
 			DNSName:            p.Name,
 			OS:                 p.Hostinfo.OS,
+			RequestTags:        p.Hostinfo.RequestTags,
 			KeepAlive:          p.KeepAlive,
 			Created:            p.Created,
 			LastSeen:           lastSeen,
 			ShareeNode:         p.Hostinfo.ShareeNode,
 			ExitNode:           p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
+			ExitNodeOption:     tsaddr.ContainsExitRoutes(p.AllowedIPs),
+			Online:             p.Online != nil && *p.Online,
 		})
 	}
 }
@@ -620,6 +671,89 @@ func (b *LocalBackend) SetNotifyCallback(notify func(ipn.Notify)) {
 	b.notify = notify
 }
 
+// notifyWatcher is an IPN bus subscriber registered by WatchNotifications.
+type notifyWatcher struct {
+	mask ipn.NotifyWatchOpt
+	ch   chan *ipn.Notify
+}
+
+// send delivers n to w without blocking, if w's mask selects any of it.
+// If w isn't keeping up, the message is dropped.
+func (w *notifyWatcher) send(n *ipn.Notify, logf logger.Logf) {
+	n, ok := w.mask.Filter(n)
+	if !ok {
+		return
+	}
+	select {
+	case w.ch <- n:
+	default:
+		logf("[unexpected] IPN bus watcher too slow; dropped %v", n)
+	}
+}
+
+// WatchNotifications subscribes to the IPN notification bus, calling fn
+// for each Notify selected by mask, until ctx is done or fn returns false.
+// It's the LocalAPI equivalent of SetNotifyCallback, except any number
+// of watchers may be registered concurrently and none of them replace
+// the single frontend notify callback.
+//
+// The Notify values passed to fn never include private keys, and
+// must not be mutated.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWatchOpt, fn func(roNotify *ipn.Notify) (keepGoing bool)) {
+	w := &notifyWatcher{
+		mask: mask,
+		ch:   make(chan *ipn.Notify, 128),
+	}
+
+	var ini *ipn.Notify
+	b.mu.Lock()
+	if mask&ipn.NotifyInitialState != 0 {
+		st := b.state
+		ini = &ipn.Notify{State: &st}
+		if mask&ipn.NotifyWatchPrefs != 0 && b.prefs != nil {
+			ini.Prefs = b.prefs.Clone()
+		}
+		if mask&ipn.NotifyWatchNetMap != 0 {
+			ini.NetMap = b.netMap
+		}
+		if mask&ipn.NotifyWatchEngineUpdates != 0 {
+			es := b.engineStatus
+			ini.Engine = &es
+		}
+	}
+	if b.notifyWatchers == nil {
+		b.notifyWatchers = map[*notifyWatcher]bool{}
+	}
+	b.notifyWatchers[w] = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.notifyWatchers, w)
+		b.mu.Unlock()
+	}()
+
+	if ini != nil {
+		ini = withoutPrivateKeys(ini)
+		ini.Version = version.Long
+		if !fn(ini) {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.ctx.Done():
+			return
+		case n := <-w.ch:
+			if !fn(n) {
+				return
+			}
+		}
+	}
+}
+
 // SetHTTPTestClient sets an alternate HTTP client to use with
 // connections to the coordination server. It exists for
 // testing. Using nil means to use the default.
@@ -867,6 +1001,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	b.logf("Backend: logs: be:%v fe:%v", blid, opts.FrontendLogID)
 	b.send(ipn.Notify{BackendLogID: &blid})
 	b.send(ipn.Notify{Prefs: prefs})
+	b.setPeerRelay(prefs)
 
 	if !loggedOut && b.hasNodeKey() {
 		// Even if !WantRunning, we should verify our key, if there
@@ -878,6 +1013,19 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	return nil
 }
 
+// setPeerRelay tells magicsock whether to relay UDP between peers,
+// per prefs.AdvertisePeerRelay.
+func (b *LocalBackend) setPeerRelay(prefs *ipn.Prefs) {
+	mc, err := b.magicConn()
+	if err != nil {
+		if prefs.AdvertisePeerRelay {
+			b.logf("can't act as peer relay: %v", err)
+		}
+		return
+	}
+	mc.SetPeerRelay(prefs.AdvertisePeerRelay)
+}
+
 // updateFilter updates the packet filter in wgengine based on the
 // given netMap and user preferences.
 func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs) {
@@ -1113,9 +1261,13 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
+	watchers := make([]*notifyWatcher, 0, len(b.notifyWatchers))
+	for w := range b.notifyWatchers {
+		watchers = append(watchers, w)
+	}
 	b.mu.Unlock()
 
-	if notifyFunc == nil {
+	if notifyFunc == nil && len(watchers) == 0 {
 		return
 	}
 
@@ -1124,7 +1276,15 @@ func (b *LocalBackend) send(n ipn.Notify) {
 	}
 
 	n.Version = version.Long
-	notifyFunc(n)
+	if notifyFunc != nil {
+		notifyFunc(n)
+	}
+	if len(watchers) > 0 {
+		wn := withoutPrivateKeys(&n)
+		for _, w := range watchers {
+			w.send(wn, b.logf)
+		}
+	}
 }
 
 func (b *LocalBackend) sendFileNotify() {
@@ -1133,7 +1293,7 @@ func (b *LocalBackend) sendFileNotify() {
 	b.mu.Lock()
 	notifyFunc := b.notify
 	apiSrv := b.peerAPIServer
-	if notifyFunc == nil || apiSrv == nil {
+	if (notifyFunc == nil && len(b.notifyWatchers) == 0) || apiSrv == nil {
 		b.mu.Unlock()
 		return
 	}
@@ -1434,6 +1594,74 @@ func (b *LocalBackend) Ping(ipStr string, useTSMP bool) {
 	})
 }
 
+// PingSync sends a single disco (or TSMP, if useTSMP) ping to ip and
+// waits for its result, or for ctx to be done.
+//
+// Unlike Ping, the result is returned to the caller rather than sent
+// to the frontend as a Notify.
+func (b *LocalBackend) PingSync(ctx context.Context, ip netaddr.IP, useTSMP bool) (*ipnstate.PingResult, error) {
+	ch := make(chan *ipnstate.PingResult, 1)
+	b.e.Ping(ip, useTSMP, func(pr *ipnstate.PingResult) {
+		// The engine may call this with its own locks held,
+		// so never block.
+		select {
+		case ch <- pr:
+		default:
+		}
+	})
+	select {
+	case pr := <-ch:
+		return pr, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// BugReportMarker logs and returns a new unique marker that users can
+// share with support to locate this point in the logs. The note, if
+// non-empty, is logged along with it.
+func (b *LocalBackend) BugReportMarker(note string) string {
+	suffix, _ := randHex(8)
+	marker := fmt.Sprintf("BUG-%v-%v-%v", b.backendLogID, time.Now().UTC().Format("20060102150405Z"), suffix)
+	b.logf("user bugreport: %s", marker)
+	if note != "" {
+		b.logf("user bugreport note: %s", note)
+	}
+	return marker
+}
+
+// DERPMap returns the current DERP map from the network map,
+// or nil if there isn't one.
+func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil {
+		return nil
+	}
+	return b.netMap.DERPMap
+}
+
+// NetcheckReport returns a netcheck report of the daemon's network
+// conditions.
+//
+// If fresh is false, it returns the last report magicsock computed
+// while determining its endpoints. Otherwise magicsock updates its
+// endpoints now, and the new report it computes doing so is returned.
+func (b *LocalBackend) NetcheckReport(ctx context.Context, fresh bool) (*netcheck.Report, error) {
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	if fresh {
+		return mc.RunNetcheck(ctx)
+	}
+	r := mc.LastNetcheckReport()
+	if r == nil {
+		return nil, errors.New("no netcheck report yet")
+	}
+	return r, nil
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1568,6 +1796,9 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	}
 
 	b.updateFilter(netMap, newp)
+	if oldp.AdvertisePeerRelay != newp.AdvertisePeerRelay {
+		b.setPeerRelay(newp)
+	}
 
 	if netMap != nil {
 		b.e.SetDERPMap(netMap.DERPMap)
@@ -1609,6 +1840,9 @@ func (b *LocalBackend) peerAPIServicesLocked() (ret []tailcfg.Service) {
 			Port:  uint16(pln.port),
 		})
 	}
+	if len(b.peerAPIListeners) > 0 {
+		ret = append(ret, b.peerAPIExtServicesLocked()...)
+	}
 	return ret
 }
 
@@ -2127,6 +2361,7 @@ func applyPrefsToHostinfo(hi *tailcfg.Hostinfo, prefs *ipn.Prefs) {
 		hi.DeviceModel = m
 	}
 	hi.ShieldsUp = prefs.ShieldsUp
+	hi.PeerRelay = prefs.AdvertisePeerRelay
 }
 
 // enterState transitions the backend into newState, updating internal
@@ -2577,6 +2812,22 @@ func (b *LocalBackend) FileTargets() ([]*apitype.FileTarget, error) {
 	return ret, nil
 }
 
+// PeerAPIURL returns the "http://ip:port" URL base of the peer API of
+// the node with the given Tailscale IP.
+func (b *LocalBackend) PeerAPIURL(ip netaddr.IP) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, ok := b.nodeByAddr[ip]
+	if !ok || n == nil {
+		return "", fmt.Errorf("no node found with IP %v", ip)
+	}
+	base := peerAPIBase(b.netMap, n)
+	if base == "" {
+		return "", fmt.Errorf("node %v does not support the peer API", ip)
+	}
+	return base, nil
+}
+
 // SetDNS adds a DNS record for the given domain name & TXT record
 // value.
 //
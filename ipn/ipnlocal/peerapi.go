@@ -6,6 +6,7 @@ package ipnlocal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -29,6 +30,7 @@ import (
 
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/interfaces"
@@ -504,6 +506,14 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.handleServeGoroutines(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/v0/debug/") {
+		h.handleServeDebug(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, peerAPIExtPrefix) {
+		h.handleServeExt(w, r)
+		return
+	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
 <meta name="viewport" content="width=device-width, initial-scale=1">
@@ -710,3 +720,198 @@ func (h *peerAPIHandler) handleServeGoroutines(w http.ResponseWriter, r *http.Re
 	}
 	w.Write(buf)
 }
+
+// handleServeDebug serves the owner-only remote diagnostics under
+// /v0/debug/, for troubleshooting headless nodes from another node of
+// the same user.
+func (h *peerAPIHandler) handleServeDebug(w http.ResponseWriter, r *http.Request) {
+	if !h.isSelf {
+		http.Error(w, "not owner", http.StatusForbidden)
+		return
+	}
+	b := h.ps.b
+	var res interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/v0/debug/") {
+	case "status":
+		res = b.Status()
+	case "netcheck":
+		report, err := b.NetcheckReport(r.Context(), false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		res = report
+	case "health":
+		hs := apitype.HealthStatus{
+			Recent: []apitype.HealthChange{},
+		}
+		if err := health.OverallError(); err != nil {
+			hs.Error = err.Error()
+		}
+		for _, c := range health.RecentOverallChanges() {
+			hs.Recent = append(hs.Recent, apitype.HealthChange{Time: c.Time, Error: c.Error})
+		}
+		res = hs
+	case "bugreport":
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		h.logf("remote bugreport requested by %v", h.remoteAddr.IP())
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, b.BugReportMarker(r.FormValue("note")))
+		return
+	default:
+		http.Error(w, "unknown debug resource", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(res)
+}
+
+// peerAPIExtPrefix is the URL path prefix under which handlers
+// registered with LocalBackend.HandlePeerAPI are served, followed by
+// their name.
+const peerAPIExtPrefix = "/v0/ext/"
+
+// peerAPIExtProto is the tailcfg.Service Proto used to advertise a
+// handler registered with LocalBackend.HandlePeerAPI in Hostinfo.
+// The Service's Description is the handler's name.
+const peerAPIExtProto = tailcfg.ServiceProto("peerapi-ext")
+
+// PeerAPICaller is the identity of the peer making a peer API request.
+//
+// Handlers registered with LocalBackend.HandlePeerAPI can get it with
+// PeerAPICallerFromContext.
+type PeerAPICaller struct {
+	RemoteAddr netaddr.IPPort
+	Node       *tailcfg.Node
+	User       tailcfg.UserProfile
+	IsSelf     bool // whether Node is owned by the same user as this node
+}
+
+type peerAPICallerKey struct{}
+
+// PeerAPICallerFromContext returns the identity of the peer making the
+// peer API request whose context is ctx. It reports false if ctx isn't
+// from a request to a handler registered with LocalBackend.HandlePeerAPI.
+func PeerAPICallerFromContext(ctx context.Context) (*PeerAPICaller, bool) {
+	c, ok := ctx.Value(peerAPICallerKey{}).(*PeerAPICaller)
+	return c, ok
+}
+
+// validPeerAPIExtName reports whether name is a valid name for
+// LocalBackend.HandlePeerAPI: 1 to 63 lowercase letters, digits or
+// hyphens.
+func validPeerAPIExtName(name string) bool {
+	if name == "" || len(name) > 63 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// HandlePeerAPI registers h to serve peer API requests under
+// "/v0/ext/<name>/", for applications embedding LocalBackend (such as
+// via tsnet) that want their own peer-authenticated endpoints.
+//
+// The "/v0/ext/<name>" prefix is stripped from the request path before
+// h is called, and the identity of the calling peer is available via
+// PeerAPICallerFromContext. Unlike the built-in handlers, h is called
+// for requests from any peer allowed to reach the peer API, so it must
+// do its own authorization.
+//
+// Registered names are advertised to peers in Hostinfo.Services; see
+// PeerAPIExtNames. The returned func unregisters h.
+func (b *LocalBackend) HandlePeerAPI(name string, h http.Handler) (unregister func(), err error) {
+	if !validPeerAPIExtName(name) {
+		return nil, fmt.Errorf("invalid peer API handler name %q", name)
+	}
+	b.mu.Lock()
+	if _, dup := b.peerAPIExt[name]; dup {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("peer API handler %q already registered", name)
+	}
+	if b.peerAPIExt == nil {
+		b.peerAPIExt = map[string]http.Handler{}
+	}
+	b.peerAPIExt[name] = h
+	hi := b.hostinfo.Clone()
+	b.mu.Unlock()
+	if hi != nil {
+		go b.doSetHostinfoFilterServices(hi)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.peerAPIExt, name)
+			hi := b.hostinfo.Clone()
+			b.mu.Unlock()
+			if hi != nil {
+				go b.doSetHostinfoFilterServices(hi)
+			}
+		})
+	}, nil
+}
+
+// peerAPIExtServicesLocked returns the Hostinfo services advertising
+// the registered peer API extensions, sorted by name.
+//
+// b.mu must be held.
+func (b *LocalBackend) peerAPIExtServicesLocked() (ret []tailcfg.Service) {
+	for name := range b.peerAPIExt {
+		ret = append(ret, tailcfg.Service{
+			Proto:       peerAPIExtProto,
+			Description: name,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Description < ret[j].Description })
+	return ret
+}
+
+// PeerAPIExtNames returns the names of the peer API extensions (see
+// LocalBackend.HandlePeerAPI) that peer advertises.
+func PeerAPIExtNames(peer *tailcfg.Node) []string {
+	var names []string
+	for _, s := range peer.Hostinfo.Services {
+		if s.Proto == peerAPIExtProto {
+			names = append(names, s.Description)
+		}
+	}
+	return names
+}
+
+func (h *peerAPIHandler) handleServeExt(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, peerAPIExtPrefix)
+	name := rest
+	if i := strings.Index(rest, "/"); i != -1 {
+		name = rest[:i]
+	} else {
+		// Like http.ServeMux, redirect "/v0/ext/foo" to "/v0/ext/foo/".
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	b := h.ps.b
+	b.mu.Lock()
+	eh, ok := b.peerAPIExt[name]
+	b.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown peer API extension", http.StatusNotFound)
+		return
+	}
+	ctx := context.WithValue(r.Context(), peerAPICallerKey{}, &PeerAPICaller{
+		RemoteAddr: h.remoteAddr,
+		Node:       h.peerNode,
+		User:       h.peerUser,
+		IsSelf:     h.isSelf,
+	})
+	http.StripPrefix(peerAPIExtPrefix+name, eh).ServeHTTP(w, r.WithContext(ctx))
+}
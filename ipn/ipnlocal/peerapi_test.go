@@ -149,6 +149,42 @@ func TestHandlePeerAPI(t *testing.T) {
 				bodyContains("ServeHTTP"),
 			),
 		},
+		{
+			name:   "peer_api_debug_deny",
+			isSelf: false,
+			req:    httptest.NewRequest("GET", "/v0/debug/health", nil),
+			checks: checks(httpStatus(403)),
+		},
+		{
+			name:   "peer_api_debug_health",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/debug/health", nil),
+			checks: checks(
+				httpStatus(200),
+				bodyContains(`"Recent"`),
+			),
+		},
+		{
+			name:   "peer_api_debug_bugreport_want_post",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/debug/bugreport", nil),
+			checks: checks(httpStatus(http.StatusMethodNotAllowed)),
+		},
+		{
+			name:   "peer_api_debug_bugreport",
+			isSelf: true,
+			req:    httptest.NewRequest("POST", "/v0/debug/bugreport", nil),
+			checks: checks(
+				httpStatus(200),
+				bodyContains("BUG-"),
+			),
+		},
+		{
+			name:   "peer_api_debug_unknown",
+			isSelf: true,
+			req:    httptest.NewRequest("GET", "/v0/debug/nope", nil),
+			checks: checks(httpStatus(404)),
+		},
 		{
 			name:       "reject_non_owner_put",
 			isSelf:     false,
@@ -571,3 +607,46 @@ func TestDeletedMarkers(t *testing.T) {
 	}
 
 }
+
+func TestHandlePeerAPIExt(t *testing.T) {
+	lb := &LocalBackend{logf: t.Logf}
+	var gotPath string
+	var gotCaller *PeerAPICaller
+	unregister, err := lb.HandlePeerAPI("myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotCaller, _ = PeerAPICallerFromContext(r.Context())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.HandlePeerAPI("myapp", http.NotFoundHandler()); err == nil {
+		t.Error("unexpected success registering duplicate name")
+	}
+	if _, err := lb.HandlePeerAPI("My App", http.NotFoundHandler()); err == nil {
+		t.Error("unexpected success registering invalid name")
+	}
+
+	peer := &tailcfg.Node{ComputedName: "some-peer-name"}
+	ph := &peerAPIHandler{
+		peerNode: peer,
+		ps:       &peerAPIServer{b: lb},
+	}
+	rr := httptest.NewRecorder()
+	ph.ServeHTTP(rr, httptest.NewRequest("GET", "/v0/ext/myapp/foo", nil))
+	if rr.Code != 200 {
+		t.Fatalf("status = %v; want 200", rr.Code)
+	}
+	if gotPath != "/foo" {
+		t.Errorf("handler path = %q; want /foo", gotPath)
+	}
+	if gotCaller == nil || gotCaller.Node != peer {
+		t.Errorf("caller = %+v; want node %v", gotCaller, peer.ComputedName)
+	}
+
+	unregister()
+	rr = httptest.NewRecorder()
+	ph.ServeHTTP(rr, httptest.NewRequest("GET", "/v0/ext/myapp/foo", nil))
+	if rr.Code != 404 {
+		t.Errorf("after unregister, status = %v; want 404", rr.Code)
+	}
+}
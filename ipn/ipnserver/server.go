@@ -66,6 +66,16 @@ type Options struct {
 	// waits for a frontend to start it.
 	AutostartStateKey ipn.StateKey
 
+	// AutostartEdits, if non-nil, are preference edits applied to
+	// the AutostartStateKey's stored prefs when autostarting.
+	// Prefs not mentioned keep their stored values, so applying the
+	// same edits on every start is idempotent.
+	AutostartEdits *ipn.MaskedPrefs
+
+	// AutostartAuthKey, if non-empty, is the node auth key used when
+	// autostarting, should the node need to log in.
+	AutostartAuthKey string
+
 	// SurviveDisconnects specifies how the server reacts to its
 	// frontend disconnecting. If true, the server keeps running on
 	// its existing state, and accepts new frontend connections. If
@@ -85,6 +95,10 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// Dialer, if non-nil, is how the backend makes TCP connections
+	// on behalf of LocalAPI clients. See LocalBackend.SetDialer.
+	Dialer ipnlocal.DialFunc
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -583,6 +597,27 @@ func (s *server) writeToClients(n ipn.Notify) {
 	}
 }
 
+// autostartPrefs returns the prefs stored in store under key (or the
+// defaults for a new node) with edits applied.
+func autostartPrefs(store ipn.StateStore, key ipn.StateKey, edits *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	var prefs *ipn.Prefs
+	bs, err := store.ReadState(key)
+	switch {
+	case errors.Is(err, ipn.ErrStateNotExist):
+		prefs = ipn.NewPrefs()
+		prefs.WantRunning = false
+	case err != nil:
+		return nil, fmt.Errorf("store.ReadState(%q): %v", key, err)
+	default:
+		prefs, err = ipn.PrefsFromBytes(bs, false)
+		if err != nil {
+			return nil, fmt.Errorf("PrefsFromBytes: %v", err)
+		}
+	}
+	prefs.ApplyEdits(edits)
+	return prefs, nil
+}
+
 // Run runs a Tailscale backend service.
 // The getEngine func is called repeatedly, once per connection, until it returns an engine successfully.
 func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (wgengine.Engine, error), opts Options) error {
@@ -683,6 +718,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	if opts.Dialer != nil {
+		b.SetDialer(opts.Dialer)
+	}
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
@@ -694,12 +732,25 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 
 	if opts.AutostartStateKey != "" {
+		startOpts := ipn.Options{StateKey: opts.AutostartStateKey}
+		if opts.AutostartEdits != nil {
+			prefs, err := autostartPrefs(store, opts.AutostartStateKey, opts.AutostartEdits)
+			if err != nil {
+				return err
+			}
+			startOpts.UpdatePrefs = prefs
+			if prefs.Persist == nil || prefs.Persist.LoginName == "" {
+				startOpts.AuthKey = opts.AutostartAuthKey
+			}
+		}
 		server.bs.GotCommand(context.TODO(), &ipn.Command{
 			Version: version.Long,
 			Start: &ipn.StartArgs{
-				Opts: ipn.Options{StateKey: opts.AutostartStateKey},
+				Opts: startOpts,
 			},
 		})
+	} else if opts.AutostartEdits != nil {
+		logf("ipnserver: no autostart state key; ignoring config")
 	}
 
 	systemd.Ready()
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+// MagicsockDebug is a snapshot of magicsock's disco state, as
+// returned by the LocalAPI's debug-magicsock handler. It is meant
+// for humans debugging connectivity; its fields may change.
+type MagicsockDebug struct {
+	DiscoKey tailcfg.DiscoKey // this node's disco public key
+
+	// HomeDERP is this node's home DERP region ID, or 0 if none.
+	HomeDERP     int
+	HomeDERPCode string `json:",omitempty"`
+
+	// Endpoints are the local endpoints last advertised to peers.
+	Endpoints []string
+
+	// Peers are the disco-capable peers in the network map,
+	// sorted by name.
+	Peers []*PeerDiscoDebug
+}
+
+// PeerDiscoDebug is the disco state of one peer.
+type PeerDiscoDebug struct {
+	Name     string // from the network map; may be empty
+	NodeKey  tailcfg.NodeKey
+	DiscoKey tailcfg.DiscoKey
+
+	// Active is whether magicsock has created endpoint state for
+	// the peer, which happens on first use. If false, the
+	// remaining fields are zero.
+	Active bool
+
+	DERPAddr string `json:",omitempty"` // "127.3.3.40:N", where N is the DERP region ID
+
+	// BestAddr is the best direct UDP path found, if any, and
+	// BestAddrLatency its last measured round trip time.
+	BestAddr        string        `json:",omitempty"`
+	BestAddrLatency time.Duration `json:",omitempty"`
+	// BestAddrAt is when BestAddr was last confirmed, and
+	// TrustBestAddrUntil is when it expires if not confirmed again.
+	BestAddrAt         time.Time
+	TrustBestAddrUntil time.Time
+
+	LastSend     time.Time // last outgoing packet from WireGuard
+	LastRecv     time.Time // last incoming packet, to within 10 seconds
+	LastFullPing time.Time // last time all endpoints were pinged
+	Heartbeat    bool      // whether the best address heartbeat is running
+
+	Endpoints []*DiscoEndpointDebug // sorted by Addr
+
+	Path *PeerPathStats `json:",omitempty"` // path telemetry, if sent to
+}
+
+// DiscoEndpointDebug is the disco state of one candidate UDP
+// endpoint of a peer.
+type DiscoEndpointDebug struct {
+	Addr string
+
+	LastPing    time.Time // last outgoing ping
+	LastGotPing time.Time // if non-zero, learned from an incoming ping rather than the network map
+	CallMeMaybe time.Time // if non-zero, last advertised via call-me-maybe
+
+	// LastPong is when the most recent pong arrived, if any, and
+	// LastPongLatency its round trip time.
+	LastPong        time.Time
+	LastPongLatency time.Duration `json:",omitempty"`
+	Pongs           int           // number of recent pongs remembered
+}
+
+// DERPConnDebug describes one active DERP connection, as returned
+// by the LocalAPI's debug-derp handler.
+type DERPConnDebug struct {
+	RegionID   int
+	RegionCode string `json:",omitempty"`
+	Home       bool   // whether it's this node's home region
+	Created    time.Time
+	LastWrite  time.Time // last time a packet was written to it
+}
@@ -38,6 +38,11 @@ type Status struct {
 	TailscaleIPs []netaddr.IP // Tailscale IP(s) assigned to this node
 	Self         *PeerStatus
 
+	// Health contains human-readable warnings about the local
+	// network, such as a captive portal or blocked UDP. It's empty
+	// if there are none.
+	Health []string `json:",omitempty"`
+
 	// MagicDNSSuffix is the network's MagicDNS suffix for nodes
 	// in the network such as "userfoo.tailscale.net".
 	// There are no surrounding dots.
@@ -72,6 +77,10 @@ type PeerStatus struct {
 	OS        string // HostInfo.OS
 	UserID    tailcfg.UserID
 
+	// RequestTags are the ACL tags the peer asked to claim
+	// (Hostinfo.RequestTags). Control may not have granted them.
+	RequestTags []string `json:",omitempty"`
+
 	TailAddrDeprecated string       `json:"TailAddr"` // Tailscale IP
 	TailscaleIPs       []netaddr.IP // Tailscale IP(s) assigned to this node
 
@@ -80,6 +89,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PeerRelay is the name of the peer relay (a tailnet node
+	// with tailcfg.Hostinfo.PeerRelay) packets to this peer are
+	// sent through, if any. If set, CurAddr is empty.
+	PeerRelay string `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
@@ -89,6 +103,22 @@ type PeerStatus struct {
 	KeepAlive     bool
 	ExitNode      bool // true if this is the currently selected exit node.
 
+	// ExitNodeOption is whether this peer advertises both
+	// 0.0.0.0/0 and ::/0 and can thus be used as an exit node.
+	ExitNodeOption bool `json:",omitempty"`
+
+	// Online is whether the control server reports this peer as
+	// currently connected to it.
+	Online bool `json:",omitempty"`
+
+	// LatencySeconds, if non-zero, is the round trip time of the
+	// most recent disco ping on the direct path in CurAddr.
+	LatencySeconds float64 `json:",omitempty"`
+
+	// PathStats is the telemetry of the paths used to reach the
+	// peer, if it's been sent to.
+	PathStats *PeerPathStats `json:",omitempty"`
+
 	PeerAPIURL   []string
 	Capabilities []string `json:",omitempty"`
 
@@ -111,6 +141,54 @@ type PeerStatus struct {
 	InEngine bool
 }
 
+// PeerPathStats is the path telemetry of a peer: the path its packets
+// are sent on, the history of that, and per-path statistics.
+type PeerPathStats struct {
+	// CurPath is "direct", "derp" or "relay" (via a peer relay),
+	// or empty if there's no path.
+	CurPath string `json:",omitempty"`
+	// CurAddr is the current path's address: an ip:port if direct,
+	// "derp-N" for DERP region N, or "relay-N" for the Nth peer
+	// relay.
+	CurAddr string `json:",omitempty"`
+	// CurDERPRegion is the DERP region ID of the current path, if
+	// it's relayed.
+	CurDERPRegion int `json:",omitempty"`
+	// CurSince is when the current path started being used.
+	CurSince time.Time
+
+	// Relayed is the total time the peer has been reached via
+	// DERP, including the current path.
+	Relayed time.Duration
+
+	// Paths are the paths used, sorted by Addr.
+	Paths []*PathStats
+
+	// Changes are the recent path changes, oldest first.
+	Changes []PathChange `json:",omitempty"`
+}
+
+// PathStats is the statistics of one path to a peer.
+type PathStats struct {
+	Addr    string // ip:port, "derp-N" for DERP region N, or "relay-N" for a peer relay
+	TxBytes int64
+	RxBytes int64
+
+	// RTTSamples is the number of recent disco pong round trip
+	// times the RTT fields summarize. If zero, they're zero.
+	RTTSamples int
+	RTTMin     time.Duration `json:",omitempty"`
+	RTTAvg     time.Duration `json:",omitempty"`
+	RTTP95     time.Duration `json:",omitempty"`
+}
+
+// PathChange is a change of the path used to reach a peer.
+type PathChange struct {
+	At   time.Time
+	From string // previous PathStats.Addr, or empty if none
+	To   string // new PathStats.Addr
+}
+
 type StatusBuilder struct {
 	mu     sync.Mutex
 	locked bool
@@ -234,6 +312,9 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PeerRelay; v != "" {
+		e.PeerRelay = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -267,6 +348,21 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if st.ExitNode {
 		e.ExitNode = true
 	}
+	if v := st.RequestTags; v != nil {
+		e.RequestTags = v
+	}
+	if st.ExitNodeOption {
+		e.ExitNodeOption = true
+	}
+	if st.Online {
+		e.Online = true
+	}
+	if v := st.LatencySeconds; v != 0 {
+		e.LatencySeconds = v
+	}
+	if v := st.PathStats; v != nil {
+		e.PathStats = v
+	}
 	if st.ShareeNode {
 		e.ShareeNode = true
 	}
@@ -373,7 +469,9 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 		// TODO: let server report this active bool instead
 		active := !ps.LastWrite.IsZero() && time.Since(ps.LastWrite) < 2*time.Minute
 		if active {
-			if ps.Relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer relay <b>%s</b>", html.EscapeString(ps.PeerRelay))
+			} else if ps.Relay != "" && ps.CurAddr == "" {
 				f("relay <b>%s</b>", html.EscapeString(ps.Relay))
 			} else if ps.CurAddr != "" {
 				f("direct <b>%s</b>", html.EscapeString(ps.CurAddr))
@@ -431,6 +529,10 @@ type PingResult struct {
 	// It is not currently set for TSMP pings.
 	DERPRegionCode string
 
+	// PeerRelay is the name of the peer relay used, if the ping
+	// went via one.
+	PeerRelay string `json:",omitempty"`
+
 	// PeerAPIPort is set by TSMP ping responses for peers that
 	// are running a peerapi server. This is the port they're
 	// running the server on.
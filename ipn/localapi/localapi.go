@@ -6,8 +6,6 @@
 package localapi
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,12 +30,6 @@ import (
 	"tailscale.com/types/logger"
 )
 
-func randHex(n int) string {
-	b := make([]byte, n)
-	rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
 func NewHandler(b *ipnlocal.LocalBackend, logf logger.Logf, logID string) *Handler {
 	return &Handler{b: b, logf: logf, backendLogID: logID}
 }
@@ -57,6 +49,14 @@ type Handler struct {
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	backendLogID string
+
+	// viaToken is whether the request was authorized by a scoped
+	// LocalAPI bearer token rather than by the connection's identity.
+	viaToken bool
+
+	// prefsExitNodeOnly is whether prefs edits are limited to the
+	// exit node settings. It's only set for bearer token requests.
+	prefsExitNodeOnly bool
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -64,7 +64,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "server has no local backend", http.StatusInternalServerError)
 		return
 	}
-	if h.RequiredPassword != "" {
+	// A valid bearer token authenticates the request on its own, in
+	// place of RequiredPassword, as clients send one or the other.
+	if tok, ok := bearerToken(r); ok {
+		scopes, ok := h.b.LocalAPITokenScopes(tok)
+		if !ok {
+			http.Error(w, "invalid or revoked token", http.StatusUnauthorized)
+			return
+		}
+		h = h.withTokenScopes(scopes, r.URL.Path)
+	} else if h.RequiredPassword != "" {
 		_, pass, ok := r.BasicAuth()
 		if !ok {
 			http.Error(w, "auth required", http.StatusUnauthorized)
@@ -102,6 +111,28 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveFileTargets(w, r)
 	case "/localapi/v0/set-dns":
 		h.serveSetDNS(w, r)
+	case "/localapi/v0/watch-ipn-bus":
+		h.serveWatchIPNBus(w, r)
+	case "/localapi/v0/ping":
+		h.servePing(w, r)
+	case "/localapi/v0/netcheck":
+		h.serveNetcheck(w, r)
+	case "/localapi/v0/derpmap":
+		h.serveDERPMap(w, r)
+	case "/localapi/v0/tokens":
+		h.serveTokens(w, r)
+	case "/localapi/v0/peer-debug":
+		h.servePeerDebug(w, r)
+	case "/localapi/v0/dial":
+		h.serveDial(w, r)
+	case "/localapi/v0/debug-capture":
+		h.serveDebugCapture(w, r)
+	case "/localapi/v0/debug-magicsock":
+		h.serveDebugMagicsock(w, r)
+	case "/localapi/v0/debug-derp":
+		h.serveDebugDERP(w, r)
+	case "/localapi/v0/debug-filter":
+		h.serveDebugFilter(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -115,11 +146,7 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logMarker := fmt.Sprintf("BUG-%v-%v-%v", h.backendLogID, time.Now().UTC().Format("20060102150405Z"), randHex(8))
-	h.logf("user bugreport: %s", logMarker)
-	if note := r.FormValue("note"); len(note) > 0 {
-		h.logf("user bugreport note: %s", note)
-	}
+	logMarker := h.b.BugReportMarker(r.FormValue("note"))
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, logMarker)
 }
@@ -241,6 +268,10 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
+		if h.prefsExitNodeOnly && !onlyExitNodeEdits(mp) {
+			http.Error(w, "token only permits exit node changes", http.StatusForbidden)
+			return
+		}
 		var err error
 		prefs, err = h.b.EditPrefs(mp)
 		if err != nil {
@@ -403,6 +434,323 @@ func (h *Handler) serveSetDNS(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{}{})
 }
 
+// serveWatchIPNBus streams ipn.Notify messages as newline-delimited
+// JSON until the client goes away. The "mask" query parameter is an
+// ipn.NotifyWatchOpt bitmask selecting what to include. Watching the
+// netmap requires write access.
+func (h *Handler) serveWatchIPNBus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "watch ipn bus access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
+		return
+	}
+	var mask ipn.NotifyWatchOpt
+	if s := r.FormValue("mask"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "bad mask", 400)
+			return
+		}
+		mask = ipn.NotifyWatchOpt(v)
+	}
+	if mask&ipn.NotifyWatchNetMap != 0 && !h.PermitWrite {
+		http.Error(w, "watch netmap access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	h.b.WatchNotifications(r.Context(), mask, func(n *ipn.Notify) (keepGoing bool) {
+		if err := enc.Encode(n); err != nil {
+			// Typically the client went away.
+			return false
+		}
+		f.Flush()
+		return true
+	})
+}
+
+// serveDebugCapture streams a pcapng capture of tunnel traffic and
+// disco messages until the client goes away.
+func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "debug capture access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	if err := h.b.StreamDebugCapture(r.Context(), flushWriter{w, f}); err != nil {
+		h.logf("debug capture: %v", err)
+	}
+}
+
+// flushWriter is an io.Writer that flushes after every write.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (n int, err error) {
+	n, err = fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "ping access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	var useTSMP bool
+	switch r.FormValue("type") {
+	case "", "disco":
+	case "TSMP":
+		useTSMP = true
+	default:
+		http.Error(w, "unsupported ping 'type'", 400)
+		return
+	}
+	res, err := h.b.PingSync(r.Context(), ip, useTSMP)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) serveNetcheck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netcheck access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	report, err := h.b.NetcheckReport(r.Context(), defBool(r.FormValue("fresh"), false))
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(report)
+}
+
+func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "derpmap access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	dm := h.b.DERPMap()
+	if dm == nil {
+		http.Error(w, "no DERP map", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(dm)
+}
+
+func (h *Handler) serveDebugMagicsock(w http.ResponseWriter, r *http.Request) {
+	h.serveDebugState(w, r, "magicsock", func() (interface{}, error) {
+		return h.b.DebugMagicsock()
+	})
+}
+
+func (h *Handler) serveDebugDERP(w http.ResponseWriter, r *http.Request) {
+	h.serveDebugState(w, r, "DERP", func() (interface{}, error) {
+		return h.b.DebugDERPConns()
+	})
+}
+
+func (h *Handler) serveDebugFilter(w http.ResponseWriter, r *http.Request) {
+	h.serveDebugState(w, r, "filter", func() (interface{}, error) {
+		return h.b.DebugFilter()
+	})
+}
+
+// serveDebugState serves the JSON result of get, which returns
+// read-only internal state named by what, for the debug-* handlers.
+func (h *Handler) serveDebugState(w http.ResponseWriter, r *http.Request, what string, get func() (interface{}, error)) {
+	if !h.PermitRead {
+		http.Error(w, what+" debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	v, err := get()
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
+
+// dialUpgradeProto is the HTTP Upgrade protocol used by the dial
+// endpoint. After the 101 response, the connection carries the raw
+// bytes of the dialed TCP connection.
+const dialUpgradeProto = "ts-dial"
+
+// serveDial dials the TCP address in the Dial-Host and Dial-Port
+// request headers from tailscaled, via netstack if needed, and then
+// copies bytes between it and the upgraded LocalAPI connection.
+func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "dial access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Upgrade") != dialUpgradeProto || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+		http.Error(w, "bad "+dialUpgradeProto+" upgrade", http.StatusBadRequest)
+		return
+	}
+	host := r.Header.Get("Dial-Host")
+	port, err := strconv.ParseUint(r.Header.Get("Dial-Port"), 10, 16)
+	if host == "" || err != nil || port == 0 {
+		http.Error(w, "missing or invalid Dial-Host or Dial-Port", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "make request over HTTP/1", http.StatusBadRequest)
+		return
+	}
+
+	outConn, err := h.b.DialTCP(r.Context(), host, uint16(port))
+	if err != nil {
+		http.Error(w, "dial failure: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outConn.Close()
+
+	reqConn, brw, err := hj.Hijack()
+	if err != nil {
+		h.logf("dial: Hijack: %v", err)
+		return
+	}
+	defer reqConn.Close()
+	fmt.Fprintf(reqConn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: upgrade\r\n\r\n", dialUpgradeProto)
+
+	// Copy each direction until EOF, then half-close its destination,
+	// so that either side can finish sending after the other is done.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(reqConn, outConn)
+		closeWrite(reqConn)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(outConn, brw.Reader)
+		closeWrite(outConn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite shuts down the writing side of c, or closes c entirely if
+// it can't be half-closed.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// servePeerDebug proxies a request for remote diagnostics ("status",
+// "netcheck", "health" or "bugreport") to the peer API of another node
+// owned by the same user.
+func (h *Handler) servePeerDebug(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "peer debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	method := "GET"
+	what := r.FormValue("what")
+	switch what {
+	case "status", "netcheck", "health":
+	case "bugreport":
+		method = "POST"
+	default:
+		http.Error(w, "invalid 'what' parameter", 400)
+		return
+	}
+	base, err := h.b.PeerAPIURL(ip)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	dstURL, err := url.Parse(base)
+	if err != nil {
+		http.Error(w, "bogus peer URL", 500)
+		return
+	}
+	outReq, err := http.NewRequestWithContext(r.Context(), method, "http://peer/v0/debug/"+what+"?note="+url.QueryEscape(r.FormValue("note")), nil)
+	if err != nil {
+		http.Error(w, "bogus outreq", 500)
+		return
+	}
+	rp := httputil.NewSingleHostReverseProxy(dstURL)
+	rp.Transport = getDialPeerTransport(h.b)
+	rp.ServeHTTP(w, outReq)
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/persist"
+	"tailscale.com/types/wgkey"
+)
+
+func TestNetworkDiagHandlers(t *testing.T) {
+	b := newTestBackend(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		noRead     bool
+		wantStatus int
+	}{
+		{name: "ping_denied", method: "POST", path: "/localapi/v0/ping?ip=100.64.0.1", noRead: true, wantStatus: http.StatusForbidden},
+		{name: "netcheck_denied", method: "GET", path: "/localapi/v0/netcheck", noRead: true, wantStatus: http.StatusForbidden},
+		{name: "derpmap_denied", method: "GET", path: "/localapi/v0/derpmap", noRead: true, wantStatus: http.StatusForbidden},
+		{name: "ping_get", method: "GET", path: "/localapi/v0/ping?ip=100.64.0.1", wantStatus: http.StatusBadRequest},
+		{name: "ping_no_ip", method: "POST", path: "/localapi/v0/ping", wantStatus: http.StatusBadRequest},
+		{name: "ping_bad_ip", method: "POST", path: "/localapi/v0/ping?ip=foo", wantStatus: http.StatusBadRequest},
+		{name: "ping_bad_type", method: "POST", path: "/localapi/v0/ping?ip=100.64.0.1&type=icmp", wantStatus: http.StatusBadRequest},
+		{name: "netcheck_post", method: "POST", path: "/localapi/v0/netcheck", wantStatus: http.StatusBadRequest},
+		{name: "derpmap_post", method: "POST", path: "/localapi/v0/derpmap", wantStatus: http.StatusBadRequest},
+		{name: "derpmap_no_netmap", method: "GET", path: "/localapi/v0/derpmap", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(b, t.Logf, "logid")
+			h.PermitRead = !tt.noRead
+			req := httptest.NewRequest(tt.method, "http://local-tailscaled.sock"+tt.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestServePingJSON(t *testing.T) {
+	b := newTestBackend(t)
+	h := NewHandler(b, t.Logf, "logid")
+	h.PermitRead = true
+
+	req := httptest.NewRequest("POST", "http://local-tailscaled.sock/localapi/v0/ping?ip=100.64.0.1&type=disco", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v; want 200; body: %s", rec.Code, rec.Body.Bytes())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q; want application/json", ct)
+	}
+	var res ipnstate.PingResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body.Bytes(), err)
+	}
+	if res.IP != "100.64.0.1" {
+		t.Errorf("IP = %q; want 100.64.0.1", res.IP)
+	}
+	// With no netmap there are no peers to ping.
+	if res.Err == "" {
+		t.Errorf("Err is empty; want a no-peer error in %s", rec.Body.Bytes())
+	}
+}
+
+func TestServeNetcheckJSON(t *testing.T) {
+	b := newTestBackend(t)
+	h := NewHandler(b, t.Logf, "logid")
+	h.PermitRead = true
+
+	req := httptest.NewRequest("GET", "http://local-tailscaled.sock/localapi/v0/netcheck?fresh=false", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q; want application/json", ct)
+	}
+	// magicsock may or may not have a report yet; either way the
+	// body must be JSON, and an error must carry an "error" field.
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body.Bytes(), err)
+	}
+	switch rec.Code {
+	case http.StatusOK:
+		if _, ok := got["UDP"]; !ok {
+			t.Errorf("report missing UDP field: %s", rec.Body.Bytes())
+		}
+	case http.StatusInternalServerError:
+		if msg, _ := got["error"].(string); msg == "" {
+			t.Errorf("error body missing message: %s", rec.Body.Bytes())
+		}
+	default:
+		t.Errorf("status = %v; want 200 or 500; body: %s", rec.Code, rec.Body.Bytes())
+	}
+}
+
+func TestWatchIPNBusNoPrivateKeys(t *testing.T) {
+	b := newTestBackend(t)
+	b.SetControlClientGetterForTesting(func(controlclient.Options) (controlclient.Client, error) {
+		return nil, errors.New("no control client in test")
+	})
+	k, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs := ipn.NewPrefs()
+	prefs.WantRunning = false
+	prefs.Persist = &persist.Persist{
+		PrivateNodeKey:                  k,
+		OldPrivateNodeKey:               k,
+		LegacyFrontendPrivateMachineKey: k,
+		LoginName:                       "alice@example.com",
+	}
+	// Start fails for lack of a control client, but only after
+	// loading prefs, which is all this test needs.
+	b.Start(ipn.Options{Prefs: prefs})
+
+	h := NewHandler(b, t.Logf, "logid")
+	h.PermitRead = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	watch := func(mask ipn.NotifyWatchOpt) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/localapi/v0/watch-ipn-bus?mask=%d", ts.URL, mask), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := watch(ipn.NotifyWatchNetMap)
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("read-only netmap watch: status = %v; want 403", res.StatusCode)
+	}
+
+	res = watch(ipn.NotifyInitialState | ipn.NotifyWatchPrefs)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v; want 200", res.StatusCode)
+	}
+	br := bufio.NewReader(res.Body)
+	readPrefs := func(what string) {
+		t.Helper()
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", what, err)
+			}
+			if strings.Contains(line, "privkey:") || strings.Contains(line, k.HexString()) {
+				t.Fatalf("%s: private key in IPN bus message: %s", what, line)
+			}
+			var n ipn.Notify
+			if err := json.Unmarshal([]byte(line), &n); err != nil {
+				t.Fatalf("%s: %v", what, err)
+			}
+			if n.Prefs != nil {
+				return
+			}
+		}
+	}
+	readPrefs("initial state")
+
+	// Changing prefs fans the new prefs out to watchers.
+	newPrefs := ipn.NewPrefs()
+	newPrefs.WantRunning = false
+	newPrefs.ShieldsUp = true
+	b.SetPrefs(newPrefs)
+	readPrefs("prefs update")
+
+	if p := b.Prefs(); p.Persist == nil || !p.Persist.PrivateNodeKey.IsZero() {
+		t.Errorf("Prefs().Persist = %v; want non-nil with keys stripped", p.Persist)
+	}
+}
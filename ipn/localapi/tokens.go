@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+)
+
+// bearerToken returns the LocalAPI token from r's Authorization
+// header, if any.
+func bearerToken(r *http.Request) (tok string, ok bool) {
+	const prefix = "Bearer "
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, prefix) {
+		return "", false
+	}
+	tok = strings.TrimSpace(v[len(prefix):])
+	return tok, tok != ""
+}
+
+// withTokenScopes returns a copy of h whose permissions are those
+// granted by scopes for a request to the given LocalAPI path,
+// regardless of the connection's identity.
+func (h *Handler) withTokenScopes(scopes []apitype.LocalAPIScope, path string) *Handler {
+	h2 := &Handler{
+		RequiredPassword: h.RequiredPassword,
+		b:                h.b,
+		logf:             h.logf,
+		backendLogID:     h.backendLogID,
+		viaToken:         true,
+	}
+	var prefsAll, prefsExitNode bool
+	for _, s := range scopes {
+		switch s {
+		case apitype.ScopeRead:
+			h2.PermitRead = true
+		case apitype.ScopeWrite:
+			h2.PermitRead, h2.PermitWrite = true, true
+			prefsAll = true
+		case apitype.ScopeStatusRead:
+			if path == "/localapi/v0/status" || path == "/localapi/v0/whois" {
+				h2.PermitRead = true
+			}
+		case apitype.ScopeFileSend:
+			if path == "/localapi/v0/file-targets" || strings.HasPrefix(path, "/localapi/v0/file-put/") {
+				h2.PermitRead, h2.PermitWrite = true, true
+			}
+		case apitype.ScopeFileReceive:
+			if strings.HasPrefix(path, "/localapi/v0/files/") {
+				h2.PermitRead, h2.PermitWrite = true, true
+			}
+		case apitype.ScopePrefsWrite:
+			if path == "/localapi/v0/prefs" {
+				h2.PermitRead, h2.PermitWrite = true, true
+				prefsAll = true
+			}
+		case apitype.ScopePrefsWriteExitNode:
+			if path == "/localapi/v0/prefs" {
+				h2.PermitRead, h2.PermitWrite = true, true
+				prefsExitNode = true
+			}
+		}
+	}
+	h2.prefsExitNodeOnly = prefsExitNode && !prefsAll
+	return h2
+}
+
+// onlyExitNodeEdits reports whether mp edits nothing but the exit
+// node preferences.
+func onlyExitNodeEdits(mp *ipn.MaskedPrefs) bool {
+	for _, f := range mp.SetFieldNames() {
+		switch f {
+		case "ExitNodeID", "ExitNodeIP", "ExitNodeAllowLANAccess":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// serveTokens manages scoped LocalAPI bearer tokens.
+//
+// GET lists the tokens (without their secrets), POST creates one from
+// a JSON apitype.LocalAPIToken body (only Name and Scopes are used),
+// and DELETE revokes the one given by the "id" parameter.
+func (h *Handler) serveTokens(w http.ResponseWriter, r *http.Request) {
+	// Tokens can't be used to manage tokens, even those with
+	// ScopeWrite, so a leaked token can't be escalated or used to
+	// revoke others.
+	if !h.PermitWrite || h.viaToken {
+		http.Error(w, "token access denied", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		toks, err := h.b.LocalAPITokens()
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		makeNonNil(&toks)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toks)
+	case "POST":
+		var req apitype.LocalAPIToken
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		tok, err := h.b.CreateLocalAPIToken(req.Name, req.Scopes)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tok)
+	case "DELETE":
+		if err := h.b.RevokeLocalAPIToken(r.FormValue("id")); err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/wgengine"
+)
+
+func newTestBackend(t *testing.T) *ipnlocal.LocalBackend {
+	t.Helper()
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	b, err := ipnlocal.NewLocalBackend(t.Logf, "logid", new(ipn.MemoryStore), e)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	t.Cleanup(b.Shutdown)
+	return b
+}
+
+func TestWithTokenScopes(t *testing.T) {
+	tests := []struct {
+		name         string
+		scopes       []apitype.LocalAPIScope
+		path         string
+		wantRead     bool
+		wantWrite    bool
+		wantExitOnly bool
+	}{
+		{
+			name:     "status_read",
+			scopes:   []apitype.LocalAPIScope{apitype.ScopeStatusRead},
+			path:     "/localapi/v0/status",
+			wantRead: true,
+		},
+		{
+			name:   "status_read_not_prefs",
+			scopes: []apitype.LocalAPIScope{apitype.ScopeStatusRead},
+			path:   "/localapi/v0/prefs",
+		},
+		{
+			name:      "file_send",
+			scopes:    []apitype.LocalAPIScope{apitype.ScopeFileSend},
+			path:      "/localapi/v0/file-put/nodeid/foo.txt",
+			wantRead:  true,
+			wantWrite: true,
+		},
+		{
+			name:   "file_send_not_receive",
+			scopes: []apitype.LocalAPIScope{apitype.ScopeFileSend},
+			path:   "/localapi/v0/files/foo.txt",
+		},
+		{
+			name:         "exit_node_only",
+			scopes:       []apitype.LocalAPIScope{apitype.ScopePrefsWriteExitNode},
+			path:         "/localapi/v0/prefs",
+			wantRead:     true,
+			wantWrite:    true,
+			wantExitOnly: true,
+		},
+		{
+			name:      "exit_node_and_full_prefs",
+			scopes:    []apitype.LocalAPIScope{apitype.ScopePrefsWriteExitNode, apitype.ScopePrefsWrite},
+			path:      "/localapi/v0/prefs",
+			wantRead:  true,
+			wantWrite: true,
+		},
+		{
+			name:     "read_all",
+			scopes:   []apitype.LocalAPIScope{apitype.ScopeRead},
+			path:     "/localapi/v0/prefs",
+			wantRead: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := (&Handler{PermitRead: true, PermitWrite: true}).withTokenScopes(tt.scopes, tt.path)
+			if h.PermitRead != tt.wantRead || h.PermitWrite != tt.wantWrite || h.prefsExitNodeOnly != tt.wantExitOnly {
+				t.Errorf("read, write, exitOnly = %v, %v, %v; want %v, %v, %v",
+					h.PermitRead, h.PermitWrite, h.prefsExitNodeOnly,
+					tt.wantRead, tt.wantWrite, tt.wantExitOnly)
+			}
+			if !h.viaToken {
+				t.Error("viaToken not set")
+			}
+		})
+	}
+}
+
+func TestOnlyExitNodeEdits(t *testing.T) {
+	if !onlyExitNodeEdits(&ipn.MaskedPrefs{ExitNodeIDSet: true, ExitNodeIPSet: true}) {
+		t.Error("exit node edit rejected")
+	}
+	if onlyExitNodeEdits(&ipn.MaskedPrefs{ExitNodeIDSet: true, ShieldsUpSet: true}) {
+		t.Error("shields up edit accepted")
+	}
+}
+
+func TestTokenWithRequiredPassword(t *testing.T) {
+	b := newTestBackend(t)
+	tok, err := b.CreateLocalAPIToken("monitoring", []apitype.LocalAPIScope{apitype.ScopeStatusRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(b, t.Logf, "logid")
+	h.RequiredPassword = "secret"
+	h.PermitRead = true
+
+	tests := []struct {
+		name       string
+		path       string
+		bearer     string
+		password   string
+		wantStatus int
+	}{
+		{name: "no_auth", path: "/localapi/v0/status", wantStatus: http.StatusUnauthorized},
+		{name: "bad_password", path: "/localapi/v0/status", password: "wrong", wantStatus: http.StatusForbidden},
+		{name: "password", path: "/localapi/v0/status", password: "secret", wantStatus: http.StatusOK},
+		{name: "token", path: "/localapi/v0/status", bearer: tok.Token, wantStatus: http.StatusOK},
+		{name: "token_out_of_scope", path: "/localapi/v0/prefs", bearer: tok.Token, wantStatus: http.StatusForbidden},
+		{name: "bad_token", path: "/localapi/v0/status", bearer: tok.Token + "x", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://local-tailscaled.sock"+tt.path, nil)
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			} else if tt.password != "" {
+				req.SetBasicAuth("", tt.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+		})
+	}
+}
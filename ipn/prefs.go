@@ -117,6 +117,12 @@ type Prefs struct {
 	// tag.
 	AdvertiseTags []string
 
+	// AdvertisePeerRelay specifies whether this node offers to
+	// relay UDP between peers that can't reach each other
+	// directly, as a nearer alternative to DERP. It's advertised to
+	// peers as tailcfg.Hostinfo.PeerRelay.
+	AdvertisePeerRelay bool
+
 	// Hostname is the hostname to use for identifying the node. If
 	// not set, os.Hostname is used.
 	Hostname string
@@ -197,6 +203,7 @@ type MaskedPrefs struct {
 	LoggedOutSet              bool `json:",omitempty"`
 	ShieldsUpSet              bool `json:",omitempty"`
 	AdvertiseTagsSet          bool `json:",omitempty"`
+	AdvertisePeerRelaySet     bool `json:",omitempty"`
 	HostnameSet               bool `json:",omitempty"`
 	OSVersionSet              bool `json:",omitempty"`
 	DeviceModelSet            bool `json:",omitempty"`
@@ -226,6 +233,20 @@ func (p *Prefs) ApplyEdits(m *MaskedPrefs) {
 	}
 }
 
+// SetFieldNames returns the names of the Prefs fields that m edits
+// (those whose corresponding "Set" field is true), in struct order.
+func (m *MaskedPrefs) SetFieldNames() []string {
+	var names []string
+	mv := reflect.ValueOf(m).Elem()
+	mt := mv.Type()
+	for i := 1; i < mt.NumField(); i++ {
+		if mv.Field(i).Bool() {
+			names = append(names, strings.TrimSuffix(mt.Field(i).Name, "Set"))
+		}
+	}
+	return names
+}
+
 func (m *MaskedPrefs) Pretty() string {
 	if m == nil {
 		return "MaskedPrefs{<nil>}"
@@ -290,6 +311,9 @@ func (p *Prefs) pretty(goos string) string {
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
+	if p.AdvertisePeerRelay {
+		sb.WriteString("relay=true ")
+	}
 	if goos == "linux" {
 		fmt.Fprintf(&sb, "nf=%v ", p.NetfilterMode)
 	}
@@ -339,6 +363,7 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.LoggedOut == p2.LoggedOut &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
+		p.AdvertisePeerRelay == p2.AdvertisePeerRelay &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
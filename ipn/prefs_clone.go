@@ -44,6 +44,7 @@ var _PrefsNeedsRegeneration = Prefs(struct {
 	LoggedOut              bool
 	ShieldsUp              bool
 	AdvertiseTags          []string
+	AdvertisePeerRelay     bool
 	Hostname               string
 	OSVersion              string
 	DeviceModel            string
@@ -45,6 +45,7 @@ func TestPrefsEqual(t *testing.T) {
 		"LoggedOut",
 		"ShieldsUp",
 		"AdvertiseTags",
+		"AdvertisePeerRelay",
 		"Hostname",
 		"OSVersion",
 		"DeviceModel",
@@ -223,6 +224,17 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{AdvertisePeerRelay: true},
+			&Prefs{AdvertisePeerRelay: false},
+			false,
+		},
+		{
+			&Prefs{AdvertisePeerRelay: true},
+			&Prefs{AdvertisePeerRelay: true},
+			true,
+		},
+
 		{
 			&Prefs{AdvertiseRoutes: nil},
 			&Prefs{AdvertiseRoutes: []netaddr.IPPrefix{}},
@@ -364,6 +376,11 @@ func TestPrefsPretty(t *testing.T) {
 			"windows",
 			"Prefs{ra=false mesh=false dns=false want=false shields=true Persist=nil}",
 		},
+		{
+			Prefs{AdvertisePeerRelay: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false relay=true Persist=nil}",
+		},
 		{
 			Prefs{AllowSingleHosts: true},
 			"windows",
@@ -632,3 +649,18 @@ func TestMaskedPrefsPretty(t *testing.T) {
 		}
 	}
 }
+
+func TestMaskedPrefsSetFieldNames(t *testing.T) {
+	m := &MaskedPrefs{
+		ExitNodeIPSet: true,
+		HostnameSet:   true,
+	}
+	got := m.SetFieldNames()
+	want := []string{"ExitNodeIP", "Hostname"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := new(MaskedPrefs).SetFieldNames(); len(got) != 0 {
+		t.Errorf("empty MaskedPrefs: got %q; want none", got)
+	}
+}
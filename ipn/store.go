@@ -44,6 +44,11 @@ const (
 	// the server should start with the Prefs JSON loaded from
 	// StateKey "user-1234".
 	ServerModeStartKey = StateKey("server-mode-start-key")
+
+	// LocalAPITokensStateKey is the key under which we store the
+	// JSON list of scoped LocalAPI bearer tokens (with only hashes
+	// of their secrets).
+	LocalAPITokensStateKey = StateKey("_localapi-tokens")
 )
 
 // StateStore persists state, and produces it back on request.
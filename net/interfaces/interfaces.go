@@ -499,6 +499,34 @@ func LikelyHomeRouterIP() (gateway, myIP netaddr.IP, ok bool) {
 	return gateway, myIP, !myIP.IsZero()
 }
 
+var likelyHomeRouterIPv6 func() (gw netaddr.IP, ifName string, ok bool)
+
+// LikelyHomeRouterIPv6 returns the likely IPv6 address of the
+// residential router, which is usually link-local and then includes
+// the zone of the interface it's reached on. It also returns a global
+// IPv6 address of the current machine on that interface.
+// This is used as the destination for PCP requests opening IPv6
+// firewall pinholes.
+func LikelyHomeRouterIPv6() (gateway, myIP netaddr.IP, ok bool) {
+	if likelyHomeRouterIPv6 == nil {
+		return
+	}
+	gateway, ifName, ok := likelyHomeRouterIPv6()
+	if !ok {
+		return
+	}
+	ForeachInterfaceAddress(func(i Interface, pfx netaddr.IPPrefix) {
+		ip := pfx.IP()
+		if i.Name != ifName || !i.IsUp() || !myIP.IsZero() {
+			return
+		}
+		if ip.Is6() && isGlobalV6(ip) {
+			myIP = ip
+		}
+	})
+	return gateway, myIP, !myIP.IsZero()
+}
+
 func isPrivateIP(ip netaddr.IP) bool {
 	return private1.Contains(ip) || private2.Contains(ip) || private3.Contains(ip)
 }
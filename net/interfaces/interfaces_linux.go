@@ -7,6 +7,7 @@ package interfaces
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ import (
 
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPLinux
+	likelyHomeRouterIPv6 = likelyHomeRouterIPv6Linux
 }
 
 var procNetRouteErr syncs.AtomicBool
@@ -87,6 +89,56 @@ func likelyHomeRouterIPLinux() (ret netaddr.IP, ok bool) {
 	return ret, !ret.IsZero()
 }
 
+var procNetIPv6RoutePath = "/proc/net/ipv6_route"
+
+/*
+Parse fe80::1%eth0 out of:
+
+$ cat /proc/net/ipv6_route
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+*/
+func likelyHomeRouterIPv6Linux() (ret netaddr.IP, ifName string, ok bool) {
+	var f []mem.RO
+	lineread.File(procNetIPv6RoutePath, func(line []byte) error {
+		if !ret.IsZero() {
+			return nil
+		}
+		f = mem.AppendFields(f[:0], mem.B(line))
+		if len(f) < 10 {
+			return nil
+		}
+		dst, dstLen, nextHop, flagsHex, ifc := f[0], f[1], f[4], f[8], f[9]
+		if !dst.EqualString("00000000000000000000000000000000") || !dstLen.EqualString("00") {
+			return nil
+		}
+		flags, err := mem.ParseUint(flagsHex, 16, 32)
+		if err != nil {
+			return nil // ignore error, skip line and keep going
+		}
+		const RTF_UP = 0x0001
+		const RTF_GATEWAY = 0x0002
+		if flags&(RTF_UP|RTF_GATEWAY) != RTF_UP|RTF_GATEWAY {
+			return nil
+		}
+		name := ifc.StringCopy()
+		if name == "lo" || strings.HasPrefix(name, "tailscale") {
+			return nil
+		}
+		var ip16 [16]byte
+		if n, err := hex.Decode(ip16[:], []byte(nextHop.StringCopy())); err != nil || n != 16 {
+			return nil
+		}
+		ip := netaddr.IPFrom16(ip16)
+		if ip.IsLinkLocalUnicast() {
+			ip = ip.WithZone(name)
+		}
+		ret, ifName = ip, name
+		return nil
+	})
+	return ret, ifName, !ret.IsZero()
+}
+
 // Android apps don't have permission to read /proc/net/route, at
 // least on Google devices and the Android emulator.
 func likelyHomeRouterIPAndroid() (ret netaddr.IP, ok bool) {
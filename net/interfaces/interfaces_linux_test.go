@@ -81,3 +81,24 @@ func BenchmarkDefaultRouteInterface(b *testing.B) {
 		}
 	}
 }
+
+func TestLikelyHomeRouterIPv6Linux(t *testing.T) {
+	dir := t.TempDir()
+	saved := procNetIPv6RoutePath
+	defer func() { procNetIPv6RoutePath = saved }()
+	procNetIPv6RoutePath = filepath.Join(dir, "ipv6_route")
+	buf := []byte("" +
+		"20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0\n")
+	if err := ioutil.WriteFile(procNetIPv6RoutePath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gw, ifName, ok := likelyHomeRouterIPv6Linux()
+	if !ok {
+		t.Fatal("no router found")
+	}
+	if gw.String() != "fe80::1%eth0" || ifName != "eth0" {
+		t.Errorf("got %v, %q; want fe80::1%%eth0, eth0", gw, ifName)
+	}
+}
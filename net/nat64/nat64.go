@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nat64 handles IPv4-embedded IPv6 addresses, as used by
+// NAT64 (RFC 6146) and DNS64 (RFC 6147) on IPv6-only networks.
+package nat64
+
+import (
+	"inet.af/netaddr"
+)
+
+// IPv4OnlyARPA is the name whose AAAA records reveal the NAT64
+// prefix a DNS64 resolver synthesizes addresses with. It only has
+// A records, for the WellKnownIPv4s.
+//
+// See RFC 7050.
+const IPv4OnlyARPA = "ipv4only.arpa"
+
+// WellKnownIPv4s are the IPv4 addresses of IPv4OnlyARPA.
+var WellKnownIPv4s = []netaddr.IP{
+	netaddr.IPv4(192, 0, 0, 170),
+	netaddr.IPv4(192, 0, 0, 171),
+}
+
+// ValidPrefix reports whether pfx is usable as a NAT64 prefix: an
+// IPv6 prefix of one of the lengths RFC 6052 allows.
+func ValidPrefix(pfx netaddr.IPPrefix) bool {
+	if !pfx.IP().Is6() {
+		return false
+	}
+	switch pfx.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// nonGlobalIPv4 are the IPv4 ranges that aren't globally routable,
+// from the IANA IPv4 Special-Purpose Address Registry (RFC 6890).
+var nonGlobalIPv4 = []netaddr.IPPrefix{
+	netaddr.MustParseIPPrefix("0.0.0.0/8"),
+	netaddr.MustParseIPPrefix("10.0.0.0/8"),
+	netaddr.MustParseIPPrefix("100.64.0.0/10"), // CGNAT, including Tailscale IPs
+	netaddr.MustParseIPPrefix("127.0.0.0/8"),
+	netaddr.MustParseIPPrefix("169.254.0.0/16"),
+	netaddr.MustParseIPPrefix("172.16.0.0/12"),
+	netaddr.MustParseIPPrefix("192.0.0.0/24"),
+	netaddr.MustParseIPPrefix("192.0.2.0/24"),
+	netaddr.MustParseIPPrefix("192.168.0.0/16"),
+	netaddr.MustParseIPPrefix("198.18.0.0/15"),
+	netaddr.MustParseIPPrefix("198.51.100.0/24"),
+	netaddr.MustParseIPPrefix("203.0.113.0/24"),
+	netaddr.MustParseIPPrefix("224.0.0.0/4"),
+	netaddr.MustParseIPPrefix("240.0.0.0/4"),
+}
+
+// IsGlobalIPv4 reports whether ip is a globally routable IPv4
+// address, and so one a NAT64 can reach. Private, shared (CGNAT),
+// link-local and other special-purpose addresses are on the local
+// side of the NAT64, if anywhere, and must not be translated.
+//
+// See RFC 6052 section 3.1.
+func IsGlobalIPv4(ip netaddr.IP) bool {
+	if !ip.Is4() {
+		return false
+	}
+	for _, pfx := range nonGlobalIPv4 {
+		if pfx.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Synthesize returns the IPv6 address representing ip4 under NAT64
+// prefix pfx, per RFC 6052 section 2.2.
+// It returns the zero IP if pfx isn't valid or ip4 isn't IPv4.
+func Synthesize(pfx netaddr.IPPrefix, ip4 netaddr.IP) netaddr.IP {
+	if !ValidPrefix(pfx) || !ip4.Is4() {
+		return netaddr.IP{}
+	}
+	a := pfx.Masked().IP().As16()
+	i := pfx.Bits() / 8
+	for _, b := range ip4.As4() {
+		if i == 8 {
+			i++ // bits 64 to 71 (the "u" octet) must be zero
+		}
+		a[i] = b
+		i++
+	}
+	return netaddr.IPFrom16(a)
+}
+
+// Extract returns the IPv4 address embedded in ip6 under NAT64
+// prefix pfx. It reports false if ip6 isn't in pfx.
+func Extract(pfx netaddr.IPPrefix, ip6 netaddr.IP) (ip4 netaddr.IP, ok bool) {
+	if !ValidPrefix(pfx) || !ip6.Is6() || !pfx.Contains(ip6) {
+		return netaddr.IP{}, false
+	}
+	a := ip6.As16()
+	if pfx.Bits() != 96 && a[8] != 0 {
+		return netaddr.IP{}, false
+	}
+	var b [4]byte
+	i := pfx.Bits() / 8
+	for j := range b {
+		if i == 8 {
+			i++
+		}
+		b[j] = a[i]
+		i++
+	}
+	return netaddr.IPv4(b[0], b[1], b[2], b[3]), true
+}
+
+// PrefixFromAddrs returns the NAT64 prefix that synthesized addrs, the
+// IPv6 addresses of IPv4OnlyARPA, or the zero prefix if there's none.
+//
+// See RFC 7050 section 3.
+func PrefixFromAddrs(addrs []netaddr.IP) netaddr.IPPrefix {
+	for _, ip := range addrs {
+		if !ip.Is6() || ip.Is4in6() {
+			continue
+		}
+		// Longest first: the well-known prefix, 64:ff9b::/96,
+		// is the common case.
+		for _, bits := range []uint8{96, 64, 56, 48, 40, 32} {
+			pfx := netaddr.IPPrefixFrom(ip, bits).Masked()
+			ip4, ok := Extract(pfx, ip)
+			if !ok {
+				continue
+			}
+			for _, wka := range WellKnownIPv4s {
+				if ip4 == wka {
+					return pfx
+				}
+			}
+		}
+	}
+	return netaddr.IPPrefix{}
+}
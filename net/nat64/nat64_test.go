@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat64
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestSynthesizeAndExtract(t *testing.T) {
+	// Examples from RFC 6052 section 2.4.
+	ip4 := netaddr.MustParseIP("192.0.2.33")
+	tests := []struct {
+		pfx  string
+		want string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	}
+	for _, tt := range tests {
+		pfx := netaddr.MustParseIPPrefix(tt.pfx)
+		got := Synthesize(pfx, ip4)
+		if want := netaddr.MustParseIP(tt.want); got != want {
+			t.Errorf("Synthesize(%v, %v) = %v; want %v", pfx, ip4, got, want)
+		}
+		back, ok := Extract(pfx, got)
+		if !ok || back != ip4 {
+			t.Errorf("Extract(%v, %v) = %v, %v; want %v, true", pfx, got, back, ok, ip4)
+		}
+	}
+}
+
+func TestSynthesizeInvalid(t *testing.T) {
+	if got := Synthesize(netaddr.MustParseIPPrefix("64:ff9b::/80"), netaddr.MustParseIP("192.0.2.33")); !got.IsZero() {
+		t.Errorf("invalid prefix length: got %v; want zero", got)
+	}
+	if got := Synthesize(netaddr.MustParseIPPrefix("64:ff9b::/96"), netaddr.MustParseIP("2001:db8::1")); !got.IsZero() {
+		t.Errorf("IPv6 input: got %v; want zero", got)
+	}
+	if _, ok := Extract(netaddr.MustParseIPPrefix("64:ff9b::/96"), netaddr.MustParseIP("2001:db8::1")); ok {
+		t.Error("Extract of address outside prefix succeeded")
+	}
+}
+
+func TestIsGlobalIPv4(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"1.2.3.4", true},
+		{"100.63.255.255", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.100.100.100", false},
+		{"169.254.1.1", false},
+		{"127.0.0.1", false},
+		{"192.0.2.33", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := IsGlobalIPv4(netaddr.MustParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsGlobalIPv4(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixFromAddrs(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []string
+		want  string
+	}{
+		{"none", nil, ""},
+		{"ipv4_only", []string{"192.0.0.170", "192.0.0.171"}, ""},
+		{"not_wka", []string{"64:ff9b::1.2.3.4"}, ""},
+		{"well_known", []string{"64:ff9b::192.0.0.170", "64:ff9b::192.0.0.171"}, "64:ff9b::/96"},
+		{"network_specific_96", []string{"2001:db8:1:2::c000:ab"}, "2001:db8:1:2::/96"},
+		{"network_specific_64", []string{"2001:db8:1:2:c0:0:aa00:0"}, "2001:db8:1:2::/64"},
+		{"network_specific_32", []string{"2001:db8:c000:aa::"}, "2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []netaddr.IP
+			for _, s := range tt.addrs {
+				addrs = append(addrs, netaddr.MustParseIP(s))
+			}
+			got := PrefixFromAddrs(addrs)
+			var want netaddr.IPPrefix
+			if tt.want != "" {
+				want = netaddr.MustParseIPPrefix(tt.want)
+			}
+			if got != want {
+				t.Errorf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netcheck
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/tailcfg"
+)
+
+// captivePortalTimeout is how long the captive portal check waits for
+// a DERP server to answer.
+const captivePortalTimeout = 2 * time.Second
+
+// httpProbeNode returns a DERP node (not a STUN-only one) to use for
+// the captive portal and proxy checks, preferring one in the region
+// with ID preferredRegion. It returns nil if there's none.
+func httpProbeNode(dm *tailcfg.DERPMap, preferredRegion int) *tailcfg.DERPNode {
+	rids := dm.RegionIDs()
+	if dm.Regions[preferredRegion] != nil {
+		rids = append([]int{preferredRegion}, rids...)
+	}
+	for _, rid := range rids {
+		reg := dm.Regions[rid]
+		if reg == nil {
+			continue
+		}
+		for _, n := range reg.Nodes {
+			// Skip test nodes, which only speak TLS on their
+			// test port.
+			if !n.STUNOnly && n.DERPTestPort == 0 && n.HostName != "" {
+				return n
+			}
+		}
+	}
+	return nil
+}
+
+// usesHTTPSProxy reports whether connections to the DERP node n would
+// go through an HTTPS proxy.
+func usesHTTPSProxy(n *tailcfg.DERPNode) bool {
+	req := &http.Request{
+		Method: "GET",
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   n.HostName,
+			Path:   "/",
+		},
+	}
+	proxyURL, err := tshttpproxy.ProxyFromEnvironment(req)
+	return err == nil && proxyURL != nil
+}
+
+// checkCaptivePortal reports whether a captive portal appears to be
+// intercepting plain HTTP requests to the DERP node n.
+func (c *Client) checkCaptivePortal(ctx context.Context, n *tailcfg.DERPNode) (found bool, err error) {
+	return c.checkCaptivePortalURL(ctx, "http://"+n.HostName+"/generate_204")
+}
+
+// errCaptiveCheckUnsupported is returned by checkCaptivePortalURL when
+// the DERP server doesn't serve the endpoint the check needs.
+var errCaptiveCheckUnsupported = errors.New("DERP server redirects to HTTPS; can't check for captive portal")
+
+// checkCaptivePortalURL fetches u, which must be served by
+// derphttp.ServeNoContent, and reports whether the response was
+// anything else.
+func (c *Client) checkCaptivePortalURL(ctx context.Context, u string) (found bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, captivePortalTimeout)
+	defer cancel()
+
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		return false, err
+	}
+	challenge := "ts_" + hex.EncodeToString(buf[:])
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(derphttp.NoContentChallengeHeader, challenge)
+
+	// Don't use a proxy: it's the path without one that a captive
+	// portal intercepts. And don't follow redirects: a redirect is
+	// what most portals answer with.
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       netns.NewDialer().DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	if isHTTPSUpgrade(req, res) {
+		// DERP servers predating ServeNoContent on port 80 send
+		// everything there to HTTPS, so the check can't tell
+		// anything from them.
+		return false, errCaptiveCheckUnsupported
+	}
+	ok := res.StatusCode == http.StatusNoContent &&
+		res.Header.Get(derphttp.NoContentResponseHeader) == "response "+challenge
+	if !ok {
+		c.vlogf("captive portal check: got status %v from %v", res.Status, u)
+	}
+	return !ok, nil
+}
+
+// isHTTPSUpgrade reports whether res redirects req to HTTPS on the
+// same host, as tsweb.Port80Handler does.
+func isHTTPSUpgrade(req *http.Request, res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return false
+	}
+	loc, err := res.Location()
+	return err == nil && loc.Scheme == "https" && loc.Hostname() == req.URL.Hostname()
+}
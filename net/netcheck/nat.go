@@ -0,0 +1,218 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netcheck
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+// NATBehavior is an RFC 4787 classification of how a NAT maps or
+// filters UDP. The zero value means unknown.
+type NATBehavior string
+
+const (
+	// EndpointIndependent means the NAT uses the same mapping for
+	// all destinations, or lets in packets from any source once a
+	// mapping exists. Peers can reach us directly.
+	EndpointIndependent NATBehavior = "endpoint-independent"
+
+	// AddressDependent means the mapping or filter depends on the
+	// destination IP, but not its port.
+	AddressDependent NATBehavior = "address-dependent"
+
+	// AddressAndPortDependent means the mapping or filter depends
+	// on both the destination IP and port. A mapping of this kind is
+	// what's commonly called a "hard" or symmetric NAT.
+	AddressAndPortDependent NATBehavior = "address-and-port-dependent"
+)
+
+// natProbeTimeout is how long each phase of the NAT behavior probe
+// waits for STUN replies.
+const natProbeTimeout = time.Second
+
+// natProbeNodes returns the STUN servers used to classify the NAT:
+// node a, which must have an alternate STUN port, and b, a server on
+// a different IP. Either is nil if the DERP map has no such server.
+func (c *Client) natProbeNodes(ctx context.Context, dm *tailcfg.DERPMap) (a, aAlt, b *net.UDPAddr) {
+	var aNode *tailcfg.DERPNode
+	for _, rid := range dm.RegionIDs() {
+		for _, n := range dm.Regions[rid].Nodes {
+			if n.STUNAltPort <= 0 || n.STUNAltPort > 1<<16-1 || !nodeMight4(n) {
+				continue
+			}
+			if a = c.nodeAddr(ctx, n, probeIPv4); a != nil {
+				aNode = n
+				break
+			}
+		}
+		if a != nil {
+			break
+		}
+	}
+	if a == nil {
+		return nil, nil, nil
+	}
+	aAlt = &net.UDPAddr{IP: a.IP, Port: aNode.STUNAltPort}
+	for _, rid := range dm.RegionIDs() {
+		for _, n := range dm.Regions[rid].Nodes {
+			if n == aNode || !nodeMight4(n) {
+				continue
+			}
+			if addr := c.nodeAddr(ctx, n, probeIPv4); addr != nil && !addr.IP.Equal(a.IP) {
+				return a, aAlt, addr
+			}
+		}
+	}
+	return a, aAlt, nil
+}
+
+// startNATProbe starts classifying the NAT using the STUN servers in
+// dm, if possible. It runs in the background, as it can take a couple
+// of seconds behind some NATs, and the result is added to reports
+// from then on. Any earlier result, possibly from another network, is
+// forgotten right away. The returned channel is closed when the probe
+// is done.
+func (c *Client) startNATProbe(dm *tailcfg.DERPMap) <-chan struct{} {
+	c.mu.Lock()
+	c.natGen++
+	gen := c.natGen
+	c.natMapping, c.natFiltering = "", ""
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), overallProbeTimeout)
+		defer cancel()
+		mapping, filtering := c.probeNATBehavior(ctx, dm)
+		c.vlogf("NAT mapping=%q filtering=%q", mapping, filtering)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if gen == c.natGen {
+			c.natMapping, c.natFiltering = mapping, filtering
+		}
+	}()
+	return done
+}
+
+// probeNATBehavior classifies the NAT using the STUN servers in dm,
+// if possible.
+func (c *Client) probeNATBehavior(ctx context.Context, dm *tailcfg.DERPMap) (mapping, filtering NATBehavior) {
+	a, aAlt, b := c.natProbeNodes(ctx, dm)
+	if a == nil {
+		return "", ""
+	}
+	// Use a fresh socket, so no earlier traffic (like that of
+	// a previous report) has already opened the NAT's filter.
+	pc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		c.logf("netcheck: NAT probe: %v", err)
+		return "", ""
+	}
+	defer pc.Close()
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	return classifyNAT(pc, a, aAlt, b, natProbeTimeout)
+}
+
+// classifyNAT sends STUN probes from pc to classify the NAT in front
+// of it. The server at a must also listen on aAlt, its alternate
+// port, and honor change-port requests. b, if non-nil, is a server on
+// a different IP. Each phase waits up to timeout for replies.
+//
+// The probes are done in two phases, so the filtering test isn't
+// spoiled by first sending to aAlt:
+//
+//  1. A plain request to a gets our mapped address, and a change-port
+//     request to a tests whether the NAT lets in a reply from aAlt,
+//     which we haven't sent to.
+//  2. Plain requests to aAlt and b tell us whether the mapping varies
+//     with the destination port or IP.
+//
+// With only one IP per server, endpoint-independent filtering can't
+// be told apart from address-dependent filtering; both are reported
+// as AddressDependent.
+func classifyNAT(pc net.PacketConn, a, aAlt, b *net.UDPAddr, timeout time.Duration) (mapping, filtering NATBehavior) {
+	txA, txChange := stun.NewTxID(), stun.NewTxID()
+	pc.WriteTo(stun.Request(txA), a)
+	pc.WriteTo(stun.RequestChangePort(txChange), a)
+	got := readNATReplies(pc, timeout, map[stun.TxID]*net.UDPAddr{
+		txA:      a,
+		txChange: aAlt,
+	})
+	mappedA, ok := got[txA]
+	if !ok {
+		// Server a isn't answering this socket at all.
+		return "", ""
+	}
+	if _, ok := got[txChange]; ok {
+		filtering = AddressDependent
+	} else {
+		filtering = AddressAndPortDependent
+	}
+
+	txAlt, txB := stun.NewTxID(), stun.NewTxID()
+	want := map[stun.TxID]*net.UDPAddr{txAlt: aAlt}
+	pc.WriteTo(stun.Request(txAlt), aAlt)
+	if b != nil {
+		want[txB] = b
+		pc.WriteTo(stun.Request(txB), b)
+	}
+	got = readNATReplies(pc, timeout, want)
+	mappedAlt, okAlt := got[txAlt]
+	mappedB, okB := got[txB]
+	switch {
+	case okB && mappedB == mappedA && (!okAlt || mappedAlt == mappedA):
+		mapping = EndpointIndependent
+	case okAlt && mappedAlt != mappedA:
+		mapping = AddressAndPortDependent
+	case okAlt && okB:
+		mapping = AddressDependent
+	}
+	return mapping, filtering
+}
+
+// readNATReplies reads STUN replies from pc for up to timeout, or
+// until each transaction in want has been answered. The map values
+// are the address each reply must come from. It returns the mapped
+// address reported in each reply.
+func readNATReplies(pc net.PacketConn, timeout time.Duration, want map[stun.TxID]*net.UDPAddr) map[stun.TxID]netaddr.IPPort {
+	got := make(map[stun.TxID]netaddr.IPPort)
+	pc.SetReadDeadline(time.Now().Add(timeout))
+	defer pc.SetReadDeadline(time.Time{})
+	var buf [1500]byte
+	for len(got) < len(want) {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			break
+		}
+		tx, ip, port, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		from, ok := want[tx]
+		src, _ := addr.(*net.UDPAddr)
+		if !ok || src == nil || src.Port != from.Port || !src.IP.Equal(from.IP) {
+			// Not ours, or a server ignoring our change-port
+			// request and answering from the wrong port.
+			continue
+		}
+		if ipp, ok := netaddr.FromStdAddr(ip, int(port), ""); ok {
+			got[tx] = ipp
+		}
+	}
+	return got
+}
@@ -26,6 +26,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
@@ -66,15 +67,27 @@ const (
 	// more aggressive than defaultActiveRetransmitTime. A few extra
 	// packets at startup is fine.
 	defaultInitialRetransmitTime = 100 * time.Millisecond
+	// nat64LookupTimeout is the maximum amount of time netcheck
+	// will wait for the DNS lookup used to detect NAT64.
+	nat64LookupTimeout = time.Second
 )
 
 type Report struct {
 	UDP                   bool     // UDP works
+	UDPBlocked            bool     // UDP doesn't work, but HTTPS to DERP does
 	IPv6                  bool     // IPv6 works
 	IPv4                  bool     // IPv4 works
 	MappingVariesByDestIP opt.Bool // for IPv4
 	HairPinning           opt.Bool // for IPv4
 
+	// NATMapping and NATFiltering are the RFC 4787 classification
+	// of the IPv4 NAT's mapping and filtering behavior. They're
+	// only determined if the DERP map has a STUN server with an
+	// alternate port (tailcfg.DERPNode.STUNAltPort). Empty means
+	// unknown. See classifyNAT for the limits of the filtering test.
+	NATMapping   NATBehavior `json:",omitempty"`
+	NATFiltering NATBehavior `json:",omitempty"`
+
 	// UPnP is whether UPnP appears present on the LAN.
 	// Empty means not checked.
 	UPnP opt.Bool
@@ -85,6 +98,19 @@ type Report struct {
 	// Empty means not checked.
 	PCP opt.Bool
 
+	// CaptivePortal is whether a captive portal appears to be
+	// intercepting plain HTTP requests to DERP servers.
+	// Empty means not checked.
+	CaptivePortal opt.Bool
+	// HTTPSProxy is whether connections to DERP servers go through
+	// an HTTPS proxy.
+	HTTPSProxy bool
+
+	// NAT64Prefix is the prefix the network's NAT64 translates
+	// IPv4 addresses into, as discovered via DNS64 (RFC 7050).
+	// It's only looked for on IPv6-only networks. Zero means none.
+	NAT64Prefix netaddr.IPPrefix
+
 	PreferredDERP   int                   // or 0 for unknown
 	RegionLatency   map[int]time.Duration // keyed by DERP Region ID
 	RegionV4Latency map[int]time.Duration // keyed by DERP Region ID
@@ -156,12 +182,29 @@ type Client struct {
 	// If nil, portmap discovery is not done.
 	PortMapper *portmapper.Client // lazily initialized on first use
 
+	// LookupIP optionally specifies a func to resolve DNS names
+	// with, for tests. If nil, net.DefaultResolver is used.
+	LookupIP func(ctx context.Context, host string) ([]netaddr.IP, error)
+
 	mu       sync.Mutex            // guards following
 	nextFull bool                  // do a full region scan, even if last != nil
 	prev     map[time.Time]*Report // some previous reports
 	last     *Report               // most recent report
 	lastFull time.Time             // time of last full (non-incremental) report
 	curState *reportState          // non-nil if we're in a call to GetReportn
+
+	// captivePortal is the result of the latest captive portal
+	// check, which finishes in the background; see
+	// startCaptivePortalCheck.
+	captivePortal opt.Bool
+	captiveGen    int // incremented by each captive portal check
+
+	// natMapping and natFiltering are the results of the latest
+	// NAT behavior probe, which finishes in the background; see
+	// startNATProbe.
+	natMapping   NATBehavior
+	natFiltering NATBehavior
+	natGen       int // incremented by each NAT probe
 }
 
 // STUNConn is the interface required by the netcheck Client when
@@ -332,9 +375,11 @@ const numIncrementalRegions = 3
 
 // makeProbePlan generates the probe plan for a DERPMap, given the most
 // recent report and whether IPv6 is configured on an interface.
-func makeProbePlan(dm *tailcfg.DERPMap, ifState *interfaces.State, last *Report) (plan probePlan) {
+//
+// If haveNAT64 is true, IPv4-only nodes are probed over IPv6 too.
+func makeProbePlan(dm *tailcfg.DERPMap, ifState *interfaces.State, last *Report, haveNAT64 bool) (plan probePlan) {
 	if last == nil || len(last.RegionLatency) == 0 {
-		return makeProbePlanInitial(dm, ifState)
+		return makeProbePlanInitial(dm, ifState, haveNAT64)
 	}
 	have6if := ifState.HaveV6Global
 	have4if := ifState.HaveV4
@@ -413,7 +458,7 @@ func makeProbePlan(dm *tailcfg.DERPMap, ifState *interfaces.State, last *Report)
 	return plan
 }
 
-func makeProbePlanInitial(dm *tailcfg.DERPMap, ifState *interfaces.State) (plan probePlan) {
+func makeProbePlanInitial(dm *tailcfg.DERPMap, ifState *interfaces.State, haveNAT64 bool) (plan probePlan) {
 	plan = make(probePlan)
 
 	for _, reg := range dm.Regions {
@@ -425,7 +470,7 @@ func makeProbePlanInitial(dm *tailcfg.DERPMap, ifState *interfaces.State) (plan
 			if ifState.HaveV4 && nodeMight4(n) {
 				p4 = append(p4, probe{delay: delay, node: n.Name, proto: probeIPv4})
 			}
-			if ifState.HaveV6Global && nodeMight6(n) {
+			if ifState.HaveV6Global && (nodeMight6(n) || haveNAT64 && nodeMight4(n)) {
 				p6 = append(p6, probe{delay: delay, node: n.Name, proto: probeIPv6})
 			}
 		}
@@ -510,7 +555,8 @@ type reportState struct {
 	pc4         STUNConn
 	pc6         STUNConn
 	pc4Hair     net.PacketConn
-	incremental bool // doing a lite, follow-up netcheck
+	incremental bool             // doing a lite, follow-up netcheck
+	nat64       netaddr.IPPrefix // NAT64 prefix to reach IPv4-only nodes over IPv6 with, or zero
 	stopProbeCh chan struct{}
 	waitPortMap sync.WaitGroup
 
@@ -704,6 +750,69 @@ func (rs *reportState) probePortMapServices() {
 	rs.setOptBool(&rs.report.PCP, res.PCP)
 }
 
+func (rs *reportState) setHTTPSProxy(v bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.report.HTTPSProxy = v
+}
+
+// startCaptivePortalCheck starts checking n for a captive portal in
+// the background, so as not to hold up incremental reports. The result
+// is added to reports from then on. If reset, any earlier result,
+// possibly from another network, is forgotten right away. The returned
+// channel is closed when the check is done.
+func (c *Client) startCaptivePortalCheck(n *tailcfg.DERPNode, reset bool) <-chan struct{} {
+	c.mu.Lock()
+	c.captiveGen++
+	gen := c.captiveGen
+	if reset {
+		c.captivePortal = ""
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		found, err := c.checkCaptivePortal(context.Background(), n)
+		if err != nil {
+			c.logf("[v1] netcheck: captive portal check: %v", err)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if gen == c.captiveGen {
+			c.captivePortal.Set(found)
+		}
+	}()
+	return done
+}
+
+// backgroundCheckWait is how long a full report waits, after its
+// STUN probes, for the checks that run in the background to finish.
+// Full reports are rare (at startup and after network changes) and
+// are the only ones some callers, like "tailscale netcheck", get, so
+// they're worth holding up a little to include the results.
+const backgroundCheckWait = 2 * time.Second
+
+// waitBackgroundChecks waits until each of the done channels is
+// closed, up to backgroundCheckWait in total or until ctx is done.
+func waitBackgroundChecks(ctx context.Context, done []<-chan struct{}) {
+	if len(done) == 0 {
+		return
+	}
+	t := time.NewTimer(backgroundCheckWait)
+	defer t.Stop()
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-t.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func newReport() *Report {
 	return &Report{
 		RegionLatency:   make(map[int]time.Duration),
@@ -749,6 +858,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	}
 	c.curState = rs
 	last := c.last
+	var prevDERP int
+	if last != nil {
+		prevDERP = last.PreferredDERP
+	}
 	now := c.timeNow()
 	if c.nextFull || now.Sub(c.lastFull) > 5*time.Minute {
 		last = nil // causes makeProbePlan below to do a full (initial) plan
@@ -756,6 +869,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		c.lastFull = now
 	}
 	rs.incremental = last != nil
+	// Captive portals are usually found right after joining a
+	// network, which causes a full report. Recheck in incremental
+	// reports only until the user has signed in.
+	checkCaptive := !c.SkipExternalNetwork && (!rs.incremental || c.captivePortal.EqualBool(true))
 	c.mu.Unlock()
 
 	defer func() {
@@ -783,6 +900,25 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		go rs.probePortMapServices()
 	}
 
+	// NAT behavior doesn't change without a network change, which
+	// causes a full report, so only classify it in full reports.
+	// Those wait a little for it and the captive portal check; see
+	// waitBackgroundChecks.
+	var bgChecks []<-chan struct{}
+	if !rs.incremental {
+		bgChecks = append(bgChecks, c.startNATProbe(dm))
+	}
+
+	if n := httpProbeNode(dm, prevDERP); n != nil {
+		rs.setHTTPSProxy(usesHTTPSProxy(n))
+		if checkCaptive {
+			done := c.startCaptivePortalCheck(n, !rs.incremental)
+			if !rs.incremental {
+				bgChecks = append(bgChecks, done)
+			}
+		}
+	}
+
 	// At least the Apple Airport Extreme doesn't allow hairpin
 	// sends from a private socket until it's seen traffic from
 	// that src IP:port to something else out on the internet.
@@ -822,7 +958,19 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		}
 	}
 
-	plan := makeProbePlan(dm, ifState, last)
+	switch {
+	case ifState.HaveV4 || !ifState.HaveV6Global:
+		// NAT64 only matters on IPv6-only networks, so don't
+		// spend a DNS lookup on every dual-stack network, nor
+		// keep a prefix from before IPv4 appeared.
+	case rs.incremental:
+		rs.nat64 = last.NAT64Prefix
+	default:
+		rs.nat64 = c.detectNAT64(ctx)
+	}
+	rs.report.NAT64Prefix = rs.nat64
+
+	plan := makeProbePlan(dm, ifState, last, !rs.nat64.IsZero())
 
 	wg := syncs.NewWaitGroupChan()
 	wg.Add(len(plan))
@@ -855,6 +1003,17 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		rs.waitPortMap.Wait()
 		c.vlogf("portMap done")
 	}
+	// Add the results of the background checks, if they're done.
+	waitBackgroundChecks(ctx, bgChecks)
+	c.mu.Lock()
+	captive := c.captivePortal
+	natMapping, natFiltering := c.natMapping, c.natFiltering
+	c.mu.Unlock()
+	rs.mu.Lock()
+	rs.report.CaptivePortal = captive
+	rs.report.NATMapping = natMapping
+	rs.report.NATFiltering = natFiltering
+	rs.mu.Unlock()
 	rs.stopTimers()
 
 	// Try HTTPS latency check if all STUN probes failed due to UDP presumably being blocked.
@@ -898,6 +1057,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	}
 
 	rs.mu.Lock()
+	rs.report.UDPBlocked = !rs.report.UDP && len(rs.report.RegionLatency) > 0
 	report := rs.report.Clone()
 	rs.mu.Unlock()
 
@@ -971,6 +1131,9 @@ func (c *Client) measureHTTPSLatency(ctx context.Context, reg *tailcfg.DERPRegio
 func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 	c.logf("[v1] report: %v", logger.ArgWriter(func(w *bufio.Writer) {
 		fmt.Fprintf(w, "udp=%v", r.UDP)
+		if r.UDPBlocked {
+			fmt.Fprintf(w, " udpblocked=true")
+		}
 		if !r.IPv4 {
 			fmt.Fprintf(w, " v4=%v", r.IPv4)
 		}
@@ -978,11 +1141,23 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		fmt.Fprintf(w, " v6=%v", r.IPv6)
 		fmt.Fprintf(w, " mapvarydest=%v", r.MappingVariesByDestIP)
 		fmt.Fprintf(w, " hair=%v", r.HairPinning)
+		if r.NATMapping != "" || r.NATFiltering != "" {
+			fmt.Fprintf(w, " nat=%v/%v", conciseNATBehavior(r.NATMapping), conciseNATBehavior(r.NATFiltering))
+		}
 		if r.AnyPortMappingChecked() {
 			fmt.Fprintf(w, " portmap=%v%v%v", conciseOptBool(r.UPnP, "U"), conciseOptBool(r.PMP, "M"), conciseOptBool(r.PCP, "C"))
 		} else {
 			fmt.Fprintf(w, " portmap=?")
 		}
+		if r.CaptivePortal.EqualBool(true) {
+			fmt.Fprintf(w, " captiveportal=true")
+		}
+		if r.HTTPSProxy {
+			fmt.Fprintf(w, " httpsproxy=true")
+		}
+		if !r.NAT64Prefix.IsZero() {
+			fmt.Fprintf(w, " nat64=%v", r.NAT64Prefix)
+		}
 		if r.GlobalV4 != "" {
 			fmt.Fprintf(w, " v4a=%v", r.GlobalV4)
 		}
@@ -1124,6 +1299,9 @@ func (rs *reportState) runProbe(ctx context.Context, dm *tailcfg.DERPMap, probe
 	}
 
 	addr := c.nodeAddr(ctx, node, probe.proto)
+	if addr == nil && probe.proto == probeIPv6 {
+		addr = c.nat64NodeAddr(ctx, node, rs.nat64)
+	}
 	if addr == nil {
 		return
 	}
@@ -1197,15 +1375,67 @@ func (c *Client) nodeAddr(ctx context.Context, n *tailcfg.DERPNode, proto probeP
 	}
 
 	// TODO(bradfitz): add singleflight+dnscache here.
-	addrs, _ := net.DefaultResolver.LookupIPAddr(ctx, n.HostName)
-	for _, a := range addrs {
-		if (a.IP.To4() != nil) == (proto == probeIPv4) {
-			return &net.UDPAddr{IP: a.IP, Port: port}
+	addrs, _ := c.lookupIP(ctx, n.HostName)
+	for _, ip := range addrs {
+		if ip.Is4() == (proto == probeIPv4) {
+			return netaddr.IPPortFrom(ip, uint16(port)).UDPAddr()
 		}
 	}
 	return nil
 }
 
+// nat64NodeAddr returns the address to probe IPv4-only node n at
+// over IPv6, through NAT64 prefix pfx. It returns nil if pfx is zero.
+func (c *Client) nat64NodeAddr(ctx context.Context, n *tailcfg.DERPNode, pfx netaddr.IPPrefix) *net.UDPAddr {
+	if pfx.IsZero() {
+		return nil
+	}
+	addr := c.nodeAddr(ctx, n, probeIPv4)
+	if addr == nil {
+		return nil
+	}
+	ipp, ok := netaddr.FromStdAddr(addr.IP, addr.Port, "")
+	if !ok {
+		return nil
+	}
+	ip6 := nat64.Synthesize(pfx, ipp.IP())
+	if ip6.IsZero() {
+		return nil
+	}
+	return netaddr.IPPortFrom(ip6, ipp.Port()).UDPAddr()
+}
+
+// detectNAT64 looks for the NAT64 prefix of the network, by
+// resolving nat64.IPv4OnlyARPA with the system's (presumably DNS64)
+// resolver. It returns the zero prefix if there's no NAT64.
+func (c *Client) detectNAT64(ctx context.Context) netaddr.IPPrefix {
+	ctx, cancel := context.WithTimeout(ctx, nat64LookupTimeout)
+	defer cancel()
+	addrs, err := c.lookupIP(ctx, nat64.IPv4OnlyARPA)
+	if err != nil {
+		c.vlogf("nat64 lookup: %v", err)
+		return netaddr.IPPrefix{}
+	}
+	return nat64.PrefixFromAddrs(addrs)
+}
+
+func (c *Client) lookupIP(ctx context.Context, host string) ([]netaddr.IP, error) {
+	if c.LookupIP != nil {
+		return c.LookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]netaddr.IP, 0, len(addrs))
+	for _, a := range addrs {
+		if ip, ok := netaddr.FromStdIP(a.IP); ok {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
 func regionHasDERPNode(r *tailcfg.DERPRegion) bool {
 	for _, n := range r.Nodes {
 		if !n.STUNOnly {
@@ -1224,6 +1454,20 @@ func maxDurationValue(m map[int]time.Duration) (max time.Duration) {
 	return max
 }
 
+// conciseNATBehavior returns the abbreviation of b used in logs:
+// "EI", "AD", "APD", or "?" for unknown.
+func conciseNATBehavior(b NATBehavior) string {
+	switch b {
+	case EndpointIndependent:
+		return "EI"
+	case AddressDependent:
+		return "AD"
+	case AddressAndPortDependent:
+		return "APD"
+	}
+	return "?"
+}
+
 func conciseOptBool(b opt.Bool, trueVal string) string {
 	if b == "" {
 		return "_"
@@ -9,6 +9,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"strconv"
@@ -17,10 +19,12 @@ import (
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tsweb"
 )
 
 func TestHairpinSTUN(t *testing.T) {
@@ -78,6 +82,164 @@ func TestBasic(t *testing.T) {
 	}
 }
 
+func TestClassifyNAT(t *testing.T) {
+	stunAddr, altPort, cleanup := stuntest.ServeAltPort(t)
+	defer cleanup()
+	otherAddr, cleanupOther := stuntest.Serve(t)
+	defer cleanupOther()
+	altAddr := &net.UDPAddr{IP: stunAddr.IP, Port: altPort}
+
+	newConn := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+
+	t.Run("no_nat", func(t *testing.T) {
+		pc := newConn()
+		defer pc.Close()
+		mapping, filtering := classifyNAT(pc, stunAddr, altAddr, otherAddr, time.Second)
+		if mapping != EndpointIndependent || filtering != AddressDependent {
+			t.Errorf("got mapping=%q filtering=%q; want %q, %q", mapping, filtering, EndpointIndependent, AddressDependent)
+		}
+	})
+
+	// A server without an alternate port answers change-port
+	// requests from its main port, which mustn't count as getting
+	// through the filter.
+	t.Run("change_port_ignored", func(t *testing.T) {
+		pc := newConn()
+		defer pc.Close()
+		bogusAlt := &net.UDPAddr{IP: otherAddr.IP, Port: otherAddr.Port + 1}
+		_, filtering := classifyNAT(pc, otherAddr, bogusAlt, nil, 250*time.Millisecond)
+		if filtering != AddressAndPortDependent {
+			t.Errorf("filtering = %q; want %q", filtering, AddressAndPortDependent)
+		}
+	})
+}
+
+// Tests that a single full report, like "tailscale netcheck" gets,
+// includes the NAT classification.
+func TestGetReportNATBehavior(t *testing.T) {
+	stunAddr, altPort, cleanup := stuntest.ServeAltPort(t)
+	defer cleanup()
+
+	dm := stuntest.DERPMapOf(stunAddr.String())
+	dm.Regions[1].Nodes[0].STUNAltPort = altPort
+	c := &Client{
+		Logf:        t.Logf,
+		UDPBindAddr: "127.0.0.1:0",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := c.GetReport(ctx, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.NATMapping != EndpointIndependent {
+		t.Errorf("NATMapping = %q; want %q", r.NATMapping, EndpointIndependent)
+	}
+	if r.NATFiltering == "" {
+		t.Error("NATFiltering not set")
+	}
+}
+
+func TestCheckCaptivePortal(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		want    bool
+		wantErr error
+	}{
+		{name: "derp", handler: http.HandlerFunc(derphttp.ServeNoContent)},
+		{name: "old_derp_https_redirect", handler: tsweb.Port80Handler{Main: http.NotFoundHandler()}, wantErr: errCaptiveCheckUnsupported},
+		{name: "portal_redirect", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://portal.example/login", http.StatusFound)
+		}), want: true},
+		{name: "portal_https_redirect", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://portal.example/login", http.StatusFound)
+		}), want: true},
+		{name: "portal_fake_204", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), want: true},
+		{name: "portal_echo_header", handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A portal copying request headers isn't enough.
+			w.Header().Set(derphttp.NoContentResponseHeader, r.Header.Get(derphttp.NoContentChallengeHeader))
+			w.WriteHeader(http.StatusNoContent)
+		}), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(tt.handler)
+			defer ts.Close()
+			c := &Client{Logf: t.Logf}
+			got, err := c.checkCaptivePortalURL(context.Background(), ts.URL+"/generate_204")
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("found = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		switch host {
+		case "ipv4only.arpa":
+			// A DNS64 resolver with the well-known prefix.
+			return []netaddr.IP{
+				netaddr.MustParseIP("192.0.0.170"),
+				netaddr.MustParseIP("64:ff9b::192.0.0.170"),
+			}, nil
+		case "derp1.example":
+			return []netaddr.IP{netaddr.MustParseIP("1.2.3.4")}, nil
+		}
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+	c := &Client{Logf: t.Logf, LookupIP: lookup}
+	ctx := context.Background()
+
+	pfx := c.detectNAT64(ctx)
+	if want := netaddr.MustParseIPPrefix("64:ff9b::/96"); pfx != want {
+		t.Fatalf("detectNAT64 = %v; want %v", pfx, want)
+	}
+
+	tests := []struct {
+		name string
+		n    *tailcfg.DERPNode
+		want string
+	}{
+		{"ipv4_literal", &tailcfg.DERPNode{IPv4: "5.6.7.8", IPv6: "none"}, "[64:ff9b::506:708]:3478"},
+		{"stun_test_ip", &tailcfg.DERPNode{STUNTestIP: "5.6.7.8", STUNPort: 1234}, "[64:ff9b::506:708]:1234"},
+		{"dns", &tailcfg.DERPNode{HostName: "derp1.example"}, "[64:ff9b::102:304]:3478"},
+		{"ipv4_disabled", &tailcfg.DERPNode{IPv4: "none", IPv6: "none"}, "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(c.nat64NodeAddr(ctx, tt.n, pfx)); got != tt.want {
+				t.Errorf("nat64NodeAddr = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := c.nat64NodeAddr(ctx, tests[0].n, netaddr.IPPrefix{}); got != nil {
+		t.Errorf("nat64NodeAddr without NAT64 = %v; want nil", got)
+	}
+
+	c.LookupIP = func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		return []netaddr.IP{netaddr.MustParseIP("192.0.0.170")}, nil
+	}
+	if pfx := c.detectNAT64(ctx); !pfx.IsZero() {
+		t.Errorf("detectNAT64 without DNS64 = %v; want zero", pfx)
+	}
+}
+
 func TestWorksWhenUDPBlocked(t *testing.T) {
 	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
@@ -277,11 +439,28 @@ func TestMakeProbePlan(t *testing.T) {
 		}
 		return pr
 	}
+	// v4OnlyMap has one region whose node has IPv6 disabled.
+	v4OnlyMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID: 1,
+				Nodes: []*tailcfg.DERPNode{{
+					Name:     "1a",
+					RegionID: 1,
+					HostName: "derp1-0",
+					IPv4:     "1.0.0.0",
+					IPv6:     "none",
+				}},
+			},
+		},
+	}
+
 	tests := []struct {
 		name    string
 		dm      *tailcfg.DERPMap
 		have6if bool
 		no4     bool // no IPv4
+		nat64   bool
 		last    *Report
 		want    probePlan
 	}{
@@ -410,6 +589,23 @@ func TestMakeProbePlan(t *testing.T) {
 				"region-5-v6": []probe{p("5a", 6), p("5b", 6, 100*ms), p("5c", 6, 200*ms)},
 			},
 		},
+		{
+			name:    "only_v6_initial_v4_only_derp",
+			have6if: true,
+			no4:     true,
+			dm:      v4OnlyMap,
+			want:    probePlan{},
+		},
+		{
+			name:    "only_v6_initial_v4_only_derp_nat64",
+			have6if: true,
+			no4:     true,
+			nat64:   true,
+			dm:      v4OnlyMap,
+			want: probePlan{
+				"region-1-v6": []probe{p("1a", 6), p("1a", 6, 100*ms), p("1a", 6, 200*ms)},
+			},
+		},
 		{
 			name:    "try_harder_for_preferred_derp",
 			dm:      basicMap,
@@ -446,7 +642,7 @@ func TestMakeProbePlan(t *testing.T) {
 				HaveV6Global: tt.have6if,
 				HaveV4:       !tt.no4,
 			}
-			got := makeProbePlan(tt.dm, ifState, tt.last)
+			got := makeProbePlan(tt.dm, ifState, tt.last, tt.nat64)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("unexpected plan; got:\n%v\nwant:\n%v\n", got, tt.want)
 			}
@@ -531,6 +727,16 @@ func TestLogConciseReport(t *testing.T) {
 			},
 			want: "udp=true v6=false mapvarydest= hair= portmap=? derp=1 derpdist=1v4:10ms",
 		},
+		{
+			name: "nat_classified",
+			r: &Report{
+				UDP:          true,
+				IPv4:         true,
+				NATMapping:   AddressAndPortDependent,
+				NATFiltering: AddressDependent,
+			},
+			want: "udp=true v6=false mapvarydest= hair= nat=APD/AD portmap=? derp=0",
+		},
 		{
 			name: "ipv4_all_region",
 			r: &Report{
@@ -6,6 +6,7 @@ package packet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 
@@ -560,3 +561,86 @@ func BenchmarkString(b *testing.B) {
 		})
 	}
 }
+
+// tcp4SynBuffer returns an IPv4 TCP SYN packet with the given MSS
+// option, preceded by nops NOP options, and a valid TCP checksum.
+func tcp4SynBuffer(mss uint16, nops int) []byte {
+	b := []byte{
+		// IPv4 header
+		0x45, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		0x01, 0x02, 0x03, 0x04, // src
+		0x05, 0x06, 0x07, 0x08, // dst
+		// TCP header
+		0xc0, 0x00, 0x00, 0x50, // ports
+		0x00, 0x00, 0x00, 0x01, // seq
+		0x00, 0x00, 0x00, 0x00, // ack
+		0x00, 0x02, 0xff, 0xff, // data offset (set below), SYN, window
+		0x00, 0x00, 0x00, 0x00, // checksum, urgent
+	}
+	for i := 0; i < nops; i++ {
+		b = append(b, tcpOptNop)
+	}
+	b = append(b, 0x02, 0x04, byte(mss>>8), byte(mss)) // MSS option
+	for len(b)%4 != 0 {
+		b = append(b, tcpOptEnd)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	b[32] = byte((len(b)-20)/4) << 4
+	binary.BigEndian.PutUint16(b[36:], tcp4Checksum(b))
+	return b
+}
+
+// tcp4Checksum returns the one's complement sum over the TCP segment
+// of IPv4 packet b and its pseudo-header, which is 0 if the checksum
+// in b is valid.
+func tcp4Checksum(b []byte) uint16 {
+	tcp := b[20:]
+	pseudo := append([]byte(nil), b[12:20]...)
+	pseudo = append(pseudo, 0, 6, 0, byte(len(tcp)))
+	return ip4Checksum(append(pseudo, tcp...))
+}
+
+func TestClampTCPMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		mss     uint16
+		nops    int
+		clamp   uint16
+		want    uint16
+		changed bool
+	}{
+		{"lowered", 1460, 0, 1200, 1200, true},
+		{"already_lower", 1000, 0, 1200, 1000, false},
+		{"equal", 1200, 0, 1200, 1200, false},
+		// An odd number of NOPs puts the MSS value at an odd
+		// offset, straddling two checksum words.
+		{"lowered_after_nop", 1460, 1, 1200, 1200, true},
+		{"lowered_after_two_nops", 1460, 2, 1200, 1200, true},
+		{"lowered_after_three_nops", 0x05b4, 3, 0x04d3, 0x04d3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tcp4SynBuffer(tt.mss, tt.nops)
+			var p Parsed
+			p.Decode(b)
+			if got := p.ClampTCPMSS(tt.clamp); got != tt.changed {
+				t.Errorf("ClampTCPMSS = %v; want %v", got, tt.changed)
+			}
+			if got := binary.BigEndian.Uint16(b[42+tt.nops:]); got != tt.want {
+				t.Errorf("MSS = %d; want %d", got, tt.want)
+			}
+			if sum := tcp4Checksum(b); sum != 0 {
+				t.Errorf("bad TCP checksum after clamping; residual %#04x", sum)
+			}
+		})
+	}
+
+	// Non-SYN packets are left alone.
+	b := tcp4SynBuffer(1460, 0)
+	b[33] = byte(TCPAck)
+	var p Parsed
+	p.Decode(b)
+	if p.ClampTCPMSS(1200) {
+		t.Error("clamped non-SYN packet")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"tailscale.com/types/ipproto"
+)
+
+// TCP option kinds.
+const (
+	tcpOptEnd = 0
+	tcpOptNop = 1
+	tcpOptMSS = 2
+)
+
+// ClampTCPMSS lowers the maximum segment size option of a TCP SYN or
+// SYN-ACK packet to mss, if it's larger, and fixes up the TCP checksum.
+// It reports whether the packet was modified.
+//
+// Unlike the rest of Parsed's methods, it writes to the decoded
+// buffer.
+func (q *Parsed) ClampTCPMSS(mss uint16) bool {
+	if q.IPProto != ipproto.TCP || q.TCPFlags&TCPSyn == 0 {
+		return false
+	}
+	tcp := q.b[q.subofs:q.length]
+	if len(tcp) < tcpHeaderLength {
+		return false
+	}
+	hdrLen := int(tcp[12]>>4) * 4
+	if hdrLen < tcpHeaderLength || hdrLen > len(tcp) {
+		return false
+	}
+	opts := tcp[tcpHeaderLength:hdrLen]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case tcpOptEnd:
+			return false
+		case tcpOptNop:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+		if opts[0] == tcpOptMSS && opts[1] == 4 {
+			old := binary.BigEndian.Uint16(opts[2:4])
+			if old <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[2:4], mss)
+			oldWord, newWord := old, mss
+			if (hdrLen-len(opts)+2)&1 == 1 {
+				// The value straddles two checksum words, so it
+				// contributes to the sum with its bytes swapped.
+				oldWord, newWord = bits.ReverseBytes16(old), bits.ReverseBytes16(mss)
+			}
+			sum := binary.BigEndian.Uint16(tcp[16:18])
+			binary.BigEndian.PutUint16(tcp[16:18], checksumUpdate(sum, oldWord, newWord))
+			return true
+		}
+		opts = opts[opts[1]:]
+	}
+	return false
+}
+
+// checksumUpdate returns the internet checksum sum updated for a
+// 16-bit word changing from old to new, per RFC 1624.
+func checksumUpdate(sum, old, new uint16) uint16 {
+	ac := uint32(^sum) + uint32(^old) + uint32(new)
+	for (ac >> 16) > 0 {
+		ac = (ac >> 16) + (ac & 0xffff)
+	}
+	return uint16(^ac)
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// References:
+//
+// PCP: https://tools.ietf.org/html/rfc6887
+
+// PCP constants.
+const (
+	pcpVersion = 2
+	pcpPort    = 5351
+
+	pcpMapLifetimeSec    = 7200 // same as NAT-PMP
+	pcpMapLifetimeDelete = 0    // 0 second lifetime deletes
+
+	pcpCodeOK            = 0
+	pcpCodeNotAuthorized = 2
+
+	pcpOpReply    = 0x80 // OR'd into request's op code on response
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpUDPProto = 17
+
+	pcpHeaderLen = 24
+	pcpMapOpLen  = 36
+)
+
+// pcpMapping is a port mapping or IPv6 firewall pinhole created
+// with PCP.
+//
+// All fields are immutable once created.
+type pcpMapping struct {
+	server   netaddr.IPPort // the PCP server (gateway)
+	internal netaddr.IPPort
+	external netaddr.IPPort
+	nonce    [12]byte // must be reused to renew or delete the mapping
+	useUntil time.Time
+	epoch    uint32
+}
+
+func (m *pcpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *pcpMapping) externalIPPort() netaddr.IPPort { return m.external }
+
+// release does a best effort fire-and-forget release of the PCP mapping m.
+func (m *pcpMapping) release() {
+	uc, err := netns.Listener().ListenPacket(context.Background(), pcpNetwork(m.server.IP()), ":0")
+	if err != nil {
+		return
+	}
+	defer uc.Close()
+	pkt := pcpMapRequest(m.internal.IP(), m.internal.Port(), m.external, pcpMapLifetimeDelete, m.nonce)
+	uc.WriteTo(pkt, m.server.UDPAddr())
+}
+
+// pcpNetwork returns the UDP network to use to talk to a PCP server at ip.
+func pcpNetwork(ip netaddr.IP) string {
+	if ip.Is4() {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// pcpAnnounceRequest generates a PCP packet with an ANNOUNCE opcode.
+func pcpAnnounceRequest(myIP netaddr.IP) []byte {
+	// See https://tools.ietf.org/html/rfc6887#section-7.1
+	pkt := make([]byte, pcpHeaderLen)
+	pkt[0] = pcpVersion // version
+	pkt[1] = pcpOpAnnounce
+	myIP16 := myIP.As16()
+	copy(pkt[8:], myIP16[:])
+	return pkt
+}
+
+// pcpMapRequest generates a PCP packet with a MAP opcode, asking
+// for UDP port localPort on myIP to be mapped for lifetimeSec seconds.
+// If they're known, suggested are the external IP and port to ask for.
+func pcpMapRequest(myIP netaddr.IP, localPort uint16, suggested netaddr.IPPort, lifetimeSec uint32, nonce [12]byte) []byte {
+	pkt := make([]byte, pcpHeaderLen+pcpMapOpLen)
+
+	// The header (https://tools.ietf.org/html/rfc6887#section-7.1)
+	pkt[0] = pcpVersion
+	pkt[1] = pcpOpMap
+	binary.BigEndian.PutUint32(pkt[4:8], lifetimeSec)
+	myIP16 := myIP.As16()
+	copy(pkt[8:], myIP16[:])
+
+	// The map opcode body (https://tools.ietf.org/html/rfc6887#section-11.1)
+	mapOp := pkt[pcpHeaderLen:]
+	copy(mapOp[:12], nonce[:])
+	mapOp[12] = pcpUDPProto
+	binary.BigEndian.PutUint16(mapOp[16:], localPort)
+	binary.BigEndian.PutUint16(mapOp[18:], suggested.Port())
+	// An all-zeros address of the same family as the internal
+	// address means no preference.
+	extIP := suggested.IP()
+	if extIP.IsZero() {
+		if myIP.Is4() {
+			extIP = netaddr.IPv4(0, 0, 0, 0)
+		} else {
+			extIP = netaddr.IPFrom16([16]byte{})
+		}
+	}
+	extIP16 := extIP.As16()
+	copy(mapOp[20:], extIP16[:])
+	return pkt
+}
+
+type pcpResponse struct {
+	OpCode     uint8
+	ResultCode uint8
+	Lifetime   uint32
+	Epoch      uint32
+}
+
+func parsePCPResponse(b []byte) (res pcpResponse, ok bool) {
+	if len(b) < pcpHeaderLen || b[0] != pcpVersion {
+		return
+	}
+	res.OpCode = b[1]
+	res.ResultCode = b[3]
+	res.Lifetime = binary.BigEndian.Uint32(b[4:])
+	res.Epoch = binary.BigEndian.Uint32(b[8:])
+	return res, true
+}
+
+// pcpMapResponse is a PCP response to a MAP request.
+type pcpMapResponse struct {
+	pcpResponse
+	Nonce        [12]byte
+	Protocol     uint8
+	InternalPort uint16
+	External     netaddr.IPPort // assigned external address
+}
+
+func parsePCPMapResponse(b []byte) (res pcpMapResponse, ok bool) {
+	if len(b) < pcpHeaderLen+pcpMapOpLen {
+		return
+	}
+	res.pcpResponse, ok = parsePCPResponse(b)
+	if !ok || res.OpCode != pcpOpReply|pcpOpMap {
+		return res, false
+	}
+	mapOp := b[pcpHeaderLen:]
+	copy(res.Nonce[:], mapOp[:12])
+	res.Protocol = mapOp[12]
+	res.InternalPort = binary.BigEndian.Uint16(mapOp[16:])
+	var ip16 [16]byte
+	copy(ip16[:], mapOp[20:36])
+	res.External = netaddr.IPPortFrom(netaddr.IPFrom16(ip16).Unmap(), binary.BigEndian.Uint16(mapOp[18:]))
+	return res, true
+}
+
+// createPCPMapping asks the PCP server at server to map the UDP
+// address internal, which is an IPv4 address behind a NAT or an IPv6
+// address behind a firewall. If prev is non-nil, it's the mapping
+// being renewed, whose nonce and external address are reused.
+func (c *Client) createPCPMapping(ctx context.Context, server, internal netaddr.IPPort, prev *pcpMapping) (*pcpMapping, error) {
+	m := &pcpMapping{
+		server:   server,
+		internal: internal,
+	}
+	var suggested netaddr.IPPort
+	if prev != nil && prev.server == server && prev.internal == internal {
+		m.nonce = prev.nonce
+		suggested = prev.external
+	} else {
+		rand.Read(m.nonce[:])
+		suggested = netaddr.IPPortFrom(netaddr.IP{}, internal.Port())
+	}
+
+	uc, err := netns.Listener().ListenPacket(ctx, pcpNetwork(server.IP()), ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	uc.SetReadDeadline(time.Now().Add(portMapServiceTimeout))
+	defer closeCloserOnContextDone(ctx, uc)()
+
+	pkt := pcpMapRequest(internal.IP(), internal.Port(), suggested, pcpMapLifetimeSec, m.nonce)
+	if _, err := uc.WriteTo(pkt, server.UDPAddr()); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 1500)
+	for {
+		n, srci, err := uc.ReadFrom(res)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return nil, err
+			}
+			return nil, NoMappingError{ErrNoPortMappingServices}
+		}
+		srcu := srci.(*net.UDPAddr)
+		src, ok := netaddr.FromStdAddr(srcu.IP, srcu.Port, srcu.Zone)
+		if !ok || src.Port() != server.Port() || src.IP().WithZone("") != server.IP().WithZone("") {
+			continue
+		}
+		pres, ok := parsePCPMapResponse(res[:n])
+		if !ok || pres.Nonce != m.nonce {
+			c.logf("unexpected PCP response: % 02x", res[:n])
+			continue
+		}
+		if pres.ResultCode != pcpCodeOK {
+			return nil, NoMappingError{fmt.Errorf("PCP MAP response code %d", pres.ResultCode)}
+		}
+		if pres.External.IP().IsUnspecified() || pres.External.Port() == 0 {
+			return nil, NoMappingError{fmt.Errorf("PCP MAP response has invalid external address %v", pres.External)}
+		}
+		m.external = pres.External
+		m.epoch = pres.Epoch
+		d := time.Duration(pres.Lifetime) * time.Second
+		d /= 2 // renew in half the time
+		m.useUntil = time.Now().Add(d)
+		return m, nil
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+// pcpMapReply builds the response a PCP server would send to the
+// MAP request req, assigning external.
+func pcpMapReply(req []byte, resultCode uint8, lifetime uint32, external netaddr.IPPort) []byte {
+	res := make([]byte, pcpHeaderLen+pcpMapOpLen)
+	res[0] = pcpVersion
+	res[1] = pcpOpReply | pcpOpMap
+	res[3] = resultCode
+	binary.BigEndian.PutUint32(res[4:], lifetime)
+	binary.BigEndian.PutUint32(res[8:], 1234) // epoch
+	copy(res[pcpHeaderLen:], req[pcpHeaderLen:pcpHeaderLen+20])
+	binary.BigEndian.PutUint16(res[pcpHeaderLen+18:], external.Port())
+	ext16 := external.IP().As16()
+	copy(res[pcpHeaderLen+20:], ext16[:])
+	return res
+}
+
+func TestPCPMapRequest(t *testing.T) {
+	nonce := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	tests := []struct {
+		name      string
+		myIP      string
+		suggested netaddr.IPPort
+		wantExtIP string
+	}{
+		{"v4_no_preference", "192.168.1.2", netaddr.IPPortFrom(netaddr.IP{}, 41641), "::ffff:0.0.0.0"},
+		{"v4_renew", "192.168.1.2", netaddr.MustParseIPPort("203.0.113.5:41641"), "::ffff:203.0.113.5"},
+		{"v6_pinhole", "2001:db8::2", netaddr.IPPortFrom(netaddr.IP{}, 41641), "::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			myIP := netaddr.MustParseIP(tt.myIP)
+			pkt := pcpMapRequest(myIP, 41641, tt.suggested, pcpMapLifetimeSec, nonce)
+			if len(pkt) != pcpHeaderLen+pcpMapOpLen {
+				t.Fatalf("len = %d", len(pkt))
+			}
+			if pkt[0] != pcpVersion || pkt[1] != pcpOpMap {
+				t.Errorf("header = % 02x", pkt[:4])
+			}
+			if got := binary.BigEndian.Uint32(pkt[4:]); got != pcpMapLifetimeSec {
+				t.Errorf("lifetime = %d", got)
+			}
+			var client16 [16]byte
+			copy(client16[:], pkt[8:24])
+			if got := netaddr.IPFrom16(client16).Unmap(); got != myIP {
+				t.Errorf("client IP = %v; want %v", got, myIP)
+			}
+			mapOp := pkt[pcpHeaderLen:]
+			if string(mapOp[:12]) != string(nonce[:]) {
+				t.Errorf("nonce = % 02x", mapOp[:12])
+			}
+			if mapOp[12] != pcpUDPProto {
+				t.Errorf("protocol = %d", mapOp[12])
+			}
+			if got := binary.BigEndian.Uint16(mapOp[16:]); got != 41641 {
+				t.Errorf("internal port = %d", got)
+			}
+			var ext16 [16]byte
+			copy(ext16[:], mapOp[20:36])
+			if got, want := netaddr.IPFrom16(ext16), netaddr.MustParseIP(tt.wantExtIP); got != want {
+				t.Errorf("suggested external IP = %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParsePCPMapResponse(t *testing.T) {
+	nonce := [12]byte{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	req := pcpMapRequest(netaddr.MustParseIP("2001:db8::2"), 41641, netaddr.IPPort{}, pcpMapLifetimeSec, nonce)
+
+	ext := netaddr.MustParseIPPort("[2001:db8::2]:41641")
+	res, ok := parsePCPMapResponse(pcpMapReply(req, pcpCodeOK, 3600, ext))
+	if !ok {
+		t.Fatal("failed to parse")
+	}
+	if res.Nonce != nonce {
+		t.Errorf("nonce = % 02x", res.Nonce)
+	}
+	if res.Lifetime != 3600 || res.Epoch != 1234 || res.InternalPort != 41641 || res.Protocol != pcpUDPProto {
+		t.Errorf("got %+v", res)
+	}
+	if res.External != ext {
+		t.Errorf("external = %v; want %v", res.External, ext)
+	}
+
+	ext4 := netaddr.MustParseIPPort("203.0.113.5:1234")
+	res, ok = parsePCPMapResponse(pcpMapReply(req, pcpCodeOK, 3600, ext4))
+	if !ok || res.External != ext4 {
+		t.Errorf("v4 external = %v, %v; want %v", res.External, ok, ext4)
+	}
+
+	// An ANNOUNCE reply isn't a MAP response.
+	announce := make([]byte, pcpHeaderLen+pcpMapOpLen)
+	announce[0] = pcpVersion
+	announce[1] = pcpOpReply | pcpOpAnnounce
+	if _, ok := parsePCPMapResponse(announce); ok {
+		t.Error("parsed ANNOUNCE reply as MAP response")
+	}
+	if _, ok := parsePCPMapResponse(announce[:pcpHeaderLen]); ok {
+		t.Error("parsed short packet")
+	}
+}
+
+func TestCreateOrGetIPv6Pinhole(t *testing.T) {
+	if v, _ := strconv.ParseBool(os.Getenv("HIT_NETWORK")); !v {
+		t.Skip("skipping test without HIT_NETWORK=1")
+	}
+	c := NewClient(t.Logf)
+	c.SetLocalPort6(1234)
+	ext, err := c.CreateOrGetIPv6Pinhole(context.Background())
+	t.Logf("Got: %v, %v", ext, err)
+	c.Close()
+}
@@ -2,8 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package portmapper is a UDP port mapping client. It currently only does
-// NAT-PMP, but will likely do UPnP and perhaps PCP later.
+// Package portmapper is a UDP port mapping client. It does NAT-PMP,
+// PCP and UPnP IGD for IPv4, and PCP for IPv6 firewall pinholes.
 package portmapper
 
 import (
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"sync"
 	"time"
 
@@ -27,7 +28,8 @@ import (
 // References:
 //
 // NAT-PMP: https://tools.ietf.org/html/rfc6886
-// PCP: https://tools.ietf.org/html/rfc6887
+// PCP: see pcp.go
+// UPnP: see upnp.go
 
 // portMapServiceTimeout is the time we wait for port mapping
 // services (UPnP, NAT-PMP, PCP) to respond before we give up and
@@ -42,14 +44,17 @@ const trustServiceStillAvailableDuration = 10 * time.Minute
 
 // Client is a port mapping client.
 type Client struct {
-	logf         logger.Logf
-	ipAndGateway func() (gw, ip netaddr.IP, ok bool)
+	logf          logger.Logf
+	ipAndGateway  func() (gw, ip netaddr.IP, ok bool)
+	ipAndGateway6 func() (gw, ip netaddr.IP, ok bool)
 
 	mu sync.Mutex // guards following, and all fields thereof
 
-	lastMyIP netaddr.IP
-	lastGW   netaddr.IP
-	closed   bool
+	lastMyIP  netaddr.IP
+	lastGW    netaddr.IP
+	lastMyIP6 netaddr.IP
+	lastGW6   netaddr.IP
+	closed    bool
 
 	lastProbe time.Time
 
@@ -59,16 +64,40 @@ type Client struct {
 
 	pcpSawTime  time.Time // time we last saw PCP was available
 	uPnPSawTime time.Time // time we last saw UPnP was available
+	uPnPMeta    uPnPDiscoResponse
 
-	localPort  uint16
-	pmpMapping *pmpMapping // non-nil if we have a PMP mapping
+	// uPnPControls caches the WAN connection service found in
+	// each UPnP device description, keyed by its location.
+	uPnPControls map[string]upnpControl
+
+	localPort uint16
+	mapping   mapping // non-nil if we have a mapping
+
+	localPort6   uint16      // local IPv6 UDP port; 0 if none
+	pinhole      *pcpMapping // non-nil if we have an IPv6 pinhole
+	pinholeError time.Time   // time PCP last failed to open a pinhole
+}
+
+// mapping is a port mapping created with one of the supported
+// protocols.
+type mapping interface {
+	// renewAfter returns the time after which the mapping should
+	// be renewed, by requesting it again.
+	renewAfter() time.Time
+	// externalIPPort returns the mapping's external address.
+	externalIPPort() netaddr.IPPort
+	// release does a best effort fire-and-forget release of the
+	// mapping.
+	release()
 }
 
 // HaveMapping reports whether we have a current valid mapping.
 func (c *Client) HaveMapping() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.pmpMapping != nil && c.pmpMapping.useUntil.After(time.Now())
+	now := time.Now()
+	return (c.mapping != nil && c.mapping.renewAfter().After(now)) ||
+		(c.pinhole != nil && c.pinhole.renewAfter().After(now))
 }
 
 // pmpMapping is an already-created PMP mapping.
@@ -87,6 +116,9 @@ func (m *pmpMapping) externalValid() bool {
 	return !m.external.IP().IsZero() && m.external.Port() != 0
 }
 
+func (m *pmpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *pmpMapping) externalIPPort() netaddr.IPPort { return m.external }
+
 // release does a best effort fire-and-forget release of the PMP mapping m.
 func (m *pmpMapping) release() {
 	uc, err := netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
@@ -101,8 +133,9 @@ func (m *pmpMapping) release() {
 // NewClient returns a new portmapping client.
 func NewClient(logf logger.Logf) *Client {
 	return &Client{
-		logf:         logf,
-		ipAndGateway: interfaces.LikelyHomeRouterIP,
+		logf:          logf,
+		ipAndGateway:  interfaces.LikelyHomeRouterIP,
+		ipAndGateway6: interfaces.LikelyHomeRouterIPv6,
 	}
 }
 
@@ -113,14 +146,22 @@ func (c *Client) SetGatewayLookupFunc(f func() (gw, myIP netaddr.IP, ok bool)) {
 	c.ipAndGateway = f
 }
 
+// SetGatewayLookupFunc6 is like SetGatewayLookupFunc, but for the IPv6
+// default router and the global IPv6 address to open pinholes for.
+// If not called, interfaces.LikelyHomeRouterIPv6 is used.
+func (c *Client) SetGatewayLookupFunc6(f func() (gw, myIP netaddr.IP, ok bool)) {
+	c.ipAndGateway6 = f
+}
+
 // NoteNetworkDown should be called when the network has transitioned to a down state.
-// It's too late to release port mappings at this point (the user might've just turned off
-// their wifi), but we can make sure we invalidate mappings for later when the network
-// comes back.
+// It's likely too late to release port mappings at this point (the user might've just
+// turned off their wifi), but we try anyway, as fire-and-forget releases are cheap,
+// and we make sure we invalidate mappings for later when the network comes back.
 func (c *Client) NoteNetworkDown() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.invalidateMappingsLocked(false)
+	c.invalidateMappingsLocked(true)
+	c.invalidatePinholeLocked(true)
 }
 
 func (c *Client) Close() error {
@@ -131,6 +172,7 @@ func (c *Client) Close() error {
 	}
 	c.closed = true
 	c.invalidateMappingsLocked(true)
+	c.invalidatePinholeLocked(true)
 	// TODO: close some future ever-listening UDP socket(s),
 	// waiting for multicast announcements from router.
 	return nil
@@ -148,6 +190,18 @@ func (c *Client) SetLocalPort(localPort uint16) {
 	c.invalidateMappingsLocked(true)
 }
 
+// SetLocalPort6 updates the local IPv6 UDP port number for which we
+// want to open a firewall pinhole. Zero means there's none.
+func (c *Client) SetLocalPort6(localPort uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort6 == localPort {
+		return
+	}
+	c.localPort6 = localPort
+	c.invalidatePinholeLocked(true)
+}
+
 func (c *Client) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
 	gw, myIP, ok = c.ipAndGateway()
 	if !ok {
@@ -166,17 +220,61 @@ func (c *Client) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
 	return
 }
 
+// gatewayAndSelfIP6 is like gatewayAndSelfIP, but for the IPv6
+// default router and the global IPv6 address we'd pinhole. It only
+// invalidates the IPv6 pinhole when they change.
+func (c *Client) gatewayAndSelfIP6() (gw, myIP netaddr.IP, ok bool) {
+	gw, myIP, ok = c.ipAndGateway6()
+	if !ok {
+		gw = netaddr.IP{}
+		myIP = netaddr.IP{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gw != c.lastGW6 || myIP != c.lastMyIP6 || !ok {
+		c.lastMyIP6 = myIP
+		c.lastGW6 = gw
+		c.invalidatePinholeLocked(true)
+	}
+	return
+}
+
 func (c *Client) invalidateMappingsLocked(releaseOld bool) {
-	if c.pmpMapping != nil {
+	if c.mapping != nil {
 		if releaseOld {
-			c.pmpMapping.release()
+			c.mapping.release()
 		}
-		c.pmpMapping = nil
+		c.mapping = nil
 	}
 	c.pmpPubIP = netaddr.IP{}
 	c.pmpPubIPTime = time.Time{}
 	c.pcpSawTime = time.Time{}
 	c.uPnPSawTime = time.Time{}
+	c.uPnPMeta = uPnPDiscoResponse{}
+	c.uPnPControls = nil
+}
+
+// setMappingLocked makes m the current mapping. If the previous
+// mapping was made with a different protocol, it's released, as it
+// would otherwise stay open on the gateway until it expires. Same
+// protocol mappings are renewals of the same port, so they're not.
+func (c *Client) setMappingLocked(m mapping) {
+	if old := c.mapping; old != nil && reflect.TypeOf(old) != reflect.TypeOf(m) {
+		old.release()
+	}
+	c.mapping = m
+}
+
+func (c *Client) invalidatePinholeLocked(releaseOld bool) {
+	if c.pinhole != nil {
+		if releaseOld {
+			c.pinhole.release()
+		}
+		c.pinhole = nil
+	}
+	c.pinholeError = time.Time{}
 }
 
 func (c *Client) sawPMPRecently() bool {
@@ -192,12 +290,20 @@ func (c *Client) sawPMPRecentlyLocked() bool {
 func (c *Client) sawPCPRecently() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.sawPCPRecentlyLocked()
+}
+
+func (c *Client) sawPCPRecentlyLocked() bool {
 	return c.pcpSawTime.After(time.Now().Add(-trustServiceStillAvailableDuration))
 }
 
 func (c *Client) sawUPnPRecently() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.sawUPnPRecentlyLocked()
+}
+
+func (c *Client) sawUPnPRecentlyLocked() bool {
 	return c.uPnPSawTime.After(time.Now().Add(-trustServiceStillAvailableDuration))
 }
 
@@ -265,27 +371,73 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 
 	// Do we have an existing mapping that's valid?
 	now := time.Now()
-	if m := c.pmpMapping; m != nil {
-		if now.Before(m.useUntil) {
+	if m := c.mapping; m != nil {
+		if now.Before(m.renewAfter()) {
 			defer c.mu.Unlock()
-			return m.external, nil
+			return m.externalIPPort(), nil
 		}
 		// The mapping might still be valid, so just try to renew it.
-		prevPort = m.external.Port()
+		prevPort = m.externalIPPort().Port()
 	}
 
 	// If we just did a Probe (e.g. via netchecker) but didn't
-	// find a PMP service, bail out early rather than probing
-	// again. Cuts down latency for most clients.
+	// find a PCP, PMP or UPnP service, bail out early rather than
+	// probing again. Cuts down latency for most clients.
+	haveRecentPCP := c.sawPCPRecentlyLocked()
 	haveRecentPMP := c.sawPMPRecentlyLocked()
 	if haveRecentPMP {
 		m.external = m.external.WithIP(c.pmpPubIP)
 	}
-	if c.lastProbe.After(now.Add(-5*time.Second)) && !haveRecentPMP {
+	haveRecentUPnP := c.sawUPnPRecentlyLocked() && c.uPnPMeta.Location != ""
+	if c.lastProbe.After(now.Add(-5*time.Second)) && !haveRecentPCP && !haveRecentPMP && !haveRecentUPnP {
 		c.mu.Unlock()
 		return netaddr.IPPort{}, NoMappingError{ErrNoPortMappingServices}
 	}
 
+	// Prefer PCP when the gateway speaks it: unlike NAT-PMP, it
+	// also reports the external address in the same round trip,
+	// and its mappings are tied to a nonce that lets us renew
+	// and release them reliably.
+	if haveRecentPCP {
+		prev, _ := c.mapping.(*pcpMapping)
+		c.mu.Unlock()
+		pm, err := c.createPCPMapping(ctx, netaddr.IPPortFrom(gw, pcpPort), m.internal, prev)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.setMappingLocked(pm)
+			return pm.external, nil
+		}
+		if ctx.Err() == context.Canceled {
+			return netaddr.IPPort{}, err
+		}
+		if !haveRecentPMP && !haveRecentUPnP {
+			if IsNoMappingError(err) {
+				return netaddr.IPPort{}, err
+			}
+			return netaddr.IPPort{}, NoMappingError{err}
+		}
+		c.logf("PCP mapping failed, falling back: %v", err)
+		c.mu.Lock()
+	}
+
+	// Prefer NAT-PMP, which is cheaper, if we know it's there.
+	if !haveRecentPMP && haveRecentUPnP {
+		location := c.uPnPMeta.Location
+		c.mu.Unlock()
+		um, err := c.createUPnPMapping(ctx, gw, location, m.internal, prevPort)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return netaddr.IPPort{}, err
+			}
+			return netaddr.IPPort{}, NoMappingError{err}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.setMappingLocked(um)
+		return um.external, nil
+	}
+
 	c.mu.Unlock()
 
 	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
@@ -351,12 +503,69 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 		if m.externalValid() {
 			c.mu.Lock()
 			defer c.mu.Unlock()
-			c.pmpMapping = m
+			c.setMappingLocked(m)
 			return m.external, nil
 		}
 	}
 }
 
+// pinholeRetryInterval is how long CreateOrGetIPv6Pinhole waits after
+// a failure before asking the IPv6 router again. Most routers don't
+// speak PCP, so we don't want to ask on every endpoint update.
+const pinholeRetryInterval = 5 * time.Minute
+
+// CreateOrGetIPv6Pinhole either asks the IPv6 default router, via PCP,
+// to open a firewall pinhole for inbound UDP to the port set by
+// SetLocalPort6, or returns a cached valid one. The returned address
+// is the one peers should send to, which is normally our own global
+// IPv6 address and port.
+//
+// If no pinhole is available, the error will be of type
+// NoMappingError; see IsNoMappingError.
+func (c *Client) CreateOrGetIPv6Pinhole(ctx context.Context) (external netaddr.IPPort, err error) {
+	gw, myIP, ok := c.gatewayAndSelfIP6()
+	if !ok {
+		return netaddr.IPPort{}, NoMappingError{ErrGatewayNotFound}
+	}
+
+	c.mu.Lock()
+	localPort := c.localPort6
+	if localPort == 0 {
+		c.mu.Unlock()
+		return netaddr.IPPort{}, NoMappingError{errors.New("no local IPv6 port")}
+	}
+	now := time.Now()
+	prev := c.pinhole
+	if prev != nil && now.Before(prev.renewAfter()) {
+		defer c.mu.Unlock()
+		return prev.external, nil
+	}
+	if prev == nil && now.Before(c.pinholeError.Add(pinholeRetryInterval)) {
+		c.mu.Unlock()
+		return netaddr.IPPort{}, NoMappingError{ErrNoPortMappingServices}
+	}
+	c.mu.Unlock()
+
+	m, err := c.createPCPMapping(ctx, netaddr.IPPortFrom(gw, pcpPort), netaddr.IPPortFrom(myIP, localPort), prev)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return netaddr.IPPort{}, err
+		}
+		c.pinhole = nil
+		c.pinholeError = time.Now()
+		if IsNoMappingError(err) {
+			return netaddr.IPPort{}, err
+		}
+		return netaddr.IPPort{}, NoMappingError{err}
+	}
+	c.pinhole = m
+	c.pinholeError = time.Time{}
+	return m.external, nil
+}
+
 type pmpResultCode uint16
 
 // NAT-PMP constants.
@@ -509,22 +718,28 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 		switch port {
 		case upnpPort:
 			if mem.Contains(mem.B(buf[:n]), mem.S(":InternetGatewayDevice:")) {
+				meta, err := parseUPnPDiscoResponse(buf[:n])
+				if err != nil {
+					c.logf("unrecognized UPnP discovery response; ignoring")
+					continue
+				}
 				res.UPnP = true
 				c.mu.Lock()
 				c.uPnPSawTime = time.Now()
+				c.uPnPMeta = meta
 				c.mu.Unlock()
 			}
 		case pcpPort: // same as pmpPort
 			if pres, ok := parsePCPResponse(buf[:n]); ok {
 				if pres.OpCode == pcpOpReply|pcpOpAnnounce {
 					pcpHeard = true
-					c.mu.Lock()
-					c.pcpSawTime = time.Now()
-					c.mu.Unlock()
 					switch pres.ResultCode {
 					case pcpCodeOK:
 						c.logf("Got PCP response: epoch: %v", pres.Epoch)
 						res.PCP = true
+						c.mu.Lock()
+						c.pcpSawTime = time.Now()
+						c.mu.Unlock()
 						continue
 					case pcpCodeNotAuthorized:
 						// A PCP service is running, but refuses to
@@ -554,87 +769,8 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	}
 }
 
-const (
-	pcpVersion = 2
-	pcpPort    = 5351
-
-	pcpCodeOK            = 0
-	pcpCodeNotAuthorized = 2
-
-	pcpOpReply    = 0x80 // OR'd into request's op code on response
-	pcpOpAnnounce = 0
-	pcpOpMap      = 1
-)
-
-// pcpAnnounceRequest generates a PCP packet with an ANNOUNCE opcode.
-func pcpAnnounceRequest(myIP netaddr.IP) []byte {
-	// See https://tools.ietf.org/html/rfc6887#section-7.1
-	pkt := make([]byte, 24)
-	pkt[0] = pcpVersion // version
-	pkt[1] = pcpOpAnnounce
-	myIP16 := myIP.As16()
-	copy(pkt[8:], myIP16[:])
-	return pkt
-}
-
-//lint:ignore U1000 moved this code from netcheck's old PCP probing; will be needed when we add PCP mapping
-
-// pcpMapRequest generates a PCP packet with a MAP opcode.
-func pcpMapRequest(myIP netaddr.IP, mapToLocalPort int, delete bool) []byte {
-	const udpProtoNumber = 17
-	lifetimeSeconds := uint32(1)
-	if delete {
-		lifetimeSeconds = 0
-	}
-	const opMap = 1
-
-	// 24 byte header + 36 byte map opcode
-	pkt := make([]byte, (32+32+128)/8+(96+8+24+16+16+128)/8)
-
-	// The header (https://tools.ietf.org/html/rfc6887#section-7.1)
-	pkt[0] = 2 // version
-	pkt[1] = opMap
-	binary.BigEndian.PutUint32(pkt[4:8], lifetimeSeconds)
-	myIP16 := myIP.As16()
-	copy(pkt[8:], myIP16[:])
-
-	// The map opcode body (https://tools.ietf.org/html/rfc6887#section-11.1)
-	mapOp := pkt[24:]
-	rand.Read(mapOp[:12]) // 96 bit mappping nonce
-	mapOp[12] = udpProtoNumber
-	binary.BigEndian.PutUint16(mapOp[16:], uint16(mapToLocalPort))
-	v4unspec := netaddr.MustParseIP("0.0.0.0")
-	v4unspec16 := v4unspec.As16()
-	copy(mapOp[20:], v4unspec16[:])
-	return pkt
-}
-
-type pcpResponse struct {
-	OpCode     uint8
-	ResultCode uint8
-	Lifetime   uint32
-	Epoch      uint32
-}
-
-func parsePCPResponse(b []byte) (res pcpResponse, ok bool) {
-	if len(b) < 24 || b[0] != pcpVersion {
-		return
-	}
-	res.OpCode = b[1]
-	res.ResultCode = b[3]
-	res.Lifetime = binary.BigEndian.Uint32(b[4:])
-	res.Epoch = binary.BigEndian.Uint32(b[8:])
-	return res, true
-}
-
 const (
 	upnpPort = 1900
 )
 
-var uPnPPacket = []byte("M-SEARCH * HTTP/1.1\r\n" +
-	"HOST: 239.255.255.250:1900\r\n" +
-	"ST: ssdp:all\r\n" +
-	"MAN: \"ssdp:discover\"\r\n" +
-	"MX: 2\r\n\r\n")
-
 var pmpReqExternalAddrPacket = []byte{0, 0} // version 0, opcode 0 = "Public address request"
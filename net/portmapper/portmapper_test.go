@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"testing"
 	"time"
+
+	"inet.af/netaddr"
 )
 
 func TestCreateOrGetMapping(t *testing.T) {
@@ -52,3 +54,36 @@ func TestClientProbeThenMap(t *testing.T) {
 	ext, err := c.CreateOrGetMapping(context.Background())
 	t.Logf("CreateOrGetMapping: %v, %v", ext, err)
 }
+
+// testMapping is a mapping that records whether it was released.
+type testMapping struct {
+	released bool
+}
+
+func (m *testMapping) renewAfter() time.Time          { return time.Time{} }
+func (m *testMapping) externalIPPort() netaddr.IPPort { return netaddr.IPPort{} }
+func (m *testMapping) release()                       { m.released = true }
+
+// otherTestMapping is a testMapping of another protocol.
+type otherTestMapping struct{ testMapping }
+
+func TestSetMappingReleasesOtherProtocol(t *testing.T) {
+	c := NewClient(t.Logf)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := &testMapping{}
+	c.setMappingLocked(first)
+	renewed := &testMapping{}
+	c.setMappingLocked(renewed)
+	if first.released {
+		t.Error("same-protocol renewal released the old mapping")
+	}
+	c.setMappingLocked(&otherTestMapping{})
+	if !renewed.released {
+		t.Error("switching protocols didn't release the old mapping")
+	}
+	if _, ok := c.mapping.(*otherTestMapping); !ok {
+		t.Errorf("mapping = %T; want *otherTestMapping", c.mapping)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// References:
+//
+// UPnP Device Architecture: https://openconnectivity.org/upnp-specs/UPnP-arch-DeviceArchitecture-v2.0-20200417.pdf
+// WANIPConnection:2: https://upnp.org/specs/gw/UPnP-gw-WANIPConnection-v2-Service.pdf
+
+const (
+	// upnpHTTPTimeout is how long we wait for the gateway's UPnP
+	// HTTP server to respond to a single request. It's more than
+	// portMapServiceTimeout because we only talk to it once we
+	// know it's there, and cheap routers can be slow to answer.
+	upnpHTTPTimeout = 2 * time.Second
+
+	// upnpLeaseSeconds is the lease duration we request for
+	// mappings, the same as for NAT-PMP.
+	upnpLeaseSeconds = 7200
+
+	// upnpMaxBody is the most we read of any UPnP HTTP response.
+	upnpMaxBody = 1 << 20
+
+	upnpMappingDescription = "tailscale"
+)
+
+// UPnP error codes from the WANIPConnection spec that we handle.
+const (
+	upnpCodeConflictInMappingEntry       = 718
+	upnpCodeOnlyPermanentLeasesSupported = 725
+)
+
+// uPnPDiscoResponse is the part of an SSDP discovery response
+// that we care about.
+type uPnPDiscoResponse struct {
+	Location string // URL of the root device description
+	Server   string
+	USN      string
+}
+
+// parseUPnPDiscoResponse parses an SSDP response, which has the form
+// of an HTTP response without a body.
+func parseUPnPDiscoResponse(body []byte) (uPnPDiscoResponse, error) {
+	var r uPnPDiscoResponse
+	res, err := http.ReadResponse(bufio.NewReaderSize(bytes.NewReader(body), 128), nil)
+	if err != nil {
+		return r, err
+	}
+	r.Location = res.Header.Get("Location")
+	r.Server = res.Header.Get("Server")
+	r.USN = res.Header.Get("Usn")
+	return r, nil
+}
+
+// upnpRoot is a UPnP root device description.
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// upnpWANServiceTypes are the service types that can create port
+// mappings, in order of preference.
+var upnpWANServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// findService returns the first service of type serviceType in d
+// or its embedded devices.
+func (d *upnpDevice) findService(serviceType string) (upnpService, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s, true
+		}
+	}
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].findService(serviceType); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// upnpControl is the WAN connection service of a UPnP gateway that
+// port mapping requests are sent to.
+type upnpControl struct {
+	URL         string // absolute control URL
+	ServiceType string
+}
+
+// upnpWANControl returns the WAN connection service described by the
+// root device description at location, which must be on the gateway gw.
+func (c *Client) upnpWANControl(ctx context.Context, gw netaddr.IP, location string) (upnpControl, error) {
+	locURL, err := upnpURLOnGateway(gw, location)
+	if err != nil {
+		return upnpControl{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, upnpHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", locURL.String(), nil)
+	if err != nil {
+		return upnpControl{}, err
+	}
+	res, err := upnpHTTPClient.Do(req)
+	if err != nil {
+		return upnpControl{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return upnpControl{}, fmt.Errorf("UPnP description: %v", res.Status)
+	}
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(res.Body, upnpMaxBody)).Decode(&root); err != nil {
+		return upnpControl{}, fmt.Errorf("UPnP description: %w", err)
+	}
+	base := locURL
+	if root.URLBase != "" {
+		if base, err = upnpURLOnGateway(gw, root.URLBase); err != nil {
+			return upnpControl{}, err
+		}
+	}
+	for _, st := range upnpWANServiceTypes {
+		svc, ok := root.Device.findService(st)
+		if !ok {
+			continue
+		}
+		u, err := base.Parse(strings.TrimSpace(svc.ControlURL))
+		if err != nil {
+			return upnpControl{}, fmt.Errorf("UPnP control URL: %w", err)
+		}
+		if _, err := upnpURLOnGateway(gw, u.String()); err != nil {
+			return upnpControl{}, err
+		}
+		return upnpControl{URL: u.String(), ServiceType: st}, nil
+	}
+	return upnpControl{}, errors.New("UPnP gateway has no WAN connection service")
+}
+
+// upnpURLOnGateway parses rawurl and checks that it's an http URL on
+// the gateway gw, so that a spoofed or misconfigured SSDP response
+// can't point us at some other host.
+func upnpURLOnGateway(gw netaddr.IP, rawurl string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return nil, fmt.Errorf("bad UPnP URL: %w", err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("UPnP URL %q is not http", rawurl)
+	}
+	if ip, err := netaddr.ParseIP(u.Hostname()); err != nil || ip != gw {
+		return nil, fmt.Errorf("UPnP URL %q is not on gateway %v", rawurl, gw)
+	}
+	return u, nil
+}
+
+var upnpHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:       netns.NewDialer().DialContext,
+		DisableKeepAlives: true,
+	},
+}
+
+// upnpError is a UPnP error returned in a SOAP fault.
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// isUPnPError reports whether err is a upnpError with the given code.
+func isUPnPError(err error, code int) bool {
+	var ue upnpError
+	return errors.As(err, &ue) && ue.Code == code
+}
+
+// upnpArg is a named argument of a SOAP action.
+type upnpArg struct {
+	Name, Value string
+}
+
+// upnpSOAP calls action on the service ctl and returns the response
+// arguments.
+func upnpSOAP(ctx context.Context, ctl upnpControl, action string, args ...upnpArg) (map[string]string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&buf, `<u:%s xmlns:u="%s">`, action, ctl.ServiceType)
+	for _, a := range args {
+		fmt.Fprintf(&buf, "<%s>", a.Name)
+		xml.EscapeText(&buf, []byte(a.Value))
+		fmt.Fprintf(&buf, "</%s>", a.Name)
+	}
+	fmt.Fprintf(&buf, `</u:%s></s:Body></s:Envelope>`, action)
+
+	ctx, cancel := context.WithTimeout(ctx, upnpHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ctl.URL, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, ctl.ServiceType, action))
+	res, err := upnpHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, upnpMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	vals, err := parseSOAPValues(body)
+	if res.StatusCode != 200 {
+		if code, cerr := strconv.Atoi(vals["errorCode"]); err == nil && cerr == nil {
+			return nil, upnpError{Code: code, Description: vals["errorDescription"]}
+		}
+		return nil, fmt.Errorf("UPnP %s: %v", action, res.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s: %w", action, err)
+	}
+	return vals, nil
+}
+
+// parseSOAPValues returns the text of the leaf elements of a SOAP
+// response or fault, keyed by their local names. That's all of the
+// response's arguments, or the fault's errorCode and errorDescription.
+func parseSOAPValues(body []byte) (map[string]string, error) {
+	vals := map[string]string{}
+	d := xml.NewDecoder(bytes.NewReader(body))
+	var name string // current element, if it might be a leaf
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return vals, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name = tok.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if name == tok.Name.Local {
+				vals[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+// upnpMapping is a port mapping created via UPnP.
+//
+// All fields are immutable once created.
+type upnpMapping struct {
+	ctl      upnpControl
+	external netaddr.IPPort
+	internal netaddr.IPPort
+	useUntil time.Time
+}
+
+func (m *upnpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *upnpMapping) externalIPPort() netaddr.IPPort { return m.external }
+
+// release does a best effort fire-and-forget deletion of the UPnP
+// mapping m, in the background.
+func (m *upnpMapping) release() {
+	go func() {
+		upnpSOAP(context.Background(), m.ctl, "DeletePortMapping",
+			upnpArg{"NewRemoteHost", ""},
+			upnpArg{"NewExternalPort", strconv.Itoa(int(m.external.Port()))},
+			upnpArg{"NewProtocol", "UDP"},
+		)
+	}()
+}
+
+// createUPnPMapping asks the UPnP gateway described at location to
+// map a UDP port to internal. It asks for external port prevPort if
+// non-zero, otherwise for the same port as internal's.
+func (c *Client) createUPnPMapping(ctx context.Context, gw netaddr.IP, location string, internal netaddr.IPPort, prevPort uint16) (*upnpMapping, error) {
+	ctl, err := c.upnpControlFor(ctx, gw, location)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := upnpSOAP(ctx, ctl, "GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	extIP, err := netaddr.ParseIP(res["NewExternalIPAddress"])
+	if err != nil || extIP.IsUnspecified() {
+		return nil, fmt.Errorf("UPnP gateway has no usable external IP (%q)", res["NewExternalIPAddress"])
+	}
+
+	extPort := prevPort
+	if extPort == 0 {
+		extPort = internal.Port()
+	}
+	lease := upnpLeaseSeconds
+	for tries := 0; ; tries++ {
+		_, err = upnpSOAP(ctx, ctl, "AddPortMapping",
+			upnpArg{"NewRemoteHost", ""},
+			upnpArg{"NewExternalPort", strconv.Itoa(int(extPort))},
+			upnpArg{"NewProtocol", "UDP"},
+			upnpArg{"NewInternalPort", strconv.Itoa(int(internal.Port()))},
+			upnpArg{"NewInternalClient", internal.IP().String()},
+			upnpArg{"NewEnabled", "1"},
+			upnpArg{"NewPortMappingDescription", upnpMappingDescription},
+			upnpArg{"NewLeaseDuration", strconv.Itoa(lease)},
+		)
+		if err == nil || tries == 2 {
+			break
+		}
+		switch {
+		case isUPnPError(err, upnpCodeOnlyPermanentLeasesSupported) && lease != 0:
+			lease = 0
+		case isUPnPError(err, upnpCodeConflictInMappingEntry):
+			// Someone else has that port; try a random one.
+			extPort = uint16(1024 + rand.Intn(65535-1024))
+		default:
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Renew in half the lease. Permanent mappings don't need
+	// renewing, but re-adding them now and then recreates them
+	// if the gateway rebooted.
+	d := time.Duration(lease) * time.Second / 2
+	if lease == 0 {
+		d = trustServiceStillAvailableDuration
+	}
+	return &upnpMapping{
+		ctl:      ctl,
+		external: netaddr.IPPortFrom(extIP, extPort),
+		internal: internal,
+		useUntil: time.Now().Add(d),
+	}, nil
+}
+
+// upnpControlFor returns the WAN connection service of the gateway
+// described at location, from cache if possible.
+func (c *Client) upnpControlFor(ctx context.Context, gw netaddr.IP, location string) (upnpControl, error) {
+	c.mu.Lock()
+	ctl, ok := c.uPnPControls[location]
+	c.mu.Unlock()
+	if ok {
+		return ctl, nil
+	}
+	ctl, err := c.upnpWANControl(ctx, gw, location)
+	if err != nil {
+		return upnpControl{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uPnPControls == nil {
+		c.uPnPControls = map[string]upnpControl{}
+	}
+	c.uPnPControls[location] = ctl
+	return ctl, nil
+}
+
+var uPnPPacket = []byte("M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"ST: ssdp:all\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n\r\n")
@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParseUPnPDiscoResponse(t *testing.T) {
+	const res = "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=120\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"USN: uuid:bcd3f4a1::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"EXT:\r\n" +
+		"SERVER: AsusWRT/386 UPnP/1.1 MiniUPnPd/2.2.0\r\n" +
+		"LOCATION: http://192.168.1.1:50470/rootDesc.xml\r\n" +
+		"\r\n"
+	got, err := parseUPnPDiscoResponse([]byte(res))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uPnPDiscoResponse{
+		Location: "http://192.168.1.1:50470/rootDesc.xml",
+		Server:   "AsusWRT/386 UPnP/1.1 MiniUPnPd/2.2.0",
+		USN:      "uuid:bcd3f4a1::urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestUPnPURLOnGateway(t *testing.T) {
+	gw := netaddr.MustParseIP("192.168.1.1")
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://192.168.1.1:5000/rootDesc.xml", true},
+		{"http://192.168.1.1/ctl/IPConn", true},
+		{"http://192.168.1.2:5000/rootDesc.xml", false},
+		{"http://router.local:5000/rootDesc.xml", false},
+		{"https://192.168.1.1:5000/rootDesc.xml", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		_, err := upnpURLOnGateway(gw, tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("upnpURLOnGateway(%q) = %v; want ok=%v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestParseSOAPValues(t *testing.T) {
+	vals, err := parseSOAPValues([]byte(upnpFault(725, "OnlyPermanentLeasesSupported")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals["errorCode"] != "725" || vals["errorDescription"] != "OnlyPermanentLeasesSupported" {
+		t.Errorf("got %v", vals)
+	}
+}
+
+const fakeIGDDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+<controlURL>/ctl/L3F</controlURL>
+</service>
+</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service>
+</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>`
+
+func upnpFault(code int, desc string) string {
+	return `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">` +
+		fmt.Sprintf("<errorCode>%d</errorCode><errorDescription>%s</errorDescription>", code, desc) +
+		`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`
+}
+
+// fakeIGD is a fake UPnP Internet Gateway Device that supports the
+// actions used by the Client, and only permanent leases.
+type fakeIGD struct {
+	mu       sync.Mutex
+	actions  []string            // SOAP actions called, in order
+	mappings map[string][]string // external port => internal client, internal port
+}
+
+func (g *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/rootDesc.xml":
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, fakeIGDDesc)
+		return
+	case r.Method == "POST" && r.URL.Path == "/ctl/IPConn":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	const prefix = "urn:schemas-upnp-org:service:WANIPConnection:1#"
+	if !strings.HasPrefix(soapAction, prefix) {
+		http.Error(w, "bad SOAPAction", 400)
+		return
+	}
+	action := strings.TrimPrefix(soapAction, prefix)
+	body, _ := ioutil.ReadAll(r.Body)
+	args, err := parseSOAPValues(body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.actions = append(g.actions, action)
+	var resArgs string
+	switch action {
+	case "GetExternalIPAddress":
+		resArgs = "<NewExternalIPAddress>203.0.113.5</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if args["NewLeaseDuration"] != "0" {
+			w.WriteHeader(500)
+			fmt.Fprint(w, upnpFault(725, "OnlyPermanentLeasesSupported"))
+			return
+		}
+		if args["NewProtocol"] != "UDP" {
+			http.Error(w, "bad protocol", 400)
+			return
+		}
+		g.mappings[args["NewExternalPort"]] = []string{args["NewInternalClient"], args["NewInternalPort"]}
+	case "DeletePortMapping":
+		delete(g.mappings, args["NewExternalPort"])
+	default:
+		w.WriteHeader(500)
+		fmt.Fprint(w, upnpFault(401, "Invalid Action"))
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, resArgs, action)
+}
+
+func (g *fakeIGD) numMappings() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.mappings)
+}
+
+func TestUPnPMapping(t *testing.T) {
+	igd := &fakeIGD{mappings: map[string][]string{}}
+	srv := httptest.NewServer(igd)
+	defer srv.Close()
+
+	// Don't use netns for the loopback server.
+	defer func(old *http.Client) { upnpHTTPClient = old }(upnpHTTPClient)
+	upnpHTTPClient = srv.Client()
+
+	localhost := netaddr.MustParseIP("127.0.0.1")
+	c := NewClient(t.Logf)
+	c.SetGatewayLookupFunc(func() (gw, myIP netaddr.IP, ok bool) {
+		return localhost, localhost, true
+	})
+	c.SetLocalPort(1234)
+	c.gatewayAndSelfIP() // note the gateway, so it doesn't reset the state below
+
+	// Pretend a Probe found the fake IGD.
+	c.mu.Lock()
+	c.lastProbe = time.Now()
+	c.uPnPSawTime = time.Now()
+	c.uPnPMeta = uPnPDiscoResponse{Location: srv.URL + "/rootDesc.xml"}
+	c.mu.Unlock()
+
+	ctx := context.Background()
+	ext, err := c.CreateOrGetMapping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netaddr.MustParseIPPort("203.0.113.5:1234"); ext != want {
+		t.Errorf("external = %v; want %v", ext, want)
+	}
+	if !c.HaveMapping() {
+		t.Error("HaveMapping = false")
+	}
+	igd.mu.Lock()
+	if got := igd.mappings["1234"]; len(got) != 2 || got[0] != "127.0.0.1" || got[1] != "1234" {
+		t.Errorf("IGD mapping = %q", got)
+	}
+	wantActions := "GetExternalIPAddress,AddPortMapping,AddPortMapping"
+	if got := strings.Join(igd.actions, ","); got != wantActions {
+		t.Errorf("actions = %s; want %s", got, wantActions)
+	}
+	igd.mu.Unlock()
+
+	// A second call is served from the cached mapping.
+	if ext2, err := c.CreateOrGetMapping(ctx); err != nil || ext2 != ext {
+		t.Errorf("second CreateOrGetMapping = %v, %v; want %v", ext2, err, ext)
+	}
+	igd.mu.Lock()
+	if n := len(igd.actions); n != 3 {
+		t.Errorf("second call made %d more requests", n-3)
+	}
+	igd.mu.Unlock()
+
+	c.Close()
+	for deadline := time.Now().Add(5 * time.Second); igd.numMappings() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("mapping not deleted on Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
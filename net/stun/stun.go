@@ -17,6 +17,7 @@ const (
 	attrNumSoftware      = 0x8022
 	attrNumFingerprint   = 0x8028
 	attrMappedAddress    = 0x0001
+	attrChangeRequest    = 0x0003 // RFC 5780 Section 7.2
 	attrXorMappedAddress = 0x0020
 	// This alternative attribute type is not
 	// mentioned in the RFC, but the shift into
@@ -30,6 +31,8 @@ const (
 	magicCookie    = "\x21\x12\xa4\x42"
 	lenFingerprint = 8 // 2+byte header + 2-byte length + 4-byte crc32
 	headerLen      = 20
+
+	changeRequestPort = 0x02 // CHANGE-REQUEST "change port" flag
 )
 
 // TxID is a transaction ID.
@@ -47,11 +50,28 @@ func NewTxID() TxID {
 // Request generates a binding request STUN packet.
 // The transaction ID, tID, should be a random sequence of bytes.
 func Request(tID TxID) []byte {
+	return request(tID, false)
+}
+
+// RequestChangePort is like Request, but asks the server to send its
+// response from its alternate port, using the RFC 5780 CHANGE-REQUEST
+// attribute. It's used to test a NAT's filtering behavior, and only
+// makes sense to send to servers known to have an alternate port.
+func RequestChangePort(tID TxID) []byte {
+	return request(tID, true)
+}
+
+func request(tID TxID, changePort bool) []byte {
 	// STUN header, RFC5389 Section 6.
 	const lenAttrSoftware = 4 + len(software)
-	b := make([]byte, 0, headerLen+lenAttrSoftware+lenFingerprint)
+	const lenAttrChangeRequest = 4 + 4
+	attrsLen := lenAttrSoftware + lenFingerprint
+	if changePort {
+		attrsLen += lenAttrChangeRequest
+	}
+	b := make([]byte, 0, headerLen+attrsLen)
 	b = append(b, bindingRequest...)
-	b = appendU16(b, uint16(lenAttrSoftware+lenFingerprint)) // number of bytes following header
+	b = appendU16(b, uint16(attrsLen)) // number of bytes following header
 	b = append(b, magicCookie...)
 	b = append(b, tID[:]...)
 
@@ -60,6 +80,13 @@ func Request(tID TxID) []byte {
 	b = appendU16(b, uint16(len(software)))
 	b = append(b, software...)
 
+	// Attribute CHANGE-REQUEST, RFC5780 Section 7.2.
+	if changePort {
+		b = appendU16(b, attrChangeRequest)
+		b = appendU16(b, 4)
+		b = appendU32(b, changeRequestPort)
+	}
+
 	// Attribute FINGERPRINT, RFC5389 Section 15.5.
 	fp := fingerPrint(b)
 	b = appendU16(b, attrNumFingerprint)
@@ -150,6 +177,24 @@ func foreachAttr(b []byte, fn func(attrType uint16, a []byte) error) error {
 	return nil
 }
 
+// WantsChangedPort reports whether the binding request b asks for
+// its response to be sent from the server's alternate port, as
+// generated by RequestChangePort. It assumes b has already been
+// validated by ParseBindingRequest.
+func WantsChangedPort(b []byte) bool {
+	if len(b) < headerLen {
+		return false
+	}
+	var want bool
+	foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if attrType == attrChangeRequest && len(a) == 4 && binary.BigEndian.Uint32(a)&changeRequestPort != 0 {
+			want = true
+		}
+		return nil
+	})
+	return want
+}
+
 // Response generates a binding response.
 func Response(txID TxID, ip net.IP, port uint16) []byte {
 	if ip4 := ip.To4(); ip4 != nil {
@@ -240,6 +240,24 @@ func TestParseBindingRequest(t *testing.T) {
 	}
 }
 
+func TestRequestChangePort(t *testing.T) {
+	tx := stun.NewTxID()
+	req := stun.RequestChangePort(tx)
+	gotTx, err := stun.ParseBindingRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotTx != tx {
+		t.Errorf("original txID %q != got txID %q", tx, gotTx)
+	}
+	if !stun.WantsChangedPort(req) {
+		t.Error("WantsChangedPort = false for RequestChangePort")
+	}
+	if stun.WantsChangedPort(stun.Request(tx)) {
+		t.Error("WantsChangedPort = true for Request")
+	}
+}
+
 func TestResponse(t *testing.T) {
 	txN := func(n int) (x stun.TxID) {
 		for i := range x {
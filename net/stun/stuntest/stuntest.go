@@ -45,14 +45,46 @@ func ServeWithPacketListener(t testing.TB, ln nettype.PacketListener) (addr *net
 		addr.IP = net.ParseIP("127.0.0.1")
 	}
 	doneCh := make(chan struct{})
-	go runSTUN(t, pc, &stats, doneCh)
+	go runSTUN(t, pc, nil, &stats, doneCh)
 	return addr, func() {
 		pc.Close()
 		<-doneCh
 	}
 }
 
-func runSTUN(t testing.TB, pc net.PacketConn, stats *stunStats, done chan<- struct{}) {
+// ServeAltPort is like Serve, but the server also listens on a second
+// port, altPort, and answers RFC 5780 change-port requests from the
+// port the request didn't arrive on.
+func ServeAltPort(t testing.TB) (addr *net.UDPAddr, altPort int, cleanupFn func()) {
+	t.Helper()
+
+	var stats stunStats
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open STUN listener: %v", err)
+	}
+	altPC, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		pc.Close()
+		t.Fatalf("failed to open STUN alternate port listener: %v", err)
+	}
+	addr = pc.LocalAddr().(*net.UDPAddr)
+	altPort = altPC.LocalAddr().(*net.UDPAddr).Port
+	doneCh := make(chan struct{})
+	altDoneCh := make(chan struct{})
+	go runSTUN(t, pc, altPC, &stats, doneCh)
+	go runSTUN(t, altPC, pc, &stats, altDoneCh)
+	return addr, altPort, func() {
+		pc.Close()
+		altPC.Close()
+		<-doneCh
+		<-altDoneCh
+	}
+}
+
+// runSTUN answers STUN requests on pc until it's closed. If other is
+// non-nil, requests asking for a changed port are answered from it.
+func runSTUN(t testing.TB, pc, other net.PacketConn, stats *stunStats, done chan<- struct{}) {
 	defer close(done)
 
 	var buf [64 << 10]byte
@@ -85,7 +117,11 @@ func runSTUN(t testing.TB, pc net.PacketConn, stats *stunStats, done chan<- stru
 		stats.mu.Unlock()
 
 		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		if _, err := pc.WriteTo(res, addr); err != nil {
+		replyPC := pc
+		if other != nil && stun.WantsChangedPort(pkt) {
+			replyPC = other
+		}
+		if _, err := replyPC.WriteTo(res, addr); err != nil {
 			t.Logf("STUN server write failed: %v", err)
 		}
 	}
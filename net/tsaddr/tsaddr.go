@@ -169,3 +169,20 @@ func NewContainsIPFunc(addrs []netaddr.IPPrefix) func(ip netaddr.IP) bool {
 	}
 	return func(ip netaddr.IP) bool { return m[ip] }
 }
+
+// ContainsExitRoutes reports whether rr contains both the IPv4 and
+// IPv6 /0 routes, as advertised by exit nodes.
+func ContainsExitRoutes(rr []netaddr.IPPrefix) bool {
+	var v4, v6 bool
+	for _, r := range rr {
+		if r.Bits() != 0 {
+			continue
+		}
+		if r.IP().Is4() {
+			v4 = true
+		} else if r.IP().Is6() {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
@@ -101,3 +101,21 @@ func BenchmarkTailscaleServiceAddr(b *testing.B) {
 		sinkIP = TailscaleServiceIP()
 	}
 }
+
+func TestContainsExitRoutes(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	tests := []struct {
+		rr   []netaddr.IPPrefix
+		want bool
+	}{
+		{nil, false},
+		{[]netaddr.IPPrefix{pfx("0.0.0.0/0")}, false},
+		{[]netaddr.IPPrefix{pfx("10.0.0.0/8"), pfx("::/0")}, false},
+		{[]netaddr.IPPrefix{pfx("100.64.1.2/32"), pfx("0.0.0.0/0"), pfx("::/0")}, true},
+	}
+	for _, tt := range tests {
+		if got := ContainsExitRoutes(tt.rr); got != tt.want {
+			t.Errorf("ContainsExitRoutes(%v) = %v; want %v", tt.rr, got, tt.want)
+		}
+	}
+}
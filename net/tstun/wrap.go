@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +21,7 @@ import (
 	"tailscale.com/net/packet"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -68,6 +70,12 @@ type Wrapper struct {
 
 	destIPActivity atomic.Value // of map[netaddr.IP]func()
 
+	// peerMTU holds the path MTUs of the WireGuard routes, for
+	// when some peer's path can't carry packets as large as the TUN
+	// MTU. The MSS of TCP connections routed via such peers is
+	// clamped to fit.
+	peerMTU atomic.Value // of peerMTUTable
+
 	// buffer stores the oldest unconsumed packet from tdev.
 	// It is made a static buffer in order to avoid allocations.
 	buffer [maxBufferSize]byte
@@ -100,6 +108,9 @@ type Wrapper struct {
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
 
+	// captureHook atomically stores the packet capture callback, if any.
+	captureHook atomic.Value // of capture.Callback
+
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
 	PreFilterIn FilterFunc
@@ -157,6 +168,66 @@ func (t *Wrapper) SetDestIPActivityFuncs(m map[netaddr.IP]func()) {
 	t.destIPActivity.Store(m)
 }
 
+// SetPeerMTUs sets the path MTUs of the WireGuard routes, keyed by
+// the peers' AllowedIPs, to clamp the MSS of TCP connections through
+// them to. A packet's route is the longest prefix matching the remote
+// IP, as in WireGuard, and a zero MTU means it isn't clamped. To
+// disable clamping, m should be nil.
+func (t *Wrapper) SetPeerMTUs(m map[netaddr.IPPrefix]int) {
+	tbl := make(peerMTUTable, 0, len(m))
+	for pfx, mtu := range m {
+		tbl = append(tbl, prefixMTU{pfx, mtu})
+	}
+	sort.Slice(tbl, func(i, j int) bool { return tbl[i].pfx.Bits() > tbl[j].pfx.Bits() })
+	t.peerMTU.Store(tbl)
+}
+
+// prefixMTU is a route's path MTU.
+type prefixMTU struct {
+	pfx netaddr.IPPrefix
+	mtu int
+}
+
+// peerMTUTable is a set of route path MTUs, most specific first.
+type peerMTUTable []prefixMTU
+
+// lookup returns the path MTU of the route to ip, or 0 if it isn't
+// clamped.
+func (tbl peerMTUTable) lookup(ip netaddr.IP) int {
+	for _, r := range tbl {
+		if r.pfx.Contains(ip) {
+			return r.mtu
+		}
+	}
+	return 0
+}
+
+// clampMSS lowers the MSS of TCP SYN packet p to fit the path MTU of
+// the route to remote, if one is set.
+func (t *Wrapper) clampMSS(p *packet.Parsed, remote netaddr.IP) {
+	if p.IPProto != ipproto.TCP || p.TCPFlags&packet.TCPSyn == 0 {
+		return
+	}
+	tbl, _ := t.peerMTU.Load().(peerMTUTable)
+	mtu := tbl.lookup(remote)
+	if mtu == 0 {
+		return
+	}
+	hdrLen := 20 + 20 // IPv4 + TCP
+	if p.IPVersion == 6 {
+		hdrLen = 40 + 20
+	}
+	if mtu > hdrLen {
+		p.ClampTCPMSS(uint16(mtu - hdrLen))
+	}
+}
+
+// hasPeerMTUs reports whether any route path MTUs are set.
+func (t *Wrapper) hasPeerMTUs() bool {
+	tbl, _ := t.peerMTU.Load().(peerMTUTable)
+	return len(tbl) > 0
+}
+
 func (t *Wrapper) Close() error {
 	var err error
 	t.closeOnce.Do(func() {
@@ -359,6 +430,7 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 
 	// For injected packets, we return early to bypass filtering.
 	if wasInjectedPacket {
+		t.capture(capture.Outbound, capture.Injected, buf[offset:offset+n])
 		t.noteActivity()
 		return n, nil
 	}
@@ -366,20 +438,19 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 	if !t.disableFilter {
 		response := t.filterOut(p)
 		if response != filter.Accept {
+			t.capture(capture.Outbound, capture.Dropped, buf[offset:offset+n])
 			// Wireguard considers read errors fatal; pretend nothing was read
 			return 0, nil
 		}
 	}
+	t.clampMSS(p, p.Dst.IP())
+	t.capture(capture.Outbound, capture.Accepted, buf[offset:offset+n])
 
 	t.noteActivity()
 	return n, nil
 }
 
-func (t *Wrapper) filterIn(buf []byte) filter.Response {
-	p := parsedPacketPool.Get().(*packet.Parsed)
-	defer parsedPacketPool.Put(p)
-	p.Decode(buf)
-
+func (t *Wrapper) filterIn(p *packet.Parsed) filter.Response {
 	if p.IPProto == ipproto.TSMP {
 		if pingReq, ok := p.AsTSMPPing(); ok {
 			t.noteActivity()
@@ -456,8 +527,14 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 // Write accepts an incoming packet. The packet begins at buf[offset:],
 // like wireguard-go/tun.Device.Write.
 func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
-	if !t.disableFilter {
-		if t.filterIn(buf[offset:]) != filter.Accept {
+	clamp := t.hasPeerMTUs()
+	if !t.disableFilter || clamp {
+		p := parsedPacketPool.Get().(*packet.Parsed)
+		defer parsedPacketPool.Put(p)
+		p.Decode(buf[offset:])
+
+		if !t.disableFilter && t.filterIn(p) != filter.Accept {
+			t.capture(capture.Inbound, capture.Dropped, buf[offset:])
 			// If we're not accepting the packet, lie to wireguard-go and pretend
 			// that everything is okay with a nil error, so wireguard-go
 			// doesn't log about this Write "failure".
@@ -473,12 +550,37 @@ func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
 			// TODO(bradfitz): fix upstream interface docs, implementation.
 			return len(buf), nil
 		}
+		if clamp {
+			t.clampMSS(p, p.Src.IP())
+		}
 	}
+	t.capture(capture.Inbound, capture.Accepted, buf[offset:])
 
 	t.noteActivity()
 	return t.tdev.Write(buf, offset)
 }
 
+// InstallCaptureHook sets the function to call with every packet
+// read from or written to the device, along with whether the packet
+// filter accepted it. A nil cb removes the hook.
+func (t *Wrapper) InstallCaptureHook(cb capture.Callback) {
+	t.captureHook.Store(cb)
+}
+
+// capture passes the packet pkt to the capture hook, if installed.
+func (t *Wrapper) capture(dir capture.Direction, verdict capture.Verdict, pkt []byte) {
+	cb, _ := t.captureHook.Load().(capture.Callback)
+	if cb == nil {
+		return
+	}
+	cb(&capture.Packet{
+		Kind:    capture.KindIP,
+		Dir:     dir,
+		Verdict: verdict,
+		Data:    pkt,
+	})
+}
+
 func (t *Wrapper) GetFilter() *filter.Filter {
 	filt, _ := t.filter.Load().(*filter.Filter)
 	return filt
@@ -507,6 +609,8 @@ func (t *Wrapper) InjectInboundDirect(buf []byte, offset int) error {
 		return errOffsetTooSmall
 	}
 
+	t.capture(capture.Inbound, capture.Injected, buf[offset:])
+
 	// Write to the underlying device to skip filters.
 	_, err := t.tdev.Write(buf, offset)
 	return err
@@ -19,6 +19,7 @@ import (
 	"tailscale.com/net/packet"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -362,6 +363,69 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestCaptureHook(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	// Drain packets written to the TUN.
+	go func() {
+		for {
+			select {
+			case <-tun.closed:
+				return
+			case <-chtun.Inbound:
+			}
+		}
+	}()
+
+	type result struct {
+		dir     capture.Direction
+		verdict capture.Verdict
+		data    string
+	}
+	var got []result
+	tun.InstallCaptureHook(func(p *capture.Packet) {
+		if p.Kind != capture.KindIP {
+			t.Errorf("Kind = %v; want KindIP", p.Kind)
+		}
+		got = append(got, result{p.Dir, p.Verdict, string(p.Data)})
+	})
+
+	goodIn := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+	badIn := udp4("5.6.7.8", "1.2.3.4", 22, 22)
+	goodOut := udp4("1.2.3.4", "5.6.7.8", 98, 98)
+	injected := udp4("1.2.3.4", "5.6.7.8", 98, 99)
+
+	tun.Write(goodIn, 0)
+	tun.Write(badIn, 0)
+	var buf [MaxPacketSize]byte
+	chtun.Outbound <- goodOut
+	tun.Read(buf[:], 0)
+	go tun.InjectOutbound(injected) // blocks until read
+	tun.Read(buf[:], 0)
+
+	want := []result{
+		{capture.Inbound, capture.Accepted, string(goodIn)},
+		{capture.Inbound, capture.Dropped, string(badIn)},
+		{capture.Outbound, capture.Accepted, string(goodOut)},
+		{capture.Outbound, capture.Injected, string(injected)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d captured packets; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("packet %d: got %v/%v; want %v/%v", i, got[i].dir, got[i].verdict, want[i].dir, want[i].verdict)
+		}
+	}
+
+	tun.InstallCaptureHook(nil)
+	tun.Write(goodIn, 0)
+	if len(got) != len(want) {
+		t.Errorf("hook called after removal")
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	ftun, tun := newFakeTUN(t.Logf, false)
 	defer tun.Close()
@@ -479,9 +543,94 @@ func TestPeerAPIBypass(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.w.SetFilter(tt.filter)
 			tt.w.disableTSMPRejected = true
-			if got := tt.w.filterIn(tt.pkt); got != tt.want {
+			p := new(packet.Parsed)
+			p.Decode(tt.pkt)
+			if got := tt.w.filterIn(p); got != tt.want {
 				t.Errorf("got = %v; want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+// tcp4synMSS returns an IPv4 TCP SYN packet from src to dst with an
+// MSS option of mss.
+func tcp4synMSS(src, dst string, mss uint16) []byte {
+	ipHeader := packet.IP4Header{
+		IPProto: ipproto.TCP,
+		Src:     netaddr.MustParseIP(src),
+		Dst:     netaddr.MustParseIP(dst),
+	}
+	tcpHeader := make([]byte, 24)
+	binary.BigEndian.PutUint16(tcpHeader[0:], 1234)
+	binary.BigEndian.PutUint16(tcpHeader[2:], 80)
+	tcpHeader[12] = 6 << 4 // data offset: 6 words
+	tcpHeader[13] |= 2     // SYN
+	tcpHeader[20] = 2      // MSS option
+	tcpHeader[21] = 4
+	binary.BigEndian.PutUint16(tcpHeader[22:], mss)
+
+	both := packet.Generate(ipHeader, tcpHeader)
+	binary.BigEndian.PutUint16(both[2:4], uint16(len(both)))
+	return both
+}
+
+func TestClampMSS(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+
+	tun.SetPeerMTUs(map[netaddr.IPPrefix]int{
+		netaddr.MustParseIPPrefix("100.64.0.2/32"): 1100,
+		netaddr.MustParseIPPrefix("100.64.0.3/32"): 0,
+		netaddr.MustParseIPPrefix("10.0.0.0/24"):   1100, // subnet routed via 100.64.0.2
+		netaddr.MustParseIPPrefix("0.0.0.0/0"):     1200, // exit node
+	})
+	mssOf := func(pkt []byte) uint16 {
+		return binary.BigEndian.Uint16(pkt[len(pkt)-2:])
+	}
+
+	// Outbound, to the peer with a small path MTU.
+	chtun.Outbound <- tcp4synMSS("100.64.0.1", "100.64.0.2", 1240)
+	var buf [MaxPacketSize]byte
+	n, err := tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mssOf(buf[:n]), uint16(1100-40); got != want {
+		t.Errorf("outbound MSS = %d; want %d", got, want)
+	}
+
+	// Outbound, to another peer.
+	chtun.Outbound <- tcp4synMSS("100.64.0.1", "100.64.0.3", 1240)
+	n, err = tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mssOf(buf[:n]), uint16(1240); got != want {
+		t.Errorf("outbound MSS to unclamped peer = %d; want %d", got, want)
+	}
+
+	// Outbound, to a subnet behind the peer, and to the internet
+	// via an exit node.
+	for _, tt := range []struct {
+		dst  string
+		want uint16
+	}{
+		{"10.0.0.5", 1100 - 40},
+		{"8.8.8.8", 1200 - 40},
+	} {
+		chtun.Outbound <- tcp4synMSS("100.64.0.1", tt.dst, 1240)
+		n, err = tun.Read(buf[:], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mssOf(buf[:n]); got != tt.want {
+			t.Errorf("outbound MSS to %v = %d; want %d", tt.dst, got, tt.want)
+		}
+	}
+
+	// Inbound, from the peer with a small path MTU.
+	go tun.Write(tcp4synMSS("100.64.0.2", "100.64.0.1", 1240), 0)
+	if got, want := mssOf(<-chtun.Inbound), uint16(1100-40); got != want {
+		t.Errorf("inbound MSS = %d; want %d", got, want)
+	}
+}
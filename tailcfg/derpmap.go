@@ -119,6 +119,13 @@ type DERPNode struct {
 	// To disable STUN on this node, use -1.
 	STUNPort int `json:",omitempty"`
 
+	// STUNAltPort optionally specifies a second STUN port on the
+	// same IP. A server with one also honors RFC 5780
+	// CHANGE-REQUEST "change port" requests by replying from the
+	// other port, which clients use to classify their NAT.
+	// Zero means none.
+	STUNAltPort int `json:",omitempty"`
+
 	// STUNOnly marks a node as only a STUN server and not a DERP
 	// server.
 	STUNOnly bool `json:",omitempty"`
@@ -117,6 +117,7 @@ var _HostinfoNeedsRegeneration = Hostinfo(struct {
 	Hostname      string
 	ShieldsUp     bool
 	ShareeNode    bool
+	PeerRelay     bool
 	GoArch        string
 	RoutableIPs   []netaddr.IPPrefix
 	RequestTags   []string
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -82,6 +83,21 @@ func (s *Server) WhoIs(addr string) (w *apitype.WhoIsResponse, ok bool) {
 	}, true
 }
 
+// HandlePeerAPI registers h to serve requests from other Tailscale
+// nodes to this node's peer API under "/v0/ext/<name>/". The handler
+// can identify the calling node and user with
+// ipnlocal.PeerAPICallerFromContext. The name is advertised to peers
+// so they can discover the service.
+//
+// See ipnlocal.LocalBackend.HandlePeerAPI for details.
+func (s *Server) HandlePeerAPI(name string, h http.Handler) (unregister func(), err error) {
+	s.initOnce.Do(s.doInit)
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	return s.lb.HandlePeerAPI(name, h)
+}
+
 func (s *Server) doInit() {
 	if err := s.start(); err != nil {
 		s.initErr = fmt.Errorf("tsnet: %w", err)
@@ -12,6 +12,8 @@ import (
 	"math"
 	"strconv"
 	"strings"
+
+	"inet.af/netaddr"
 )
 
 type portValue struct{ n *uint16 }
@@ -44,3 +46,37 @@ func (p portValue) Set(v string) error {
 	*p.n = uint16(n)
 	return nil
 }
+
+type ipPortsValue struct{ ipps *[]netaddr.IPPort }
+
+// IPPortsValue returns a flag.Value that appends an ip:port to dst
+// each time the flag is given.
+func IPPortsValue(dst *[]netaddr.IPPort) flag.Value {
+	return ipPortsValue{dst}
+}
+
+func (v ipPortsValue) String() string {
+	if v.ipps == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for i, ipp := range *v.ipps {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(ipp.String())
+	}
+	return sb.String()
+}
+
+func (v ipPortsValue) Set(s string) error {
+	ipp, err := netaddr.ParseIPPort(s)
+	if err != nil {
+		return fmt.Errorf("expecting ip:port: %w", err)
+	}
+	if ipp.Port() == 0 {
+		return errors.New("port must be non-zero")
+	}
+	*v.ipps = append(*v.ipps, ipp)
+	return nil
+}
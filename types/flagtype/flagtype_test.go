@@ -0,0 +1,80 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flagtype
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestIPPortsValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []netaddr.IPPort
+		wantStr string
+		wantErr bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:    "one",
+			args:    []string{"-ep=1.2.3.4:41641"},
+			want:    []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41641")},
+			wantStr: "1.2.3.4:41641",
+		},
+		{
+			name: "repeated",
+			args: []string{"-ep=1.2.3.4:41641", "-ep=[2001:db8::1]:443"},
+			want: []netaddr.IPPort{
+				netaddr.MustParseIPPort("1.2.3.4:41641"),
+				netaddr.MustParseIPPort("[2001:db8::1]:443"),
+			},
+			wantStr: "1.2.3.4:41641,[2001:db8::1]:443",
+		},
+		{
+			name:    "no_port",
+			args:    []string{"-ep=1.2.3.4"},
+			wantErr: true,
+		},
+		{
+			name:    "hostname",
+			args:    []string{"-ep=example.com:41641"},
+			wantErr: true,
+		},
+		{
+			name:    "port_zero",
+			args:    []string{"-ep=1.2.3.4:0"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []netaddr.IPPort
+			v := IPPortsValue(&got)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			fs.Var(v, "ep", "")
+			err := fs.Parse(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse error = %v; wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+			if s := v.String(); s != tt.wantStr {
+				t.Errorf("String = %q; want %q", s, tt.wantStr)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capture records packets passing through the engine
+// (tunnel traffic and disco frames) and writes them out in pcapng
+// format for debugging.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kind is the type of a captured packet.
+type Kind uint8
+
+const (
+	// KindIP is an IP packet seen by the TUN wrapper.
+	KindIP Kind = iota
+	// KindDisco is a decrypted disco message payload.
+	KindDisco
+)
+
+// Direction is the direction a captured packet travels, relative to
+// the network (as in tstun): inbound packets came from a peer,
+// outbound packets are headed to one.
+type Direction uint8
+
+const (
+	Inbound Direction = iota + 1
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return "unknown"
+}
+
+// Verdict is what happened to a captured packet.
+type Verdict uint8
+
+const (
+	// Accepted packets passed the packet filter.
+	Accepted Verdict = iota
+	// Dropped packets were seen before the packet filter and
+	// were rejected by it.
+	Dropped
+	// Injected packets were synthesized locally (by netstack,
+	// TSMP, MagicDNS, etc) and bypassed the packet filter.
+	Injected
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accepted:
+		return "accepted"
+	case Dropped:
+		return "dropped"
+	case Injected:
+		return "injected"
+	}
+	return "unknown"
+}
+
+// Packet is a packet handed to a Callback.
+type Packet struct {
+	Kind    Kind
+	Dir     Direction
+	Verdict Verdict
+	// Peer optionally describes the remote end, such as the
+	// ip:port a disco message was sent to or received from.
+	Peer string
+	// Data is the packet contents. It is only valid for the
+	// duration of the callback.
+	Data []byte
+}
+
+// Callback is the type of function called for each captured packet.
+// It must not block or retain p or p.Data.
+type Callback func(p *Packet)
+
+// queueSize is the number of packets a Sink buffers before it starts
+// dropping them because its writer is too slow.
+const queueSize = 512
+
+// snapLen is the maximum packet length recorded.
+const snapLen = 65535
+
+type record struct {
+	when time.Time
+	p    Packet
+}
+
+// A Sink writes captured packets to an io.Writer in pcapng format.
+//
+// Packets are written by a separate goroutine. If the writer can't
+// keep up, packets are dropped rather than slowing down the data path.
+type Sink struct {
+	w    io.Writer
+	ch   chan record
+	done chan struct{}
+	stop chan struct{}
+	once sync.Once
+
+	mu      sync.Mutex
+	err     error
+	dropped int
+}
+
+// NewSink returns a new Sink that writes a pcapng stream to w,
+// starting with the section and interface headers.
+// The caller must call Close when done.
+func NewSink(w io.Writer) *Sink {
+	s := &Sink{
+		w:    w,
+		ch:   make(chan record, queueSize),
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Capture enqueues a copy of p to be written. It never blocks.
+// It has the signature of a Callback.
+func (s *Sink) Capture(p *Packet) {
+	r := record{when: time.Now(), p: *p}
+	n := len(p.Data)
+	if n > snapLen {
+		n = snapLen
+	}
+	r.p.Data = append([]byte(nil), p.Data[:n]...)
+	select {
+	case s.ch <- r:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of packets dropped because the writer
+// was too slow.
+func (s *Sink) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Done returns a channel that's closed when the Sink stops writing,
+// either because Close was called or because a write failed.
+func (s *Sink) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error that stopped the Sink, if any.
+func (s *Sink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the Sink and waits for its writer goroutine to exit.
+// Packets still queued are discarded.
+func (s *Sink) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+func (s *Sink) run() {
+	defer close(s.done)
+	if err := s.write(appendHeader(nil)); err != nil {
+		return
+	}
+	var buf []byte
+	for {
+		select {
+		case <-s.stop:
+			return
+		case r := <-s.ch:
+			buf = appendPacket(buf[:0], r.when, &r.p)
+			if err := s.write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Sink) write(b []byte) error {
+	_, err := s.w.Write(b)
+	if err != nil {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// pcapng block types, link types and option codes.
+// See https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-03.html.
+const (
+	blockSHB = 0x0A0D0D0A // section header block
+	blockIDB = 0x00000001 // interface description block
+	blockEPB = 0x00000006 // enhanced packet block
+
+	linkTypeRaw   = 101 // raw IPv4/IPv6
+	linkTypeUser0 = 147 // private use; disco messages
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optIfName   = 2 // in IDB
+	optEPBFlags = 2 // in EPB
+
+	byteOrderMagic = 0x1A2B3C4D
+)
+
+// interfaceID returns the pcapng interface ID for k, which is its
+// index in the IDBs written by appendHeader.
+func interfaceID(k Kind) uint32 {
+	if k == KindDisco {
+		return 1
+	}
+	return 0
+}
+
+// appendHeader appends the section header and the two interface
+// description blocks (IP packets, then disco messages) to b.
+func appendHeader(b []byte) []byte {
+	b = appendBlock(b, blockSHB, func(b []byte) []byte {
+		b = appendUint32(b, byteOrderMagic)
+		b = appendUint16(b, 1) // major version
+		b = appendUint16(b, 0) // minor version
+		b = appendUint64(b, ^uint64(0))
+		return b
+	})
+	for _, iface := range []struct {
+		linkType uint16
+		name     string
+	}{
+		{linkTypeRaw, "tailscale"},
+		{linkTypeUser0, "disco"},
+	} {
+		b = appendBlock(b, blockIDB, func(b []byte) []byte {
+			b = appendUint16(b, iface.linkType)
+			b = appendUint16(b, 0) // reserved
+			b = appendUint32(b, snapLen)
+			b = appendOption(b, optIfName, []byte(iface.name))
+			return appendUint32(b, optEndOfOpt)
+		})
+	}
+	return b
+}
+
+// appendPacket appends an enhanced packet block for p, captured at
+// time when, to b.
+func appendPacket(b []byte, when time.Time, p *Packet) []byte {
+	return appendBlock(b, blockEPB, func(b []byte) []byte {
+		us := uint64(when.UnixNano() / 1e3) // default if_tsresol is microseconds
+		b = appendUint32(b, interfaceID(p.Kind))
+		b = appendUint32(b, uint32(us>>32))
+		b = appendUint32(b, uint32(us))
+		b = appendUint32(b, uint32(len(p.Data)))
+		b = appendUint32(b, uint32(len(p.Data)))
+		b = append(b, p.Data...)
+		b = pad(b)
+
+		// The low two bits of epb_flags are the direction:
+		// 1 is inbound, 2 is outbound.
+		var flags [4]byte
+		binary.LittleEndian.PutUint32(flags[:], uint32(p.Dir))
+		b = appendOption(b, optEPBFlags, flags[:])
+		comment := p.Verdict.String()
+		if p.Peer != "" {
+			comment += " " + p.Dir.String() + " " + p.Peer
+		}
+		b = appendOption(b, optComment, []byte(comment))
+		return appendUint32(b, optEndOfOpt)
+	})
+}
+
+// appendBlock appends a block of type typ to b, with a body written
+// by body and the leading and trailing total length fields.
+func appendBlock(b []byte, typ uint32, body func([]byte) []byte) []byte {
+	start := len(b)
+	b = appendUint32(b, typ)
+	b = appendUint32(b, 0) // total length, filled in below
+	b = body(b)
+	n := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], n)
+	return appendUint32(b, n)
+}
+
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(val)))
+	b = append(b, val...)
+	return pad(b)
+}
+
+// pad pads b with zeros to a multiple of 4 bytes.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
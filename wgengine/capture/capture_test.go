@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// parseBlocks splits a pcapng stream into blocks, checking that the
+// leading and trailing lengths agree.
+func parseBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	var ret []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("short block: %d bytes left", len(b))
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) {
+			t.Fatalf("bad block length %d", n)
+		}
+		if trail := binary.LittleEndian.Uint32(b[n-4:]); trail != n {
+			t.Fatalf("trailing length %d != %d", trail, n)
+		}
+		ret = append(ret, block{typ, b[8 : n-4]})
+		b = b[n:]
+	}
+	return ret
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.b.Bytes()...)
+}
+
+func TestSink(t *testing.T) {
+	var buf syncBuffer
+	s := NewSink(&buf)
+	data := []byte{0x45, 0, 0, 20, 1, 2, 3}
+	s.Capture(&Packet{Kind: KindIP, Dir: Outbound, Verdict: Dropped, Data: data})
+	data[0] = 0 // Capture must have copied it
+	s.Capture(&Packet{Kind: KindDisco, Dir: Inbound, Verdict: Accepted, Peer: "1.2.3.4:41641", Data: []byte{1}})
+
+	var blocks []block
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		blocks = parseBlocks(t, buf.Bytes())
+		if len(blocks) >= 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d blocks; want 5", len(blocks))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	wantTypes := []uint32{blockSHB, blockIDB, blockIDB, blockEPB, blockEPB}
+	for i, b := range blocks {
+		if b.typ != wantTypes[i] {
+			t.Errorf("block %d type = %#x; want %#x", i, b.typ, wantTypes[i])
+		}
+	}
+	if got := binary.LittleEndian.Uint32(blocks[0].body); got != byteOrderMagic {
+		t.Errorf("byte order magic = %#x", got)
+	}
+	if got := binary.LittleEndian.Uint16(blocks[1].body); got != linkTypeRaw {
+		t.Errorf("first interface link type = %d", got)
+	}
+	if got := binary.LittleEndian.Uint16(blocks[2].body); got != linkTypeUser0 {
+		t.Errorf("second interface link type = %d", got)
+	}
+
+	epb := blocks[3].body
+	if iface := binary.LittleEndian.Uint32(epb); iface != 0 {
+		t.Errorf("IP packet interface = %d; want 0", iface)
+	}
+	capLen := binary.LittleEndian.Uint32(epb[12:])
+	if capLen != uint32(len(data)) {
+		t.Fatalf("captured length = %d; want %d", capLen, len(data))
+	}
+	if got := epb[20 : 20+capLen]; got[0] != 0x45 {
+		t.Errorf("packet data = % x; not copied on capture", got)
+	}
+	opts := epb[20+(capLen+3)&^3:]
+	if code, flags := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint32(opts[4:]); code != optEPBFlags || flags != 2 {
+		t.Errorf("epb_flags option = %d, %d; want %d, 2", code, flags, optEPBFlags)
+	}
+	if !bytes.Contains(opts, []byte("dropped")) {
+		t.Errorf("options %q don't contain verdict", opts)
+	}
+
+	epb = blocks[4].body
+	if iface := binary.LittleEndian.Uint32(epb); iface != 1 {
+		t.Errorf("disco interface = %d; want 1", iface)
+	}
+	if !bytes.Contains(epb, []byte("accepted in 1.2.3.4:41641")) {
+		t.Errorf("disco block %q missing comment", epb)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("boom") }
+
+func TestSinkWriteError(t *testing.T) {
+	s := NewSink(errWriter{})
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink didn't stop after write error")
+	}
+	if err := s.Err(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Err = %v; want boom", err)
+	}
+	s.Capture(&Packet{Data: []byte{1}}) // must not block or panic
+	s.Close()
+}
@@ -279,6 +279,29 @@ func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 
+// Matches returns a copy of the rules f enforces: its IPv4 rules,
+// followed by its IPv6 rules. A rule given to New that covers both
+// address families appears once in each half.
+func (f *Filter) Matches() []Match {
+	ret := make([]Match, 0, len(f.matches4)+len(f.matches6))
+	for _, m := range f.matches4 {
+		ret = append(ret, *m.Clone())
+	}
+	for _, m := range f.matches6 {
+		ret = append(ret, *m.Clone())
+	}
+	return ret
+}
+
+// LocalNets returns the prefixes that incoming packets must be
+// destined to.
+func (f *Filter) LocalNets() []netaddr.IPPrefix {
+	if f.local == nil {
+		return nil
+	}
+	return f.local.Prefixes()
+}
+
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
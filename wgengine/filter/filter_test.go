@@ -817,3 +817,42 @@ func TestMatchesFromFilterRules(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchesAccessor(t *testing.T) {
+	dual := Match{
+		IPProto: defaultProtos,
+		Srcs:    nets("100.64.1.1", "fd7a:115c:a1e0::1"),
+		Dsts:    netports("100.64.2.2:22", "fd7a:115c:a1e0::2:22"),
+	}
+	var localNets netaddr.IPSetBuilder
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("100.64.2.2/32"))
+	localNetsSet, _ := localNets.IPSet()
+	f := New([]Match{dual}, localNetsSet, localNetsSet, nil, t.Logf)
+
+	got := f.Matches()
+	if len(got) != 2 {
+		t.Fatalf("got %d matches; want 2: %v", len(got), got)
+	}
+	want4 := Match{
+		IPProto: defaultProtos,
+		Srcs:    nets("100.64.1.1"),
+		Dsts:    netports("100.64.2.2:22"),
+	}
+	if !reflect.DeepEqual(got[0], want4) {
+		t.Errorf("IPv4 match = %v; want %v", got[0], want4)
+	}
+	if !got[1].Srcs[0].IP().Is6() || !got[1].Dsts[0].Net.IP().Is6() {
+		t.Errorf("IPv6 match = %v", got[1])
+	}
+	got[0].Srcs[0] = netaddr.MustParseIPPrefix("1.2.3.4/32")
+	if f.Matches()[0].Srcs[0] == got[0].Srcs[0] {
+		t.Error("Matches returned memory aliased with the filter")
+	}
+
+	if nets := f.LocalNets(); len(nets) != 1 || nets[0] != netaddr.MustParseIPPrefix("100.64.2.2/32") {
+		t.Errorf("LocalNets = %v", nets)
+	}
+	if f.ShieldsUp() {
+		t.Error("ShieldsUp = true")
+	}
+}
@@ -40,6 +40,7 @@ import (
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/portmapper"
@@ -54,6 +55,7 @@ import (
 	"tailscale.com/types/wgkey"
 	"tailscale.com/util/uniq"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -124,6 +126,9 @@ type Conn struct {
 	noteRecvActivity func(tailcfg.DiscoKey) // or nil, see Options.NoteRecvActivity
 	simulatedNetwork bool
 	disableLegacy    bool
+	staticEndpoints  []netaddr.IPPort
+	pathMTUFunc      func(tailcfg.NodeKey, int) // or nil
+	hardNATTraversal bool
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -159,9 +164,34 @@ type Conn struct {
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
 
+	// captureHook, if it holds a non-nil func, is called with the
+	// payload of every disco message sent or received.
+	captureHook atomic.Value // of capture.Callback
+
+	// nat64Prefix holds the NAT64 prefix from the most recent
+	// netcheck report, zero if the network has none. If set, IPv4
+	// destinations are reached through it. See nat64Dst.
+	nat64Prefix atomic.Value // of netaddr.IPPrefix
+
+	// hardNATAddr holds this node's public IPv4 address if the
+	// most recent netcheck report found it behind a hard NAT, and
+	// hardNATTraversal is on; the zero IP otherwise. See spray.go.
+	hardNATAddr atomic.Value // of netaddr.IP
+
+	// sprayRoutes maps peer endpoints found by port spraying to
+	// the spray sockets that reach them. It's replaced, not
+	// modified, with sprayMu held. See Conn.sprayRoute.
+	sprayRoutes  atomic.Value // of map[netaddr.IPPort]*sprayConn
+	sprayMu      sync.Mutex   // also guards sprayConn.locked and closed
+	spraySockets int          // open or reserved spray sockets; guarded by sprayMu
+
 	// derpRecvCh is used by receiveDERP to read DERP messages.
 	derpRecvCh chan derpReadResult
 
+	// sprayRecvCh is used by receiveSpray to read packets from
+	// spray sockets.
+	sprayRecvCh chan sprayReadResult
+
 	// bind is the wireguard-go conn.Bind for Conn.
 	bind *connBind
 
@@ -170,6 +200,9 @@ type Conn struct {
 	// hot flows.
 	ippEndpoint4, ippEndpoint6 ippEndpointCache
 
+	// ippEndpointSpray is likewise owned by receiveSpray.
+	ippEndpointSpray ippEndpointCache
+
 	// ============================================================
 	mu     sync.Mutex // guards all following fields; see userspaceEngine lock ordering rules
 	muCond *sync.Cond
@@ -233,6 +266,12 @@ type Conn struct {
 	nodeOfDisco map[tailcfg.DiscoKey]*tailcfg.Node
 	discoOfNode map[tailcfg.NodeKey]tailcfg.DiscoKey
 	discoOfAddr map[netaddr.IPPort]tailcfg.DiscoKey // validated non-DERP paths only
+	// relayIDOfNode and relayNodeOfID map the peers that offer to
+	// relay (tailcfg.Hostinfo.PeerRelay) to and from the relay ID
+	// used as the port of their relayMagicIP paths.
+	relayIDOfNode map[tailcfg.NodeKey]uint16
+	relayNodeOfID map[uint16]tailcfg.NodeKey
+	lastRelayID   uint16 // last relay ID assigned
 	// endpointsOfDisco tracks the wireguard-go endpoints for peers
 	// with recent activity.
 	endpointOfDisco map[tailcfg.DiscoKey]*discoEndpoint // those with activity only
@@ -275,6 +314,10 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// lastNetCheckReport is the most recent netcheck.Report from
+	// updateNetInfo, or nil if none has completed yet.
+	lastNetCheckReport *netcheck.Report
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
 	privateKey  key.Private        // WireGuard private key for this node
@@ -311,6 +354,10 @@ type Conn struct {
 
 	// havePrivateKey is whether privateKey is non-zero.
 	havePrivateKey syncs.AtomicBool
+
+	// peerRelay is whether this node relays packets between peers
+	// that can't reach each other directly. See relay.go.
+	peerRelay syncs.AtomicBool
 }
 
 // derpRoute is a route entry for a public key, saying that a certain
@@ -420,6 +467,22 @@ type Options struct {
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
+
+	// StaticEndpoints optionally specifies endpoints to always
+	// advertise, in addition to those discovered, such as the
+	// public side of a manually configured port forward.
+	StaticEndpoints []netaddr.IPPort
+
+	// PathMTUFunc optionally provides a func to be called when the
+	// discovered MTU of the path to a peer changes. The mtu is the
+	// largest tunnel packet known to make it, or 0 if unknown.
+	// See pathmtu.go.
+	PathMTUFunc func(peer tailcfg.NodeKey, mtu int)
+
+	// HardNATTraversal enables port spraying to reach peers from
+	// behind a hard NAT, and answering peers that do so. It only
+	// helps if the peer enables it too. See spray.go.
+	HardNATTraversal bool
 }
 
 func (o *Options) logf() logger.Logf {
@@ -452,6 +515,7 @@ func newConn() *Conn {
 		addrsByUDP:      make(map[netaddr.IPPort]*addrSet),
 		addrsByKey:      make(map[key.Public]*addrSet),
 		derpRecvCh:      make(chan derpReadResult),
+		sprayRecvCh:     make(chan sprayReadResult),
 		derpStarted:     make(chan struct{}),
 		peerLastDerp:    make(map[key.Public]int),
 		endpointOfDisco: make(map[tailcfg.DiscoKey]*discoEndpoint),
@@ -480,6 +544,9 @@ func NewConn(opts Options) (*Conn, error) {
 	c.noteRecvActivity = opts.NoteRecvActivity
 	c.simulatedNetwork = opts.SimulatedNetwork
 	c.disableLegacy = opts.DisableLegacyNetworking
+	c.staticEndpoints = append([]netaddr.IPPort(nil), opts.StaticEndpoints...)
+	c.pathMTUFunc = opts.PathMTUFunc
+	c.hardNATTraversal = opts.HardNATTraversal
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "))
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
@@ -668,6 +735,18 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
+	if old := c.nat64(); old != report.NAT64Prefix {
+		c.logf("magicsock: NAT64 prefix %v (was %v)", report.NAT64Prefix, old)
+		c.nat64Prefix.Store(report.NAT64Prefix)
+	}
+	if c.hardNATTraversal {
+		c.updateHardNAT(report)
+	}
+	health.SetNetcheckResult(report.UDPBlocked, report.CaptivePortal.EqualBool(true), report.HTTPSProxy)
+
+	c.mu.Lock()
+	c.lastNetCheckReport = report
+	c.mu.Unlock()
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -703,6 +782,63 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	return report, nil
 }
 
+// LastNetcheckReport returns the most recent netcheck report used to
+// determine endpoints and the home DERP region, or nil if none has
+// completed yet. The returned report must not be mutated.
+func (c *Conn) LastNetcheckReport() *netcheck.Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastNetCheckReport
+}
+
+// RunNetcheck runs an endpoint update now, including a netcheck with
+// the Conn's own sockets and state, and returns the netcheck report.
+// If an endpoint update is already running, it waits for that to
+// finish first. If ctx is done first, RunNetcheck returns early,
+// leaving the update to finish in the background.
+func (c *Conn) RunNetcheck(ctx context.Context) (*netcheck.Report, error) {
+	// Wake up the waits below when ctx is done.
+	waitDone := make(chan struct{})
+	defer close(waitDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.muCond.Broadcast()
+			c.mu.Unlock()
+		case <-waitDone:
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wait := func() error {
+		for c.endpointsUpdateActive && !c.closed && ctx.Err() == nil {
+			c.muCond.Wait()
+		}
+		if c.closed {
+			return errConnClosed
+		}
+		return ctx.Err()
+	}
+	if err := wait(); err != nil {
+		return nil, err
+	}
+	if c.privateKey.IsZero() && c.everHadKey {
+		return nil, errors.New("magicsock: stopped, no private key")
+	}
+	old := c.lastNetCheckReport
+	c.endpointsUpdateActive = true
+	go c.updateEndpoints("netcheck-api")
+	if err := wait(); err != nil {
+		return nil, err
+	}
+	if r := c.lastNetCheckReport; r != nil && r != old {
+		return r, nil
+	}
+	return nil, errors.New("netcheck failed; see tailscaled logs")
+}
+
 var processStartUnixNano = time.Now().UnixNano()
 
 // pickDERPFallback returns a non-zero but deterministic DERP node to
@@ -878,6 +1014,10 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 // c.mu must be held
 func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netaddr.IPPort) {
 	res.LatencySeconds = latency.Seconds()
+	if isRelayPath(ep) {
+		res.PeerRelay = c.relayNameLocked(ep)
+		return
+	}
 	if ep.IP() != derpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -1002,6 +1142,11 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 	} else if !portmapper.IsNoMappingError(err) {
 		c.logf("portmapper: %v", err)
 	}
+	if ext, err := c.portMapper.CreateOrGetIPv6Pinhole(ctx); err == nil {
+		addAddr(ext, tailcfg.EndpointPortmapped)
+	} else if !portmapper.IsNoMappingError(err) {
+		c.logf("portmapper: IPv6 pinhole: %v", err)
+	}
 
 	if nr.GlobalV4 != "" {
 		addAddr(ipp(nr.GlobalV4), tailcfg.EndpointSTUN)
@@ -1021,6 +1166,12 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		addAddr(ipp(nr.GlobalV6), tailcfg.EndpointSTUN)
 	}
 
+	// Endpoints the user configured, typically the public side of
+	// manual port forwards that STUN can't discover.
+	for _, ep := range c.staticEndpoints {
+		addAddr(ep, tailcfg.EndpointExplicitConf)
+	}
+
 	c.ignoreSTUNPackets()
 
 	if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
@@ -1129,9 +1280,48 @@ var udpAddrPool = &sync.Pool{
 // sendUDP sends UDP packet b to ipp.
 // See sendAddr's docs on the return value meanings.
 func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+	if sc := c.sprayRoute(ipp); sc != nil {
+		return sc.send(ipp, b)
+	}
 	ua := udpAddrPool.Get().(*net.UDPAddr)
 	defer udpAddrPool.Put(ua)
-	return c.sendUDPStd(ipp.UDPAddrAt(ua), b)
+	return c.sendUDPStd(c.nat64Dst(ipp).UDPAddrAt(ua), b)
+}
+
+// nat64 returns the network's NAT64 prefix, or the zero prefix if
+// it has none.
+func (c *Conn) nat64() netaddr.IPPrefix {
+	pfx, _ := c.nat64Prefix.Load().(netaddr.IPPrefix)
+	return pfx
+}
+
+// nat64Dst returns the address to send packets for ipp to. That's
+// ipp itself, unless the network is IPv6-only with NAT64 and ipp is a
+// globally routable IPv4 address, in which case it's ipp's NAT64
+// address. Private, CGNAT and link-local addresses are left alone:
+// they're not reachable through a NAT64, if at all.
+func (c *Conn) nat64Dst(ipp netaddr.IPPort) netaddr.IPPort {
+	if !c.noV4.Get() || !nat64.IsGlobalIPv4(ipp.IP()) {
+		return ipp
+	}
+	if ip6 := nat64.Synthesize(c.nat64(), ipp.IP()); !ip6.IsZero() {
+		return ipp.WithIP(ip6)
+	}
+	return ipp
+}
+
+// nat64Src is the inverse of nat64Dst, for the source addresses of
+// received packets: packets from NAT64 addresses are treated as
+// coming from the IPv4 addresses they represent.
+func (c *Conn) nat64Src(ipp netaddr.IPPort) netaddr.IPPort {
+	pfx := c.nat64()
+	if pfx.IsZero() {
+		return ipp
+	}
+	if ip4, ok := nat64.Extract(pfx, ipp.IP()); ok {
+		return ipp.WithIP(ip4)
+	}
+	return ipp
 }
 
 // sendUDP sends UDP packet b to addr.
@@ -1158,8 +1348,9 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 	return err == nil, err
 }
 
-// sendAddr sends packet b to addr, which is either a real UDP address
-// or a fake UDP address representing a DERP server (see derpmap.go).
+// sendAddr sends packet b to addr, which is either a real UDP address,
+// a fake UDP address representing a DERP server (see derpmap.go), or
+// a fake UDP address representing a peer relay (see relay.go).
 // The provided public key identifies the recipient.
 //
 // The returned err is whether there was an error writing when it
@@ -1169,6 +1360,9 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
 func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent bool, err error) {
+	if addr.IP() == relayMagicIPAddr {
+		return c.sendRelay(addr, pubKey, b)
+	}
 	if addr.IP() != derpMagicIPAddr {
 		return c.sendUDP(addr, b)
 	}
@@ -1292,6 +1486,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	dc.SetCanAckPings(true)
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.NAT64Prefix = c.nat64
 
 	ctx, cancel := context.WithCancel(c.connCtx)
 	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
@@ -1585,6 +1780,13 @@ func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
 		if err != nil {
 			return 0, nil, err
 		}
+		ipp = c.nat64Src(ipp)
+		if isRelayFrame(b[:n]) {
+			if n, ep := c.receiveRelay(b[:n], ipp); ep != nil {
+				return n, ep, nil
+			}
+			continue
+		}
 		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
 			return n, ep, nil
 		}
@@ -1600,6 +1802,12 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 		if err != nil {
 			return 0, nil, err
 		}
+		if isRelayFrame(b[:n]) {
+			if n, ep := c.receiveRelay(b[:n], ipp); ep != nil {
+				return n, ep, nil
+			}
+			continue
+		}
 		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4); ok {
 			return n, ep, nil
 		}
@@ -1637,6 +1845,9 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 			cache.gen = de.numStopAndReset()
 		}
 	}
+	if de, ok := ep.(*discoEndpoint); ok {
+		de.paths.noteRecv(ipp, len(b))
+	}
 	c.noteRecvActivityFromEndpoint(ep)
 	return ep, true
 }
@@ -1724,6 +1935,9 @@ func (c *Conn) processDERPReadResult(dm derpReadResult, b []byte) (n int, ep con
 		}
 	}
 
+	if discoEp != nil {
+		discoEp.paths.noteRecv(ipp, n)
+	}
 	if !didNoteRecvActivity {
 		c.noteRecvActivityFromEndpoint(ep)
 	}
@@ -1743,36 +1957,70 @@ const (
 )
 
 func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+	pkt, payload, err := c.sealDiscoMessage(dstDisco, m)
+	if err != nil {
+		return false, err
+	}
+	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	if sent {
+		c.captureDisco(capture.Outbound, dst, payload)
+		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
+			c.logf("[v1] magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
+		}
+	} else if err == nil {
+		// Can't send. (e.g. no IPv6 locally)
+	} else {
+		if !c.networkDown() {
+			c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
+		}
+	}
+	return sent, err
+}
+
+// sealDiscoMessage returns the packet carrying disco message m to
+// dstDisco, and m's plaintext payload.
+func (c *Conn) sealDiscoMessage(dstDisco tailcfg.DiscoKey, m disco.Message) (pkt, payload []byte, err error) {
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
-		return false, errConnClosed
+		return nil, nil, errConnClosed
 	}
 	var nonce [disco.NonceLen]byte
 	if _, err := crand.Read(nonce[:]); err != nil {
 		panic(err) // worth dying for
 	}
-	pkt := make([]byte, 0, 512) // TODO: size it correctly? pool? if it matters.
+	pkt = make([]byte, 0, 512) // TODO: size it correctly? pool? if it matters.
 	pkt = append(pkt, disco.Magic...)
 	pkt = append(pkt, c.discoPublic[:]...)
 	pkt = append(pkt, nonce[:]...)
 	sharedKey := c.sharedDiscoKeyLocked(dstDisco)
 	c.mu.Unlock()
 
-	pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, sharedKey)
-	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
-	if sent {
-		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
-			c.logf("[v1] magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
-		}
-	} else if err == nil {
-		// Can't send. (e.g. no IPv6 locally)
-	} else {
-		if !c.networkDown() {
-			c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
-		}
+	payload = m.AppendMarshal(nil)
+	pkt = box.SealAfterPrecomputation(pkt, payload, &nonce, sharedKey)
+	return pkt, payload, nil
+}
+
+// InstallCaptureHook sets the function to call with the plaintext
+// payload of every disco message sent or received. A nil cb removes
+// the hook.
+func (c *Conn) InstallCaptureHook(cb capture.Callback) {
+	c.captureHook.Store(cb)
+}
+
+// captureDisco passes the disco message payload to the capture hook,
+// if installed.
+func (c *Conn) captureDisco(dir capture.Direction, peer netaddr.IPPort, payload []byte) {
+	cb, _ := c.captureHook.Load().(capture.Callback)
+	if cb == nil {
+		return
 	}
-	return sent, err
+	cb(&capture.Packet{
+		Kind: capture.KindDisco,
+		Dir:  dir,
+		Peer: derpStr(peer.String()),
+		Data: payload,
+	})
 }
 
 // handleDiscoMessage handles a discovery message and reports whether
@@ -1898,6 +2146,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 		// TODO(bradfitz): add some counter for this that logs rarely
 		return
 	}
+	c.captureDisco(capture.Inbound, src, payload)
 
 	dm, err := disco.Parse(payload)
 	if debugDisco {
@@ -1934,6 +2183,47 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) (isDiscoMsg bo
 				len(dm.MyNumber))
 			go de.handleCallMeMaybe(dm)
 		}
+	case *disco.PathProbe:
+		if src.IP() == derpMagicIPAddr || isRelayPath(src) {
+			// Only direct paths are probed.
+			return
+		}
+		go c.sendDiscoMessage(src, peerNode.Key, sender, &disco.PathProbeAck{
+			TxID: dm.TxID,
+			Size: uint16(len(msg)),
+		}, discoVerboseLog)
+	case *disco.PathProbeAck:
+		if de == nil {
+			return
+		}
+		de.handlePathProbeAckLocked(dm, src)
+	case *disco.CallMeViaRelay:
+		if src.IP() != derpMagicIPAddr {
+			// CallMeViaRelay messages should only come via DERP.
+			c.logf("[unexpected] CallMeViaRelay packets should only come via DERP")
+			return
+		}
+		if de != nil {
+			c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got call-me-via-relay, %d relays",
+				c.discoShort, de.discoShort,
+				de.publicKey.ShortString(), derpStr(src.String()),
+				len(dm.Relays))
+			go c.handleCallMeViaRelay(de, dm)
+		}
+	case *disco.SprayPorts:
+		if src.IP() != derpMagicIPAddr {
+			// SprayPorts messages should only come via DERP.
+			c.logf("[unexpected] SprayPorts packets should only come via DERP")
+			return
+		}
+		if de == nil || !c.hardNATTraversal {
+			return
+		}
+		c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got spray-ports, %d ports of %v",
+			c.discoShort, de.discoShort,
+			de.publicKey.ShortString(), derpStr(src.String()),
+			dm.Count, dm.IP)
+		de.handleSprayPortsLocked(dm)
 	}
 	return
 }
@@ -1950,15 +2240,20 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.I
 		c.logf("[v1] magicsock: disco: %v<-%v (%v, %v)  got ping tx=%x", c.discoShort, de.discoShort, peerNode.Key.ShortString(), src, dm.TxID[:6])
 	}
 
-	// Remember this route if not present.
-	c.setAddrToDiscoLocked(src, sender, nil)
+	// Remember this route if not present. A relay path is one
+	// address for all peers relayed by that relay, so it can't
+	// identify the sender.
+	if !isRelayPath(src) {
+		c.setAddrToDiscoLocked(src, sender, nil)
+	}
 	de.addCandidateEndpoint(src)
 
 	ipDst := src
 	discoDest := sender
 	go c.sendDiscoMessage(ipDst, peerNode.Key, discoDest, &disco.Pong{
-		TxID: dm.TxID,
-		Src:  src,
+		TxID:    dm.TxID,
+		Src:     src,
+		Version: disco.Version,
 	}, discoVerboseLog)
 }
 
@@ -2256,6 +2551,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 			break
 		}
 	}
+	c.updatePeerRelaysLocked(nm)
 
 	// Clean c.endpointOfDisco for discovery keys that are no longer present.
 	for dk, de := range c.endpointOfDisco {
@@ -2413,7 +2709,7 @@ func (c *connBind) Open(ignoredPort uint16) ([]conn.ReceiveFunc, uint16, error)
 		return nil, 0, errors.New("magicsock: connBind already open")
 	}
 	c.closed = false
-	fns := []conn.ReceiveFunc{c.receiveIPv4, c.receiveIPv6, c.receiveDERP}
+	fns := []conn.ReceiveFunc{c.receiveIPv4, c.receiveIPv6, c.receiveDERP, c.receiveSpray}
 	// TODO: Combine receiveIPv4 and receiveIPv6 and receiveIP into a single
 	// closure that closes over a *RebindingUDPConn?
 	return fns, c.LocalPort(), nil
@@ -2439,6 +2735,8 @@ func (c *connBind) Close() error {
 	// Send an empty read result to unblock receiveDERP,
 	// which will then check connBind.Closed.
 	c.derpRecvCh <- derpReadResult{}
+	// Likewise for receiveSpray.
+	c.sprayRecvCh <- sprayReadResult{}
 	return nil
 }
 
@@ -2589,6 +2887,9 @@ func (c *Conn) initialBind() error {
 	c.portMapper.SetLocalPort(c.LocalPort())
 	if err := c.bindSocket(&c.pconn6, "udp6"); err != nil {
 		c.logf("magicsock: ignoring IPv6 bind failure: %v", err)
+		c.portMapper.SetLocalPort6(0)
+	} else {
+		c.portMapper.SetLocalPort6(uint16(c.pconn6.LocalAddr().Port))
 	}
 	return nil
 }
@@ -2695,6 +2996,9 @@ func (c *Conn) Rebind() {
 	c.portMapper.SetLocalPort(c.LocalPort())
 	if err := c.bindSocket(&c.pconn6, "udp6"); err != nil {
 		c.logf("magicsock: Rebind ignoring IPv6 bind failure: %v", err)
+		c.portMapper.SetLocalPort6(0)
+	} else {
+		c.portMapper.SetLocalPort6(uint16(c.pconn6.LocalAddr().Port))
 	}
 
 	c.mu.Lock()
@@ -3063,6 +3367,59 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	})
 }
 
+// DebugState returns a snapshot of c's disco state for debugging.
+func (c *Conn) DebugState() *ipnstate.MagicsockDebug {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := &ipnstate.MagicsockDebug{
+		DiscoKey:     c.discoPublic,
+		HomeDERP:     c.myDerp,
+		HomeDERPCode: c.derpRegionCodeOfIDLocked(c.myDerp),
+	}
+	for _, ep := range c.lastEndpoints {
+		ret.Endpoints = append(ret.Endpoints, ep.Addr.String())
+	}
+	for dk, n := range c.nodeOfDisco {
+		pd := &ipnstate.PeerDiscoDebug{
+			Name:     n.Name,
+			NodeKey:  n.Key,
+			DiscoKey: dk,
+		}
+		if de, ok := c.endpointOfDisco[dk]; ok {
+			de.populateDebug(pd)
+		}
+		ret.Peers = append(ret.Peers, pd)
+	}
+	sort.Slice(ret.Peers, func(i, j int) bool {
+		a, b := ret.Peers[i], ret.Peers[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.NodeKey.String() < b.NodeKey.String()
+	})
+	return ret
+}
+
+// DebugDERPConns returns the active DERP connections, sorted by
+// region ID.
+func (c *Conn) DebugDERPConns() []ipnstate.DERPConnDebug {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ret []ipnstate.DERPConnDebug
+	c.foreachActiveDerpSortedLocked(func(regionID int, ad activeDerp) {
+		ret = append(ret, ipnstate.DERPConnDebug{
+			RegionID:   regionID,
+			RegionCode: c.derpRegionCodeOfIDLocked(regionID),
+			Home:       regionID == c.myDerp,
+			Created:    ad.createTime,
+			LastWrite:  *ad.lastWrite,
+		})
+	})
+	return ret
+}
+
 func ippDebugString(ua netaddr.IPPort) string {
 	if ua.IP() == derpMagicIPAddr {
 		return fmt.Sprintf("derp-%d", ua.Port())
@@ -3104,7 +3461,18 @@ type discoEndpoint struct {
 	endpointState      map[netaddr.IPPort]*endpointState
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
+	peerDiscoVersion uint8                   // disco.Version of the peer's last Pong
+	sentProbe        map[stun.TxID]sentProbe // path MTU probes awaiting acks
+	pathMTU          int                     // bestAddr's MTU last reported to Conn.pathMTUFunc; 0 if unknown
+
+	spray          *sprayRound       // our spray round to the peer, if any; see spray.go
+	lastSpray      time.Time         // last time a spray round was started
+	lastSprayReply time.Time         // last time we answered the peer's SprayPorts
+	pendingSpray   *disco.SprayPorts // SprayPorts to answer once the peer's disco.Version is known
+
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+
+	paths pathStats // has its own lock; may be used with or without mu held
 }
 
 type pendingCLIPing struct {
@@ -3178,6 +3546,18 @@ type endpointState struct {
 	// was advertised last via a call-me-maybe disco message.
 	callMeMaybeTime time.Time
 
+	// relayOfferedAt, if non-zero, means this endpoint is a path
+	// via a peer relay, and is the last time we or the peer
+	// offered it (see offerRelays).
+	relayOfferedAt time.Time
+
+	// mtu is the largest tunnel MTU known to work on this path,
+	// or 0 if unknown. mtuProbeBest is the largest acknowledged
+	// so far in the probe round started at mtuProbedAt.
+	mtu          int
+	mtuProbeBest int
+	mtuProbedAt  time.Time
+
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
@@ -3191,6 +3571,11 @@ const indexSentinelDeleted = -1
 // shouldDeleteLocked reports whether we should delete this endpoint.
 func (st *endpointState) shouldDeleteLocked() bool {
 	switch {
+	case !st.relayOfferedAt.IsZero():
+		// A path via a peer relay. Keep it while it's still
+		// offered or the peer still pings us over it.
+		return time.Since(st.relayOfferedAt) > sessionActiveTimeout &&
+			time.Since(st.lastGotPing) > sessionActiveTimeout
 	case !st.callMeMaybeTime.IsZero():
 		return false
 	case st.lastGotPing.IsZero():
@@ -3323,7 +3708,9 @@ func (de *discoEndpoint) wantFullPingLocked(now time.Time) bool {
 	if now.After(de.trustBestAddrUntil) {
 		return true
 	}
-	if de.bestAddr.latency <= goodEnoughLatency {
+	if de.bestAddr.latency <= goodEnoughLatency && !isRelayPath(de.bestAddr.IPPort) {
+		// Paths via peer relays are never good enough; keep
+		// looking for a direct one.
 		return false
 	}
 	if now.Sub(de.lastFullPing) >= upgradeInterval {
@@ -3380,6 +3767,7 @@ func (de *discoEndpoint) send(b []byte) error {
 	if udpAddr.IsZero() && derpAddr.IsZero() {
 		return errors.New("no UDP or DERP addr")
 	}
+	de.paths.noteSend(now, udpAddr, derpAddr, len(b))
 	var err error
 	if !udpAddr.IsZero() {
 		_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
@@ -3400,7 +3788,7 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
+	if sp.purpose != pingSpray && (debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil)) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
 	de.removeSentPingLocked(txid, sp)
@@ -3450,10 +3838,20 @@ const (
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingSpray means that the ping was to a random port of a
+	// peer behind a hard NAT, which asked for it with a
+	// SprayPorts message. Such ports aren't endpoints (yet).
+	pingSpray
+
+	// pingVersion means that the ping was via DERP, to learn the
+	// peer's disco.Version from its pong before answering a
+	// message that needs a recent enough peer.
+	pingVersion
 )
 
 func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpose discoPingPurpose) {
-	if purpose != pingCLI {
+	if purpose != pingCLI && purpose != pingSpray && purpose != pingVersion {
 		st, ok := de.endpointState[ep]
 		if !ok {
 			// Shouldn't happen. But don't ping an endpoint that's
@@ -3472,7 +3870,7 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 		purpose: purpose,
 	}
 	logLevel := discoLog
-	if purpose == pingHeartbeat {
+	if purpose == pingHeartbeat || purpose == pingSpray {
 		logLevel = discoVerboseLog
 	}
 	go de.sendDiscoPing(ep, txid, logLevel)
@@ -3507,6 +3905,14 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 		// sent so our firewall ports are probably open and now
 		// would be a good time for them to connect.
 		go de.c.enqueueCallMeMaybe(derpAddr, de)
+
+		if de.bestAddr.IsZero() || isRelayPath(de.bestAddr.IPPort) {
+			// No direct path (yet). Also offer to meet via a
+			// peer relay, in case there never will be one, and
+			// try harder if our NAT is why.
+			go de.c.offerRelays(de, derpAddr)
+			de.maybeSprayLocked(now, derpAddr)
+		}
 	}
 }
 
@@ -3620,15 +4026,31 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 
 	now := time.Now()
 	latency := now.Sub(sp.at)
+	de.paths.noteRTT(sp.to, latency)
+	de.peerDiscoVersion = m.Version
+	if req := de.pendingSpray; req != nil {
+		de.pendingSpray = nil
+		de.answerSprayLocked(req, now)
+	}
 
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
-		if !ok {
+		if !ok && sp.purpose == pingSpray {
+			// A port of the peer's hard NAT that got through.
+			// Like an endpoint the peer pinged us from, it's
+			// kept while the peer keeps pinging us from it.
+			st = &endpointState{lastGotPing: now}
+			de.endpointState[sp.to] = st
+		} else if !ok {
 			// This is no longer an endpoint we care about.
 			return
 		}
 
-		de.c.setAddrToDiscoLocked(src, de.discoKey, de)
+		if !isRelayPath(src) {
+			// Relay paths are shared by all peers using the
+			// relay; see handlePingLocked.
+			de.c.setAddrToDiscoLocked(src, de.discoKey, de)
+		}
 
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
@@ -3665,6 +4087,8 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
 		}
+		de.updatePathMTULocked()
+		de.maybeProbeMTULocked(now)
 	}
 }
 
@@ -3685,6 +4109,10 @@ func betterAddr(a, b addrLatency) bool {
 	if a.IsZero() {
 		return false
 	}
+	if isRelayPath(a.IPPort) != isRelayPath(b.IPPort) {
+		// Any direct path beats one via a peer relay.
+		return !isRelayPath(a.IPPort)
+	}
 	if a.IP().Is6() && b.IP().Is4() {
 		// Prefer IPv6 for being a bit more robust, as long as
 		// the latencies are roughly equivalent.
@@ -3786,9 +4214,60 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	ps.LastWrite = de.lastSend
 
 	now := time.Now()
+	ps.PathStats = de.paths.status(now)
 	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
-		ps.CurAddr = udpAddr.String()
+		if isRelayPath(udpAddr) {
+			ps.PeerRelay = de.c.relayNameLocked(udpAddr) // c.mu is held by UpdateStatus
+		} else {
+			ps.CurAddr = udpAddr.String()
+		}
+		if de.bestAddr.IPPort == udpAddr {
+			ps.LatencySeconds = de.bestAddr.latency.Seconds()
+		}
+	}
+}
+
+// populateDebug fills in pd's endpoint state from de.
+func (de *discoEndpoint) populateDebug(pd *ipnstate.PeerDiscoDebug) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	pd.Active = true
+	if !de.derpAddr.IsZero() {
+		pd.DERPAddr = de.derpAddr.String()
 	}
+	if !de.bestAddr.IsZero() {
+		pd.BestAddr = de.bestAddr.IPPort.String()
+		pd.BestAddrLatency = de.bestAddr.latency
+	}
+	pd.BestAddrAt = de.bestAddrAt
+	pd.TrustBestAddrUntil = de.trustBestAddrUntil
+	pd.LastSend = de.lastSend
+	if unix := atomic.LoadInt64(&de.lastRecvUnixAtomic); unix != 0 {
+		pd.LastRecv = time.Unix(unix, 0)
+	}
+	pd.LastFullPing = de.lastFullPing
+	pd.Heartbeat = de.heartBeatTimer != nil
+	pd.Path = de.paths.status(time.Now())
+
+	for ep, st := range de.endpointState {
+		ed := &ipnstate.DiscoEndpointDebug{
+			Addr:        ep.String(),
+			LastPing:    st.lastPing,
+			LastGotPing: st.lastGotPing,
+			CallMeMaybe: st.callMeMaybeTime,
+			Pongs:       len(st.recentPongs),
+		}
+		if len(st.recentPongs) > 0 {
+			latest := st.recentPongs[st.recentPong]
+			ed.LastPong = latest.pongAt
+			ed.LastPongLatency = latest.latency
+		}
+		pd.Endpoints = append(pd.Endpoints, ed)
+	}
+	sort.Slice(pd.Endpoints, func(i, j int) bool {
+		return pd.Endpoints[i].Addr < pd.Endpoints[j].Addr
+	})
 }
 
 // stopAndReset stops timers associated with de and resets its state back to zero.
@@ -3815,19 +4294,32 @@ func (de *discoEndpoint) stopAndReset() {
 	for txid, sp := range de.sentPing {
 		de.removeSentPingLocked(txid, sp)
 	}
+	for txid, sp := range de.sentProbe {
+		sp.timer.Stop()
+		delete(de.sentProbe, txid)
+	}
 	if de.heartBeatTimer != nil {
 		de.heartBeatTimer.Stop()
 		de.heartBeatTimer = nil
 	}
+	if de.spray != nil {
+		de.spray.close()
+		de.spray = nil
+	}
 	de.pendingCLIPings = nil
+	de.paths.reset()
 }
 
 func (de *discoEndpoint) numStopAndReset() int64 {
 	return atomic.LoadInt64(&de.numStopAndResetAtomic)
 }
 
-// derpStr replaces DERP IPs in s with "derp-".
-func derpStr(s string) string { return strings.ReplaceAll(s, "127.3.3.40:", "derp-") }
+// derpStr replaces DERP IPs in s with "derp-", and peer relay IPs
+// with "relay-".
+func derpStr(s string) string {
+	s = strings.ReplaceAll(s, "127.3.3.40:", "derp-")
+	return strings.ReplaceAll(s, "127.3.3.41:", "relay-")
+}
 
 // ippEndpointCache is a mutex-free single-element cache, mapping from
 // a single netaddr.IPPort to a single endpoint.
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -33,7 +34,9 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpmap"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
@@ -138,6 +141,18 @@ type magicStack struct {
 // before anything interesting happens.
 func newMagicStack(t testing.TB, logf logger.Logf, l nettype.PacketListener, derpMap *tailcfg.DERPMap, disableLegacy bool) *magicStack {
 	t.Helper()
+	return newMagicStackOpts(t, derpMap, Options{
+		Logf:                    logf,
+		PacketListener:          l,
+		DisableLegacyNetworking: disableLegacy,
+	})
+}
+
+// newMagicStackOpts is like newMagicStack, but takes the magicsock
+// Options. Their EndpointsFunc and SimulatedNetwork are overwritten.
+func newMagicStackOpts(t testing.TB, derpMap *tailcfg.DERPMap, opts Options) *magicStack {
+	t.Helper()
+	logf := opts.Logf
 
 	privateKey, err := wgkey.NewPrivate()
 	if err != nil {
@@ -145,15 +160,11 @@ func newMagicStack(t testing.TB, logf logger.Logf, l nettype.PacketListener, der
 	}
 
 	epCh := make(chan []tailcfg.Endpoint, 100) // arbitrary
-	conn, err := NewConn(Options{
-		Logf:           logf,
-		PacketListener: l,
-		EndpointsFunc: func(eps []tailcfg.Endpoint) {
-			epCh <- eps
-		},
-		SimulatedNetwork:        l != nettype.Std{},
-		DisableLegacyNetworking: disableLegacy,
-	})
+	opts.EndpointsFunc = func(eps []tailcfg.Endpoint) {
+		epCh <- eps
+	}
+	opts.SimulatedNetwork = opts.PacketListener != nettype.Std{}
+	conn, err := NewConn(opts)
 	if err != nil {
 		t.Fatalf("constructing magicsock: %v", err)
 	}
@@ -268,6 +279,9 @@ func meshStacks(logf logger.Logf, ms []*magicStack) (cleanup func()) {
 				AllowedIPs: addrs,
 				Endpoints:  epStrings(eps[i]),
 				DERP:       "127.3.3.40:1",
+				Hostinfo: tailcfg.Hostinfo{
+					PeerRelay: peer.conn.peerRelay.Get(),
+				},
 			}
 			nm.Peers = append(nm.Peers, peer)
 		}
@@ -381,6 +395,37 @@ collectEndpoints:
 	}
 }
 
+func TestStaticEndpoints(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	static := netaddr.MustParseIPPort("203.0.113.7:41641")
+	conn, err := NewConn(Options{
+		EndpointsFunc:           func(eps []tailcfg.Endpoint) {},
+		Logf:                    t.Logf,
+		DisableLegacyNetworking: true,
+		StaticEndpoints:         []netaddr.IPPort{static},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	eps, err := conn.determineEndpoints(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ep := range eps {
+		if ep.Addr == static {
+			if ep.Type != tailcfg.EndpointExplicitConf {
+				t.Errorf("static endpoint type = %v; want %v", ep.Type, tailcfg.EndpointExplicitConf)
+			}
+			return
+		}
+	}
+	t.Errorf("static endpoint %v not in %v", static, eps)
+}
+
 func pickPort(t testing.TB) uint16 {
 	t.Helper()
 	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
@@ -867,6 +912,246 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 	logf("starting cleanup")
 }
 
+// blockPeer is a natlab.PacketHandler that drops all packets
+// exchanged with ip.
+type blockPeer struct {
+	ip netaddr.IP
+}
+
+func (b blockPeer) HandleIn(p *natlab.Packet, iif *natlab.Interface) *natlab.Packet {
+	if p.Src.IP() == b.ip {
+		return nil
+	}
+	return p
+}
+
+func (b blockPeer) HandleOut(p *natlab.Packet, oif *natlab.Interface) *natlab.Packet {
+	if p.Dst.IP() == b.ip {
+		return nil
+	}
+	return p
+}
+
+func (b blockPeer) HandleForward(p *natlab.Packet, iif, oif *natlab.Interface) *natlab.Packet {
+	return p
+}
+
+// TestPeerRelay verifies that two magicStacks that can't reach each
+// other directly, but can both reach a third that offers to relay,
+// move their traffic from DERP to that relay.
+func TestPeerRelay(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	tlogf, setT := makeNestable(t)
+	setT(t)
+	logf, closeLogf := logger.LogfCloser(tlogf)
+	defer closeLogf()
+
+	mstun := &natlab.Machine{Name: "stun"}
+	m1 := &natlab.Machine{Name: "m1"}
+	m2 := &natlab.Machine{Name: "m2"}
+	mr := &natlab.Machine{Name: "relay"}
+	inet := natlab.NewInternet()
+	sif := mstun.Attach("eth0", inet)
+	m1if := m1.Attach("eth0", inet)
+	m2if := m2.Attach("eth0", inet)
+	mr.Attach("eth0", inet)
+	m1.PacketHandler = blockPeer{m2if.V4()}
+	m2.PacketHandler = blockPeer{m1if.V4()}
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap, true)
+	defer ms1.Close()
+	ms2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap, true)
+	defer ms2.Close()
+	relay := newMagicStack(t, logger.WithPrefix(logf, "relay: "), mr, derpMap, true)
+	defer relay.Close()
+	relay.conn.SetPeerRelay(true)
+
+	cleanup = meshStacks(logf, []*magicStack{ms1, ms2, relay})
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		pst := ms1.Status().Peer[ms2.Public()]
+		if pst.CurAddr != "" {
+			t.Fatalf("unexpected direct path %s->%s via %s", ms1, ms2, pst.CurAddr)
+		}
+		if pst.PeerRelay != "" {
+			logf("relayed path %s->%s found via %s", ms1, ms2, pst.PeerRelay)
+			return
+		}
+	}
+	t.Errorf("magicsock did not find a peer relay path from %s to %s", ms1, ms2)
+}
+
+// TestHardNATTraversal verifies that a magicStack behind a NAT that
+// maps each destination to a different port, and one behind an easy
+// NAT, find a direct path to each other by port spraying.
+func TestHardNATTraversal(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	// Make finding a pair of ports all but certain.
+	defer func(old int) { sprayPorts = old }(sprayPorts)
+	sprayPorts = 1024
+
+	tlogf, setT := makeNestable(t)
+	setT(t)
+	logf, closeLogf := logger.LogfCloser(tlogf)
+	defer closeLogf()
+
+	mstun := &natlab.Machine{Name: "stun"}
+	mstun2 := &natlab.Machine{Name: "stun2"}
+	m1 := &natlab.Machine{
+		Name:          "m1",
+		PacketHandler: &natlab.Firewall{},
+	}
+	nat1 := &natlab.Machine{
+		Name: "nat1",
+	}
+	m2 := &natlab.Machine{
+		Name:          "m2",
+		PacketHandler: &natlab.Firewall{},
+	}
+	nat2 := &natlab.Machine{
+		Name: "nat2",
+	}
+
+	inet := natlab.NewInternet()
+	lan1 := &natlab.Network{
+		Name:    "lan1",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+	lan2 := &natlab.Network{
+		Name:    "lan2",
+		Prefix4: mustPrefix("192.168.1.0/24"),
+	}
+
+	sif := mstun.Attach("eth0", inet)
+	sif2 := mstun2.Attach("eth0", inet)
+	nat1WAN := nat1.Attach("wan", inet)
+	nat1LAN := nat1.Attach("lan1", lan1)
+	nat2WAN := nat2.Attach("wan", inet)
+	nat2LAN := nat2.Attach("lan2", lan2)
+	m1.Attach("eth0", lan1)
+	m2.Attach("eth0", lan2)
+	lan1.SetDefaultGateway(nat1LAN)
+	lan2.SetDefaultGateway(nat2LAN)
+
+	nat1.PacketHandler = &natlab.SNAT44{
+		Machine:           nat1,
+		ExternalInterface: nat1WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat1LAN,
+		},
+	}
+	nat2.PacketHandler = &natlab.SNAT44{
+		Machine:           nat2,
+		ExternalInterface: nat2WAN,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat2LAN,
+		},
+	}
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	// A second STUN server, on another IP, shows m1 that its NAT
+	// mapping varies by destination.
+	stunAddr2, stunCleanup2 := stuntest.ServeWithPacketListener(t, mstun2)
+	defer stunCleanup2()
+	node2 := *derpMap.Regions[1].Nodes[0]
+	node2.Name = "t2"
+	node2.STUNPort = stunAddr2.Port
+	node2.STUNTestIP = sif2.V4().String()
+	derpMap.Regions[1].Nodes = append(derpMap.Regions[1].Nodes, &node2)
+
+	newStack := func(name string, l nettype.PacketListener) *magicStack {
+		return newMagicStackOpts(t, derpMap, Options{
+			Logf:                    logger.WithPrefix(logf, name+": "),
+			PacketListener:          l,
+			DisableLegacyNetworking: true,
+			HardNATTraversal:        true,
+		})
+	}
+	ms1 := newStack("conn1", m1)
+	defer ms1.Close()
+	ms2 := newStack("conn2", m2)
+	defer ms2.Close()
+
+	cleanup = meshStacks(logf, []*magicStack{ms1, ms2})
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	mustDirect := func(m1, m2 *magicStack) {
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			pst := m1.Status().Peer[m2.Public()]
+			if pst.CurAddr != "" {
+				logf("direct link %s->%s found with addr %s", m1, m2, pst.CurAddr)
+				return
+			}
+		}
+		t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
+	}
+	mustDirect(ms1, ms2)
+	mustDirect(ms2, ms1)
+
+	if ip := ms1.conn.hardNATIP(); ip != nat1WAN.V4() {
+		t.Errorf("conn1 hard NAT IP = %v; want %v", ip, nat1WAN.V4())
+	}
+	if ip := ms2.conn.hardNATIP(); !ip.IsZero() {
+		t.Errorf("conn2 hard NAT IP = %v; want none", ip)
+	}
+}
+
+func TestHandleSprayPortsChecks(t *testing.T) {
+	de := &discoEndpoint{
+		c:        &Conn{logf: t.Logf},
+		sentPing: map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{
+			netaddr.MustParseIPPort("1.2.3.4:41641"): {},
+		},
+		peerDiscoVersion: disco.Version,
+	}
+	// Not one of the peer's endpoints.
+	de.handleSprayPortsLocked(&disco.SprayPorts{IP: netaddr.MustParseIP("5.6.7.8"), Count: 256})
+	if len(de.sentPing) != 0 || !de.lastSprayReply.IsZero() {
+		t.Errorf("sprayed a non-endpoint IP")
+	}
+	// The peer's endpoint, but it hasn't shown it speaks SprayPorts.
+	de.peerDiscoVersion = 1
+	de.handleSprayPortsLocked(&disco.SprayPorts{IP: netaddr.MustParseIP("1.2.3.4"), Count: 256})
+	if len(de.sentPing) != 0 || !de.lastSprayReply.IsZero() {
+		t.Errorf("sprayed for an old peer")
+	}
+}
+
+func TestReserveSpraySockets(t *testing.T) {
+	c := new(Conn)
+	if got := c.reserveSpraySockets(maxSpraySockets - 10); got != maxSpraySockets-10 {
+		t.Fatalf("first reservation = %d", got)
+	}
+	if got := c.reserveSpraySockets(256); got != 10 {
+		t.Fatalf("second reservation = %d; want 10", got)
+	}
+	if got := c.reserveSpraySockets(1); got != 0 {
+		t.Fatalf("reservation over budget = %d; want 0", got)
+	}
+	c.releaseSpraySockets(5)
+	if got := c.reserveSpraySockets(256); got != 5 {
+		t.Fatalf("reservation after release = %d; want 5", got)
+	}
+}
+
 func testTwoDevicePing(t *testing.T, d *devices) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1627,6 +1912,10 @@ func TestBetterAddr(t *testing.T) {
 		{a: al("10.0.0.2:123", 5*ms), b: al("1.2.3.4:555", 6*ms), want: true},
 		{a: al("10.0.0.2:123", 5*ms), b: al("10.0.0.2:123", 10*ms), want: false}, // same IPPort
 
+		// Direct paths beat peer relays, even if slower:
+		{a: al("1.2.3.4:555", 50*ms), b: al("127.3.3.41:1", 10*ms), want: true},
+		{a: al("127.3.3.41:1", 10*ms), b: al("[2001::5]:123", 50*ms), want: false},
+
 		// Prefer IPv6 if roughly equivalent:
 		{
 			a:    al("[2001::5]:123", 100*ms),
@@ -1670,3 +1959,161 @@ func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	}
 	return
 }
+
+func TestPathStats(t *testing.T) {
+	var ps pathStats
+	if got := ps.status(time.Now()); got != nil {
+		t.Fatalf("status of zero pathStats = %+v; want nil", got)
+	}
+
+	t0 := time.Unix(1000, 0)
+	derp := netaddr.IPPortFrom(derpMagicIPAddr, 2)
+	direct := netaddr.MustParseIPPort("1.2.3.4:41641")
+
+	ps.noteSend(t0, netaddr.IPPort{}, derp, 100)
+	ps.noteSend(t0.Add(time.Second), direct, derp, 100) // not yet trusted; still relayed
+	ps.noteSend(t0.Add(3*time.Second), direct, netaddr.IPPort{}, 50)
+	ps.noteRecv(direct, 70)
+	for i := 1; i <= 20; i++ {
+		ps.noteRTT(direct, time.Duration(i)*time.Millisecond)
+	}
+
+	st := ps.status(t0.Add(10 * time.Second))
+	if st.CurPath != "direct" || st.CurAddr != "1.2.3.4:41641" || st.CurDERPRegion != 0 {
+		t.Errorf("cur = %q %q %d", st.CurPath, st.CurAddr, st.CurDERPRegion)
+	}
+	if !st.CurSince.Equal(t0.Add(3 * time.Second)) {
+		t.Errorf("CurSince = %v", st.CurSince)
+	}
+	if st.Relayed != 3*time.Second {
+		t.Errorf("Relayed = %v; want 3s", st.Relayed)
+	}
+	wantChanges := []ipnstate.PathChange{
+		{At: t0, From: "", To: "derp-2"},
+		{At: t0.Add(3 * time.Second), From: "derp-2", To: "1.2.3.4:41641"},
+	}
+	if !reflect.DeepEqual(st.Changes, wantChanges) {
+		t.Errorf("Changes = %+v; want %+v", st.Changes, wantChanges)
+	}
+	wantPaths := []*ipnstate.PathStats{
+		{
+			Addr:       "1.2.3.4:41641",
+			TxBytes:    150,
+			RxBytes:    70,
+			RTTSamples: 20,
+			RTTMin:     1 * time.Millisecond,
+			RTTAvg:     10500 * time.Microsecond,
+			RTTP95:     19 * time.Millisecond,
+		},
+		{Addr: "derp-2", TxBytes: 200},
+	}
+	if !reflect.DeepEqual(st.Paths, wantPaths) {
+		for _, p := range st.Paths {
+			t.Logf("got path %+v", p)
+		}
+		t.Errorf("Paths mismatch")
+	}
+
+	// Falling back to DERP counts towards the relayed time, including
+	// the period still in progress.
+	ps.noteSend(t0.Add(20*time.Second), netaddr.IPPort{}, derp, 10)
+	st = ps.status(t0.Add(25 * time.Second))
+	if st.CurPath != "derp" || st.CurDERPRegion != 2 {
+		t.Errorf("cur = %q region %d; want derp region 2", st.CurPath, st.CurDERPRegion)
+	}
+	if st.Relayed != 8*time.Second {
+		t.Errorf("Relayed = %v; want 8s", st.Relayed)
+	}
+
+	for i := 0; i < 2*pathChangeCount; i++ {
+		ps.noteSend(t0, direct, netaddr.IPPort{}, 1)
+		ps.noteSend(t0, netaddr.IPPort{}, derp, 1)
+	}
+	for i := 0; i < 2*maxPathsTracked; i++ {
+		ps.noteRecv(netaddr.IPPortFrom(netaddr.IPv4(10, 0, 0, 1), uint16(i+1)), 1)
+	}
+	for i := 0; i < 2*rttSampleCount; i++ {
+		ps.noteRTT(derp, time.Millisecond)
+	}
+	st = ps.status(t0)
+	if len(st.Changes) != pathChangeCount {
+		t.Errorf("len(Changes) = %d; want %d", len(st.Changes), pathChangeCount)
+	}
+	if len(st.Paths) != maxPathsTracked {
+		t.Errorf("len(Paths) = %d; want %d", len(st.Paths), maxPathsTracked)
+	}
+	for _, p := range st.Paths {
+		if p.Addr == "derp-2" && p.RTTSamples != rttSampleCount {
+			t.Errorf("derp RTTSamples = %d; want %d", p.RTTSamples, rttSampleCount)
+		}
+	}
+
+	ps.reset()
+	if got := ps.status(time.Now()); got != nil {
+		t.Errorf("status after reset = %+v; want nil", got)
+	}
+}
+
+// Tests that byte counts add up when the per-packet fast path races
+// with path changes. Run with -race.
+func TestPathStatsConcurrent(t *testing.T) {
+	var ps pathStats
+	now := time.Now()
+	derp := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	direct := netaddr.MustParseIPPort("1.2.3.4:41641")
+
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			ps.noteSend(now, direct, netaddr.IPPort{}, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if i%100 == 0 {
+				ps.noteSend(now, netaddr.IPPort{}, derp, 1)
+			} else {
+				ps.noteSend(now, direct, netaddr.IPPort{}, 1)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			ps.noteRecv(direct, 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// Mostly not the send path, so via the receive-side cache.
+		for i := 0; i < n; i++ {
+			ps.noteRecv(derp, 1)
+		}
+	}()
+	wg.Wait()
+
+	var tx, rx int64
+	for _, p := range ps.status(now).Paths {
+		tx += p.TxBytes
+		rx += p.RxBytes
+	}
+	if tx != 2*n || rx != 2*n {
+		t.Errorf("tx, rx = %d, %d; want %d, %d", tx, rx, 2*n, 2*n)
+	}
+}
+
+func BenchmarkPathStatsNoteSend(b *testing.B) {
+	var ps pathStats
+	now := time.Now()
+	direct := netaddr.MustParseIPPort("1.2.3.4:41641")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ps.noteSend(now, direct, netaddr.IPPort{}, 1280)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+// Path MTU discovery.
+//
+// The TUN MTU is small enough to fit nearly every path, but some
+// (PPPoE, some cellular networks) carry less, and packets too large
+// for them silently disappear. So once a peer's best direct path is
+// known, magicsock sends it disco.PathProbe messages padded to the
+// size WireGuard packets of various tunnel MTUs would be. The largest
+// acknowledged one is the path's MTU, which is reported via
+// Options.PathMTUFunc so TCP connections to the peer can be clamped
+// to fit.
+//
+// Probes are sent like any other packet, so they measure what
+// actually gets through, whatever the OS does about fragmentation.
+
+import (
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// mtuProbeInterval is how often a path's MTU is probed again.
+	mtuProbeInterval = 10 * time.Minute
+
+	// wgDataOverhead is how much larger a WireGuard data packet is
+	// than the tunnel packet it carries: a 16 byte header and a 16
+	// byte authentication tag.
+	wgDataOverhead = 32
+
+	// pathProbeOverhead is the UDP payload size of a
+	// disco.PathProbe without padding: the disco header, the
+	// naclbox overhead, and the message type, version and TxID.
+	pathProbeOverhead = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen + box.Overhead + 2 + 12
+)
+
+// mtuProbeSizes are the tunnel MTUs probed for. The first is the
+// largest TUN MTU in use (see tstun); MTUs above it don't matter.
+var mtuProbeSizes = []int{1280, 1200, 1100, 1000, 900, 800, 576}
+
+// sentProbe is a disco.PathProbe awaiting its PathProbeAck.
+type sentProbe struct {
+	to    netaddr.IPPort
+	mtu   int         // tunnel MTU the probe was sized for
+	timer *time.Timer // timeout timer
+}
+
+// probeUDPSize returns the UDP payload size of a WireGuard packet
+// carrying a tunnel packet of size mtu, which is also the size
+// PathProbes for mtu are padded to.
+func probeUDPSize(mtu int) int { return mtu + wgDataOverhead }
+
+// maybeProbeMTULocked starts path MTU discovery on de's best path, if
+// the peer supports it and the path wasn't probed recently.
+//
+// de.mu must be held.
+func (de *discoEndpoint) maybeProbeMTULocked(now time.Time) {
+	ep := de.bestAddr.IPPort
+	if de.peerDiscoVersion < 1 || ep.IsZero() || isRelayPath(ep) {
+		return
+	}
+	st, ok := de.endpointState[ep]
+	if !ok || (!st.mtuProbedAt.IsZero() && now.Sub(st.mtuProbedAt) < mtuProbeInterval) {
+		return
+	}
+	st.mtuProbedAt = now
+	st.mtuProbeBest = 0
+
+	if de.sentProbe == nil {
+		de.sentProbe = map[stun.TxID]sentProbe{}
+	}
+	for _, mtu := range mtuProbeSizes {
+		txid := stun.NewTxID()
+		de.sentProbe[txid] = sentProbe{
+			to:    ep,
+			mtu:   mtu,
+			timer: time.AfterFunc(pingTimeoutDuration, func() { de.probeTimeout(txid) }),
+		}
+		padding := probeUDPSize(mtu) - pathProbeOverhead
+		go de.sendDiscoMessage(ep, &disco.PathProbe{TxID: [12]byte(txid), Padding: padding}, discoVerboseLog)
+	}
+}
+
+func (de *discoEndpoint) probeTimeout(txid stun.TxID) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	sp, ok := de.sentProbe[txid]
+	if !ok {
+		return
+	}
+	delete(de.sentProbe, txid)
+	de.finishProbeLocked(sp.to)
+}
+
+// handlePathProbeAckLocked handles a reply to a probe from
+// maybeProbeMTULocked.
+//
+// It should be called with the Conn.mu held.
+func (de *discoEndpoint) handlePathProbeAckLocked(m *disco.PathProbeAck, src netaddr.IPPort) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	sp, ok := de.sentProbe[stun.TxID(m.TxID)]
+	if !ok || sp.to != src {
+		return
+	}
+	sp.timer.Stop()
+	delete(de.sentProbe, stun.TxID(m.TxID))
+
+	if st, ok := de.endpointState[sp.to]; ok && int(m.Size) == probeUDPSize(sp.mtu) && sp.mtu > st.mtuProbeBest {
+		st.mtuProbeBest = sp.mtu
+	}
+	de.finishProbeLocked(sp.to)
+}
+
+// finishProbeLocked records the MTU of path ep once none of the
+// probes sent to it are outstanding.
+//
+// de.mu must be held.
+func (de *discoEndpoint) finishProbeLocked(ep netaddr.IPPort) {
+	for _, sp := range de.sentProbe {
+		if sp.to == ep {
+			return
+		}
+	}
+	st, ok := de.endpointState[ep]
+	if !ok {
+		return
+	}
+	if st.mtu != st.mtuProbeBest {
+		de.c.logf("[v1] magicsock: disco: path MTU to %v (%v) via %v is %d", de.publicKey.ShortString(), de.discoShort, ep, st.mtuProbeBest)
+	}
+	st.mtu = st.mtuProbeBest
+	de.updatePathMTULocked()
+}
+
+// updatePathMTULocked reports the MTU of de's best path to
+// Conn.pathMTUFunc, if it changed.
+//
+// de.mu must be held.
+func (de *discoEndpoint) updatePathMTULocked() {
+	var mtu int
+	if st, ok := de.endpointState[de.bestAddr.IPPort]; ok {
+		mtu = st.mtu
+	}
+	if mtu == de.pathMTU {
+		return
+	}
+	de.pathMTU = mtu
+	if f := de.c.pathMTUFunc; f != nil {
+		go f(de.publicKey, mtu)
+	}
+}
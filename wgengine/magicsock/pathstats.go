@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+const (
+	// rttSampleCount is how many disco pong round trip times are
+	// remembered per path.
+	rttSampleCount = 64
+
+	// pathChangeCount is how many path changes are remembered per
+	// peer.
+	pathChangeCount = 32
+
+	// maxPathsTracked is how many paths per peer have statistics
+	// kept. When exceeded, the least recently used one is
+	// forgotten, so a roaming peer doesn't grow the map forever.
+	maxPathsTracked = 16
+)
+
+// pathStats is the path telemetry of a discoEndpoint: which path its
+// packets are sent on, how that changed over time, and per-path byte
+// counts and round trip times.
+//
+// noteSend and noteRecv run for every packet, so while the send path
+// and receive source are unchanged they only do atomic adds to those
+// paths' stats, via fast, without taking mu.
+type pathStats struct {
+	fast atomic.Value // of *pathFast; nil until the first send or receive
+
+	mu sync.Mutex // leaf lock; may be acquired with discoEndpoint.mu held
+
+	cur      netaddr.IPPort // current send path; derpMagicIPAddr:region if relayed
+	curSince time.Time
+	relayed  time.Duration // time spent relayed, excluding the current path
+	changes  []ipnstate.PathChange
+	paths    map[netaddr.IPPort]*pathStat
+}
+
+// pathFast is the stats of the current send path and of the last
+// receive source, for updating without pathStats.mu. Its stats aren't
+// evicted while they're in use. It's replaced, not modified, under
+// pathStats.mu.
+type pathFast struct {
+	udpAddr, derpAddr netaddr.IPPort // as passed to noteSend
+	udp, derp         *pathStat      // stats of udpAddr and derpAddr, or nil if zero
+	recvAddr          netaddr.IPPort // as last passed to noteRecv's slow path
+	recv              *pathStat      // stats of recvAddr, or nil if zero
+}
+
+// stat returns the stats of ipp if it's one of f's paths, else nil.
+func (f *pathFast) stat(ipp netaddr.IPPort) *pathStat {
+	switch {
+	case f == nil || ipp.IsZero():
+		return nil
+	case ipp == f.udpAddr:
+		return f.udp
+	case ipp == f.derpAddr:
+		return f.derp
+	case ipp == f.recvAddr:
+		return f.recv
+	}
+	return nil
+}
+
+func (ps *pathStats) loadFast() *pathFast {
+	f, _ := ps.fast.Load().(*pathFast)
+	return f
+}
+
+// pathStat is the statistics of one path.
+type pathStat struct {
+	txBytes, rxBytes int64 // updated atomically; first for 64-bit alignment
+	lastUsed         time.Time
+	rtts             []time.Duration // ring buffer of up to rttSampleCount
+	rttNext          int             // next index to write in rtts, once full
+}
+
+func isDERPPath(ipp netaddr.IPPort) bool { return ipp.IP() == derpMagicIPAddr }
+
+// pathString returns the ipnstate.PathStats.Addr form of ipp.
+func pathString(ipp netaddr.IPPort) string {
+	if ipp.IsZero() {
+		return ""
+	}
+	return derpStr(ipp.String())
+}
+
+// statLocked returns the stats of path ipp, creating them if needed.
+func (ps *pathStats) statLocked(ipp netaddr.IPPort, now time.Time) *pathStat {
+	st, ok := ps.paths[ipp]
+	if !ok {
+		if ps.paths == nil {
+			ps.paths = map[netaddr.IPPort]*pathStat{}
+		}
+		if len(ps.paths) >= maxPathsTracked {
+			ps.evictOldestLocked()
+		}
+		st = &pathStat{}
+		ps.paths[ipp] = st
+	}
+	st.lastUsed = now
+	return st
+}
+
+func (ps *pathStats) evictOldestLocked() {
+	var oldest netaddr.IPPort
+	var oldestAt time.Time
+	f := ps.loadFast()
+	for ipp, st := range ps.paths {
+		if ipp == ps.cur || f.stat(ipp) != nil {
+			continue
+		}
+		if oldestAt.IsZero() || st.lastUsed.Before(oldestAt) {
+			oldest, oldestAt = ipp, st.lastUsed
+		}
+	}
+	delete(ps.paths, oldest)
+}
+
+// reset forgets all recorded paths and statistics.
+func (ps *pathStats) reset() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.fast.Store((*pathFast)(nil))
+	ps.cur = netaddr.IPPort{}
+	ps.curSince = time.Time{}
+	ps.relayed = 0
+	ps.changes = nil
+	ps.paths = nil
+}
+
+// noteSend records that n bytes are being sent to the addresses
+// returned by discoEndpoint.addrForSendLocked. When both are
+// non-zero, the direct path isn't yet trusted, so DERP is considered
+// the current path.
+func (ps *pathStats) noteSend(now time.Time, udpAddr, derpAddr netaddr.IPPort, n int) {
+	if f := ps.loadFast(); f != nil && f.udpAddr == udpAddr && f.derpAddr == derpAddr {
+		f.addTx(n)
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	cur := udpAddr
+	if !derpAddr.IsZero() {
+		cur = derpAddr
+	}
+	if cur != ps.cur {
+		if isDERPPath(ps.cur) {
+			ps.relayed += now.Sub(ps.curSince)
+		}
+		if len(ps.changes) == pathChangeCount {
+			copy(ps.changes, ps.changes[1:])
+			ps.changes = ps.changes[:pathChangeCount-1]
+		}
+		ps.changes = append(ps.changes, ipnstate.PathChange{
+			At:   now,
+			From: pathString(ps.cur),
+			To:   pathString(cur),
+		})
+		ps.cur = cur
+		ps.curSince = now
+	}
+	f := &pathFast{udpAddr: udpAddr, derpAddr: derpAddr}
+	if old := ps.loadFast(); old != nil {
+		// lastUsed isn't updated on the fast path, so do it now.
+		if old.udp != nil {
+			old.udp.lastUsed = now
+		}
+		if old.derp != nil {
+			old.derp.lastUsed = now
+		}
+		f.recvAddr, f.recv = old.recvAddr, old.recv
+	}
+	if !udpAddr.IsZero() {
+		f.udp = ps.statLocked(udpAddr, now)
+	}
+	if !derpAddr.IsZero() {
+		f.derp = ps.statLocked(derpAddr, now)
+	}
+	ps.fast.Store(f)
+	f.addTx(n)
+}
+
+func (f *pathFast) addTx(n int) {
+	if f.udp != nil {
+		atomic.AddInt64(&f.udp.txBytes, int64(n))
+	}
+	if f.derp != nil {
+		atomic.AddInt64(&f.derp.txBytes, int64(n))
+	}
+}
+
+// noteRecv records that n bytes were received from src, which is
+// derpMagicIPAddr:region for packets relayed by DERP.
+func (ps *pathStats) noteRecv(src netaddr.IPPort, n int) {
+	if st := ps.loadFast().stat(src); st != nil {
+		atomic.AddInt64(&st.rxBytes, int64(n))
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	now := time.Now()
+	f := &pathFast{}
+	if old := ps.loadFast(); old != nil {
+		*f = *old
+		// lastUsed isn't updated on the fast path, so do it now.
+		if old.recv != nil {
+			old.recv.lastUsed = now
+		}
+	}
+	f.recvAddr, f.recv = src, ps.statLocked(src, now)
+	ps.fast.Store(f)
+	atomic.AddInt64(&f.recv.rxBytes, int64(n))
+}
+
+// noteRTT records the round trip time d of a disco ping sent to ipp.
+func (ps *pathStats) noteRTT(ipp netaddr.IPPort, d time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	st := ps.statLocked(ipp, time.Now())
+	if len(st.rtts) < rttSampleCount {
+		st.rtts = append(st.rtts, d)
+		return
+	}
+	st.rtts[st.rttNext] = d
+	st.rttNext = (st.rttNext + 1) % rttSampleCount
+}
+
+// status returns a snapshot of ps, or nil if nothing's been recorded.
+func (ps *pathStats) status(now time.Time) *ipnstate.PeerPathStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(ps.paths) == 0 && ps.cur.IsZero() {
+		return nil
+	}
+
+	ret := &ipnstate.PeerPathStats{
+		CurAddr:  pathString(ps.cur),
+		CurSince: ps.curSince,
+		Relayed:  ps.relayed,
+		Changes:  append([]ipnstate.PathChange(nil), ps.changes...),
+	}
+	switch {
+	case isDERPPath(ps.cur):
+		ret.CurPath = "derp"
+		ret.CurDERPRegion = int(ps.cur.Port())
+		ret.Relayed += now.Sub(ps.curSince)
+	case isRelayPath(ps.cur):
+		ret.CurPath = "relay"
+	case !ps.cur.IsZero():
+		ret.CurPath = "direct"
+	}
+	for ipp, st := range ps.paths {
+		ret.Paths = append(ret.Paths, st.status(pathString(ipp)))
+	}
+	sort.Slice(ret.Paths, func(i, j int) bool {
+		return ret.Paths[i].Addr < ret.Paths[j].Addr
+	})
+	return ret
+}
+
+func (st *pathStat) status(addr string) *ipnstate.PathStats {
+	ret := &ipnstate.PathStats{
+		Addr:       addr,
+		TxBytes:    atomic.LoadInt64(&st.txBytes),
+		RxBytes:    atomic.LoadInt64(&st.rxBytes),
+		RTTSamples: len(st.rtts),
+	}
+	if len(st.rtts) == 0 {
+		return ret
+	}
+	sorted := append([]time.Duration(nil), st.rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	ret.RTTMin = sorted[0]
+	ret.RTTAvg = sum / time.Duration(len(sorted))
+	ret.RTTP95 = sorted[(len(sorted)*95+99)/100-1]
+	return ret
+}
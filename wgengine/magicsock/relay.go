@@ -0,0 +1,384 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+// Peer relays.
+//
+// When two peers can't reach each other directly, their traffic goes
+// via DERP, over TCP. If some other node in the tailnet has opted in
+// to relaying (tailcfg.Hostinfo.PeerRelay) and both peers have a
+// direct UDP path to it, the relay can instead forward their packets
+// over UDP, which is usually a lot faster than DERP.
+//
+// Relayed packets are wrapped in a small frame (see relayMagic) that
+// names the other end by its node public key: a relayForward frame
+// sent to the relay names the destination, and the relay rewrites it
+// to a relayDeliver frame naming the source before sending it on. The
+// payload is passed through untouched: it's either a WireGuard packet
+// or a disco message, so the relay can't read it, and the ends run
+// the normal disco ping/pong over it to validate the path.
+//
+// A path via a relay is represented as a fake UDP address,
+// relayMagicIP with the port being a locally-assigned relay ID (see
+// Conn.relayIDOfNode), much like DERP paths are. Such paths are only
+// used when no direct path works, and discovery keeps looking for a
+// direct path while they're in use.
+
+import (
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+// relayMagicIP is a fake WireGuard endpoint IP address that means to
+// send via a peer relay. The port number is the relay ID.
+//
+// Mnemonic: one after DerpMagicIP.
+const relayMagicIP = "127.3.3.41"
+
+var relayMagicIPAddr = netaddr.MustParseIP(relayMagicIP)
+
+// relayMagic is the prefix of relay frames. Like disco.Magic, it
+// can't be the start of a WireGuard or STUN packet.
+const relayMagic = "TS💁" // 6 bytes: 0x54 53 f0 9f 92 81
+
+// Relay frame types, the byte after relayMagic.
+const (
+	relayForward = 1 // to a relay; the key is the destination
+	relayDeliver = 2 // from a relay; the key is the source
+)
+
+// relayHeaderLen is the length of a relay frame header: relayMagic,
+// the frame type, and a node public key.
+const relayHeaderLen = len(relayMagic) + 1 + len(key.Public{})
+
+// isRelayPath reports whether ipp is a path via a peer relay.
+func isRelayPath(ipp netaddr.IPPort) bool { return ipp.IP() == relayMagicIPAddr }
+
+// isRelayFrame reports whether b looks like a relay frame.
+func isRelayFrame(b []byte) bool {
+	return len(b) >= relayHeaderLen && string(b[:len(relayMagic)]) == relayMagic
+}
+
+func appendRelayHeader(b []byte, typ byte, k key.Public) []byte {
+	b = append(b, relayMagic...)
+	b = append(b, typ)
+	return append(b, k[:]...)
+}
+
+// SetPeerRelay sets whether c relays packets between peers that
+// can't reach each other directly.
+func (c *Conn) SetPeerRelay(on bool) {
+	if c.peerRelay.Get() == on {
+		return
+	}
+	c.peerRelay.Set(on)
+	c.logf("magicsock: peer relay enabled=%v", on)
+}
+
+// updatePeerRelaysLocked assigns relay IDs to the peers in nm that
+// offer to relay, and forgets those that no longer do.
+//
+// c.mu must be held.
+func (c *Conn) updatePeerRelaysLocked(nm *netmap.NetworkMap) {
+	want := map[tailcfg.NodeKey]bool{}
+	for _, n := range nm.Peers {
+		if n.Hostinfo.PeerRelay && !n.DiscoKey.IsZero() {
+			want[n.Key] = true
+		}
+	}
+	for nk, id := range c.relayIDOfNode {
+		if !want[nk] {
+			delete(c.relayIDOfNode, nk)
+			delete(c.relayNodeOfID, id)
+		}
+	}
+	for nk := range want {
+		if _, ok := c.relayIDOfNode[nk]; ok {
+			continue
+		}
+		if c.relayIDOfNode == nil {
+			c.relayIDOfNode = map[tailcfg.NodeKey]uint16{}
+			c.relayNodeOfID = map[uint16]tailcfg.NodeKey{}
+		}
+		id := c.nextRelayIDLocked()
+		c.relayIDOfNode[nk] = id
+		c.relayNodeOfID[id] = nk
+		c.logf("[v1] magicsock: peer %v offers to relay, as relay-%d", nk.ShortString(), id)
+	}
+}
+
+// nextRelayIDLocked returns an unused, non-zero relay ID.
+//
+// c.mu must be held.
+func (c *Conn) nextRelayIDLocked() uint16 {
+	for {
+		c.lastRelayID++
+		if _, used := c.relayNodeOfID[c.lastRelayID]; !used && c.lastRelayID != 0 {
+			return c.lastRelayID
+		}
+	}
+}
+
+// relayEndpointLocked returns the endpoint of the relay with the
+// given ID, or nil if it's unknown or idle.
+//
+// c.mu must be held.
+func (c *Conn) relayEndpointLocked(id uint16) *discoEndpoint {
+	nk, ok := c.relayNodeOfID[id]
+	if !ok {
+		return nil
+	}
+	dk, ok := c.discoOfNode[nk]
+	if !ok {
+		return nil
+	}
+	return c.endpointOfDisco[dk]
+}
+
+// relayNameLocked returns the name of the relay of path ipp, for
+// status and "tailscale ping" output.
+//
+// c.mu must be held.
+func (c *Conn) relayNameLocked(ipp netaddr.IPPort) string {
+	nk, ok := c.relayNodeOfID[ipp.Port()]
+	if !ok {
+		return derpStr(ipp.String())
+	}
+	if n, ok := c.nodeOfDisco[c.discoOfNode[nk]]; ok {
+		if n.ComputedName != "" {
+			return n.ComputedName
+		}
+		if n.Hostinfo.Hostname != "" {
+			return n.Hostinfo.Hostname
+		}
+	}
+	return nk.ShortString()
+}
+
+// relayAddr returns the direct UDP address of de to use for relaying
+// through or by it, or the zero value if there isn't one yet. In that
+// case, or if the address is no longer trusted, discovery is started.
+func (de *discoEndpoint) relayAddr(now time.Time) netaddr.IPPort {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	de.noteActiveLocked()
+	if (de.bestAddr.IsZero() || now.After(de.trustBestAddrUntil)) && de.wantFullPingLocked(now) {
+		de.sendPingsLocked(now, true)
+	}
+	if de.bestAddr.IsZero() || isRelayPath(de.bestAddr.IPPort) {
+		return netaddr.IPPort{}
+	}
+	return de.bestAddr.IPPort
+}
+
+// sendRelay sends packet b to the peer dst via the relay of path addr.
+// See sendAddr's docs on the return value meanings.
+func (c *Conn) sendRelay(addr netaddr.IPPort, dst key.Public, b []byte) (sent bool, err error) {
+	c.mu.Lock()
+	rde := c.relayEndpointLocked(addr.Port())
+	c.mu.Unlock()
+	if rde == nil {
+		return false, nil
+	}
+	ua := rde.relayAddr(time.Now())
+	if ua.IsZero() {
+		return false, nil
+	}
+	pkt := make([]byte, 0, relayHeaderLen+len(b))
+	pkt = appendRelayHeader(pkt, relayForward, dst)
+	pkt = append(pkt, b...)
+	return c.sendUDP(ua, pkt)
+}
+
+// receiveRelay handles relay frame b, received from src.
+//
+// If b carried a WireGuard packet for wireguard-go, the packet is
+// moved to the front of b and its length and endpoint are returned.
+// Otherwise ep is nil.
+func (c *Conn) receiveRelay(b []byte, src netaddr.IPPort) (n int, ep conn.Endpoint) {
+	var k key.Public
+	copy(k[:], b[len(relayMagic)+1:relayHeaderLen])
+	switch b[len(relayMagic)] {
+	case relayForward:
+		c.forwardRelay(b, src, k)
+	case relayDeliver:
+		return c.receiveRelayed(b, src, k)
+	}
+	return 0, nil
+}
+
+// forwardRelay relays frame b, received from src, to the peer dst, if
+// this node relays for peers and both ends are known.
+func (c *Conn) forwardRelay(b []byte, src netaddr.IPPort, dst key.Public) {
+	if !c.peerRelay.Get() {
+		return
+	}
+	var srcNode *tailcfg.Node
+	var dde *discoEndpoint
+	c.mu.Lock()
+	if dk, ok := c.discoOfAddr[src]; ok {
+		srcNode = c.nodeOfDisco[dk]
+	}
+	if dk, ok := c.discoOfNode[tailcfg.NodeKey(dst)]; ok {
+		dde = c.endpointOfDisco[dk]
+	}
+	c.mu.Unlock()
+	if srcNode == nil || dde == nil || srcNode.Key == tailcfg.NodeKey(dst) {
+		return
+	}
+	ua := dde.relayAddr(time.Now())
+	if ua.IsZero() {
+		return
+	}
+	b[len(relayMagic)] = relayDeliver
+	copy(b[len(relayMagic)+1:], srcNode.Key[:])
+	c.sendUDP(ua, b)
+}
+
+// receiveRelayed handles frame b, relayed from the peer from by the
+// relay at src.
+func (c *Conn) receiveRelayed(b []byte, src netaddr.IPPort, from key.Public) (n int, ep conn.Endpoint) {
+	var id uint16
+	c.mu.Lock()
+	if dk, ok := c.discoOfAddr[src]; ok {
+		if node, ok := c.nodeOfDisco[dk]; ok {
+			id = c.relayIDOfNode[node.Key]
+		}
+	}
+	c.mu.Unlock()
+	if id == 0 {
+		// Not from a peer we know to be a relay.
+		return 0, nil
+	}
+	path := netaddr.IPPortFrom(relayMagicIPAddr, id)
+	payload := b[relayHeaderLen:]
+	if c.handleDiscoMessage(payload, path) {
+		return 0, nil
+	}
+	if !c.havePrivateKey.Get() {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	dk, ok := c.discoOfNode[tailcfg.NodeKey(from)]
+	de := c.endpointOfDisco[dk]
+	c.mu.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	didNoteRecvActivity := false
+	if de == nil && c.noteRecvActivity != nil {
+		// Idle peer; have wireguard-go create it, as for DERP
+		// packets in processDERPReadResult.
+		didNoteRecvActivity = true
+		c.noteRecvActivity(dk)
+		c.mu.Lock()
+		de = c.endpointOfDisco[dk]
+		c.mu.Unlock()
+	}
+	if de == nil {
+		return 0, nil
+	}
+	n = copy(b, payload)
+	de.paths.noteRecv(path, n)
+	if !didNoteRecvActivity {
+		c.noteRecvActivityFromEndpoint(de)
+	}
+	return n, de
+}
+
+// relayPathsFor returns the paths via peer relays that can be used to
+// reach de, and the relays' node keys. Only relays that this node has
+// a trusted direct path to are returned; discovery is started for the
+// others. If only is non-nil, only relays in it are considered.
+func (c *Conn) relayPathsFor(de *discoEndpoint, only []key.Public) (paths []netaddr.IPPort, relays []key.Public) {
+	now := time.Now()
+	var idle []tailcfg.DiscoKey
+
+	c.mu.Lock()
+	for nk, id := range c.relayIDOfNode {
+		if nk == de.publicKey || (only != nil && !containsKey(only, key.Public(nk))) {
+			continue
+		}
+		dk, ok := c.discoOfNode[nk]
+		if !ok {
+			continue
+		}
+		rde, ok := c.endpointOfDisco[dk]
+		if !ok {
+			idle = append(idle, dk)
+			continue
+		}
+		if rde.relayAddr(now).IsZero() {
+			continue
+		}
+		paths = append(paths, netaddr.IPPortFrom(relayMagicIPAddr, id))
+		relays = append(relays, key.Public(nk))
+	}
+	c.mu.Unlock()
+
+	if c.noteRecvActivity != nil {
+		// Wake up idle relays so they're usable next time.
+		for _, dk := range idle {
+			c.noteRecvActivity(dk)
+		}
+	}
+	return paths, relays
+}
+
+func containsKey(ks []key.Public, k key.Public) bool {
+	for _, v := range ks {
+		if v == k {
+			return true
+		}
+	}
+	return false
+}
+
+// offerRelays tells de (via DERP at derpAddr) which peer relays we
+// can reach it through and starts pinging it through them.
+func (c *Conn) offerRelays(de *discoEndpoint, derpAddr netaddr.IPPort) {
+	paths, relays := c.relayPathsFor(de, nil)
+	if len(relays) == 0 {
+		return
+	}
+	de.addRelayPaths(paths)
+	de.sendDiscoMessage(derpAddr, &disco.CallMeViaRelay{Relays: relays}, discoLog)
+}
+
+// handleCallMeViaRelay handles a CallMeViaRelay discovery message
+// from de, pinging it through those of the offered relays we can
+// reach too.
+func (c *Conn) handleCallMeViaRelay(de *discoEndpoint, m *disco.CallMeViaRelay) {
+	paths, _ := c.relayPathsFor(de, m.Relays)
+	de.addRelayPaths(paths)
+}
+
+// addRelayPaths adds paths via peer relays as endpoints of de and
+// pings them.
+func (de *discoEndpoint) addRelayPaths(paths []netaddr.IPPort) {
+	if len(paths) == 0 {
+		return
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	now := time.Now()
+	for _, ep := range paths {
+		st, ok := de.endpointState[ep]
+		if !ok {
+			st = &endpointState{}
+			de.endpointState[ep] = st
+		}
+		st.relayOfferedAt = now
+		de.startPingLocked(ep, now, pingDiscovery)
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+// Hard NAT traversal by port spraying.
+//
+// A NAT whose mapping depends on the destination (a "hard" NAT, see
+// netcheck.NATBehavior) gives each peer a public port different from
+// the one STUN saw, so peers behind one can't be reached at any
+// endpoint we advertise. If the other side's NAT is easy, though,
+// there's a way through, with Options.HardNATTraversal on both ends:
+//
+// The hard side opens sprayPorts new sockets and pings the peer's
+// endpoints from each, so its NAT creates that many mappings, at
+// ports it picks at random. It then tells the peer via DERP, with a
+// disco.SprayPorts message, to ping sprayProbes random ports of its
+// public IP. By the birthday paradox, one of those likely hits one of
+// the mappings, and gets through: the easy side's firewall was opened
+// by its ping to that port, and the hard side's by its ping to the
+// easy side's endpoint.
+//
+// The spray socket the first packet from the peer arrives on becomes
+// the hard side's route to that endpoint (see Conn.sprayRoute), so
+// the replies use the same mapping. From there on, it's an ordinary
+// UDP path, validated and kept alive by disco pings and pongs.
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/stun"
+)
+
+const (
+	// sprayInterval is the minimum time between spray rounds to a
+	// peer, and between answering a peer's.
+	sprayInterval = 30 * time.Second
+
+	// sprayLifetime is how long the sockets of a spray round wait
+	// for a packet from the peer before they're closed.
+	sprayLifetime = 15 * time.Second
+
+	// sprayProbes is how many random ports of the hard NAT the
+	// easy side pings in reply to a SprayPorts. With 256 ports
+	// open on the hard side, 98% of rounds find a pair.
+	sprayProbes = 1024
+
+	// sprayReadBufSize is the read buffer size of spray sockets.
+	// It fits a WireGuard packet of any tunnel MTU in use.
+	sprayReadBufSize = 2048
+)
+
+// sprayPorts is how many sockets the hard side opens per spray round.
+// It's a var for tests.
+var sprayPorts = 256
+
+// maxSpraySockets is how many spray sockets a Conn may have open at
+// once, across all peers, so spraying to several peers at a time
+// can't use up the process's file descriptors.
+const maxSpraySockets = 512
+
+// sprayRound is a round of port spraying to a peer, by the hard side.
+type sprayRound struct {
+	conns []*sprayConn
+	timer *time.Timer // closes conns that didn't find a path
+}
+
+// sprayConn is one of the sockets of a sprayRound.
+type sprayConn struct {
+	de   *discoEndpoint
+	pc   net.PacketConn
+	dsts []netaddr.IPPort // peer endpoints pinged from pc
+
+	// guarded by Conn.sprayMu
+	locked bool // pc routes packets to a peer endpoint
+	closed bool
+}
+
+// sprayReadResult is a packet received on a sprayConn, passed to
+// connBind.receiveSpray.
+type sprayReadResult struct {
+	src netaddr.IPPort
+	// copyBuf is called to copy the data to dst. It returns how
+	// much data was copied. copyBuf can only be called once.
+	// If copyBuf is nil, that's a signal from the sender to ignore
+	// this message.
+	copyBuf func(dst []byte) int
+}
+
+// hardNAT reports whether r says the IPv4 NAT maps each destination
+// to a different public port.
+func hardNAT(r *netcheck.Report) bool {
+	switch r.NATMapping {
+	case netcheck.EndpointIndependent:
+		return false
+	case netcheck.AddressDependent, netcheck.AddressAndPortDependent:
+		return true
+	}
+	return r.MappingVariesByDestIP.EqualBool(true)
+}
+
+// updateHardNAT records, from netcheck report r, whether this node is
+// behind a hard NAT and so sprays ports to reach peers.
+func (c *Conn) updateHardNAT(r *netcheck.Report) {
+	var ip netaddr.IP
+	if hardNAT(r) {
+		if ipp, err := netaddr.ParseIPPort(r.GlobalV4); err == nil {
+			ip = ipp.IP()
+		}
+	}
+	if ip == c.hardNATIP() {
+		return
+	}
+	if ip.IsZero() {
+		c.logf("magicsock: no longer behind a hard NAT")
+	} else {
+		c.logf("magicsock: behind a hard NAT as %v; spraying ports to reach peers", ip)
+	}
+	c.hardNATAddr.Store(ip)
+}
+
+// hardNATIP returns this node's public IPv4 address if it's behind a
+// hard NAT and does hard NAT traversal, or the zero IP otherwise.
+func (c *Conn) hardNATIP() netaddr.IP {
+	ip, _ := c.hardNATAddr.Load().(netaddr.IP)
+	return ip
+}
+
+// sprayRoute returns the spray socket that packets to ipp are sent
+// from, or nil if they're sent normally.
+func (c *Conn) sprayRoute(ipp netaddr.IPPort) *sprayConn {
+	m, _ := c.sprayRoutes.Load().(map[netaddr.IPPort]*sprayConn)
+	return m[ipp]
+}
+
+// updateSprayRoutesLocked replaces c.sprayRoutes with a copy modified
+// by f.
+//
+// c.sprayMu must be held.
+func (c *Conn) updateSprayRoutesLocked(f func(map[netaddr.IPPort]*sprayConn)) {
+	old, _ := c.sprayRoutes.Load().(map[netaddr.IPPort]*sprayConn)
+	m := make(map[netaddr.IPPort]*sprayConn, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	f(m)
+	c.sprayRoutes.Store(m)
+}
+
+// maybeSprayLocked starts a spray round to de if this node is behind
+// a hard NAT and de has no direct path.
+//
+// de.mu must be held.
+func (de *discoEndpoint) maybeSprayLocked(now time.Time, derpAddr netaddr.IPPort) {
+	c := de.c
+	if !c.hardNATTraversal || (!de.lastSpray.IsZero() && now.Sub(de.lastSpray) < sprayInterval) {
+		return
+	}
+	ip := c.hardNATIP()
+	if ip.IsZero() {
+		return
+	}
+	var dsts []netaddr.IPPort
+	for ep := range de.endpointState {
+		if ep.IP().Is4() && !isRelayPath(ep) {
+			dsts = append(dsts, ep)
+		}
+	}
+	if len(dsts) == 0 {
+		return
+	}
+	if de.spray != nil {
+		// The last round didn't find a path, or it stopped
+		// working.
+		de.spray.close()
+		de.spray = nil
+	}
+	de.lastSpray = now
+	go de.runSpray(ip, sprayPorts, dsts, derpAddr)
+}
+
+// runSpray runs a spray round to de from behind a hard NAT with public
+// IPv4 address ip: it opens n sockets, pings dsts, the peer's
+// endpoints, from each, and then asks the peer via DERP at derpAddr
+// to ping back.
+func (de *discoEndpoint) runSpray(ip netaddr.IP, n int, dsts []netaddr.IPPort, derpAddr netaddr.IPPort) {
+	c := de.c
+	n = c.reserveSpraySockets(n)
+	if n == 0 {
+		c.logf("[v1] magicsock: disco: not spraying to %v; too many spray sockets open", de.publicKey.ShortString())
+		return
+	}
+	r := new(sprayRound)
+	for i := 0; i < n; i++ {
+		pc, err := c.listenPacket("udp4", netaddr.IP{}, 0)
+		if err != nil {
+			c.logf("magicsock: disco: spray to %v: %v", de.publicKey.ShortString(), err)
+			c.releaseSpraySockets(n - i)
+			r.close()
+			return
+		}
+		r.conns = append(r.conns, &sprayConn{de: de, pc: pc, dsts: dsts})
+	}
+	if !de.installSpray(r) {
+		r.close()
+		return
+	}
+	for _, sc := range r.conns {
+		go sc.read()
+	}
+	for _, dst := range dsts {
+		ua := dst.UDPAddr()
+		for _, sc := range r.conns {
+			pkt, _, err := c.sealDiscoMessage(de.discoKey, &disco.Ping{TxID: [12]byte(stun.NewTxID())})
+			if err != nil {
+				return
+			}
+			sc.pc.WriteTo(pkt, ua)
+		}
+	}
+	c.logf("[v1] magicsock: disco: sprayed %d ports to %v (%v)", len(r.conns), de.publicKey.ShortString(), de.discoShort)
+	de.sendDiscoMessage(derpAddr, &disco.SprayPorts{IP: ip, Count: uint16(len(r.conns))}, discoLog)
+}
+
+// reserveSpraySockets reserves up to n of the Conn's maxSpraySockets
+// spray sockets, and returns how many it did. Each is released when
+// its sprayConn is closed, or by releaseSpraySockets if it's never
+// opened.
+func (c *Conn) reserveSpraySockets(n int) int {
+	c.sprayMu.Lock()
+	defer c.sprayMu.Unlock()
+	if free := maxSpraySockets - c.spraySockets; n > free {
+		n = free
+	}
+	c.spraySockets += n
+	return n
+}
+
+func (c *Conn) releaseSpraySockets(n int) {
+	c.sprayMu.Lock()
+	defer c.sprayMu.Unlock()
+	c.spraySockets -= n
+}
+
+// installSpray makes r de's current spray round, unless de or its
+// Conn has been closed since the round started.
+func (de *discoEndpoint) installSpray(r *sprayRound) bool {
+	c := de.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.endpointOfDisco[de.discoKey] != de {
+		return false
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.spray != nil {
+		return false
+	}
+	de.spray = r
+	r.timer = time.AfterFunc(sprayLifetime, func() { de.expireSpray(r) })
+	return true
+}
+
+// expireSpray closes the sockets of spray round r that haven't found
+// a path.
+func (de *discoEndpoint) expireSpray(r *sprayRound) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.spray != r {
+		return
+	}
+	kept := r.conns[:0]
+	for _, sc := range r.conns {
+		if !sc.closeIfIdle() {
+			kept = append(kept, sc)
+		}
+	}
+	r.conns = kept
+	if len(kept) == 0 {
+		de.spray = nil
+	}
+}
+
+func (r *sprayRound) close() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	for _, sc := range r.conns {
+		sc.close()
+	}
+}
+
+// lockRoute makes sc the route to peer endpoint ipp, unless there
+// already is one. It reports whether it did.
+func (sc *sprayConn) lockRoute(ipp netaddr.IPPort) bool {
+	c := sc.de.c
+	c.sprayMu.Lock()
+	defer c.sprayMu.Unlock()
+	if sc.closed || c.sprayRoute(ipp) != nil {
+		return false
+	}
+	sc.locked = true
+	c.updateSprayRoutesLocked(func(m map[netaddr.IPPort]*sprayConn) {
+		m[ipp] = sc
+	})
+	return true
+}
+
+// closeIfIdle closes sc unless it's the route to a peer endpoint.
+// It reports whether it did.
+func (sc *sprayConn) closeIfIdle() bool {
+	c := sc.de.c
+	c.sprayMu.Lock()
+	locked := sc.locked
+	c.sprayMu.Unlock()
+	if locked {
+		return false
+	}
+	sc.close()
+	return true
+}
+
+func (sc *sprayConn) close() {
+	c := sc.de.c
+	c.sprayMu.Lock()
+	if !sc.closed {
+		c.spraySockets--
+	}
+	sc.closed = true
+	if sc.locked {
+		c.updateSprayRoutesLocked(func(m map[netaddr.IPPort]*sprayConn) {
+			for ipp, v := range m {
+				if v == sc {
+					delete(m, ipp)
+				}
+			}
+		})
+	}
+	c.sprayMu.Unlock()
+	sc.pc.Close()
+}
+
+// send sends UDP packet b to ipp from sc's socket.
+// See sendAddr's docs on the return value meanings.
+func (sc *sprayConn) send(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+	_, err = sc.pc.WriteTo(b, ipp.UDPAddr())
+	return err == nil, err
+}
+
+func (sc *sprayConn) isDst(ipp netaddr.IPPort) bool {
+	for _, dst := range sc.dsts {
+		if dst == ipp {
+			return true
+		}
+	}
+	return false
+}
+
+// read runs in a goroutine for the life of sc, passing packets from
+// the peer on to receiveSpray. The first one makes sc the route to
+// the endpoint it came from, and starts discovery on that path.
+func (sc *sprayConn) read() {
+	de, c := sc.de, sc.de.c
+	buf := make([]byte, sprayReadBufSize)
+	didCopy := make(chan struct{}, 1)
+	var pkt []byte
+	res := sprayReadResult{}
+	res.copyBuf = func(dst []byte) int {
+		n := copy(dst, pkt)
+		didCopy <- struct{}{}
+		return n
+	}
+	for {
+		n, addr, err := sc.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		src, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+		if !ok || !sc.isDst(src) {
+			continue
+		}
+		if sc.lockRoute(src) {
+			c.logf("magicsock: disco: hard NAT path to %v (%v) found at %v, from local %v", de.publicKey.ShortString(), de.discoShort, src, sc.pc.LocalAddr())
+			de.mu.Lock()
+			if _, ok := de.endpointState[src]; ok {
+				de.startPingLocked(src, time.Now(), pingDiscovery)
+			}
+			de.mu.Unlock()
+		}
+
+		pkt = buf[:n]
+		res.src = src
+		select {
+		case <-c.donec:
+			return
+		case c.sprayRecvCh <- res:
+		}
+		select {
+		case <-c.donec:
+			return
+		case <-didCopy:
+		}
+	}
+}
+
+// receiveSpray reads a packet from c.sprayRecvCh into b and returns
+// the associated endpoint. It is called by wireguard-go.
+func (c *connBind) receiveSpray(b []byte) (n int, ep conn.Endpoint, err error) {
+	for rr := range c.sprayRecvCh {
+		if c.Closed() {
+			break
+		}
+		if rr.copyBuf == nil {
+			continue
+		}
+		n := rr.copyBuf(b)
+		if ep, ok := c.receiveIP(b[:n], rr.src, &c.ippEndpointSpray); ok {
+			return n, ep, nil
+		}
+	}
+	return 0, nil, net.ErrClosed
+}
+
+// handleSprayPortsLocked handles a SprayPorts message from de's peer,
+// which is behind a hard NAT, by pinging random ports of its IP.
+//
+// It should be called with the Conn.mu held.
+func (de *discoEndpoint) handleSprayPortsLocked(m *disco.SprayPorts) {
+	if !m.IP.Is4() || m.Count == 0 {
+		return
+	}
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	// Only spray an IP the peer is known to be at, so the message
+	// can't make us scan or flood anyone else.
+	if !de.hasEndpointIPLocked(m.IP) {
+		de.c.logf("[unexpected] magicsock: disco: spray-ports from %v (%v) for %v, not one of its endpoints", de.publicKey.ShortString(), de.discoShort, m.IP)
+		return
+	}
+	if de.peerDiscoVersion < 2 {
+		// Older peers don't send SprayPorts. If we just haven't
+		// heard a pong from this one yet, ask for one via DERP,
+		// and answer when it comes.
+		if !de.derpAddr.IsZero() {
+			de.pendingSpray = m
+			de.startPingLocked(de.derpAddr, time.Now(), pingVersion)
+		}
+		return
+	}
+	de.answerSprayLocked(m, time.Now())
+}
+
+// answerSprayLocked pings sprayProbes random ports of m.IP, the
+// peer's hard NAT, at most once per sprayInterval.
+//
+// de.mu must be held.
+func (de *discoEndpoint) answerSprayLocked(m *disco.SprayPorts, now time.Time) {
+	if de.peerDiscoVersion < 2 {
+		return
+	}
+	if !de.lastSprayReply.IsZero() && now.Sub(de.lastSprayReply) < sprayInterval {
+		return
+	}
+	de.lastSprayReply = now
+	de.c.logf("[v1] magicsock: disco: pinging %d random ports of %v for %v (%v)", sprayProbes, m.IP, de.publicKey.ShortString(), de.discoShort)
+	for i := 0; i < sprayProbes; i++ {
+		port := uint16(1024 + rand.Intn(1<<16-1024))
+		de.startPingLocked(netaddr.IPPortFrom(m.IP, port), now, pingSpray)
+	}
+}
+
+// hasEndpointIPLocked reports whether ip is the IP of one of de's
+// direct endpoints.
+//
+// de.mu must be held.
+func (de *discoEndpoint) hasEndpointIPLocked(ip netaddr.IP) bool {
+	for ep := range de.endpointState {
+		if ep.IP() == ip && !isRelayPath(ep) {
+			return true
+		}
+	}
+	return false
+}
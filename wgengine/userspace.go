@@ -43,6 +43,7 @@ import (
 	"tailscale.com/types/netmap"
 	"tailscale.com/types/wgkey"
 	"tailscale.com/version"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -122,6 +123,7 @@ type userspaceEngine struct {
 	networkMapCallbacks map[*someHandle]NetworkMapCallback
 	tsIPByIPPort        map[netaddr.IPPort]netaddr.IP          // allows registration of IP:ports as belonging to a certain Tailscale IP for whois lookups
 	pongCallback        map[[8]byte]func(packet.TSMPPongReply) // for TSMP pong responses
+	peerPathMTU         map[tailcfg.NodeKey]int                // discovered path MTUs; see magicsock.Options.PathMTUFunc
 
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
@@ -158,6 +160,15 @@ type Config struct {
 	// If zero, a port is automatically selected.
 	ListenPort uint16
 
+	// StaticEndpoints are additional endpoints to advertise to
+	// peers, such as the public side of a manual port forward to
+	// ListenPort. See magicsock.Options.StaticEndpoints.
+	StaticEndpoints []netaddr.IPPort
+
+	// HardNATTraversal enables port spraying to reach peers from
+	// behind hard NATs. See magicsock.Options.HardNATTraversal.
+	HardNATTraversal bool
+
 	// RespondToPing determines whether this engine should internally
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
@@ -274,10 +285,13 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	magicsockOpts := magicsock.Options{
 		Logf:             logf,
 		Port:             conf.ListenPort,
+		StaticEndpoints:  conf.StaticEndpoints,
 		EndpointsFunc:    endpointsFn,
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteReceiveActivity,
+		PathMTUFunc:      e.setPeerPathMTU,
+		HardNATTraversal: conf.HardNATTraversal,
 		LinkMonitor:      e.linkMon,
 	}
 
@@ -786,6 +800,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 	}
 
 	e.lastCfgFull = *cfg.Clone()
+	e.updatePeerMTUsLocked()
 
 	// Tell magicsock about the new (or initial) private key
 	// (which is needed by DERP) before wgdev gets it, as wgdev
@@ -1100,6 +1115,63 @@ func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	}
 }
 
+// setPeerPathMTU is called by magicsock when the discovered MTU
+// of the path to peer changes. A zero mtu means unknown.
+func (e *userspaceEngine) setPeerPathMTU(peer tailcfg.NodeKey, mtu int) {
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	e.mu.Lock()
+	if mtu == 0 {
+		delete(e.peerPathMTU, peer)
+	} else {
+		if e.peerPathMTU == nil {
+			e.peerPathMTU = map[tailcfg.NodeKey]int{}
+		}
+		e.peerPathMTU[peer] = mtu
+	}
+	e.mu.Unlock()
+	e.updatePeerMTUsLocked()
+}
+
+// updatePeerMTUsLocked tells the tundev the path MTU of each
+// WireGuard route whose peer is only reachable with packets smaller
+// than the TUN MTU, so it can clamp TCP connections through it. That
+// includes subnet routes and the exit node's default route, not just
+// the peer's own Tailscale IPs.
+//
+// e.wgLock must be held, but not e.mu.
+func (e *userspaceEngine) updatePeerMTUsLocked() {
+	tunMTU, err := e.tundev.MTU()
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var m map[netaddr.IPPrefix]int
+	var clamp bool
+	for _, p := range e.lastCfgFull.Peers {
+		mtu, ok := e.peerPathMTU[tailcfg.NodeKey(p.PublicKey)]
+		if !ok || mtu >= tunMTU {
+			// Still needed in the map, so more specific routes
+			// to this peer take precedence over less specific
+			// ones to clamped peers.
+			mtu = 0
+		} else {
+			clamp = true
+		}
+		for _, pfx := range p.AllowedIPs {
+			if m == nil {
+				m = map[netaddr.IPPrefix]int{}
+			}
+			m[pfx] = mtu
+		}
+	}
+	if !clamp {
+		m = nil
+	}
+	e.tundev.SetPeerMTUs(m)
+}
+
 func (e *userspaceEngine) DiscoPublicKey() tailcfg.DiscoKey {
 	return e.magicConn.DiscoPublicKey()
 }
@@ -1244,6 +1316,11 @@ func (e *userspaceEngine) UnregisterIPPortIdentity(ipport netaddr.IPPort) {
 	delete(e.tsIPByIPPort, ipport)
 }
 
+func (e *userspaceEngine) InstallCaptureHook(cb capture.Callback) {
+	e.tundev.InstallCaptureHook(cb)
+	e.magicConn.InstallCaptureHook(cb)
+}
+
 var whoIsSleeps = [...]time.Duration{
 	0,
 	10 * time.Millisecond,
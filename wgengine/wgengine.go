@@ -12,6 +12,7 @@ import (
 	"tailscale.com/net/dns"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
@@ -147,4 +148,9 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// InstallCaptureHook sets the function to call with every
+	// packet passing through the TUN device and every disco
+	// message, for debug packet captures. A nil cb removes it.
+	InstallCaptureHook(capture.Callback)
 }